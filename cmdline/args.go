@@ -2,6 +2,7 @@ package main
 
 import "fmt"
 import "log"
+import "os"
 import "strconv"
 import "strings"
 
@@ -83,6 +84,14 @@ func portalsToIndices(arg portalsValue, portals []lib.Portal) []int {
 
 }
 
+func portalsToPortalList(arg portalsValue, portals []lib.Portal) []lib.Portal {
+	var result []lib.Portal
+	for _, index := range portalsToIndices(arg, portals) {
+		result = append(result, portals[index])
+	}
+	return result
+}
+
 type numberLimitValue struct {
 	Value   int
 	Exactly bool
@@ -105,3 +114,104 @@ func (n numberLimitValue) String() string {
 	}
 	return "<=" + strconv.FormatUint(uint64(n.Value), 10)
 }
+
+type circleValue struct {
+	CircleString string
+	Center       s2.LatLng
+	Radius       float64
+}
+
+func (c *circleValue) Set(circleStr string) error {
+	parts := strings.Split(circleStr, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("cannot parse \"%s\" as lat,lng,radius", circleStr)
+	}
+	var center portalValue
+	if err := center.Set(parts[0] + "," + parts[1]); err != nil {
+		return err
+	}
+	radius, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return err
+	}
+	if radius <= 0 {
+		return fmt.Errorf("radius must be positive, got %s", parts[2])
+	}
+	c.Center = center.LatLng
+	c.Radius = radius
+	c.CircleString = circleStr
+	return nil
+}
+
+func (c circleValue) String() string {
+	return c.CircleString
+}
+
+// portalRegions - regions the portals read from files are restricted to
+var portalRegions []lib.Region
+
+// readRegion reads polygons from the file if it exists,
+// otherwise treats the arg as a comma separated list of s2 cell tokens.
+func readRegion(arg string) lib.Region {
+	if _, err := os.Stat(arg); err == nil {
+		region, err := lib.ParseRegionFile(arg)
+		if err != nil {
+			log.Fatalf("Could not parse region file %s : %v\n", arg, err)
+		}
+		return region
+	}
+	region, err := lib.CellTokensRegion(strings.Split(arg, ","))
+	if err != nil {
+		log.Fatalf("Region \"%s\" is neither a region file nor a list of s2 cell tokens: %v\n", arg, err)
+	}
+	return region
+}
+
+func readBlockers(filename string) []lib.Segment {
+	if filename == "" {
+		return nil
+	}
+	blockers, err := lib.ParseBlockersFile(filename)
+	if err != nil {
+		log.Fatalf("Could not parse blockers file %s : %v\n", filename, err)
+	}
+	fmt.Fprintf(infoOutput, "Read %d blocking links\n", len(blockers))
+	return blockers
+}
+
+// readPortals reads portals from the file, or from stdin if filename is "-",
+// keeping only the ones inside the region if it's given.
+// Aborts if fewer than minPortals portals remain, as the searches need at least that many.
+func readPortals(filename string, format lib.PortalFileFormat, minPortals int) []lib.Portal {
+	var portals []lib.Portal
+	var err error
+	if filename == "-" {
+		portals, err = lib.ParseReader(os.Stdin, format)
+	} else if format == lib.AutoDetectFormat {
+		portals, err = lib.ParseFile(filename)
+	} else {
+		var file *os.File
+		file, err = os.Open(filename)
+		if err == nil {
+			defer file.Close()
+			portals, err = lib.ParseReader(file, format)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Could not parse file %s : %v\n", filename, err)
+	}
+	if len(portalRegions) > 0 {
+		numPortals := len(portals)
+		for _, region := range portalRegions {
+			portals = lib.PortalsInRegion(portals, region)
+		}
+		fmt.Fprintf(infoOutput, "%d of %d portals from %s lie inside the region\n", len(portals), numPortals, filename)
+		if len(portals) < minPortals {
+			log.Fatalf("Expected at least %d portals inside the region, got %d\n", minPortals, len(portals))
+		}
+	}
+	if len(portals) < minPortals {
+		log.Fatalf("Expected at least %d portals in %s, got %d\n", minPortals, filename, len(portals))
+	}
+	return portals
+}
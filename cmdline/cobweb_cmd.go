@@ -1,55 +1,102 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"time"
 
 	"github.com/pwiecz/portal_patterns/lib"
 )
 
 type cobwebCmd struct {
-	flags         *flag.FlagSet
-	cornerPortals *portalsValue
+	flags           *flag.FlagSet
+	cornerPortals   *portalsValue
+	keys            *bool
+	route           *bool
+	blockers        *string
+	maxLinkLength   *float64
+	minFieldArea    *float64
+	minFieldHeight  *float64
+	disabledPortals *portalsValue
+	memoryBudget    *uint64
+	checkpoint      *string
 }
 
-func NewCobwebCmd() cobwebCmd {
+func NewCobwebCmd() *cobwebCmd {
 	flags := flag.NewFlagSet("cobweb", flag.ExitOnError)
 	cmd := cobwebCmd{
-		flags:         flags,
-		cornerPortals: &portalsValue{},
+		flags:           flags,
+		cornerPortals:   &portalsValue{},
+		keys:            flags.Bool("keys", false, "print number of keys needed and number of outbound links of every portal"),
+		route:           flags.Bool("route", false, "print the order of visiting portals minimizing the walking distance"),
+		blockers:        flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:   flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		minFieldArea:    flags.Float64("min_field_area", 0, "don't make fields with area smaller than that many square meters"),
+		minFieldHeight:  flags.Float64("min_field_height", 0, "don't make fields with any of the heights shorter than that many meters"),
+		disabledPortals: &portalsValue{},
+		memoryBudget:    flags.Uint64("memory_budget", lib.DefaultMemoryBudget>>20, "limit in MiB of memory used by the search, fail if the search would need more"),
+		checkpoint:      flags.String("checkpoint", "", "periodically save the state of the search to this file, and resume the search from it if it's been interrupted"),
 	}
 	flags.Var(cmd.cornerPortals, "corner_portal", "fix corner portal of the cobweb field")
-	return cmd
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of the cobweb field")
+	return &cmd
 }
 
 func (c *cobwebCmd) Usage(fileBase string) {
-	fmt.Fprintf(flag.CommandLine.Output(), "%s cobweb [-corner_portal=<lat>,<lng>]... <portals_file>\n", fileBase)
+	fmt.Fprintf(flag.CommandLine.Output(), "%s cobweb [-keys] [-route] [-blockers=<file>] [-max_link_length=<meters>] [-min_field_area=<square meters>] [-min_field_height=<meters>] [-disabled_portal=<lat>,<lng>]... [-corner_portal=<lat>,<lng>]... [-memory_budget=<MiB>] [-checkpoint=<file>] <portals_file>\n", fileBase)
 	c.flags.PrintDefaults()
 }
 
-func (c *cobwebCmd) Run(args []string, output io.Writer, progressFunc func(int, int)) {
+func (c *cobwebCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
 	c.flags.Parse(args)
 	fileArgs := c.flags.Args()
 	if len(fileArgs) != 1 {
 		log.Fatalln("cobweb command requires exactly one file argument")
 	}
-	portals, err := lib.ParseFile(fileArgs[0])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[0], err)
-	}
-	fmt.Printf("Read %d portals\n", len(portals))
+	portals := readPortals(fileArgs[0], params.inputFormat, 3)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
 	if len(*c.cornerPortals) > 3 {
 		log.Fatalf("cobweb command accepts at most three corner portals - %d specified", len(*c.cornerPortals))
 	}
 	cornerPortalIndices := portalsToIndices(*c.cornerPortals, portals)
+	disabledPortals := portalsToPortalList(*c.disabledPortals, portals)
 
-	result := lib.LargestCobweb(portals, cornerPortalIndices, progressFunc)
+	searchStart := time.Now()
+	solver := lib.CobwebSolver{
+		FixedCornerIndices: cornerPortalIndices,
+		Options: []lib.CobwebOption{
+			lib.CobwebBlockers(readBlockers(*c.blockers)), lib.CobwebMaxLinkLength(*c.maxLinkLength), lib.CobwebMinFieldSize{Area: *c.minFieldArea, Height: *c.minFieldHeight}, lib.CobwebDisabledPortals(disabledPortals),
+			lib.CobwebMemoryBudget(*c.memoryBudget << 20), lib.CobwebCheckpoint{File: *c.checkpoint}},
+	}
+	solverResults, err := lib.SolveTop(ctx, solver, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	results := lib.Solutions[[]lib.Portal](solverResults)
 
-	fmt.Fprintln(output, "")
-	for i, portal := range result {
-		fmt.Fprintf(output, "%d: %s\n", i, portal.Name)
+	if params.format == jsonFormat {
+		report := newJSONReport("cobweb", c.flags, start)
+		for i, result := range results {
+			solution := report.solution(i)
+			solution.addResult(solverResults[i])
+			plan, err := lib.CobwebPlan(result)
+			solution.addPlan(plan, err, *c.route, disabledPortals)
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, result := range results {
+		printSolutionHeader(params.output, i, len(results))
+		fmt.Fprintln(params.output, "")
+		for i, portal := range result {
+			fmt.Fprintf(params.output, "%d: %s\n", i, portal.Name)
+		}
+		if *c.keys || *c.route || len(disabledPortals) > 0 {
+			plan, err := lib.CobwebPlan(result)
+			printPlanReports(params.output, plan, err, *c.keys, *c.route, disabledPortals)
+		}
+		fmt.Fprintf(params.output, "\n%s\n", lib.CobwebDrawToolsString(result))
 	}
-	fmt.Fprintf(output, "\n%s\n", lib.CobwebDrawToolsString(result))
 }
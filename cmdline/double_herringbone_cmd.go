@@ -1,60 +1,106 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"time"
 
 	"github.com/pwiecz/portal_patterns/lib"
 )
 
 type doubleHerringboneCmd struct {
-	flags       *flag.FlagSet
-	basePortals *portalsValue
+	flags           *flag.FlagSet
+	basePortals     *portalsValue
+	keys            *bool
+	route           *bool
+	blockers        *string
+	maxLinkLength   *float64
+	minFieldArea    *float64
+	minFieldHeight  *float64
+	disabledPortals *portalsValue
 }
 
-func NewDoubleHerringboneCmd() doubleHerringboneCmd {
+func NewDoubleHerringboneCmd() *doubleHerringboneCmd {
 	flags := flag.NewFlagSet("double_herringbone", flag.ExitOnError)
 	cmd := doubleHerringboneCmd{
-		flags:       flags,
-		basePortals: &portalsValue{},
+		flags:           flags,
+		basePortals:     &portalsValue{},
+		keys:            flags.Bool("keys", false, "print number of keys needed and number of outbound links of every portal"),
+		route:           flags.Bool("route", false, "print the order of visiting portals minimizing the walking distance"),
+		blockers:        flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:   flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		minFieldArea:    flags.Float64("min_field_area", 0, "don't make fields with area smaller than that many square meters"),
+		minFieldHeight:  flags.Float64("min_field_height", 0, "don't make fields with any of the heights shorter than that many meters"),
+		disabledPortals: &portalsValue{},
 	}
 	flags.Var(cmd.basePortals, "base_portal", "fix a base portal of the double herringbone field")
-	return cmd
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of the double herringbone field")
+	return &cmd
 }
 
 func (d *doubleHerringboneCmd) Usage(fileBase string) {
-	fmt.Fprintf(flag.CommandLine.Output(), "%s double_herringbone [-base_portal=<lat>,<lng>]... <portals_file>\n", fileBase)
+	fmt.Fprintf(flag.CommandLine.Output(), "%s double_herringbone [-keys] [-route] [-blockers=<file>] [-max_link_length=<meters>] [-min_field_area=<square meters>] [-min_field_height=<meters>] [-disabled_portal=<lat>,<lng>]... [-base_portal=<lat>,<lng>]... <portals_file>\n", fileBase)
 	d.flags.PrintDefaults()
 }
 
-func (d *doubleHerringboneCmd) Run(args []string, output io.Writer, numWorkers int, progressFunc func(int, int)) {
+func (d *doubleHerringboneCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
 	d.flags.Parse(args)
 	fileArgs := d.flags.Args()
 	if len(fileArgs) != 1 {
 		log.Fatalln("double_herringbone command requires exactly one file argument")
 	}
-	portals, err := lib.ParseFile(fileArgs[0])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[0], err)
-	}
-	fmt.Printf("Read %d portals\n", len(portals))
+	portals := readPortals(fileArgs[0], params.inputFormat, 3)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
 	if len(*d.basePortals) > 2 {
 		log.Fatalf("double_herringbone command accepts at most two base portals - %d specified", len(*d.basePortals))
 	}
 	basePortalIndices := portalsToIndices(*d.basePortals, portals)
+	disabledPortals := portalsToPortalList(*d.disabledPortals, portals)
+
+	searchStart := time.Now()
+	solver := lib.DoubleHerringboneSolver{
+		FixedBaseIndices: basePortalIndices,
+		NumWorkers:       params.numWorkers,
+		Options: []lib.HerringboneOption{
+			lib.HerringboneBlockers(readBlockers(*d.blockers)), lib.HerringboneMaxLinkLength(*d.maxLinkLength), lib.HerringboneMinFieldSize{Area: *d.minFieldArea, Height: *d.minFieldHeight}, lib.HerringboneDisabledPortals(disabledPortals)},
+	}
+	results, err := lib.SolveTop(ctx, solver, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	solutions := lib.Solutions[lib.DoubleHerringboneSolution](results)
 
-	b0, b1, result0, result1 := lib.LargestDoubleHerringbone(portals, basePortalIndices, numWorkers, progressFunc)
-	fmt.Fprintf(output, "\nBase (%s) (%s)\n", b0.Name, b1.Name)
-	fmt.Fprintln(output, "First part:")
-	for i, portal := range result0 {
-		fmt.Fprintf(output, "%d: %s\n", i, portal.Name)
+	if params.format == jsonFormat {
+		report := newJSONReport("double_herringbone", d.flags, start)
+		for i, s := range solutions {
+			b0, b1, result0, result1 := s.B0, s.B1, s.Backbone0, s.Backbone1
+			solution := report.solution(i)
+			solution.addResult(results[i])
+			plan, err := lib.DoubleHerringbonePlan(b0, b1, result0, result1)
+			solution.addPlan(plan, err, *d.route, disabledPortals)
+		}
+		report.write(params.output, searchTime)
+		return
 	}
-	fmt.Fprintln(output, "Second part:")
-	for i, portal := range result1 {
-		fmt.Fprintf(output, "%d: %s\n", i, portal.Name)
+	for i, s := range solutions {
+		printSolutionHeader(params.output, i, len(solutions))
+		b0, b1, result0, result1 := s.B0, s.B1, s.Backbone0, s.Backbone1
+		fmt.Fprintf(params.output, "\nBase (%s) (%s)\n", b0.Name, b1.Name)
+		fmt.Fprintln(params.output, "First part:")
+		for i, portal := range result0 {
+			fmt.Fprintf(params.output, "%d: %s\n", i, portal.Name)
+		}
+		fmt.Fprintln(params.output, "Second part:")
+		for i, portal := range result1 {
+			fmt.Fprintf(params.output, "%d: %s\n", i, portal.Name)
 
+		}
+		if *d.keys || *d.route || len(disabledPortals) > 0 {
+			plan, err := lib.DoubleHerringbonePlan(b0, b1, result0, result1)
+			printPlanReports(params.output, plan, err, *d.keys, *d.route, disabledPortals)
+		}
+		fmt.Fprintf(params.output, "\n%s\n", lib.DoubleHerringboneDrawToolsString(b0, b1, result0, result1))
 	}
-	fmt.Fprintf(output, "\n%s\n", lib.DoubleHerringboneDrawToolsString(b0, b1, result0, result1))
 }
@@ -1,88 +1,255 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"runtime"
+	"time"
 
 	"github.com/pwiecz/portal_patterns/lib"
 )
 
 type droneFlightCmd struct {
-	flags        *flag.FlagSet
-	useLongJumps *bool
-	leastKeys * bool
-	leastJumps *bool
-	startPortal  *portalValue
-	endPortal    *portalValue
+	flags         *flag.FlagSet
+	useLongJumps  *bool
+	leastKeys     *bool
+	leastJumps    *bool
+	startPortal   *portalValue
+	endPortal     *portalValue
+	freeMoveRange *float64
+	keyJumpRange  *float64
+	cellLevel     *int
+	waypoints     *portalsValue
+	unordered     *bool
+	keyInventory  *portalsValue
+	maxKeys       *int
+	reachability  *bool
+	geoJSONFile   *string
 }
 
-func NewDroneFlightCmd() droneFlightCmd {
+func NewDroneFlightCmd() *droneFlightCmd {
 	flags := flag.NewFlagSet("drone_flight", flag.ExitOnError)
 	cmd := droneFlightCmd{
-		flags:        flags,
-		useLongJumps: flags.Bool("use_long_jumps", false, "when creating the drone flight consider using long jumps that require a key to the target portal"),
-		leastKeys:    flags.Bool("least_keys", false, "among the longest flights find one that requires the least keys (default)"),
-		leastJumps:   flags.Bool("least_jumps", false, "among the longest flights find one that requires the least jumps"),
-		startPortal:  &portalValue{},
-		endPortal:    &portalValue{},
+		flags:         flags,
+		useLongJumps:  flags.Bool("use_long_jumps", false, "when creating the drone flight consider using long jumps that require a key to the target portal"),
+		leastKeys:     flags.Bool("least_keys", false, "among the longest flights find one that requires the least keys (default)"),
+		leastJumps:    flags.Bool("least_jumps", false, "among the longest flights find one that requires the least jumps"),
+		startPortal:   &portalValue{},
+		endPortal:     &portalValue{},
+		freeMoveRange: flags.Float64("free_move_range", lib.DefaultDroneFlightFreeMoveRange, "distance in meters to s2 cells of portals the drone can fly to without a key"),
+		keyJumpRange:  flags.Float64("key_jump_range", lib.DefaultDroneFlightKeyJumpRange, "distance in meters to portals the drone can fly to with a key"),
+		cellLevel:     flags.Int("cell_level", lib.DefaultDroneFlightCellLevel, "level of s2 cells used to check the free move range"),
+		waypoints:     &portalsValue{},
+		unordered:     flags.Bool("unordered_waypoints", false, "visit the waypoints in any order"),
+		keyInventory:  &portalsValue{},
+		reachability:  flags.Bool("reachability", false, "instead of the longest flight find all the portals reachable from the start portal, with the least keys or jumps needed to get there"),
+		geoJSONFile:   flags.String("geojson", "", "write the portals reachable from the start portal as GeoJSON to this file"),
+		maxKeys:       flags.Int("max_keys", -1, "don't use more keys than that, apart from the held ones. If < 0 there's no limit"),
 	}
 	flags.Var(cmd.startPortal, "start_portal", "fix the start portal of the drone flight path")
 	flags.Var(cmd.endPortal, "end_portal", "fix the end portal of the drone flight path")
-	return cmd
+	flags.Var(cmd.keyInventory, "key_inventory", "portal whose key is already held, so that long jumps to it need no more keys, may be repeated")
+	flags.Var(cmd.waypoints, "waypoint", "find a flight visiting the waypoint portal instead of the longest flight, may be repeated")
+	return &cmd
 }
 
 func (d *droneFlightCmd) Usage(fileBase string) {
-	fmt.Fprintf(flag.CommandLine.Output(), "%s drone_flight [-start_portal=<lat>,<lng>] [-end_portal=<lat>,<lng>] [-use_long_jumps] [-least_keys|-least_jumps]\n", fileBase)
+	fmt.Fprintf(flag.CommandLine.Output(), "%s drone_flight [-start_portal=<lat>,<lng>] [-end_portal=<lat>,<lng>] [-use_long_jumps] [-least_keys|-least_jumps] [-free_move_range=<meters>] [-key_jump_range=<meters>] [-cell_level=<level>] [-waypoint=<lat>,<lng>...] [-unordered_waypoints] [-key_inventory=<lat>,<lng>...] [-max_keys=<n>] [-reachability [-geojson=<file>]]\n", fileBase)
 	d.flags.PrintDefaults()
 }
 
-func (d *droneFlightCmd) Run(args []string, numWorkers int, output io.Writer, progressFunc func(int, int)) {
+func (d *droneFlightCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
 	d.flags.Parse(flag.Args()[1:])
 	fileArgs := d.flags.Args()
 	if len(fileArgs) != 1 {
 		log.Fatalln("drone_flight command requires exactly one file argument")
 	}
-	portals, err := lib.ParseFile(fileArgs[0])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[0], err)
-	}
+	portals := readPortals(fileArgs[0], params.inputFormat, 2)
 	if *d.leastJumps && *d.leastKeys {
 		log.Fatalln("only one of -least_keys -least_jumps can be specified at the same time")
 	}
-	fmt.Printf("Read %d portals\n", len(portals))
+	if *d.freeMoveRange < 0 || *d.keyJumpRange < 0 {
+		log.Fatalln("-free_move_range and -key_jump_range must not be negative")
+	}
+	if *d.cellLevel < 0 || *d.cellLevel > 30 {
+		log.Fatalln("-cell_level must be between 0 and 30")
+	}
+	if (len(*d.keyInventory) > 0 || *d.maxKeys >= 0) && !*d.useLongJumps {
+		log.Println("-key_inventory and -max_keys have no effect without -use_long_jumps")
+	}
+	if *d.reachability && (d.startPortal.LatLngString == "" || d.endPortal.LatLngString != "" || len(*d.waypoints) > 0) {
+		log.Fatalln("-reachability requires -start_portal, and no -end_portal nor -waypoint")
+	}
+	if *d.reachability && *d.maxKeys >= 0 && *d.leastJumps {
+		log.Fatalln("-reachability with -max_keys is not supported together with -least_jumps")
+	}
+	if *d.geoJSONFile != "" && !*d.reachability {
+		log.Fatalln("-geojson is supported only together with -reachability")
+	}
+	if *d.unordered && len(*d.waypoints) == 0 {
+		log.Fatalln("-unordered_waypoints requires at least one -waypoint")
+	}
+	numWaypoints := len(*d.waypoints)
+	if d.startPortal.LatLngString != "" {
+		numWaypoints++
+	}
+	if d.endPortal.LatLngString != "" {
+		numWaypoints++
+	}
+	if len(*d.waypoints) > 0 && numWaypoints < 2 {
+		log.Fatalln("flight through waypoints requires at least two waypoints, including the start and end portals")
+	}
+	if *d.unordered && numWaypoints > lib.MaxUnorderedDroneFlightWaypoints {
+		log.Fatalf("at most %d unordered waypoints, including the start and end portals, are supported - %d specified", lib.MaxUnorderedDroneFlightWaypoints, numWaypoints)
+	}
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
 
 	numDroneFlightWorkers := runtime.GOMAXPROCS(0)
-	if numWorkers > 0 {
-		numDroneFlightWorkers = numWorkers
+	if params.numWorkers > 0 {
+		numDroneFlightWorkers = params.numWorkers
 	}
 
 	options := []lib.DroneFlightOption{
-		lib.DroneFlightProgressFunc(progressFunc),
 		lib.DroneFlightNumWorkers(numDroneFlightWorkers),
 		lib.DroneFlightStartPortalIndex(portalToIndex(*d.startPortal, portals)),
 		lib.DroneFlightEndPortalIndex(portalToIndex(*d.endPortal, portals)),
 		lib.DroneFlightUseLongJumps(*d.useLongJumps),
+		lib.DroneFlightFreeMoveRange(*d.freeMoveRange),
+		lib.DroneFlightKeyJumpRange(*d.keyJumpRange),
+		lib.DroneFlightCellLevel(*d.cellLevel),
+		lib.DroneFlightKeyInventory(portalsToIndices(*d.keyInventory, portals)),
+		lib.DroneFlightMaxKeys(*d.maxKeys),
 	}
 	if *d.leastJumps {
 		options = append(options, lib.DroneFlightLeastJumps{})
 	} else if *d.leastKeys {
 		options = append(options, lib.DroneFlightLeastKeys{})
 	}
+	if *d.reachability {
+		options = append(options, lib.DroneFlightProgressFunc(params.progressFunc))
+		d.runReachability(ctx, portals, options, params.output, params.format, start)
+		return
+	}
+	if len(*d.waypoints) > 0 {
+		options = append(options, lib.DroneFlightProgressFunc(params.progressFunc), lib.DroneFlightUnorderedWaypoints(*d.unordered))
+		d.runWaypoints(ctx, portals, options, params.output, params.format, start)
+		return
+	}
 
-	result, keysNeeded := lib.LongestDroneFlight(portals, options...)
-	distance := result[0].LatLng.Distance(result[len(result)-1].LatLng) * lib.RadiansToMeters
-	fmt.Fprintln(output, "")
-	fmt.Fprintf(output, "Max flight distance: %fm\n", distance)
+	searchStart := time.Now()
+	results, err := lib.SolveTop(ctx, lib.DroneFlightSolver{Options: options}, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	solutions := lib.Solutions[lib.DroneFlightSolution](results)
+	if params.format == jsonFormat {
+		report := newJSONReport("drone_flight", d.flags, start)
+		for i, s := range solutions {
+			result, keysNeeded := s.Path, s.KeysNeeded
+			distance := result[0].LatLng.Distance(result[len(result)-1].LatLng) * lib.RadiansToMeters
+			solution := report.solution(i)
+			solution.addResult(results[i])
+			solution.Metrics["flight_distance"] = distance
+			solution.Metrics["num_jumps"] = len(result) - 1
+			solution.Metrics["keys_needed"] = len(keysNeeded)
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, s := range solutions {
+		printSolutionHeader(params.output, i, len(solutions))
+		result, keysNeeded := s.Path, s.KeysNeeded
+		distance := result[0].LatLng.Distance(result[len(result)-1].LatLng) * lib.RadiansToMeters
+		fmt.Fprintln(params.output, "")
+		fmt.Fprintf(params.output, "Max flight distance: %fm\n", distance)
+		fmt.Fprintf(params.output, "Keys needed: %d\n", len(keysNeeded))
+		for i, portal := range result {
+			fmt.Fprintf(params.output, "%d: %s\n", i, portal.Name)
+		}
+		fmt.Fprintf(params.output, "\n[%s", lib.PolylineFromPortalList(result))
+		if len(keysNeeded) > 0 {
+			fmt.Fprintf(params.output, ",%s", lib.MarkersFromPortalList(keysNeeded))
+		}
+		fmt.Fprintln(params.output, "]")
+	}
+}
+
+func (d *droneFlightCmd) runWaypoints(ctx context.Context, portals []lib.Portal, options []lib.DroneFlightOption, output io.Writer, format outputFormat, start time.Time) {
+	searchStart := time.Now()
+	route, err := lib.DroneFlightThroughWaypoints(ctx, portals, portalsToIndices(*d.waypoints, portals), options...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	searchTime := time.Since(searchStart)
+	path, keysNeeded := route.Path(), route.KeysNeeded()
+
+	if format == jsonFormat {
+		report := newJSONReport("drone_flight", d.flags, start)
+		solution := report.solution(0)
+		solution.addResult(lib.DroneFlightResult(path, keysNeeded))
+		solution.Metrics["num_jumps"] = len(path) - 1
+		solution.Metrics["keys_needed"] = len(keysNeeded)
+		for _, leg := range route.Legs {
+			jsonLeg := jsonDroneFlightLeg{}
+			for _, portal := range leg.Path {
+				jsonLeg.Path = append(jsonLeg.Path, portal.Guid)
+			}
+			for _, portal := range leg.KeysNeeded {
+				jsonLeg.KeysNeeded = append(jsonLeg.KeysNeeded, portal.Guid)
+			}
+			solution.Legs = append(solution.Legs, jsonLeg)
+		}
+		report.write(output, searchTime)
+		return
+	}
+	fmt.Fprintf(output, "Jumps: %d\n", len(path)-1)
 	fmt.Fprintf(output, "Keys needed: %d\n", len(keysNeeded))
-	for i, portal := range result {
-		fmt.Fprintf(output, "%d: %s\n", i, portal.Name)
+	for i, leg := range route.Legs {
+		fmt.Fprintf(output, "\nLeg %d: %s -> %s, keys needed: %d\n", i+1, route.Waypoints[i].Name, route.Waypoints[i+1].Name, len(leg.KeysNeeded))
+		for j, portal := range leg.Path {
+			fmt.Fprintf(output, "%d: %s\n", j, portal.Name)
+		}
 	}
-	fmt.Fprintf(output, "\n[%s", lib.PolylineFromPortalList(result))
+	fmt.Fprintf(output, "\n[%s", lib.PolylineFromPortalList(path))
 	if len(keysNeeded) > 0 {
 		fmt.Fprintf(output, ",%s", lib.MarkersFromPortalList(keysNeeded))
 	}
 	fmt.Fprintln(output, "]")
 }
+
+func (d *droneFlightCmd) runReachability(ctx context.Context, portals []lib.Portal, options []lib.DroneFlightOption, output io.Writer, format outputFormat, start time.Time) {
+	searchStart := time.Now()
+	reachable, err := lib.DroneFlightReachability(ctx, portals, portalToIndex(*d.startPortal, portals), options...)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	if *d.geoJSONFile != "" {
+		if err := os.WriteFile(*d.geoJSONFile, []byte(lib.DroneFlightReachabilityGeoJSON(reachable)), 0644); err != nil {
+			log.Fatalf("Could not write GeoJSON file: %v\n", err)
+		}
+	}
+
+	if format == jsonFormat {
+		report := newJSONReport("drone_flight", d.flags, start)
+		solution := report.solution(0)
+		solution.addResult(lib.DroneFlightReachabilityResult(reachable))
+		solution.Metrics["num_reachable"] = len(reachable)
+		for _, portal := range reachable {
+			solution.Reachable = append(solution.Reachable, jsonReachablePortal{
+				Guid:       portal.Portal.Guid,
+				Prev:       portal.Prev.Guid,
+				Jumps:      portal.NumJumps,
+				KeysNeeded: portal.NumKeysNeeded,
+			})
+		}
+		report.write(output, searchTime)
+		return
+	}
+	fmt.Fprintf(output, "Reachable portals: %d\n", len(reachable))
+	for _, portal := range reachable {
+		fmt.Fprintf(output, "%s: jumps: %d, keys needed: %d\n", portal.Portal.Name, portal.NumJumps, portal.NumKeysNeeded)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+type fanCmd struct {
+	flags            *flag.FlagSet
+	anchorPortals    *portalsValue
+	keys             *bool
+	route            *bool
+	blockers         *string
+	maxLinkLength    *float64
+	minFieldArea     *float64
+	minFieldHeight   *float64
+	maxOutboundLinks *int
+	disabledPortals  *portalsValue
+}
+
+func NewFanCmd() *fanCmd {
+	flags := flag.NewFlagSet("fan", flag.ExitOnError)
+	cmd := fanCmd{
+		flags:            flags,
+		anchorPortals:    &portalsValue{},
+		keys:             flags.Bool("keys", false, "print number of keys needed and number of outbound links of every portal"),
+		route:            flags.Bool("route", false, "print the order of visiting portals minimizing the walking distance"),
+		blockers:         flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:    flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		minFieldArea:     flags.Float64("min_field_area", 0, "don't make fields with area smaller than that many square meters"),
+		minFieldHeight:   flags.Float64("min_field_height", 0, "don't make fields with any of the heights shorter than that many meters"),
+		maxOutboundLinks: flags.Int("max_outbound_links", 0, "don't throw more than that many links from the anchor portal, 0 means no limit"),
+		disabledPortals:  &portalsValue{},
+	}
+	flags.Var(cmd.anchorPortals, "anchor_portal", "fix anchor portal of the fan")
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of the fan field")
+	return &cmd
+}
+
+func (f *fanCmd) Usage(fileBase string) {
+	fmt.Fprintf(flag.CommandLine.Output(), "%s fan [-keys] [-route] [-blockers=<file>] [-max_link_length=<meters>] [-min_field_area=<square meters>] [-min_field_height=<meters>] [-max_outbound_links=<n>] [-disabled_portal=<lat>,<lng>]... [-anchor_portal=<lat>,<lng>] <portals_file>\n", fileBase)
+	f.flags.PrintDefaults()
+}
+
+func (f *fanCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
+	f.flags.Parse(args)
+	fileArgs := f.flags.Args()
+	if len(fileArgs) != 1 {
+		log.Fatalln("fan command requires exactly one file argument")
+	}
+	portals := readPortals(fileArgs[0], params.inputFormat, 3)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
+	if len(*f.anchorPortals) > 1 {
+		log.Fatalf("fan command accepts at most one anchor portal - %d specified", len(*f.anchorPortals))
+	}
+	if *f.maxOutboundLinks < 0 {
+		log.Fatalf("-max_outbound_links must not be negative - %d specified", *f.maxOutboundLinks)
+	}
+	anchorPortalIndices := portalsToIndices(*f.anchorPortals, portals)
+	disabledPortals := portalsToPortalList(*f.disabledPortals, portals)
+
+	searchStart := time.Now()
+	solver := lib.FanSolver{
+		FixedAnchorIndices: anchorPortalIndices,
+		Options: []lib.FanOption{
+			lib.FanBlockers(readBlockers(*f.blockers)), lib.FanMaxLinkLength(*f.maxLinkLength), lib.FanMinFieldSize{Area: *f.minFieldArea, Height: *f.minFieldHeight},
+			lib.FanMaxOutboundLinks(*f.maxOutboundLinks), lib.FanDisabledPortals(disabledPortals)},
+	}
+	solverResults, err := lib.SolveTop(ctx, solver, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	results := lib.Solutions[lib.FanSolution](solverResults)
+
+	if params.format == jsonFormat {
+		report := newJSONReport("fan", f.flags, start)
+		for i, result := range results {
+			solution := report.solution(i)
+			solution.addResult(solverResults[i])
+			plan, err := lib.FanPlan(result.Anchor, result.Fan)
+			solution.addPlan(plan, err, *f.route, disabledPortals)
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, result := range results {
+		printSolutionHeader(params.output, i, len(results))
+		fmt.Fprintf(params.output, "\nAnchor: %s\nFan portals:\n", result.Anchor.Name)
+		for i, portal := range result.Fan {
+			fmt.Fprintf(params.output, "%d: %s\n", i, portal.Name)
+		}
+		if *f.keys || *f.route || len(disabledPortals) > 0 {
+			plan, err := lib.FanPlan(result.Anchor, result.Fan)
+			printPlanReports(params.output, plan, err, *f.keys, *f.route, disabledPortals)
+		}
+		fmt.Fprintf(params.output, "\n%s\n", lib.FanDrawToolsString(result.Anchor, result.Fan))
+	}
+}
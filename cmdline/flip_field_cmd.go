@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"runtime"
+	"time"
 
 	"github.com/pwiecz/portal_patterns/lib"
 )
@@ -16,9 +18,17 @@ type flipFieldCmd struct {
 	maxFlipPortals     *int
 	simpleBackbone     *bool
 	basePortals        *portalsValue
+	keys               *bool
+	route              *bool
+	blockers           *string
+	maxLinkLength      *float64
+	disabledPortals    *portalsValue
+	flipPortals        *portalsValue
+	noFlipPortals      *portalsValue
+	executionPlan      *bool
 }
 
-func NewFlipFieldCmd() flipFieldCmd {
+func NewFlipFieldCmd() *flipFieldCmd {
 	flags := flag.NewFlagSet("flip_field", flag.ExitOnError)
 	cmd := flipFieldCmd{
 		flags: flags,
@@ -26,21 +36,33 @@ func NewFlipFieldCmd() flipFieldCmd {
 			Value:   16,
 			Exactly: true,
 		},
-		maxFlipPortals: flags.Int("max_flip_portals", 0, "if >0 don't try to optimize for number of flip portals above this value"),
-		simpleBackbone: flags.Bool("simple_backbone", false, "make all backbone portals linkable from the first backbone portal"),
-		basePortals:    &portalsValue{},
+		maxFlipPortals:  flags.Int("max_flip_portals", 0, "if >0 don't try to optimize for number of flip portals above this value"),
+		simpleBackbone:  flags.Bool("simple_backbone", false, "make all backbone portals linkable from the first backbone portal"),
+		basePortals:     &portalsValue{},
+		keys:            flags.Bool("keys", false, "print number of keys needed and number of outbound links of every portal"),
+		route:           flags.Bool("route", false, "print the order of visiting portals minimizing the walking distance"),
+		blockers:        flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:   flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		disabledPortals: &portalsValue{},
+		flipPortals:     &portalsValue{},
+		noFlipPortals:   &portalsValue{},
+		executionPlan:   flags.Bool("execution_plan", false, "print the backbone links, initial fan links, flips and re-links in the order of execution, with the number of fields after every step"),
 	}
 	flags.Var(cmd.numBackbonePortals, "num_backbone_portals", "limit of number of portals in the \"backbone\" of the field. May be a number of have a format of \"<=number\"")
 	flags.Var(cmd.basePortals, "base_portal", "fix a base portal of the flip field")
-	return cmd
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of the flip field")
+	flags.Var(cmd.flipPortals, "flip_portal", "make this portal one of the flip portals")
+	flags.Var(cmd.noFlipPortals, "no_flip_portal", "don't make this portal a flip portal, it still may be a backbone portal")
+	return &cmd
 }
 
 func (f *flipFieldCmd) Usage(fileBase string) {
-	fmt.Fprintf(flag.CommandLine.Output(), "%s flip_field [-num_backbone_portals=[<=]<number>] [--max_flip_portals=<number>] [--simple_backbone] [-base_portal=<lat>,<lng>]... <portals_file>\n", fileBase)
+	fmt.Fprintf(flag.CommandLine.Output(), "%s flip_field [-num_backbone_portals=[<=]<number>] [--max_flip_portals=<number>] [--simple_backbone] [-keys] [-route] [-blockers=<file>] [-max_link_length=<meters>] [-disabled_portal=<lat>,<lng>]... [-base_portal=<lat>,<lng>]... [-flip_portal=<lat>,<lng>]... [-no_flip_portal=<lat>,<lng>]... [-execution_plan] <portals_file>\n", fileBase)
 	f.flags.PrintDefaults()
 }
 
-func (f *flipFieldCmd) Run(args []string, numWorkers int, output io.Writer, progressFunc func(int, int)) {
+func (f *flipFieldCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
 	f.flags.Parse(flag.Args()[1:])
 	if f.numBackbonePortals.Value <= 2 {
 		log.Fatalln("-num_backbone_portals limit must be at least 2")
@@ -49,15 +71,25 @@ func (f *flipFieldCmd) Run(args []string, numWorkers int, output io.Writer, prog
 	if len(fileArgs) != 1 {
 		log.Fatalln("flip_field command requires exactly one file argument")
 	}
-	portals, err := lib.ParseFile(fileArgs[0])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[0], err)
-	}
-	fmt.Printf("Read %d portals\n", len(portals))
+	portals := readPortals(fileArgs[0], params.inputFormat, 3)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
 	if len(*f.basePortals) > 2 {
 		log.Fatalf("flip_field command accepts at most two base portals - %d specified", len(*f.basePortals))
 	}
 	basePortalIndices := portalsToIndices(*f.basePortals, portals)
+	disabledPortals := portalsToPortalList(*f.disabledPortals, portals)
+	flipPortalIndices := portalsToIndices(*f.flipPortals, portals)
+	noFlipPortalIndices := portalsToIndices(*f.noFlipPortals, portals)
+	if *f.maxFlipPortals > 0 && len(flipPortalIndices) > *f.maxFlipPortals {
+		log.Fatalf("-flip_portal given %d times, more than -max_flip_portals=%d", len(flipPortalIndices), *f.maxFlipPortals)
+	}
+	for _, i := range flipPortalIndices {
+		for _, j := range append(noFlipPortalIndices, basePortalIndices...) {
+			if i == j {
+				log.Fatalf("flip portal \"%s\" cannot be also given with -no_flip_portal or -base_portal", portals[i].Name)
+			}
+		}
+	}
 
 	var numPortalLimit lib.PortalLimit
 	if f.numBackbonePortals.Exactly {
@@ -66,26 +98,94 @@ func (f *flipFieldCmd) Run(args []string, numWorkers int, output io.Writer, prog
 		numPortalLimit = lib.LESS_EQUAL
 	}
 	numFlipFieldWorkers := runtime.GOMAXPROCS(0)
-	if numWorkers > 0 {
-		numFlipFieldWorkers = numWorkers
+	if params.numWorkers > 0 {
+		numFlipFieldWorkers = params.numWorkers
 	}
 	options := []lib.FlipFieldOption{
-		lib.FlipFieldProgressFunc(progressFunc),
 		lib.FlipFieldNumWorkers(numFlipFieldWorkers),
 		lib.FlipFieldBackbonePortalLimit{Value: f.numBackbonePortals.Value, LimitType: numPortalLimit},
 		lib.FlipFieldMaxFlipPortals(*f.maxFlipPortals),
 		lib.FlipFieldSimpleBackbone(*f.simpleBackbone),
 		lib.FlipFieldFixedBaseIndices(basePortalIndices),
+		lib.FlipFieldBlockers(readBlockers(*f.blockers)),
+		lib.FlipFieldMaxLinkLength(*f.maxLinkLength),
+		lib.FlipFieldDisabledPortals(disabledPortals),
+		lib.FlipFieldForcedFlipPortalIndices(flipPortalIndices),
+		lib.FlipFieldExcludedFlipPortalIndices(noFlipPortalIndices),
+	}
+	searchStart := time.Now()
+	results, err := lib.SolveTop(ctx, lib.FlipFieldSolver{Options: options}, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	solutions := lib.Solutions[lib.FlipFieldSolution](results)
+
+	if params.format == jsonFormat {
+		report := newJSONReport("flip_field", f.flags, start)
+		for i, s := range solutions {
+			backbone, rest := s.Backbone, s.FlipPortals
+			solution := report.solution(i)
+			solution.addResult(results[i])
+			solution.Metrics["num_backbone_portals"] = len(backbone)
+			solution.Metrics["num_flip_portals"] = len(rest)
+			execution, err := lib.FlipFieldExecutionPlan(backbone, rest)
+			solution.addPlan(execution.Plan(), err, *f.route, disabledPortals)
+			if *f.executionPlan {
+				for _, step := range execution.Steps {
+					jsonStep := jsonFlipFieldStep{
+						Phase:            step.Phase.String(),
+						Origin:           step.Origin.Guid,
+						NumFields:        step.NumFields,
+						NumFieldsCreated: step.NumFieldsCreated,
+					}
+					if step.Type == lib.LINK {
+						jsonStep.Destination = step.Destination.Guid
+					}
+					solution.Execution = append(solution.Execution, jsonStep)
+				}
+			}
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, s := range solutions {
+		printSolutionHeader(params.output, i, len(solutions))
+		backbone, rest := s.Backbone, s.FlipPortals
+		fmt.Fprintf(params.output, "\nNum backbone portals: %d, num flip portals: %d, num fields: %d\nBackbone:\n",
+			len(backbone), len(rest), len(rest)*(2*len(backbone)-3))
+		for i, portal := range backbone {
+			fmt.Fprintf(params.output, "%d: %s\n", i, portal.Name)
+		}
+		if *f.keys || *f.route || len(disabledPortals) > 0 {
+			plan, err := lib.FlipFieldPlan(backbone, rest)
+			printPlanReports(params.output, plan, err, *f.keys, *f.route, disabledPortals)
+		}
+		if *f.executionPlan {
+			execution, err := lib.FlipFieldExecutionPlan(backbone, rest)
+			printFlipFieldExecution(params.output, execution, err)
+		}
+		fmt.Fprintf(params.output, "\n[%s", lib.PolylineFromPortalList(backbone))
+		if len(rest) > 0 {
+			fmt.Fprintf(params.output, ",%s", lib.MarkersFromPortalList(rest))
+		}
+		fmt.Fprintln(params.output, "]")
+	}
+}
+
+func printFlipFieldExecution(output io.Writer, execution lib.FlipFieldExecution, err error) {
+	if err != nil {
+		fmt.Fprintf(output, "\nWARNING: the link plan is not valid: %v\n", err)
 	}
-	backbone, rest := lib.LargestFlipField(portals, options...)
-	fmt.Fprintf(output, "\nNum backbone portals: %d, num flip portals: %d, num fields: %d\nBackbone:\n",
-		len(backbone), len(rest), len(rest)*(2*len(backbone)-3))
-	for i, portal := range backbone {
+	fmt.Fprintln(output, "\nFlip order:")
+	for i, portal := range execution.FlipOrder {
 		fmt.Fprintf(output, "%d: %s\n", i, portal.Name)
 	}
-	fmt.Fprintf(output, "\n[%s", lib.PolylineFromPortalList(backbone))
-	if len(rest) > 0 {
-		fmt.Fprintf(output, ",%s", lib.MarkersFromPortalList(rest))
+	fmt.Fprintln(output, "\nExecution plan:")
+	for i, step := range execution.Steps {
+		if step.Type == lib.FLIP {
+			fmt.Fprintf(output, "%d: [%s] flip %s", i, step.Phase, step.Origin.Name)
+		} else {
+			fmt.Fprintf(output, "%d: [%s] link %s -> %s", i, step.Phase, step.Origin.Name, step.Destination.Name)
+		}
+		fmt.Fprintf(output, " (fields: %d, created: %d)\n", step.NumFields, step.NumFieldsCreated)
 	}
-	fmt.Fprintln(output, "]")
 }
@@ -1,54 +1,100 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"time"
 
 	"github.com/pwiecz/portal_patterns/lib"
 )
 
 type herringboneCmd struct {
-	flags       *flag.FlagSet
-	basePortals *portalsValue
+	flags           *flag.FlagSet
+	basePortals     *portalsValue
+	keys            *bool
+	route           *bool
+	blockers        *string
+	maxLinkLength   *float64
+	minFieldArea    *float64
+	minFieldHeight  *float64
+	disabledPortals *portalsValue
 }
 
-func NewHerringboneCmd() herringboneCmd {
+func NewHerringboneCmd() *herringboneCmd {
 	flags := flag.NewFlagSet("herringbone", flag.ExitOnError)
 	cmd := herringboneCmd{
-		flags:       flags,
-		basePortals: &portalsValue{},
+		flags:           flags,
+		basePortals:     &portalsValue{},
+		keys:            flags.Bool("keys", false, "print number of keys needed and number of outbound links of every portal"),
+		route:           flags.Bool("route", false, "print the order of visiting portals minimizing the walking distance"),
+		blockers:        flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:   flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		minFieldArea:    flags.Float64("min_field_area", 0, "don't make fields with area smaller than that many square meters"),
+		minFieldHeight:  flags.Float64("min_field_height", 0, "don't make fields with any of the heights shorter than that many meters"),
+		disabledPortals: &portalsValue{},
 	}
 	flags.Var(cmd.basePortals, "base_portal", "fix a base portal of the herringbone field")
-	return cmd
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of the herringbone field")
+	return &cmd
 }
 
 func (h *herringboneCmd) Usage(fileBase string) {
-	fmt.Fprintf(flag.CommandLine.Output(), "%s herringbone [-base_portal=<lat>,<lng>]... <portals_file>\n", fileBase)
+	fmt.Fprintf(flag.CommandLine.Output(), "%s herringbone [-keys] [-route] [-blockers=<file>] [-max_link_length=<meters>] [-min_field_area=<square meters>] [-min_field_height=<meters>] [-disabled_portal=<lat>,<lng>]... [-base_portal=<lat>,<lng>]... <portals_file>\n", fileBase)
 	h.flags.PrintDefaults()
 }
 
-func (h *herringboneCmd) Run(args []string, output io.Writer, numWorkers int, progressFunc func(int, int)) {
+func (h *herringboneCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
 	h.flags.Parse(args)
 	fileArgs := h.flags.Args()
 	if len(fileArgs) != 1 {
 		log.Fatalln("herringbone command requires exactly one file argument")
 	}
-	portals, err := lib.ParseFile(fileArgs[0])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[0], err)
-	}
-	fmt.Printf("Read %d portals\n", len(portals))
+	portals := readPortals(fileArgs[0], params.inputFormat, 3)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
 	if len(*h.basePortals) > 2 {
 		log.Fatalf("herringbone command accepts at most two base portals - %d specified", len(*h.basePortals))
 	}
 	basePortalIndices := portalsToIndices(*h.basePortals, portals)
+	disabledPortals := portalsToPortalList(*h.disabledPortals, portals)
+
+	searchStart := time.Now()
+	solver := lib.HerringboneSolver{
+		FixedBaseIndices: basePortalIndices,
+		NumWorkers:       params.numWorkers,
+		Options: []lib.HerringboneOption{
+			lib.HerringboneBlockers(readBlockers(*h.blockers)), lib.HerringboneMaxLinkLength(*h.maxLinkLength), lib.HerringboneMinFieldSize{Area: *h.minFieldArea, Height: *h.minFieldHeight}, lib.HerringboneDisabledPortals(disabledPortals)},
+	}
+	results, err := lib.SolveTop(ctx, solver, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	solutions := lib.Solutions[lib.HerringboneSolution](results)
 
-	b0, b1, result := lib.LargestHerringbone(portals, basePortalIndices, numWorkers, progressFunc)
-	fmt.Fprintf(output, "\nBase (%s) (%s)\n", b0.Name, b1.Name)
-	for i, portal := range result {
-		fmt.Fprintf(output, "%d: %s\n", i, portal.Name)
+	if params.format == jsonFormat {
+		report := newJSONReport("herringbone", h.flags, start)
+		for i, s := range solutions {
+			b0, b1, result := s.B0, s.B1, s.Backbone
+			solution := report.solution(i)
+			solution.addResult(results[i])
+			plan, err := lib.HerringbonePlan(b0, b1, result)
+			solution.addPlan(plan, err, *h.route, disabledPortals)
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, s := range solutions {
+		printSolutionHeader(params.output, i, len(solutions))
+		b0, b1, result := s.B0, s.B1, s.Backbone
+		fmt.Fprintf(params.output, "\nBase (%s) (%s)\n", b0.Name, b1.Name)
+		for i, portal := range result {
+			fmt.Fprintf(params.output, "%d: %s\n", i, portal.Name)
+		}
+		if *h.keys || *h.route || len(disabledPortals) > 0 {
+			plan, err := lib.HerringbonePlan(b0, b1, result)
+			printPlanReports(params.output, plan, err, *h.keys, *h.route, disabledPortals)
+		}
+		fmt.Fprintf(params.output, "\n%s\n", lib.HerringboneDrawToolsString(b0, b1, result))
 	}
-	fmt.Fprintf(output, "\n%s\n", lib.HerringboneDrawToolsString(b0, b1, result))
 }
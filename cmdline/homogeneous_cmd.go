@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
 	"time"
@@ -21,9 +21,18 @@ type homogeneousCmd struct {
 	random          *bool
 	pure            *bool
 	cornerPortals   *portalsValue
+	keys            *bool
+	route           *bool
+	blockers        *string
+	maxLinkLength   *float64
+	minFieldArea    *float64
+	minFieldHeight  *float64
+	disabledPortals *portalsValue
+	memoryBudget    *uint64
+	checkpoint      *string
 }
 
-func NewHomogeneousCmd() homogeneousCmd {
+func NewHomogeneousCmd() *homogeneousCmd {
 	flags := flag.NewFlagSet("homogeneous", flag.ExitOnError)
 	cmd := homogeneousCmd{
 		flags:           flags,
@@ -35,13 +44,23 @@ func NewHomogeneousCmd() homogeneousCmd {
 		random:          flags.Bool("random", false, "pick a random top triangle"),
 		pure:            flags.Bool("pure", false, "consider only pure homogeneous fields (those that use all the portals inside the top level triangle)"),
 		cornerPortals:   &portalsValue{},
+		keys:            flags.Bool("keys", false, "print number of keys needed and number of outbound links of every portal"),
+		route:           flags.Bool("route", false, "print the order of visiting portals minimizing the walking distance"),
+		blockers:        flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:   flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		minFieldArea:    flags.Float64("min_field_area", 0, "don't make fields with area smaller than that many square meters"),
+		minFieldHeight:  flags.Float64("min_field_height", 0, "don't make fields with any of the heights shorter than that many meters"),
+		disabledPortals: &portalsValue{},
+		memoryBudget:    flags.Uint64("memory_budget", lib.DefaultMemoryBudget>>20, "limit in MiB of memory used by the search, fail if the search would need more"),
+		checkpoint:      flags.String("checkpoint", "", "periodically save the state of the search to this file, and resume the search from it if it's been interrupted (requires -pure)"),
 	}
 	flags.Var(cmd.cornerPortals, "corner_portal", "fix corner portal of the homogeneous field")
-	return cmd
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of the homogeneous field")
+	return &cmd
 }
 
 func (h *homogeneousCmd) Usage(fileBase string) {
-	fmt.Fprintf(flag.CommandLine.Output(), "%s homogeneous [-max_depth=<n>] [-pretty] [-largest_area|-smallest_area|-most_equilateral|-random] [-pure] [-corner_portal=<lat>,<lng>]... <portals_file>\n", fileBase)
+	fmt.Fprintf(flag.CommandLine.Output(), "%s homogeneous [-max_depth=<n>] [-pretty] [-largest_area|-smallest_area|-most_equilateral|-random] [-pure] [-keys] [-route] [-blockers=<file>] [-max_link_length=<meters>] [-min_field_area=<square meters>] [-min_field_height=<meters>] [-disabled_portal=<lat>,<lng>]... [-corner_portal=<lat>,<lng>]... [-memory_budget=<MiB>] [-checkpoint=<file>] <portals_file>\n", fileBase)
 	h.flags.PrintDefaults()
 }
 
@@ -52,7 +71,8 @@ func btoi(b bool) int {
 	return 0
 }
 
-func (h *homogeneousCmd) Run(args []string, output io.Writer, numWorkers int, progressFunc func(int, int)) {
+func (h *homogeneousCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
 	h.flags.Parse(args)
 	if *h.maxDepth < 1 {
 		log.Fatalln("-max_depth must by at least 1")
@@ -60,24 +80,28 @@ func (h *homogeneousCmd) Run(args []string, output io.Writer, numWorkers int, pr
 	if btoi(*h.largestArea)+btoi(*h.smallestArea)+btoi(*h.mostEquilateral)+btoi(*h.random) > 1 {
 		log.Fatalln("only one of -largest_area -smallest_area -most_equilateral -random can be specified at the same time")
 	}
+	if *h.checkpoint != "" && !*h.pure {
+		log.Fatalln("-checkpoint is supported only together with -pure")
+	}
 	fileArgs := h.flags.Args()
 	if len(fileArgs) != 1 {
 		log.Fatalln("homogeneous command requires exactly one file argument")
 	}
-	portals, err := lib.ParseFile(fileArgs[0])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[0], err)
-	}
-	fmt.Printf("Read %d portals\n", len(portals))
+	portals := readPortals(fileArgs[0], params.inputFormat, 3)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
 	if len(*h.cornerPortals) > 3 {
 		log.Fatalf("homogeneous command accepts at most three corner portals - %d specified", len(*h.cornerPortals))
 	}
 	cornerPortalIndices := portalsToIndices(*h.cornerPortals, portals)
+	disabledPortals := portalsToPortalList(*h.disabledPortals, portals)
 	options := []lib.HomogeneousOption{
-		lib.HomogeneousNumWorkers(numWorkers),
-		lib.HomogeneousProgressFunc(progressFunc),
+		lib.HomogeneousNumWorkers(params.numWorkers),
 		lib.HomogeneousMaxDepth(*h.maxDepth),
 		lib.HomogeneousFixedCornerIndices(cornerPortalIndices),
+		lib.HomogeneousBlockers(readBlockers(*h.blockers)),
+		lib.HomogeneousMaxLinkLength(*h.maxLinkLength),
+		lib.HomogeneousMinFieldSize{Area: *h.minFieldArea, Height: *h.minFieldHeight},
+		lib.HomogeneousDisabledPortals(disabledPortals),
 	}
 	// check for pretty before setting top level scorer, as pretty overwrites the top level scorer
 	if *h.pretty {
@@ -97,13 +121,40 @@ func (h *homogeneousCmd) Run(args []string, output io.Writer, numWorkers int, pr
 		options = append(options, lib.HomogeneousRandom{Rand: rand})
 	}
 	options = append(options, lib.HomogeneousPure(*h.pure))
+	options = append(options, lib.HomogeneousMemoryBudget(*h.memoryBudget<<20))
+	options = append(options, lib.HomogeneousCheckpoint{File: *h.checkpoint})
 
-	result, depth := lib.DeepestHomogeneous(portals, options...)
+	searchStart := time.Now()
+	results, err := lib.SolveTop(ctx, lib.HomogeneousSolver{Options: options}, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	solutions := lib.Solutions[lib.HomogeneousSolution](results)
 
-	fmt.Fprintf(output, "\nDepth: %d\n", depth)
-	for i, portal := range result {
-		fmt.Fprintf(output, "%d: %s\n", i, portal.Name)
+	if params.format == jsonFormat {
+		report := newJSONReport("homogeneous", h.flags, start)
+		for i, s := range solutions {
+			result, depth := s.Portals, s.Depth
+			solution := report.solution(i)
+			solution.addResult(results[i])
+			solution.Metrics["depth"] = depth
+			plan, err := lib.HomogeneousPlan(depth, result)
+			solution.addPlan(plan, err, *h.route, disabledPortals)
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, s := range solutions {
+		printSolutionHeader(params.output, i, len(solutions))
+		result, depth := s.Portals, s.Depth
+		fmt.Fprintf(params.output, "\nDepth: %d\n", depth)
+		for i, portal := range result {
+			fmt.Fprintf(params.output, "%d: %s\n", i, portal.Name)
+		}
+		if *h.keys || *h.route || len(disabledPortals) > 0 {
+			plan, err := lib.HomogeneousPlan(depth, result)
+			printPlanReports(params.output, plan, err, *h.keys, *h.route, disabledPortals)
+		}
+		drawTools := lib.HomogeneousDrawToolsString(depth, result)
+		fmt.Fprintf(params.output, "\n%s\n", drawTools)
 	}
-	drawTools := lib.HomogeneousDrawToolsString(depth, result)
-	fmt.Fprintf(output, "\n%s\n", drawTools)
 }
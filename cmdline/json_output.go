@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+type outputFormat int
+
+const (
+	textFormat outputFormat = iota
+	jsonFormat
+)
+
+func parseOutputFormat(format string) (outputFormat, error) {
+	switch format {
+	case "text":
+		return textFormat, nil
+	case "json":
+		return jsonFormat, nil
+	}
+	return textFormat, fmt.Errorf("unknown output format \"%s\", expected \"text\" or \"json\"", format)
+}
+
+type jsonPortal struct {
+	Guid string  `json:"guid"`
+	Name string  `json:"name"`
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+	Role string  `json:"role,omitempty"`
+}
+
+type jsonPortalKeys struct {
+	Guid          string `json:"guid"`
+	Keys          int    `json:"keys"`
+	OutboundLinks int    `json:"outbound_links"`
+}
+
+type jsonRouteStop struct {
+	Guid  string   `json:"guid"`
+	Links []string `json:"links,omitempty"`
+	Flip  bool     `json:"flip,omitempty"`
+}
+
+type jsonRoute struct {
+	Distance float64         `json:"distance"`
+	Stops    []jsonRouteStop `json:"stops"`
+}
+
+type jsonDroneFlightLeg struct {
+	Path       []string `json:"path"`
+	KeysNeeded []string `json:"keys_needed,omitempty"`
+}
+
+type jsonReachablePortal struct {
+	Guid       string `json:"guid"`
+	Prev       string `json:"prev"`
+	Jumps      int    `json:"jumps"`
+	KeysNeeded int    `json:"keys_needed"`
+}
+
+type jsonFlipFieldStep struct {
+	Phase            string `json:"phase"`
+	Origin           string `json:"origin"`
+	Destination      string `json:"destination,omitempty"`
+	NumFields        int    `json:"num_fields"`
+	NumFieldsCreated int    `json:"num_fields_created"`
+}
+
+type jsonTiming struct {
+	Start         time.Time `json:"start"`
+	SearchSeconds float64   `json:"search_seconds"`
+	TotalSeconds  float64   `json:"total_seconds"`
+}
+
+// jsonSolution - a single pattern found by a command
+type jsonSolution struct {
+	Portals   []jsonPortal           `json:"portals"`
+	Metrics   map[string]interface{} `json:"metrics"`
+	Keys      []jsonPortalKeys       `json:"keys,omitempty"`
+	Route     *jsonRoute             `json:"route,omitempty"`
+	Legs      []jsonDroneFlightLeg   `json:"legs,omitempty"`
+	Reachable []jsonReachablePortal  `json:"reachable,omitempty"`
+	Execution []jsonFlipFieldStep    `json:"execution,omitempty"`
+	DrawTools json.RawMessage        `json:"draw_tools"`
+}
+
+func newJSONSolution() jsonSolution {
+	return jsonSolution{
+		Metrics:   make(map[string]interface{}),
+		DrawTools: json.RawMessage("[]"),
+	}
+}
+
+// jsonReport - result of a single command run in a machine readable form.
+// The best solution is stored directly in the report, the following ones in Alternatives.
+type jsonReport struct {
+	Command    string            `json:"command"`
+	Parameters map[string]string `json:"parameters"`
+	Files      []string          `json:"files"`
+	jsonSolution
+	Alternatives []*jsonSolution `json:"alternatives,omitempty"`
+	Timing       jsonTiming      `json:"timing"`
+}
+
+func newJSONReport(command string, flags *flag.FlagSet, start time.Time) *jsonReport {
+	parameters := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		parameters[f.Name] = f.Value.String()
+	})
+	return &jsonReport{
+		Command:      command,
+		Parameters:   parameters,
+		Files:        flags.Args(),
+		jsonSolution: newJSONSolution(),
+		Timing:       jsonTiming{Start: start},
+	}
+}
+
+// solution returns storage for i-th best solution.
+func (r *jsonReport) solution(i int) *jsonSolution {
+	if i == 0 {
+		return &r.jsonSolution
+	}
+	solution := newJSONSolution()
+	r.Alternatives = append(r.Alternatives, &solution)
+	return &solution
+}
+
+// addResult adds the portals of the pattern together with their roles,
+// the score and the total cost of the pattern and its draw tools rendering.
+func (r *jsonSolution) addResult(result lib.Result) {
+	cost := 0.0
+	counted := make(map[string]struct{})
+	for _, portal := range result.Portals {
+		if _, ok := counted[portal.Portal.Guid]; !ok {
+			counted[portal.Portal.Guid] = struct{}{}
+			cost += portal.Portal.Cost
+		}
+		r.Portals = append(r.Portals, jsonPortal{
+			Guid: portal.Portal.Guid,
+			Name: portal.Portal.Name,
+			Lat:  portal.Portal.LatLng.Lat.Degrees(),
+			Lng:  portal.Portal.LatLng.Lng.Degrees(),
+			Role: string(portal.Role),
+		})
+	}
+	r.Metrics["score"] = result.Score
+	if cost != 0 {
+		r.Metrics["cost"] = cost
+	}
+	r.DrawTools = json.RawMessage(result.DrawToolsString())
+}
+
+// addPlan adds the field and link counts, the length of the longest link,
+// the keys needed to execute the plan, and if requested, the walking route.
+func (r *jsonSolution) addPlan(plan lib.Plan, planErr error, route bool, disabledPortals []lib.Portal) {
+	if planErr != nil {
+		r.Metrics["plan_error"] = planErr.Error()
+	}
+	var disabledInside []string
+	for _, portal := range plan.PortalsInsideFields(disabledPortals) {
+		disabledInside = append(disabledInside, portal.Guid)
+	}
+	if len(disabledInside) > 0 {
+		r.Metrics["disabled_portals_inside_fields"] = disabledInside
+	}
+	r.Metrics["num_fields"] = plan.NumFields()
+	r.Metrics["num_links"] = plan.NumLinks()
+	r.Metrics["longest_link"] = plan.LongestLink()
+	keysNeeded := 0
+	for _, k := range lib.PlanKeys(plan) {
+		r.Keys = append(r.Keys, jsonPortalKeys{Guid: k.Portal.Guid, Keys: k.Keys, OutboundLinks: k.OutboundLinks})
+		keysNeeded += k.Keys
+	}
+	r.Metrics["keys_needed"] = keysNeeded
+	if route {
+		walkingRoute := lib.WalkingRoute(plan)
+		r.Route = &jsonRoute{Distance: walkingRoute.Distance}
+		for _, stop := range walkingRoute.Stops {
+			jsonStop := jsonRouteStop{Guid: stop.Portal.Guid}
+			for _, step := range stop.Steps {
+				switch step.Type {
+				case lib.LINK:
+					jsonStop.Links = append(jsonStop.Links, step.Destination.Guid)
+				case lib.FLIP:
+					jsonStop.Flip = true
+				}
+			}
+			r.Route.Stops = append(r.Route.Stops, jsonStop)
+		}
+	}
+}
+
+func (r *jsonReport) write(output io.Writer, searchTime time.Duration) {
+	r.Timing.SearchSeconds = searchTime.Seconds()
+	r.Timing.TotalSeconds = time.Since(r.Timing.Start).Seconds()
+	bytes, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		log.Fatalf("Could not encode the result as json: %v\n", err)
+	}
+	fmt.Fprintf(output, "%s\n", bytes)
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
@@ -13,37 +17,70 @@ import (
 	"github.com/pwiecz/portal_patterns/lib"
 )
 
+// infoOutput - where to print informational messages, which are not part of the result
+var infoOutput io.Writer = os.Stdout
+
 func main() {
 	fileBase := filepath.Base(os.Args[0])
 	cpuprofile := flag.String("cpuprofile", "", "write CPU profile to this file")
 	numWorkersFlag := flag.Int("num_workers", 0, "if applicable for given algorithm use that many worker threads. If <= 0 use as many as there are CPUs on the machine")
 	showProgress := flag.Bool("progress", true, "show progress bar")
 	output := flag.String("output", "-", "write output to this file, instead of printing it to stdout")
+	formatFlag := flag.String("format", "text", "output format, either \"text\" or \"json\"")
+	topFlag := flag.Int("top", 1, "find up to that many best solutions having distinct sets of portals")
+	inputFormatFlag := flag.String("input_format", "auto", "format of the portals files: auto, json, csv, drawtools, geojson or kml. Use \"-\" as a file name to read portals from stdin")
+	regionFlag := flag.String("region", "", "use only portals inside this region: polygons from a GeoJSON, KML or draw tools file, or a comma separated list of s2 cell tokens")
+	withinRadius := &circleValue{}
+	flag.Var(withinRadius, "within_radius", "use only portals within given distance in meters from a point, specified as <lat>,<lng>,<meters>")
 	flag.BoolVar(showProgress, "P", true, "show progress bar")
-	cobwebCmd := NewCobwebCmd()
-	herringboneCmd := NewHerringboneCmd()
-	doubleHerringboneCmd := NewDoubleHerringboneCmd()
-	threeCornersCmd := NewThreeCornersCmd()
-	flipFieldCmd := NewFlipFieldCmd()
-	homogeneousCmd := NewHomogeneousCmd()
-	droneFlightCmd := NewDroneFlightCmd()
+	commands := map[string]command{
+		"cobweb":             NewCobwebCmd(),
+		"herringbone":        NewHerringboneCmd(),
+		"double_herringbone": NewDoubleHerringboneCmd(),
+		"three_corners":      NewThreeCornersCmd(),
+		"flip_field":         NewFlipFieldCmd(),
+		"homogeneous":        NewHomogeneousCmd(),
+		"drone_flight":       NewDroneFlightCmd(),
+		"max_fields":         NewMaxFieldsCmd(),
+		"onion":              NewOnionCmd(),
+		"fan":                NewFanCmd(),
+	}
+	// Patterns registered in lib without a command of their own are run with their default parameters.
+	for _, name := range lib.SolverNames() {
+		if _, ok := commands[name]; !ok {
+			commands[name] = newSolverCmd(name)
+		}
+	}
 
 	defaultUsage := flag.Usage
 	flag.Usage = func() {
 		defaultUsage()
-		cobwebCmd.Usage(fileBase)
-		threeCornersCmd.Usage(fileBase)
-		herringboneCmd.Usage(fileBase)
-		doubleHerringboneCmd.Usage(fileBase)
-		flipFieldCmd.Usage(fileBase)
-		homogeneousCmd.Usage(fileBase)
-		droneFlightCmd.Usage(fileBase)
+		for _, name := range lib.SolverNames() {
+			commands[name].Usage(fileBase)
+		}
 	}
 	flag.Parse()
 	if len(flag.Args()) <= 1 {
 		flag.Usage()
 		os.Exit(0)
 	}
+	format, err := parseOutputFormat(*formatFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	inputFormat, err := lib.ParsePortalFileFormat(*inputFormatFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *topFlag < 1 {
+		log.Fatalln("-top must be at least 1")
+	}
+	if *regionFlag != "" {
+		portalRegions = append(portalRegions, readRegion(*regionFlag))
+	}
+	if withinRadius.CircleString != "" {
+		portalRegions = append(portalRegions, lib.CircleRegion(withinRadius.Center, withinRadius.Radius))
+	}
 	numWorkers := runtime.GOMAXPROCS(0)
 	if *numWorkersFlag > 0 {
 		numWorkers = *numWorkersFlag
@@ -71,28 +108,73 @@ func main() {
 		}
 		defer pprof.StopCPUProfile()
 	}
+	if format == jsonFormat && *output == "-" {
+		// Keep stdout a valid json document.
+		infoOutput = os.Stderr
+		*showProgress = false
+	}
 	progressFunc := lib.PrintProgressBar
 	if !*showProgress {
 		progressFunc = func(int, int) {}
 	}
-	switch flag.Args()[0] {
-	case "cobweb":
-		cobwebCmd.Run(flag.Args()[1:], outputWriter, progressFunc)
-	case "herringbone":
-		herringboneCmd.Run(flag.Args()[1:], outputWriter, numWorkers, progressFunc)
-	case "double_herringbone":
-		doubleHerringboneCmd.Run(flag.Args()[1:], outputWriter, numWorkers, progressFunc)
-	case "flip_field":
-		flipFieldCmd.Run(flag.Args()[1:], numWorkers, outputWriter, progressFunc)
-	case "three_corners":
-		threeCornersCmd.Run(flag.Args()[1:], outputWriter, progressFunc)
-	case "homogeneous":
-		fallthrough
-	case "homogenous":
-		homogeneousCmd.Run(flag.Args()[1:], outputWriter, numWorkers, progressFunc)
-	case "drone_flight":
-		droneFlightCmd.Run(flag.Args()[1:], numWorkers, outputWriter, progressFunc)
-	default:
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	name := flag.Args()[0]
+	if name == "homogenous" {
+		name = "homogeneous"
+	}
+	if _, err := lib.NewSolver(name); err != nil {
 		log.Fatalf("Unknown command: \"%s\"\n", flag.Args()[0])
 	}
+	commands[name].Run(ctx, flag.Args()[1:], runParams{
+		inputFormat:  inputFormat,
+		output:       outputWriter,
+		format:       format,
+		numWorkers:   numWorkers,
+		numResults:   *topFlag,
+		progressFunc: progressFunc,
+	})
+}
+
+// runParams - parameters given to the program, common for all the commands
+type runParams struct {
+	inputFormat  lib.PortalFileFormat
+	output       io.Writer
+	format       outputFormat
+	numWorkers   int
+	numResults   int
+	progressFunc func(int, int)
+}
+
+// command - subcommand of the program searching for one of the patterns registered in lib
+type command interface {
+	Usage(fileBase string)
+	Run(ctx context.Context, args []string, params runParams)
+}
+
+// printSolutionHeader separates consecutive solutions, if there is more than one of them.
+func printSolutionHeader(output io.Writer, i, numSolutions int) {
+	if numSolutions > 1 {
+		fmt.Fprintf(output, "\nSolution %d of %d\n", i+1, numSolutions)
+	}
+}
+
+// checkSearchError aborts on search failure, but lets an interrupted search
+// print the best result found before the interruption, and a search which
+// failed to save its checkpoint print its result.
+func checkSearchError(err error) {
+	if err == nil {
+		return
+	}
+	var checkpointErr *lib.CheckpointError
+	if errors.As(err, &checkpointErr) {
+		log.Println(err)
+		return
+	}
+	var cancelledErr *lib.CancelledError
+	if errors.As(err, &cancelledErr) {
+		log.Println("Search interrupted, printing the best result found so far")
+		return
+	}
+	log.Fatal(err)
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+type maxFieldsCmd struct {
+	flags           *flag.FlagSet
+	keys            *bool
+	route           *bool
+	blockers        *string
+	maxLinkLength   *float64
+	minFieldArea    *float64
+	minFieldHeight  *float64
+	disabledPortals *portalsValue
+	memoryBudget    *uint64
+}
+
+func NewMaxFieldsCmd() *maxFieldsCmd {
+	flags := flag.NewFlagSet("max_fields", flag.ExitOnError)
+	cmd := maxFieldsCmd{
+		flags:           flags,
+		keys:            flags.Bool("keys", false, "print number of keys needed and number of outbound links of every portal"),
+		route:           flags.Bool("route", false, "print the order of visiting portals minimizing the walking distance"),
+		blockers:        flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:   flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		minFieldArea:    flags.Float64("min_field_area", 0, "don't make fields with area smaller than that many square meters"),
+		minFieldHeight:  flags.Float64("min_field_height", 0, "don't make fields with any of the heights shorter than that many meters"),
+		disabledPortals: &portalsValue{},
+		memoryBudget:    flags.Uint64("memory_budget", lib.DefaultMemoryBudget>>20, "limit in MiB of memory used by the search, fail if the search would need more"),
+	}
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of any field")
+	return &cmd
+}
+
+func (m *maxFieldsCmd) Usage(fileBase string) {
+	fmt.Fprintf(flag.CommandLine.Output(), "%s max_fields [-keys] [-route] [-blockers=<file>] [-max_link_length=<meters>] [-min_field_area=<square meters>] [-min_field_height=<meters>] [-disabled_portal=<lat>,<lng>]... [-memory_budget=<MiB>] <portals_file>\n", fileBase)
+	m.flags.PrintDefaults()
+}
+
+func (m *maxFieldsCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
+	m.flags.Parse(args)
+	fileArgs := m.flags.Args()
+	if len(fileArgs) != 1 {
+		log.Fatalln("max_fields command requires exactly one file argument")
+	}
+	portals := readPortals(fileArgs[0], params.inputFormat, 3)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
+	disabledPortals := portalsToPortalList(*m.disabledPortals, portals)
+
+	searchStart := time.Now()
+	solver := lib.MaxFieldsSolver{
+		Options: []lib.MaxFieldsOption{
+			lib.MaxFieldsBlockers(readBlockers(*m.blockers)), lib.MaxFieldsMaxLinkLength(*m.maxLinkLength),
+			lib.MaxFieldsMinFieldSize{Area: *m.minFieldArea, Height: *m.minFieldHeight},
+			lib.MaxFieldsDisabledPortals(disabledPortals), lib.MaxFieldsMemoryBudget(*m.memoryBudget << 20)},
+	}
+	solverResults, err := lib.SolveTop(ctx, solver, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	results := lib.Solutions[[]lib.Field](solverResults)
+
+	if params.format == jsonFormat {
+		report := newJSONReport("max_fields", m.flags, start)
+		for i, fields := range results {
+			solution := report.solution(i)
+			solution.addResult(solverResults[i])
+			plan, err := lib.MaxFieldsPlan(fields)
+			solution.addPlan(plan, err, *m.route, disabledPortals)
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, fields := range results {
+		result := solverResults[i]
+		plan, planErr := lib.MaxFieldsPlan(fields)
+		printSolutionHeader(params.output, i, len(results))
+		fmt.Fprintf(params.output, "\nNum portals: %d, num fields: %d, num links: %d\nLinks:\n",
+			len(result.Portals), plan.NumFields(), plan.NumLinks())
+		for i, step := range plan.Steps {
+			fmt.Fprintf(params.output, "%d: %s -> %s (%d fields)\n", i, step.Origin.Name, step.Destination.Name, len(step.Fields))
+		}
+		printPlanReports(params.output, plan, planErr, *m.keys, *m.route, disabledPortals)
+		fmt.Fprintf(params.output, "\n%s\n", lib.MaxFieldsDrawToolsString(fields))
+	}
+}
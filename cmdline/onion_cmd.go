@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+type onionCmd struct {
+	flags           *flag.FlagSet
+	anchorPortals   *portalsValue
+	keys            *bool
+	route           *bool
+	blockers        *string
+	maxLinkLength   *float64
+	minFieldArea    *float64
+	minFieldHeight  *float64
+	disabledPortals *portalsValue
+	memoryBudget    *uint64
+}
+
+func NewOnionCmd() *onionCmd {
+	flags := flag.NewFlagSet("onion", flag.ExitOnError)
+	cmd := onionCmd{
+		flags:           flags,
+		anchorPortals:   &portalsValue{},
+		keys:            flags.Bool("keys", false, "print number of keys needed and number of outbound links of every portal"),
+		route:           flags.Bool("route", false, "print the order of visiting portals minimizing the walking distance"),
+		blockers:        flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:   flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		minFieldArea:    flags.Float64("min_field_area", 0, "don't make fields with area smaller than that many square meters"),
+		minFieldHeight:  flags.Float64("min_field_height", 0, "don't make fields with any of the heights shorter than that many meters"),
+		disabledPortals: &portalsValue{},
+		memoryBudget:    flags.Uint64("memory_budget", lib.DefaultMemoryBudget>>20, "limit in MiB of memory used by the search, fail if the search would need more"),
+	}
+	flags.Var(cmd.anchorPortals, "anchor_portal", "fix anchor portal - a corner of the outermost field of the onion")
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of the onion field")
+	return &cmd
+}
+
+func (o *onionCmd) Usage(fileBase string) {
+	fmt.Fprintf(flag.CommandLine.Output(), "%s onion [-keys] [-route] [-blockers=<file>] [-max_link_length=<meters>] [-min_field_area=<square meters>] [-min_field_height=<meters>] [-disabled_portal=<lat>,<lng>]... [-anchor_portal=<lat>,<lng>]... [-memory_budget=<MiB>] <portals_file>\n", fileBase)
+	o.flags.PrintDefaults()
+}
+
+func (o *onionCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
+	o.flags.Parse(args)
+	fileArgs := o.flags.Args()
+	if len(fileArgs) != 1 {
+		log.Fatalln("onion command requires exactly one file argument")
+	}
+	portals := readPortals(fileArgs[0], params.inputFormat, 3)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
+	if len(*o.anchorPortals) > 3 {
+		log.Fatalf("onion command accepts at most three anchor portals - %d specified", len(*o.anchorPortals))
+	}
+	anchorPortalIndices := portalsToIndices(*o.anchorPortals, portals)
+	disabledPortals := portalsToPortalList(*o.disabledPortals, portals)
+
+	searchStart := time.Now()
+	solver := lib.OnionSolver{
+		FixedAnchorIndices: anchorPortalIndices,
+		Options: []lib.OnionOption{
+			lib.OnionBlockers(readBlockers(*o.blockers)), lib.OnionMaxLinkLength(*o.maxLinkLength), lib.OnionMinFieldSize{Area: *o.minFieldArea, Height: *o.minFieldHeight}, lib.OnionDisabledPortals(disabledPortals),
+			lib.OnionMemoryBudget(*o.memoryBudget << 20)},
+	}
+	solverResults, err := lib.SolveTop(ctx, solver, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	results := lib.Solutions[[]lib.IndexedPortal](solverResults)
+
+	if params.format == jsonFormat {
+		report := newJSONReport("onion", o.flags, start)
+		for i, result := range results {
+			solution := report.solution(i)
+			solution.addResult(solverResults[i])
+			plan, err := lib.OnionPlan(result)
+			solution.addPlan(plan, err, *o.route, disabledPortals)
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, result := range results {
+		printSolutionHeader(params.output, i, len(results))
+		fmt.Fprintln(params.output, "")
+		for i, portal := range result {
+			fmt.Fprintf(params.output, "%d: %s (corner %d)\n", i, portal.Portal.Name, portal.Index)
+		}
+		if *o.keys || *o.route || len(disabledPortals) > 0 {
+			plan, err := lib.OnionPlan(result)
+			printPlanReports(params.output, plan, err, *o.keys, *o.route, disabledPortals)
+		}
+		fmt.Fprintf(params.output, "\n%s\n", lib.OnionDrawToolsString(result))
+	}
+}
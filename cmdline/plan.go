@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+func printPlanReports(output io.Writer, plan lib.Plan, planErr error, keys, route bool, disabledPortals []lib.Portal) {
+	if planErr != nil {
+		fmt.Fprintf(output, "\nWARNING: the link plan is not valid: %v\n", planErr)
+	}
+	for _, portal := range plan.PortalsInsideFields(disabledPortals) {
+		fmt.Fprintf(output, "WARNING: disabled portal %s lies inside a field\n", portal.Name)
+	}
+	if keys {
+		printKeys(output, plan)
+	}
+	if route {
+		printRoute(output, plan)
+	}
+}
+
+func printKeys(output io.Writer, plan lib.Plan) {
+	keys := lib.PlanKeys(plan)
+	fmt.Fprintln(output, "\nKeys:")
+	for _, k := range keys {
+		fmt.Fprintf(output, "%s: keys %d, outbound links %d\n", k.Portal.Name, k.Keys, k.OutboundLinks)
+	}
+	for _, k := range lib.PortalsExceedingOutboundLimit(keys) {
+		fmt.Fprintf(output, "WARNING: %s throws %d outbound links, more than %d possible without link amps\n",
+			k.Portal.Name, k.OutboundLinks, lib.MaxOutboundLinks)
+	}
+}
+
+func printRoute(output io.Writer, plan lib.Plan) {
+	route := lib.WalkingRoute(plan)
+	fmt.Fprintf(output, "\nRoute, total walking distance: %.1fm\n", route.Distance)
+	for i, stop := range route.Stops {
+		var actions []string
+		for _, step := range stop.Steps {
+			switch step.Type {
+			case lib.LINK:
+				actions = append(actions, fmt.Sprintf("link to %s (%d fields)", step.Destination.Name, len(step.Fields)))
+			case lib.FLIP:
+				actions = append(actions, "flip")
+			}
+		}
+		fmt.Fprintf(output, "%d: %s: %s\n", i, stop.Portal.Name, strings.Join(actions, ", "))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+// solverCmd - command running a solver registered in lib with its default parameters
+type solverCmd struct {
+	name  string
+	flags *flag.FlagSet
+}
+
+func newSolverCmd(name string) *solverCmd {
+	return &solverCmd{
+		name:  name,
+		flags: flag.NewFlagSet(name, flag.ExitOnError),
+	}
+}
+
+func (c *solverCmd) Usage(fileBase string) {
+	fmt.Fprintf(flag.CommandLine.Output(), "%s %s <portals_file>\n", fileBase, c.name)
+	c.flags.PrintDefaults()
+}
+
+func (c *solverCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
+	c.flags.Parse(args)
+	fileArgs := c.flags.Args()
+	if len(fileArgs) != 1 {
+		log.Fatalf("%s command requires exactly one file argument\n", c.name)
+	}
+	solver, err := lib.NewSolver(c.name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	portals := readPortals(fileArgs[0], params.inputFormat, 1)
+	fmt.Fprintf(infoOutput, "Read %d portals\n", len(portals))
+
+	searchStart := time.Now()
+	results, err := lib.SolveTop(ctx, solver, portals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+
+	if params.format == jsonFormat {
+		report := newJSONReport(c.name, c.flags, start)
+		for i, result := range results {
+			report.solution(i).addResult(result)
+		}
+		report.write(params.output, searchTime)
+		return
+	}
+	for i, result := range results {
+		printSolutionHeader(params.output, i, len(results))
+		fmt.Fprintln(params.output, "")
+		for i, portal := range result.Portals {
+			fmt.Fprintf(params.output, "%d: %s (%s)\n", i, portal.Portal.Name, portal.Role)
+		}
+		fmt.Fprintf(params.output, "\n%s\n", result.DrawToolsString())
+	}
+}
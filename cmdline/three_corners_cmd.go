@@ -1,61 +1,112 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"math"
+	"time"
 
 	"github.com/pwiecz/portal_patterns/lib"
 )
 
 type threeCornersCmd struct {
-	flags *flag.FlagSet
+	flags           *flag.FlagSet
+	blockers        *string
+	maxLinkLength   *float64
+	minFieldArea    *float64
+	minFieldHeight  *float64
+	disabledPortals *portalsValue
 }
 
-func NewThreeCornersCmd() threeCornersCmd {
+func NewThreeCornersCmd() *threeCornersCmd {
 	flags := flag.NewFlagSet("three_corners", flag.ExitOnError)
 	cmd := threeCornersCmd{
-		flags: flags,
+		flags:           flags,
+		disabledPortals: &portalsValue{},
+		blockers:        flags.String("blockers", "", "don't make links crossing the links read from this file (draw tools or IITC link export)"),
+		maxLinkLength:   flags.Float64("max_link_length", 0, "don't make links longer than that many meters, 0 means no limit"),
+		minFieldArea:    flags.Float64("min_field_area", 0, "don't make fields with area smaller than that many square meters"),
+		minFieldHeight:  flags.Float64("min_field_height", 0, "don't make fields with any of the heights shorter than that many meters"),
 	}
-	return cmd
+	flags.Var(cmd.disabledPortals, "disabled_portal", "don't use this portal as a vertex of the field")
+	return &cmd
 }
 
 func (t *threeCornersCmd) Usage(fileBase string) {
-	fmt.Fprintf(flag.CommandLine.Output(), "%s three_corners <portals1_file> <portals2_file> <portals3_file>\n", fileBase)
+	fmt.Fprintf(flag.CommandLine.Output(), "%s three_corners [-blockers=<file>] [-max_link_length=<meters>] [-min_field_area=<square meters>] [-min_field_height=<meters>] [-disabled_portal=<lat>,<lng>]... <portals1_file> <portals2_file> <portals3_file>\n", fileBase)
 	t.flags.PrintDefaults()
 }
 
-func (t *threeCornersCmd) Run(args []string, output io.Writer, progressFunc func(int, int)) {
+func (t *threeCornersCmd) Run(ctx context.Context, args []string, params runParams) {
+	start := time.Now()
 	t.flags.Parse(args)
 	fileArgs := t.flags.Args()
 	if len(fileArgs) != 3 {
 		log.Fatalln("three_corners command requires exactly three file argument")
 	}
-	portals1, err := lib.ParseFile(fileArgs[0])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[0], err)
+	numStdin := 0
+	for _, fileArg := range fileArgs {
+		if fileArg == "-" {
+			numStdin++
+		}
 	}
-	fmt.Printf("Read %d portals(1)\n", len(portals1))
-	portals2, err := lib.ParseFile(fileArgs[1])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[1], err)
+	if numStdin > 1 {
+		log.Fatalln("only one of the three_corners files can be read from stdin")
 	}
-	fmt.Printf("Read %d portals(2)\n", len(portals2))
-	portals3, err := lib.ParseFile(fileArgs[2])
-	if err != nil {
-		log.Fatalf("Could not parse file %s : %v\n", fileArgs[3], err)
+	portals1 := readPortals(fileArgs[0], params.inputFormat, 1)
+	fmt.Fprintf(infoOutput, "Read %d portals(1)\n", len(portals1))
+	portals2 := readPortals(fileArgs[1], params.inputFormat, 1)
+	fmt.Fprintf(infoOutput, "Read %d portals(2)\n", len(portals2))
+	portals3 := readPortals(fileArgs[2], params.inputFormat, 1)
+	fmt.Fprintf(infoOutput, "Read %d portals(3)\n", len(portals3))
+
+	allPortals := append(append(append([]lib.Portal{}, portals1...), portals2...), portals3...)
+	disabledPortals := portalsToPortalList(*t.disabledPortals, allPortals)
+
+	searchStart := time.Now()
+	solver := lib.ThreeCornersSolver{
+		Groups: [3][]int{
+			indexRange(0, len(portals1)),
+			indexRange(len(portals1), len(portals1)+len(portals2)),
+			indexRange(len(portals1)+len(portals2), len(allPortals))},
+		Options: []lib.ThreeCornersOption{
+			lib.ThreeCornersBlockers(readBlockers(*t.blockers)), lib.ThreeCornersMaxLinkLength(*t.maxLinkLength), lib.ThreeCornersMinFieldSize{Area: *t.minFieldArea, Height: *t.minFieldHeight}, lib.ThreeCornersDisabledPortals(disabledPortals)},
 	}
-	fmt.Printf("Read %d portals(3)\n", len(portals3))
-	if len(portals1)+len(portals2)+len(portals3) >= math.MaxUint16-1 {
-		log.Fatalln("Too many portals")
+	results, err := lib.SolveTop(ctx, solver, allPortals, params.numResults, params.progressFunc)
+	checkSearchError(err)
+	searchTime := time.Since(searchStart)
+	solutions := lib.Solutions[[]lib.IndexedPortal](results)
+	if params.format == jsonFormat {
+		report := newJSONReport("three_corners", t.flags, start)
+		for i, result := range solutions {
+			solution := report.solution(i)
+			solution.addResult(results[i])
+			plan, err := lib.ThreeCornersPlan(result)
+			solution.addPlan(plan, err, false, disabledPortals)
+		}
+		report.write(params.output, searchTime)
+		return
 	}
+	for i, result := range solutions {
+		printSolutionHeader(params.output, i, len(solutions))
+		fmt.Fprintln(params.output, "")
+		for i, indexedPortal := range result {
+			fmt.Fprintf(params.output, "%d: %s\n", i, indexedPortal.Portal.Name)
+		}
+		if len(disabledPortals) > 0 {
+			plan, err := lib.ThreeCornersPlan(result)
+			printPlanReports(params.output, plan, err, false, false, disabledPortals)
+		}
+		fmt.Fprintf(params.output, "\n%s\n", lib.ThreeCornersDrawToolsString(result))
+	}
+}
 
-	result := lib.LargestThreeCorner(portals1, portals2, portals3, progressFunc)
-	fmt.Fprintln(output, "")
-	for i, indexedPortal := range result {
-		fmt.Fprintf(output, "%d: %s\n", i, indexedPortal.Portal.Name)
+// indexRange returns indices of portals from begin (inclusive) to end (exclusive).
+func indexRange(begin, end int) []int {
+	indices := make([]int, 0, end-begin)
+	for i := begin; i < end; i++ {
+		indices = append(indices, i)
 	}
-	fmt.Fprintf(output, "\n%s\n", lib.ThreeCornersDrawToolsString(result))
+	return indices
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"image/color"
 
 	"github.com/golang/geo/s2"
@@ -10,8 +12,14 @@ import (
 
 type baseTab struct {
 	*fltk.Pack
-	portals *Portals
-	pattern pattern
+	portals         *Portals
+	pattern         pattern
+	numAlternatives *fltk.Spinner
+	alternatives    *fltk.Choice
+	// called when user picks a different one of the alternative solutions
+	onAlternativeSelected func()
+	// why the last search stopped before finishing, nil if it finished or got cancelled
+	searchErr error
 }
 
 func newBaseTab(name string, portals *Portals, pattern pattern) *baseTab {
@@ -25,9 +33,72 @@ func newBaseTab(name string, portals *Portals, pattern pattern) *baseTab {
 
 	fltk.NewBox(fltk.NO_BOX, 0, 0, 760, 5) // padding at the top
 
+	alternativesPack := fltk.NewPack(0, 0, 700, 30)
+	alternativesPack.SetType(fltk.HORIZONTAL)
+	fltk.NewBox(fltk.NO_BOX, 0, 0, 200, 30)
+	t.numAlternatives = fltk.NewSpinner(0, 0, 60, 30, "Alternative solutions:")
+	t.numAlternatives.SetMinimum(1)
+	t.numAlternatives.SetMaximum(20)
+	t.numAlternatives.SetValue(1)
+	t.numAlternatives.SetType(fltk.SPINNER_INT_INPUT)
+	fltk.NewBox(fltk.NO_BOX, 0, 0, 80, 30)
+	t.alternatives = fltk.NewChoice(0, 0, 120, 30, "Show:")
+	t.alternatives.Deactivate()
+	alternativesPack.End()
+
 	return t
 }
 
+// numResults - number of alternative solutions to search for
+func (t *baseTab) numResults() int {
+	return int(t.numAlternatives.Value())
+}
+
+// setNumAlternatives fills the list of alternative solutions to choose from.
+func (t *baseTab) setNumAlternatives(numAlternatives int) {
+	// The menu size includes the terminating item.
+	for t.alternatives.Size() > 1 {
+		t.alternatives.Remove(0)
+	}
+	for i := 0; i < numAlternatives; i++ {
+		i := i
+		t.alternatives.Add(fmt.Sprintf("Solution %d", i+1), func() { t.selectAlternative(i) })
+	}
+	if numAlternatives > 1 {
+		t.alternatives.SetValue(0)
+		t.alternatives.Activate()
+	} else {
+		t.alternatives.Deactivate()
+	}
+}
+
+func (t *baseTab) selectAlternative(i int) {
+	t.pattern.showAlternative(i)
+	if t.onAlternativeSelected != nil {
+		t.onAlternativeSelected()
+	}
+}
+
+// setSearchError remembers why the last search stopped, a cancelled search is not an error.
+func (t *baseTab) setSearchError(err error) {
+	var cancelledErr *lib.CancelledError
+	if errors.As(err, &cancelledErr) {
+		err = nil
+	}
+	t.searchErr = err
+}
+
+// solutionInfo appends the error of the last search, if any, to the info about the solution.
+func (t *baseTab) solutionInfo(info string) string {
+	if t.searchErr == nil {
+		return info
+	}
+	if info == "" {
+		return fmt.Sprintf("Search stopped: %v", t.searchErr)
+	}
+	return fmt.Sprintf("%s\nSearch stopped: %v", info, t.searchErr)
+}
+
 func (t *baseTab) strokeColor(guid string) color.Color {
 	if _, ok := t.portals.selectedPortals[guid]; ok {
 		return color.NRGBA{0, 0, 0, 255}
@@ -78,11 +149,3 @@ func portalsToPoints(portals []lib.Portal) []s2.Point {
 	return points
 
 }
-func portalPathsToPointPaths(portalPaths [][]lib.Portal) [][]s2.Point {
-	pointPaths := make([][]s2.Point, 0, len(portalPaths))
-	for _, portalPath := range portalPaths {
-		pointPaths = append(pointPaths, portalsToPoints(portalPath))
-	}
-	return pointPaths
-
-}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image/color"
 
@@ -11,6 +12,7 @@ import (
 
 type cobwebTab struct {
 	*baseTab
+	solutions         [][]lib.Portal
 	solution          []lib.Portal
 	searchingFinished bool
 	solutionText      string
@@ -29,28 +31,43 @@ func newCobwebTab(portals *Portals) *cobwebTab {
 }
 
 func (t *cobwebTab) onReset() {
+	t.setSearchError(nil)
 	t.cornerPortals = make(map[string]struct{})
+	t.solutions = nil
 	t.solution = nil
 	t.solutionText = ""
+	t.setNumAlternatives(0)
 }
-func (t *cobwebTab) onSearch(progressFunc func(int, int), onSearchDone func()) {
-	portals := t.enabledPortals()
+func (t *cobwebTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
+	portals := t.portals.portals
 	corners := []int{}
 	for i, portal := range portals {
 		if _, ok := t.cornerPortals[portal.Guid]; ok {
 			corners = append(corners, i)
 		}
 	}
+	disabledPortals := t.disabledPortals()
+	numResults := t.numResults()
 	t.searchingFinished = false
 	go func() {
-		solution := lib.LargestCobweb(portals, corners, progressFunc)
+		results, err := lib.SolveTop(ctx, lib.CobwebSolver{FixedCornerIndices: corners, Options: []lib.CobwebOption{lib.CobwebDisabledPortals(disabledPortals)}}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[[]lib.Portal](results)
 		fltk.Awake(func() {
-			t.solution = solution
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
 			t.searchingFinished = true
 			onSearchDone()
 		})
 	}()
 }
+func (t *cobwebTab) showAlternative(i int) {
+	t.solution = nil
+	if i < len(t.solutions) {
+		t.solution = t.solutions[i]
+	}
+}
 func (t *cobwebTab) finishedSearching() bool {
 	return t.searchingFinished
 }
@@ -58,13 +75,13 @@ func (t *cobwebTab) hasSolution() bool {
 	return len(t.solution) > 0
 }
 func (t *cobwebTab) solutionInfoString() string {
-	return t.solutionText
+	return t.solutionInfo(t.solutionText)
 }
-func (t *cobwebTab) solutionDrawToolsString() string {
-	return lib.CobwebDrawToolsString(t.solution)
+func (t *cobwebTab) result() lib.Result {
+	return lib.CobwebResult(t.solution)
 }
 func (t *cobwebTab) solutionPaths() [][]s2.Point {
-	return [][]s2.Point{portalsToPoints(lib.CobwebPolyline(t.solution))}
+	return t.result().Paths()
 }
 
 func (t *cobwebTab) portalLabel(guid string) string {
@@ -186,6 +203,8 @@ func (t *cobwebTab) load(state cobwebState) error {
 		}
 		t.cornerPortals[cornerGUID] = struct{}{}
 	}
+	t.solutions = nil
+	t.setNumAlternatives(0)
 	t.solution = nil
 	for _, solutionGUID := range state.Solution {
 		if portal, ok := t.portals.portalMap[solutionGUID]; !ok {
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image/color"
-	"runtime"
 
 	"github.com/golang/geo/s2"
 	"github.com/pwiecz/go-fltk"
@@ -12,6 +12,7 @@ import (
 
 type doubleHerringboneTab struct {
 	*baseTab
+	solutions         []lib.DoubleHerringboneSolution
 	b0, b1            lib.Portal
 	spine0, spine1    []lib.Portal
 	searchingFinished bool
@@ -31,30 +32,46 @@ func newDoubleHerringboneTab(portals *Portals) *doubleHerringboneTab {
 }
 
 func (t *doubleHerringboneTab) onReset() {
+	t.setSearchError(nil)
 	t.basePortals = make(map[string]struct{})
+	t.solutions = nil
 	t.spine0 = nil
 	t.spine1 = nil
 	t.solutionText = ""
+	t.setNumAlternatives(0)
 }
-func (t *doubleHerringboneTab) onSearch(progressFunc func(int, int), onSearchDone func()) {
-	portals := t.enabledPortals()
+func (t *doubleHerringboneTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
+	portals := t.portals.portals
 	base := []int{}
 	for i, portal := range portals {
 		if _, ok := t.basePortals[portal.Guid]; ok {
 			base = append(base, i)
 		}
 	}
+	disabledPortals := t.disabledPortals()
+	numResults := t.numResults()
 	t.searchingFinished = false
 	go func() {
-		b0, b1, spine0, spine1 := lib.LargestDoubleHerringbone(portals, base, runtime.GOMAXPROCS(0), progressFunc)
+		results, err := lib.SolveTop(ctx, lib.DoubleHerringboneSolver{FixedBaseIndices: base, Options: []lib.HerringboneOption{lib.HerringboneDisabledPortals(disabledPortals)}}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[lib.DoubleHerringboneSolution](results)
 		fltk.Awake(func() {
-			t.b0, t.b1, t.spine0, t.spine1 = b0, b1, spine0, spine1
-			t.solutionText = fmt.Sprintf("Solution length: %d + %d", len(t.spine0), len(t.spine1))
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
 			t.searchingFinished = true
 			onSearchDone()
 		})
 	}()
 }
+func (t *doubleHerringboneTab) showAlternative(i int) {
+	t.spine0, t.spine1 = nil, nil
+	if i < len(t.solutions) {
+		solution := t.solutions[i]
+		t.b0, t.b1, t.spine0, t.spine1 = solution.B0, solution.B1, solution.Backbone0, solution.Backbone1
+	}
+	t.solutionText = fmt.Sprintf("Solution length: %d + %d", len(t.spine0), len(t.spine1))
+}
 func (t *doubleHerringboneTab) finishedSearching() bool {
 	return t.searchingFinished
 }
@@ -62,13 +79,13 @@ func (t *doubleHerringboneTab) hasSolution() bool {
 	return len(t.spine0)+len(t.spine1) > 0
 }
 func (t *doubleHerringboneTab) solutionInfoString() string {
-	return t.solutionText
+	return t.solutionInfo(t.solutionText)
 }
-func (t *doubleHerringboneTab) solutionDrawToolsString() string {
-	return lib.DoubleHerringboneDrawToolsString(t.b0, t.b1, t.spine0, t.spine1)
+func (t *doubleHerringboneTab) result() lib.Result {
+	return lib.DoubleHerringboneResult(t.b0, t.b1, t.spine0, t.spine1)
 }
 func (t *doubleHerringboneTab) solutionPaths() [][]s2.Point {
-	return [][]s2.Point{portalsToPoints(lib.DoubleHerringbonePolyline(t.b0, t.b1, t.spine0, t.spine1))}
+	return t.result().Paths()
 }
 func (t *doubleHerringboneTab) portalLabel(guid string) string {
 	if _, ok := t.basePortals[guid]; ok {
@@ -210,6 +227,8 @@ func (t *doubleHerringboneTab) load(state doubleHerringboneState) error {
 	} else {
 		t.b1 = b1Portal
 	}
+	t.solutions = nil
+	t.setNumAlternatives(0)
 	t.spine0 = nil
 	for _, spine0GUID := range state.Spine0 {
 		if spine0Portal, ok := t.portals.portalMap[spine0GUID]; !ok {
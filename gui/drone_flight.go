@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image/color"
 	"runtime"
@@ -12,8 +13,15 @@ import (
 
 type droneFlightTab struct {
 	*baseTab
-	useLongJumps      *fltk.CheckButton
-	optimizeFor       *fltk.Choice
+	useLongJumps    *fltk.CheckButton
+	optimizeFor     *fltk.Choice
+	maxKeys         *fltk.Spinner
+	reachabilityMap *fltk.CheckButton
+	solutions       []lib.DroneFlightSolution
+	reachable       []lib.DroneFlightReachablePortal
+	// number of jumps needed to reach portals of the reachability map
+	reachableJumps    map[string]int
+	maxReachableJumps int
 	solution, keys    []lib.Portal
 	searchingFinished bool
 	solutionText      string
@@ -45,26 +53,50 @@ func newDroneFlightTab(portals *Portals) *droneFlightTab {
 	optimizeForPack.End()
 	t.Add(optimizeForPack)
 
+	maxKeysPack := fltk.NewPack(0, 0, 700, 30)
+	maxKeysPack.SetType(fltk.HORIZONTAL)
+	fltk.NewBox(fltk.NO_BOX, 0, 0, 200, 30)
+	t.maxKeys = fltk.NewSpinner(0, 0, 200, 30, "Max keys needed:")
+	t.maxKeys.SetType(fltk.SPINNER_INT_INPUT)
+	t.maxKeys.SetMinimum(-1)
+	t.maxKeys.SetMaximum(9999)
+	// -1 means no limit
+	t.maxKeys.SetValue(-1)
+	maxKeysPack.End()
+	t.Add(maxKeysPack)
+
+	reachabilityMapPack := fltk.NewPack(0, 0, 700, 30)
+	reachabilityMapPack.SetType(fltk.HORIZONTAL)
+	fltk.NewBox(fltk.NO_BOX, 0, 0, 200, 30)
+	t.reachabilityMap = fltk.NewCheckButton(200, 0, 200, 30, "Reachability map from the start portal")
+	t.reachabilityMap.SetValue(false)
+	reachabilityMapPack.End()
+	t.Add(reachabilityMapPack)
+
 	t.End()
 
 	return t
 }
 
 func (t *droneFlightTab) onReset() {
+	t.setSearchError(nil)
+	t.solutions = nil
 	t.solution = nil
 	t.keys = nil
+	t.setReachable(nil)
 	t.solutionText = ""
 	t.startPortal = ""
 	t.endPortal = ""
+	t.setNumAlternatives(0)
 }
-func (t *droneFlightTab) onSearch(progressFunc func(int, int), onSearchDone func()) {
+func (t *droneFlightTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
 	if len(t.portals.portals) < 3 {
 		return
 	}
 	options := []lib.DroneFlightOption{
-		lib.DroneFlightProgressFunc(progressFunc),
 		lib.DroneFlightUseLongJumps(t.useLongJumps.Value()),
 		lib.DroneFlightNumWorkers(runtime.GOMAXPROCS(0)),
+		lib.DroneFlightMaxKeys(int(t.maxKeys.Value())),
 	}
 	switch t.optimizeFor.Value() {
 	case 0:
@@ -81,41 +113,99 @@ func (t *droneFlightTab) onSearch(progressFunc func(int, int), onSearchDone func
 			options = append(options, lib.DroneFlightEndPortalIndex(i))
 		}
 	}
+	if t.reachabilityMap.Value() {
+		options = append(options, lib.DroneFlightProgressFunc(progressFunc))
+		t.searchReachability(ctx, portals, options, onSearchDone)
+		return
+	}
+	numResults := t.numResults()
 	t.searchingFinished = false
 	go func() {
-		solution, keys := lib.LongestDroneFlight(portals, options...)
+		results, err := lib.SolveTop(ctx, lib.DroneFlightSolver{Options: options}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[lib.DroneFlightSolution](results)
 		fltk.Awake(func() {
-			t.solution, t.keys = solution, keys
-			if len(t.solution) == 0 {
-				t.solutionText = "No flightpath found"
-			} else {
-				distance := t.solution[0].LatLng.Distance(t.solution[len(t.solution)-1].LatLng) * lib.RadiansToMeters
-				t.solutionText = fmt.Sprintf("Flight distance: %.1fm, keys needed: %d", distance, len(t.keys))
-			}
-			t.searchingFinished = false
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setReachable(nil)
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
+			t.searchingFinished = true
 			onSearchDone()
 		})
 	}()
 }
 
+func (t *droneFlightTab) searchReachability(ctx context.Context, portals []lib.Portal, options []lib.DroneFlightOption, onSearchDone func()) {
+	startIndex := -1
+	for i, portal := range portals {
+		if t.startPortal == portal.Guid {
+			startIndex = i
+		}
+	}
+	if startIndex < 0 {
+		t.solutionText = "Reachability map needs a start portal"
+		onSearchDone()
+		return
+	}
+	t.searchingFinished = false
+	go func() {
+		reachable, err := lib.DroneFlightReachability(ctx, portals, startIndex, options...)
+		fltk.Awake(func() {
+			t.setSearchError(err)
+			t.solutions = nil
+			t.solution, t.keys = nil, nil
+			t.setNumAlternatives(0)
+			t.setReachable(reachable)
+			t.searchingFinished = true
+			onSearchDone()
+		})
+	}()
+}
+
+func (t *droneFlightTab) setReachable(reachable []lib.DroneFlightReachablePortal) {
+	t.reachable = reachable
+	t.reachableJumps = make(map[string]int)
+	t.maxReachableJumps = 0
+	for _, portal := range reachable {
+		t.reachableJumps[portal.Portal.Guid] = portal.NumJumps
+		if portal.NumJumps > t.maxReachableJumps {
+			t.maxReachableJumps = portal.NumJumps
+		}
+	}
+	if len(reachable) > 0 {
+		t.solutionText = fmt.Sprintf("Reachable portals: %d, max jumps needed: %d", len(reachable), t.maxReachableJumps)
+	}
+}
+
+func (t *droneFlightTab) showAlternative(i int) {
+	t.solution, t.keys = nil, nil
+	if i < len(t.solutions) {
+		t.solution, t.keys = t.solutions[i].Path, t.solutions[i].KeysNeeded
+	}
+	if len(t.solution) == 0 {
+		t.solutionText = "No flightpath found"
+	} else {
+		distance := t.solution[0].LatLng.Distance(t.solution[len(t.solution)-1].LatLng) * lib.RadiansToMeters
+		t.solutionText = fmt.Sprintf("Flight distance: %.1fm, keys needed: %d", distance, len(t.keys))
+	}
+}
 func (t *droneFlightTab) finishedSearching() bool {
 	return t.searchingFinished
 }
 func (t *droneFlightTab) hasSolution() bool {
-	return len(t.solution) > 0
+	return len(t.solution) > 0 || len(t.reachable) > 0
 }
 func (t *droneFlightTab) solutionInfoString() string {
-	return t.solutionText
+	return t.solutionInfo(t.solutionText)
 }
-func (t *droneFlightTab) solutionDrawToolsString() string {
-	s := fmt.Sprintf("[%s", lib.PolylineFromPortalList(t.solution))
-	if len(t.keys) > 0 {
-		s += fmt.Sprintf(",%s", lib.MarkersFromPortalList(t.keys))
+func (t *droneFlightTab) result() lib.Result {
+	if len(t.reachable) > 0 {
+		return lib.DroneFlightReachabilityResult(t.reachable)
 	}
-	return s + "]"
+	return lib.DroneFlightResult(t.solution, t.keys)
 }
 func (t *droneFlightTab) solutionPaths() [][]s2.Point {
-	return [][]s2.Point{portalsToPoints(t.solution)}
+	return t.result().Paths()
 }
 func (t *droneFlightTab) portalLabel(guid string) string {
 	if t.startPortal == guid {
@@ -124,6 +214,9 @@ func (t *droneFlightTab) portalLabel(guid string) string {
 	if t.endPortal == guid {
 		return "End"
 	}
+	if jumps, ok := t.reachableJumps[guid]; ok {
+		return fmt.Sprintf("%d jumps", jumps)
+	}
 	return t.baseTab.portalLabel(guid)
 }
 func (t *droneFlightTab) portalColor(guid string) (color.Color, color.Color) {
@@ -133,6 +226,14 @@ func (t *droneFlightTab) portalColor(guid string) (color.Color, color.Color) {
 	if t.endPortal == guid {
 		return color.NRGBA{128, 128, 0, 128}, t.baseTab.strokeColor(guid)
 	}
+	if jumps, ok := t.reachableJumps[guid]; ok {
+		// From green for the closest portals to red for the furthest ones.
+		red := uint8(0)
+		if t.maxReachableJumps > 0 {
+			red = uint8(255 * jumps / t.maxReachableJumps)
+		}
+		return color.NRGBA{red, 255 - red, 0, 192}, t.baseTab.strokeColor(guid)
+	}
 	return t.baseTab.portalColor(guid)
 }
 
@@ -229,22 +330,33 @@ func (t *droneFlightTab) contextMenu() *menu {
 	return menu
 }
 
+type droneFlightReachableState struct {
+	Portal     string `json:"portal"`
+	Prev       string `json:"prev"`
+	Jumps      int    `json:"jumps"`
+	KeysNeeded int    `json:"keysNeeded"`
+}
+
 type droneFlightState struct {
-	UseLongJumps bool     `json:"useLongJumps"`
-	OptimizeFor  string   `json:"optimizeFor"`
-	Solution     []string `json:"solution"`
-	Keys         []string `json:"keys"`
-	StartPortal  string   `json:"startPortal"`
-	EndPortal    string   `json:"endPortal"`
-	SolutionText string   `json:"solutionText"`
+	UseLongJumps    bool                        `json:"useLongJumps"`
+	OptimizeFor     string                      `json:"optimizeFor"`
+	MaxKeys         *int                        `json:"maxKeys,omitempty"`
+	ReachabilityMap bool                        `json:"reachabilityMap"`
+	Solution        []string                    `json:"solution"`
+	Keys            []string                    `json:"keys"`
+	Reachable       []droneFlightReachableState `json:"reachable"`
+	StartPortal     string                      `json:"startPortal"`
+	EndPortal       string                      `json:"endPortal"`
+	SolutionText    string                      `json:"solutionText"`
 }
 
 func (t *droneFlightTab) state() droneFlightState {
 	state := droneFlightState{
-		UseLongJumps: t.useLongJumps.Value(),
-		StartPortal:  t.startPortal,
-		EndPortal:    t.endPortal,
-		SolutionText: t.solutionText,
+		UseLongJumps:    t.useLongJumps.Value(),
+		ReachabilityMap: t.reachabilityMap.Value(),
+		StartPortal:     t.startPortal,
+		EndPortal:       t.endPortal,
+		SolutionText:    t.solutionText,
 	}
 	switch t.optimizeFor.Value() {
 	case 0:
@@ -258,11 +370,27 @@ func (t *droneFlightTab) state() droneFlightState {
 	for _, keyPortal := range t.keys {
 		state.Keys = append(state.Keys, keyPortal.Guid)
 	}
+	if maxKeys := int(t.maxKeys.Value()); maxKeys >= 0 {
+		state.MaxKeys = &maxKeys
+	}
+	for _, portal := range t.reachable {
+		state.Reachable = append(state.Reachable, droneFlightReachableState{
+			Portal:     portal.Portal.Guid,
+			Prev:       portal.Prev.Guid,
+			Jumps:      portal.NumJumps,
+			KeysNeeded: portal.NumKeysNeeded,
+		})
+	}
 	return state
 }
 
 func (t *droneFlightTab) load(state droneFlightState) error {
 	t.useLongJumps.SetValue(state.UseLongJumps)
+	t.maxKeys.SetValue(-1)
+	if state.MaxKeys != nil {
+		t.maxKeys.SetValue(float64(*state.MaxKeys))
+	}
+	t.reachabilityMap.SetValue(state.ReachabilityMap)
 	switch state.OptimizeFor {
 	case "LeastKeys":
 		t.optimizeFor.SetValue(0)
@@ -271,6 +399,8 @@ func (t *droneFlightTab) load(state droneFlightState) error {
 	default:
 		return fmt.Errorf("invalid droneFlight.optimizeFor value \"%s\"", state.OptimizeFor)
 	}
+	t.solutions = nil
+	t.setNumAlternatives(0)
 	t.solution = nil
 	for _, solutionGUID := range state.Solution {
 		if solutionPortal, ok := t.portals.portalMap[solutionGUID]; !ok {
@@ -286,6 +416,24 @@ func (t *droneFlightTab) load(state droneFlightState) error {
 			t.keys = append(t.keys, keyPortal)
 		}
 	}
+	reachable := []lib.DroneFlightReachablePortal{}
+	for _, reachableState := range state.Reachable {
+		portal, ok := t.portals.portalMap[reachableState.Portal]
+		if !ok {
+			return fmt.Errorf("invalid droneFlight reachable portal \"%s\"", reachableState.Portal)
+		}
+		prev, ok := t.portals.portalMap[reachableState.Prev]
+		if !ok {
+			return fmt.Errorf("invalid droneFlight reachable portal \"%s\"", reachableState.Prev)
+		}
+		reachable = append(reachable, lib.DroneFlightReachablePortal{
+			Portal:        portal,
+			Prev:          prev,
+			NumJumps:      reachableState.Jumps,
+			NumKeysNeeded: reachableState.KeysNeeded,
+		})
+	}
+	t.setReachable(reachable)
 	if _, ok := t.portals.portalMap[state.StartPortal]; !ok && state.StartPortal != "" {
 		return fmt.Errorf("invalid droneFlight.startPortal \"%s\"", state.StartPortal)
 	}
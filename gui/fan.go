@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+
+	"github.com/golang/geo/s2"
+	"github.com/pwiecz/go-fltk"
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+type fanTab struct {
+	*baseTab
+	maxOutboundLinks  *fltk.Spinner
+	solutions         []lib.FanSolution
+	anchor            lib.Portal
+	fan               []lib.Portal
+	searchingFinished bool
+	solutionText      string
+	anchorPortals     map[string]struct{}
+}
+
+var _ pattern = (*fanTab)(nil)
+
+func newFanTab(portals *Portals) *fanTab {
+	t := &fanTab{}
+	t.baseTab = newBaseTab("Fan", portals, t)
+	t.anchorPortals = make(map[string]struct{})
+
+	maxOutboundLinksPack := fltk.NewPack(0, 0, 700, 30)
+	maxOutboundLinksPack.SetType(fltk.HORIZONTAL)
+	fltk.NewBox(fltk.NO_BOX, 0, 0, 200, 30)
+	t.maxOutboundLinks = fltk.NewSpinner(0, 0, 200, 30, "Max outbound links:")
+	t.maxOutboundLinks.SetType(fltk.SPINNER_INT_INPUT)
+	t.maxOutboundLinks.SetMinimum(0)
+	t.maxOutboundLinks.SetMaximum(9999)
+	// 0 means no limit
+	t.maxOutboundLinks.SetValue(0)
+	maxOutboundLinksPack.End()
+	t.Add(maxOutboundLinksPack)
+
+	t.End()
+
+	return t
+}
+
+func (t *fanTab) onReset() {
+	t.setSearchError(nil)
+	t.anchorPortals = make(map[string]struct{})
+	t.solutions = nil
+	t.anchor = lib.Portal{}
+	t.fan = nil
+	t.solutionText = ""
+	t.setNumAlternatives(0)
+}
+func (t *fanTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
+	portals := t.portals.portals
+	anchors := []int{}
+	for i, portal := range portals {
+		if _, ok := t.anchorPortals[portal.Guid]; ok {
+			anchors = append(anchors, i)
+		}
+	}
+	options := []lib.FanOption{
+		lib.FanMaxOutboundLinks(int(t.maxOutboundLinks.Value())),
+		lib.FanDisabledPortals(t.disabledPortals()),
+	}
+	numResults := t.numResults()
+	t.searchingFinished = false
+	go func() {
+		results, err := lib.SolveTop(ctx, lib.FanSolver{FixedAnchorIndices: anchors, Options: options}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[lib.FanSolution](results)
+		fltk.Awake(func() {
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
+			t.searchingFinished = true
+			onSearchDone()
+		})
+	}()
+}
+func (t *fanTab) showAlternative(i int) {
+	t.anchor, t.fan = lib.Portal{}, nil
+	t.solutionText = ""
+	if i < len(t.solutions) {
+		t.anchor, t.fan = t.solutions[i].Anchor, t.solutions[i].Fan
+		t.solutionText = fmt.Sprintf("Num fan portals: %d, num fields: %d", len(t.fan), len(t.fan)-1)
+	}
+}
+func (t *fanTab) finishedSearching() bool {
+	return t.searchingFinished
+}
+func (t *fanTab) hasSolution() bool {
+	return len(t.fan) > 0
+}
+func (t *fanTab) solutionInfoString() string {
+	return t.solutionInfo(t.solutionText)
+}
+func (t *fanTab) result() lib.Result {
+	return lib.FanResult(t.anchor, t.fan)
+}
+func (t *fanTab) solutionPaths() [][]s2.Point {
+	return t.result().Paths()
+}
+
+func (t *fanTab) portalLabel(guid string) string {
+	if _, ok := t.anchorPortals[guid]; ok {
+		return "Anchor"
+	}
+	return t.baseTab.portalLabel(guid)
+}
+func (t *fanTab) portalColor(guid string) (color.Color, color.Color) {
+	if _, ok := t.anchorPortals[guid]; ok {
+		return color.NRGBA{0, 128, 0, 128}, t.baseTab.strokeColor(guid)
+	}
+	return t.baseTab.portalColor(guid)
+}
+
+func (t *fanTab) enableSelectedPortals() {
+	for guid := range t.portals.selectedPortals {
+		delete(t.portals.disabledPortals, guid)
+	}
+}
+
+func (t *fanTab) disableSelectedPortals() {
+	for guid := range t.portals.selectedPortals {
+		t.portals.disabledPortals[guid] = struct{}{}
+		delete(t.anchorPortals, guid)
+	}
+}
+
+func (t *fanTab) makeSelectedPortalAnchor() {
+	for guid := range t.portals.selectedPortals {
+		delete(t.portals.disabledPortals, guid)
+		t.anchorPortals[guid] = struct{}{}
+	}
+}
+func (t *fanTab) unmakeSelectedPortalAnchor() {
+	for guid := range t.portals.selectedPortals {
+		delete(t.anchorPortals, guid)
+	}
+}
+func (t *fanTab) contextMenu() *menu {
+	var aSelectedGUID string
+	numSelectedEnabled := 0
+	numSelectedDisabled := 0
+	numSelectedAnchor := 0
+	for guid := range t.portals.selectedPortals {
+		aSelectedGUID = guid
+		if _, ok := t.portals.disabledPortals[guid]; ok {
+			numSelectedDisabled++
+		} else {
+			numSelectedEnabled++
+		}
+		if _, ok := t.anchorPortals[guid]; ok {
+			numSelectedAnchor++
+		}
+	}
+	menu := &menu{}
+	if len(t.portals.selectedPortals) > 1 {
+		menu.header = fmt.Sprintf("%d portals selected", len(t.portals.selectedPortals))
+	} else if len(t.portals.selectedPortals) == 1 {
+		menu.header = t.portals.portalMap[aSelectedGUID].Name
+	}
+	if numSelectedDisabled > 0 {
+		if len(t.portals.selectedPortals) == 1 {
+			menu.items = append(menu.items, menuItem{"Enable", t.enableSelectedPortals})
+		} else {
+			menu.items = append(menu.items, menuItem{"Enable All", t.enableSelectedPortals})
+		}
+	}
+	if numSelectedEnabled > 0 {
+		if len(t.portals.selectedPortals) == 1 {
+			menu.items = append(menu.items, menuItem{"Disable", t.disableSelectedPortals})
+		} else {
+			menu.items = append(menu.items, menuItem{"Disable All", t.disableSelectedPortals})
+		}
+	}
+	// Fan has a single anchor portal.
+	if numSelectedAnchor > 0 {
+		menu.items = append(menu.items, menuItem{"Unmake anchor", t.unmakeSelectedPortalAnchor})
+	} else if len(t.portals.selectedPortals) == 1 && len(t.anchorPortals) == 0 {
+		menu.items = append(menu.items, menuItem{"Make anchor", t.makeSelectedPortalAnchor})
+	}
+	return menu
+}
+
+type fanState struct {
+	AnchorPortals    []string `json:"anchorPortals"`
+	MaxOutboundLinks int      `json:"maxOutboundLinks"`
+	Anchor           string   `json:"anchor"`
+	Solution         []string `json:"solution"`
+	SolutionText     string   `json:"solutionText"`
+}
+
+func (t *fanTab) state() fanState {
+	state := fanState{
+		MaxOutboundLinks: int(t.maxOutboundLinks.Value()),
+	}
+	for anchorGUID := range t.anchorPortals {
+		state.AnchorPortals = append(state.AnchorPortals, anchorGUID)
+	}
+	if len(t.fan) > 0 {
+		state.Anchor = t.anchor.Guid
+	}
+	for _, portal := range t.fan {
+		state.Solution = append(state.Solution, portal.Guid)
+	}
+	state.SolutionText = t.solutionText
+	return state
+}
+
+func (t *fanTab) load(state fanState) error {
+	t.anchorPortals = make(map[string]struct{})
+	for _, anchorGUID := range state.AnchorPortals {
+		if _, ok := t.portals.portalMap[anchorGUID]; !ok {
+			return fmt.Errorf("unknown fan anchor portal %s", anchorGUID)
+		}
+		t.anchorPortals[anchorGUID] = struct{}{}
+	}
+	if state.MaxOutboundLinks < 0 {
+		return fmt.Errorf("negative fan.maxOutboundLinks value %d", state.MaxOutboundLinks)
+	}
+	t.maxOutboundLinks.SetValue(float64(state.MaxOutboundLinks))
+	t.solutions = nil
+	t.setNumAlternatives(0)
+	t.anchor, t.fan = lib.Portal{}, nil
+	if len(state.Solution) > 0 {
+		anchor, ok := t.portals.portalMap[state.Anchor]
+		if !ok {
+			return fmt.Errorf("unknown fan solution portal %s", state.Anchor)
+		}
+		t.anchor = anchor
+	}
+	for _, guid := range state.Solution {
+		if portal, ok := t.portals.portalMap[guid]; !ok {
+			return fmt.Errorf("unknown fan solution portal %s", guid)
+		} else {
+			t.fan = append(t.fan, portal)
+		}
+	}
+	t.solutionText = state.SolutionText
+	return nil
+}
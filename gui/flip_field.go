@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image/color"
 	"runtime"
@@ -16,6 +17,7 @@ type flipFieldTab struct {
 	exactly            *fltk.CheckButton
 	maxFlipPortals     *fltk.Spinner
 	simpleBackbone     *fltk.CheckButton
+	solutions          []lib.FlipFieldSolution
 	backbone           []lib.Portal
 	flipPortals        []lib.Portal
 	searchingFinished  bool
@@ -69,17 +71,20 @@ func newFlipFieldTab(portals *Portals) *flipFieldTab {
 }
 
 func (t *flipFieldTab) onReset() {
+	t.setSearchError(nil)
 	t.basePortals = make(map[string]struct{})
+	t.solutions = nil
 	t.backbone = nil
 	t.flipPortals = nil
 	t.solutionText = ""
+	t.setNumAlternatives(0)
 }
-func (t *flipFieldTab) onSearch(progressFunc func(int, int), onSearchDone func()) {
+func (t *flipFieldTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
 	numPortalLimit := lib.LESS_EQUAL
 	if t.exactly.Value() {
 		numPortalLimit = lib.EQUAL
 	}
-	portals := t.enabledPortals()
+	portals := t.portals.portals
 	base := []int{}
 	for i, portal := range portals {
 		if _, ok := t.basePortals[portal.Guid]; ok {
@@ -87,25 +92,36 @@ func (t *flipFieldTab) onSearch(progressFunc func(int, int), onSearchDone func()
 		}
 	}
 	options := []lib.FlipFieldOption{
-		lib.FlipFieldProgressFunc(progressFunc),
 		lib.FlipFieldBackbonePortalLimit{Value: int(t.numBackbonePortals.Value()), LimitType: numPortalLimit},
 		lib.FlipFieldFixedBaseIndices(base),
 		lib.FlipFieldMaxFlipPortals(int(t.maxFlipPortals.Value())),
 		lib.FlipFieldSimpleBackbone(t.simpleBackbone.Value()),
 		lib.FlipFieldNumWorkers(runtime.GOMAXPROCS(0)),
+		lib.FlipFieldDisabledPortals(t.disabledPortals()),
 	}
+	numResults := t.numResults()
 	t.searchingFinished = false
 	go func() {
-		backbone, flipPortals := lib.LargestFlipField(portals, options...)
+		results, err := lib.SolveTop(ctx, lib.FlipFieldSolver{Options: options}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[lib.FlipFieldSolution](results)
 		fltk.Awake(func() {
-			t.backbone, t.flipPortals = backbone, flipPortals
-			t.solutionText = fmt.Sprintf("Num backbone portals: %d, num flip portals: %d", len(t.backbone), len(t.flipPortals))
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
 			t.searchingFinished = true
 			onSearchDone()
 		})
 	}()
 }
 
+func (t *flipFieldTab) showAlternative(i int) {
+	t.backbone, t.flipPortals = nil, nil
+	if i < len(t.solutions) {
+		t.backbone, t.flipPortals = t.solutions[i].Backbone, t.solutions[i].FlipPortals
+	}
+	t.solutionText = fmt.Sprintf("Num backbone portals: %d, num flip portals: %d", len(t.backbone), len(t.flipPortals))
+}
 func (t *flipFieldTab) finishedSearching() bool {
 	return t.searchingFinished
 }
@@ -113,14 +129,10 @@ func (t *flipFieldTab) hasSolution() bool {
 	return len(t.backbone) > 0 && len(t.flipPortals) > 0
 }
 func (t *flipFieldTab) solutionInfoString() string {
-	return t.solutionText
+	return t.solutionInfo(t.solutionText)
 }
-func (t *flipFieldTab) solutionDrawToolsString() string {
-	s := fmt.Sprintf("[%s", lib.PolylineFromPortalList(t.backbone))
-	if len(t.flipPortals) > 0 {
-		s += fmt.Sprintf(",%s", lib.MarkersFromPortalList(t.flipPortals))
-	}
-	return s + "]"
+func (t *flipFieldTab) result() lib.Result {
+	return lib.FlipFieldResult(t.backbone, t.flipPortals)
 }
 func (t *flipFieldTab) solutionPaths() [][]s2.Point {
 	lines := [][]s2.Point{portalsToPoints(t.backbone)}
@@ -282,6 +294,8 @@ func (t *flipFieldTab) load(state flipFieldState) error {
 	}
 	t.maxFlipPortals.SetValue(float64(state.MaxFlipPortals))
 	t.simpleBackbone.SetValue(state.SimpleBackbone)
+	t.solutions = nil
+	t.setNumAlternatives(0)
 	t.backbone = nil
 	for _, backboneGUID := range state.Backbone {
 		if backbonePortal, ok := t.portals.portalMap[backboneGUID]; !ok {
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image/color"
-	"runtime"
 
 	"github.com/golang/geo/s2"
 	"github.com/pwiecz/go-fltk"
@@ -12,6 +12,7 @@ import (
 
 type herringboneTab struct {
 	*baseTab
+	solutions         []lib.HerringboneSolution
 	b0, b1            lib.Portal
 	spine             []lib.Portal
 	searchingFinished bool
@@ -31,30 +32,45 @@ func newHerringboneTab(portals *Portals) *herringboneTab {
 }
 
 func (t *herringboneTab) onReset() {
+	t.setSearchError(nil)
 	t.basePortals = make(map[string]struct{})
+	t.solutions = nil
 	t.spine = nil
 	t.solutionText = ""
+	t.setNumAlternatives(0)
 }
-func (t *herringboneTab) onSearch(progressFunc func(int, int), onSearchDone func()) {
-	portals := t.enabledPortals()
+func (t *herringboneTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
+	portals := t.portals.portals
 	base := []int{}
 	for i, portal := range portals {
 		if _, ok := t.basePortals[portal.Guid]; ok {
 			base = append(base, i)
 		}
 	}
+	disabledPortals := t.disabledPortals()
+	numResults := t.numResults()
 	t.searchingFinished = false
 	go func() {
-		b0, b1, spine := lib.LargestHerringbone(portals, base, runtime.GOMAXPROCS(0), progressFunc)
+		results, err := lib.SolveTop(ctx, lib.HerringboneSolver{FixedBaseIndices: base, Options: []lib.HerringboneOption{lib.HerringboneDisabledPortals(disabledPortals)}}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[lib.HerringboneSolution](results)
 		fltk.Awake(func() {
-			t.b0, t.b1, t.spine = b0, b1, spine
-			t.solutionText = fmt.Sprintf("Solution length: %d", len(t.spine))
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
 			t.searchingFinished = true
 			onSearchDone()
 		})
 	}()
 }
 
+func (t *herringboneTab) showAlternative(i int) {
+	t.spine = nil
+	if i < len(t.solutions) {
+		t.b0, t.b1, t.spine = t.solutions[i].B0, t.solutions[i].B1, t.solutions[i].Backbone
+	}
+	t.solutionText = fmt.Sprintf("Solution length: %d", len(t.spine))
+}
 func (t *herringboneTab) finishedSearching() bool {
 	return t.searchingFinished
 }
@@ -62,13 +78,13 @@ func (t *herringboneTab) hasSolution() bool {
 	return len(t.spine) > 0
 }
 func (t *herringboneTab) solutionInfoString() string {
-	return t.solutionText
+	return t.solutionInfo(t.solutionText)
 }
-func (t *herringboneTab) solutionDrawToolsString() string {
-	return lib.HerringboneDrawToolsString(t.b0, t.b1, t.spine)
+func (t *herringboneTab) result() lib.Result {
+	return lib.HerringboneResult(t.b0, t.b1, t.spine)
 }
 func (t *herringboneTab) solutionPaths() [][]s2.Point {
-	return [][]s2.Point{portalsToPoints(lib.HerringbonePolyline(t.b0, t.b1, t.spine))}
+	return t.result().Paths()
 }
 
 func (t *herringboneTab) portalLabel(guid string) string {
@@ -206,6 +222,8 @@ func (t *herringboneTab) load(state herringboneState) error {
 	} else {
 		t.b1 = b1Portal
 	}
+	t.solutions = nil
+	t.setNumAlternatives(0)
 	t.spine = nil
 	for _, spineGUID := range state.Spine {
 		if spinePortal, ok := t.portals.portalMap[spineGUID]; !ok {
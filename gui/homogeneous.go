@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image/color"
 	"math/rand"
@@ -17,6 +18,7 @@ type homogeneousTab struct {
 	innerPortals      *fltk.Choice
 	topLevel          *fltk.Choice
 	pure              *fltk.CheckButton
+	solutions         []lib.HomogeneousSolution
 	depth             uint16
 	searchingFinished bool
 	solution          []lib.Portal
@@ -77,15 +79,17 @@ func newHomogeneousTab(portals *Portals) *homogeneousTab {
 }
 
 func (t *homogeneousTab) onReset() {
+	t.setSearchError(nil)
 	t.cornerPortals = make(map[string]struct{})
+	t.solutions = nil
 	t.depth = 0
 	t.solution = nil
 	t.solutionText = ""
+	t.setNumAlternatives(0)
 }
-func (t *homogeneousTab) onSearch(progressFunc func(int, int), onSearchDone func()) {
+func (t *homogeneousTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
 	options := []lib.HomogeneousOption{
 		lib.HomogeneousMaxDepth(t.maxDepth.Value()),
-		lib.HomogeneousProgressFunc(progressFunc),
 	}
 	if t.pure.Value() {
 		options = append(options, lib.HomogeneousPure(true))
@@ -104,7 +108,7 @@ func (t *homogeneousTab) onSearch(progressFunc func(int, int), onSearchDone func
 		rand := rand.New(rand.NewSource(time.Now().UnixNano()))
 		options = append(options, lib.HomogeneousRandom{Rand: rand})
 	}
-	portals := t.enabledPortals()
+	portals := t.portals.portals
 	disabledPortals := t.disabledPortals()
 	if len(disabledPortals) > 0 {
 		options = append(options, lib.HomogeneousDisabledPortals(disabledPortals))
@@ -115,23 +119,34 @@ func (t *homogeneousTab) onSearch(progressFunc func(int, int), onSearchDone func
 			corners = append(corners, i)
 		}
 	}
+	numResults := t.numResults()
 	t.searchingFinished = false
 	go func() {
 		options = append(options, lib.HomogeneousFixedCornerIndices(corners))
-		solution, depth := lib.DeepestHomogeneous(portals, options...)
+		results, err := lib.SolveTop(ctx, lib.HomogeneousSolver{Options: options}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[lib.HomogeneousSolution](results)
 		fltk.Awake(func() {
-			t.solution, t.depth = solution, depth
-			if t.depth > 0 {
-				t.solutionText = fmt.Sprintf("Solution depth: %d", t.depth)
-			} else {
-				t.solutionText = "No solution found"
-			}
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
 			t.searchingFinished = true
 			onSearchDone()
 		})
 	}()
 }
 
+func (t *homogeneousTab) showAlternative(i int) {
+	t.solution, t.depth = nil, 0
+	if i < len(t.solutions) {
+		t.solution, t.depth = t.solutions[i].Portals, t.solutions[i].Depth
+	}
+	if t.depth > 0 {
+		t.solutionText = fmt.Sprintf("Solution depth: %d", t.depth)
+	} else {
+		t.solutionText = "No solution found"
+	}
+}
 func (t *homogeneousTab) finishedSearching() bool {
 	return t.searchingFinished
 }
@@ -139,13 +154,13 @@ func (t *homogeneousTab) hasSolution() bool {
 	return len(t.solution) > 0
 }
 func (t *homogeneousTab) solutionInfoString() string {
-	return t.solutionText
+	return t.solutionInfo(t.solutionText)
 }
-func (t *homogeneousTab) solutionDrawToolsString() string {
-	return lib.HomogeneousDrawToolsString(t.depth, t.solution)
+func (t *homogeneousTab) result() lib.Result {
+	return lib.HomogeneousResult(t.depth, t.solution)
 }
 func (t *homogeneousTab) solutionPaths() [][]s2.Point {
-	return portalPathsToPointPaths(lib.HomogeneousPolylines(t.depth, t.solution))
+	return t.result().Paths()
 }
 func (t *homogeneousTab) portalLabel(guid string) string {
 	if _, ok := t.cornerPortals[guid]; ok {
@@ -321,6 +336,8 @@ func (t *homogeneousTab) load(state homogeneousState) error {
 		return fmt.Errorf("negative homogeneous.depth value %d", state.Depth)
 	}
 	t.depth = uint16(state.Depth)
+	t.solutions = nil
+	t.setNumAlternatives(0)
 	t.solution = nil
 	for _, solutionGUID := range state.Solution {
 		if solutionPortal, ok := t.portals.portalMap[solutionGUID]; !ok {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -53,8 +54,12 @@ type MainWindow struct {
 	flipField          *flipFieldTab
 	droneFlight        *droneFlightTab
 	threeCorners       *threeCornersTab
+	maxFields          *maxFieldsTab
+	onion              *onionTab
+	fan                *fanTab
 	selectedTab        int
 	searchInProgress   bool
+	cancelSearch       context.CancelFunc
 }
 
 func NewMainWindow(conf *configuration.Configuration) *MainWindow {
@@ -122,6 +127,9 @@ func NewMainWindow(conf *configuration.Configuration) *MainWindow {
 	w.droneFlight = newDroneFlightTab(w.portals)
 	w.flipField = newFlipFieldTab(w.portals)
 	w.threeCorners = newThreeCornersTab(w.portals)
+	w.maxFields = newMaxFieldsTab(w.portals)
+	w.onion = newOnionTab(w.portals)
+	w.fan = newFanTab(w.portals)
 	w.tabs.Add(w.homogeneous)
 	w.tabs.Add(w.herringbone)
 	w.tabs.Add(w.doubleHerringbone)
@@ -129,6 +137,12 @@ func NewMainWindow(conf *configuration.Configuration) *MainWindow {
 	w.tabs.Add(w.droneFlight)
 	w.tabs.Add(w.flipField)
 	w.tabs.Add(w.threeCorners)
+	w.tabs.Add(w.maxFields)
+	w.tabs.Add(w.onion)
+	w.tabs.Add(w.fan)
+	for _, tab := range []*baseTab{w.homogeneous.baseTab, w.herringbone.baseTab, w.doubleHerringbone.baseTab, w.cobweb.baseTab, w.droneFlight.baseTab, w.flipField.baseTab, w.threeCorners.baseTab, w.maxFields.baseTab, w.onion.baseTab, w.fan.baseTab} {
+		tab.onAlternativeSelected = w.onAlternativeSelected
+	}
 	w.tabs.SetCallback(func() { w.onTabSelected(w.tabs.Value()) })
 	w.tabs.End()
 	// Mark one random tab as resizable, as per www.fltk.org/doc-1.3/classFl__Tabs.html - "resizing caveats"
@@ -200,6 +214,12 @@ func (w *MainWindow) selectedPattern() pattern {
 		return w.flipField
 	case 6:
 		return w.threeCorners
+	case 7:
+		return w.maxFields
+	case 8:
+		return w.onion
+	case 9:
+		return w.fan
 	}
 	return nil
 }
@@ -471,21 +491,31 @@ func (w *MainWindow) onResetPortalsPressed() {
 	w.droneFlight.onReset()
 	w.flipField.onReset()
 	w.threeCorners.onReset()
+	w.maxFields.onReset()
+	w.onion.onReset()
+	w.fan.onReset()
 	w.SetLabel("")
 	w.mapWindow.Redraw()
 }
 
 func (w *MainWindow) onSearchPressed() {
+	if w.searchInProgress {
+		w.cancelSearch()
+		w.search.Deactivate()
+		return
+	}
 	w.searchInProgress = true
 	w.add.Deactivate()
 	w.reset.Deactivate()
-	w.search.Deactivate()
+	w.search.SetLabel("Cancel")
 	w.export.Deactivate()
 	w.copy.Deactivate()
 	w.portalList.Deactivate()
 	w.progress.SetValue(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancelSearch = cancel
 	selectedPattern := w.selectedPattern()
-	selectedPattern.onSearch(w.progressCallback, w.onSearchDone)
+	selectedPattern.onSearch(ctx, w.progressCallback, w.onSearchDone)
 }
 func (w *MainWindow) progressCallback(val, max int) {
 	now := time.Now()
@@ -503,6 +533,9 @@ func (w *MainWindow) progressCallback(val, max int) {
 }
 func (w *MainWindow) onSearchDone() {
 	w.searchInProgress = false
+	w.cancelSearch()
+	w.cancelSearch = nil
+	w.search.SetLabel("Search")
 	w.progress.SetValue(w.progress.Maximum())
 	w.add.Activate()
 	w.reset.Activate()
@@ -520,6 +553,12 @@ func (w *MainWindow) onSearchDone() {
 	}
 	w.mapWindow.Redraw()
 }
+func (w *MainWindow) onAlternativeSelected() {
+	selectedPattern := w.selectedPattern()
+	w.solutionLabel.SetLabel(selectedPattern.solutionInfoString())
+	w.mapWindow.SetPaths(selectedPattern.solutionPaths())
+	w.mapWindow.Redraw()
+}
 func (w *MainWindow) onExportPressed() {
 	fileChooser := fltk.NewFileChooser(w.configuration.PortalsDirectory, "JSON files (*.json)", fltk.FileChooser_CREATE, "Select draw tools file")
 	fileChooser.SetPreview(false)
@@ -539,12 +578,12 @@ func (w *MainWindow) onDrawToolsFileSelected(filename string) {
 		return
 	}
 	defer file.Close()
-	if _, err := file.WriteString(w.selectedPattern().solutionDrawToolsString()); err != nil {
+	if _, err := file.WriteString(w.selectedPattern().result().DrawToolsString()); err != nil {
 		fltk.MessageBox("Error exporting", "Error writing to file "+filename+"\n"+err.Error())
 	}
 }
 func (w *MainWindow) onCopyPressed() {
-	fltk.CopyToClipboard(w.selectedPattern().solutionDrawToolsString())
+	fltk.CopyToClipboard(w.selectedPattern().result().DrawToolsString())
 }
 
 type state struct {
@@ -559,6 +598,9 @@ type state struct {
 	DroneFlight       droneFlightState       `json:"droneFlight"`
 	FlipField         flipFieldState         `json:"flipField"`
 	ThreeCorners      threeCornersState      `json:"threeCorners"`
+	MaxFields         maxFieldsState         `json:"maxFields"`
+	Onion             onionState             `json:"onion"`
+	Fan               fanState               `json:"fan"`
 }
 
 func (w *MainWindow) encode(writer io.Writer) error {
@@ -572,6 +614,9 @@ func (w *MainWindow) encode(writer io.Writer) error {
 		DroneFlight:       w.droneFlight.state(),
 		FlipField:         w.flipField.state(),
 		ThreeCorners:      w.threeCorners.state(),
+		MaxFields:         w.maxFields.state(),
+		Onion:             w.onion.state(),
+		Fan:               w.fan.state(),
 	}
 
 	s.DisabledPortals = maps.Keys(w.portals.disabledPortals)
@@ -625,7 +670,16 @@ func (w *MainWindow) decode(reader io.Reader) error {
 	if err := w.threeCorners.load(s.ThreeCorners); err != nil {
 		return err
 	}
-	if s.SelectedTab < 0 || s.SelectedTab > 6 {
+	if err := w.maxFields.load(s.MaxFields); err != nil {
+		return err
+	}
+	if err := w.onion.load(s.Onion); err != nil {
+		return err
+	}
+	if err := w.fan.load(s.Fan); err != nil {
+		return err
+	}
+	if s.SelectedTab < 0 || s.SelectedTab > 9 {
 		return fmt.Errorf("invalid selected tab %d", s.SelectedTab)
 	}
 	w.selectedTab = s.SelectedTab
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+
+	"github.com/golang/geo/s2"
+	"github.com/pwiecz/go-fltk"
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+type maxFieldsTab struct {
+	*baseTab
+	solutions         [][]lib.Field
+	solution          []lib.Field
+	searchingFinished bool
+	solutionText      string
+}
+
+var _ pattern = (*maxFieldsTab)(nil)
+
+func newMaxFieldsTab(portals *Portals) *maxFieldsTab {
+	t := &maxFieldsTab{}
+	t.baseTab = newBaseTab("Max Fields", portals, t)
+	t.End()
+
+	return t
+}
+
+func (t *maxFieldsTab) onReset() {
+	t.setSearchError(nil)
+	t.solutions = nil
+	t.solution = nil
+	t.solutionText = ""
+	t.setNumAlternatives(0)
+}
+func (t *maxFieldsTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
+	portals := t.portals.portals
+	disabledPortals := t.disabledPortals()
+	numResults := t.numResults()
+	t.searchingFinished = false
+	go func() {
+		results, err := lib.SolveTop(ctx, lib.MaxFieldsSolver{Options: []lib.MaxFieldsOption{lib.MaxFieldsDisabledPortals(disabledPortals)}}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[[]lib.Field](results)
+		fltk.Awake(func() {
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
+			t.searchingFinished = true
+			onSearchDone()
+		})
+	}()
+}
+func (t *maxFieldsTab) showAlternative(i int) {
+	t.solution = nil
+	t.solutionText = "No solution found"
+	if i < len(t.solutions) && len(t.solutions[i]) > 0 {
+		t.solution = t.solutions[i]
+		t.solutionText = fmt.Sprintf("Num fields: %d", len(t.solution))
+	}
+}
+func (t *maxFieldsTab) finishedSearching() bool {
+	return t.searchingFinished
+}
+func (t *maxFieldsTab) hasSolution() bool {
+	return len(t.solution) > 0
+}
+func (t *maxFieldsTab) solutionInfoString() string {
+	return t.solutionInfo(t.solutionText)
+}
+func (t *maxFieldsTab) result() lib.Result {
+	return lib.MaxFieldsResult(t.solution)
+}
+func (t *maxFieldsTab) solutionPaths() [][]s2.Point {
+	return t.result().Paths()
+}
+
+func (t *maxFieldsTab) portalLabel(guid string) string {
+	return t.baseTab.portalLabel(guid)
+}
+func (t *maxFieldsTab) portalColor(guid string) (color.Color, color.Color) {
+	return t.baseTab.portalColor(guid)
+}
+
+func (t *maxFieldsTab) enableSelectedPortals() {
+	for guid := range t.portals.selectedPortals {
+		delete(t.portals.disabledPortals, guid)
+	}
+}
+
+func (t *maxFieldsTab) disableSelectedPortals() {
+	for guid := range t.portals.selectedPortals {
+		t.portals.disabledPortals[guid] = struct{}{}
+	}
+}
+
+func (t *maxFieldsTab) contextMenu() *menu {
+	var aSelectedGUID string
+	numSelectedEnabled := 0
+	numSelectedDisabled := 0
+	for guid := range t.portals.selectedPortals {
+		aSelectedGUID = guid
+		if _, ok := t.portals.disabledPortals[guid]; ok {
+			numSelectedDisabled++
+		} else {
+			numSelectedEnabled++
+		}
+	}
+	menu := &menu{}
+	if len(t.portals.selectedPortals) > 1 {
+		menu.header = fmt.Sprintf("%d portals selected", len(t.portals.selectedPortals))
+	} else if len(t.portals.selectedPortals) == 1 {
+		menu.header = t.portals.portalMap[aSelectedGUID].Name
+	}
+	if numSelectedDisabled > 0 {
+		if len(t.portals.selectedPortals) == 1 {
+			menu.items = append(menu.items, menuItem{"Enable", t.enableSelectedPortals})
+		} else {
+			menu.items = append(menu.items, menuItem{"Enable All", t.enableSelectedPortals})
+		}
+	}
+	if numSelectedEnabled > 0 {
+		if len(t.portals.selectedPortals) == 1 {
+			menu.items = append(menu.items, menuItem{"Disable", t.disableSelectedPortals})
+		} else {
+			menu.items = append(menu.items, menuItem{"Disable All", t.disableSelectedPortals})
+		}
+	}
+	return menu
+}
+
+type maxFieldsState struct {
+	Solution     [][3]string `json:"solution"`
+	SolutionText string      `json:"solutionText"`
+}
+
+func (t *maxFieldsTab) state() maxFieldsState {
+	state := maxFieldsState{}
+	for _, field := range t.solution {
+		state.Solution = append(state.Solution, [3]string{field[0].Guid, field[1].Guid, field[2].Guid})
+	}
+	state.SolutionText = t.solutionText
+	return state
+}
+
+func (t *maxFieldsTab) load(state maxFieldsState) error {
+	t.solutions = nil
+	t.setNumAlternatives(0)
+	t.solution = nil
+	for _, fieldGUIDs := range state.Solution {
+		var field lib.Field
+		for i, guid := range fieldGUIDs {
+			portal, ok := t.portals.portalMap[guid]
+			if !ok {
+				return fmt.Errorf("unknown max fields solution portal %s", guid)
+			}
+			field[i] = portal
+		}
+		t.solution = append(t.solution, field)
+	}
+	t.solutionText = state.SolutionText
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+
+	"github.com/golang/geo/s2"
+	"github.com/pwiecz/go-fltk"
+	"github.com/pwiecz/portal_patterns/lib"
+)
+
+type onionTab struct {
+	*baseTab
+	solutions         [][]lib.IndexedPortal
+	solution          []lib.IndexedPortal
+	searchingFinished bool
+	solutionText      string
+	anchorPortals     map[string]struct{}
+}
+
+var _ pattern = (*onionTab)(nil)
+
+func newOnionTab(portals *Portals) *onionTab {
+	t := &onionTab{}
+	t.baseTab = newBaseTab("Onion", portals, t)
+	t.anchorPortals = make(map[string]struct{})
+	t.End()
+
+	return t
+}
+
+func (t *onionTab) onReset() {
+	t.setSearchError(nil)
+	t.anchorPortals = make(map[string]struct{})
+	t.solutions = nil
+	t.solution = nil
+	t.solutionText = ""
+	t.setNumAlternatives(0)
+}
+func (t *onionTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
+	portals := t.portals.portals
+	anchors := []int{}
+	for i, portal := range portals {
+		if _, ok := t.anchorPortals[portal.Guid]; ok {
+			anchors = append(anchors, i)
+		}
+	}
+	disabledPortals := t.disabledPortals()
+	numResults := t.numResults()
+	t.searchingFinished = false
+	go func() {
+		results, err := lib.SolveTop(ctx, lib.OnionSolver{FixedAnchorIndices: anchors, Options: []lib.OnionOption{lib.OnionDisabledPortals(disabledPortals)}}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[[]lib.IndexedPortal](results)
+		fltk.Awake(func() {
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
+			t.searchingFinished = true
+			onSearchDone()
+		})
+	}()
+}
+func (t *onionTab) showAlternative(i int) {
+	t.solution = nil
+	if i < len(t.solutions) {
+		t.solution = t.solutions[i]
+	}
+}
+func (t *onionTab) finishedSearching() bool {
+	return t.searchingFinished
+}
+func (t *onionTab) hasSolution() bool {
+	return len(t.solution) > 0
+}
+func (t *onionTab) solutionInfoString() string {
+	return t.solutionInfo(t.solutionText)
+}
+func (t *onionTab) result() lib.Result {
+	return lib.OnionResult(t.solution)
+}
+func (t *onionTab) solutionPaths() [][]s2.Point {
+	return t.result().Paths()
+}
+
+func (t *onionTab) portalLabel(guid string) string {
+	if _, ok := t.anchorPortals[guid]; ok {
+		return "Anchor"
+	}
+	return t.baseTab.portalLabel(guid)
+}
+func (t *onionTab) portalColor(guid string) (color.Color, color.Color) {
+	if _, ok := t.anchorPortals[guid]; ok {
+		return color.NRGBA{0, 128, 0, 128}, t.baseTab.strokeColor(guid)
+	}
+	return t.baseTab.portalColor(guid)
+}
+
+func (t *onionTab) enableSelectedPortals() {
+	for guid := range t.portals.selectedPortals {
+		delete(t.portals.disabledPortals, guid)
+	}
+}
+
+func (t *onionTab) disableSelectedPortals() {
+	for guid := range t.portals.selectedPortals {
+		t.portals.disabledPortals[guid] = struct{}{}
+		delete(t.anchorPortals, guid)
+	}
+}
+
+func (t *onionTab) makeSelectedPortalsAnchors() {
+	for guid := range t.portals.selectedPortals {
+		delete(t.portals.disabledPortals, guid)
+		t.anchorPortals[guid] = struct{}{}
+	}
+}
+func (t *onionTab) unmakeSelectedPortalsAnchors() {
+	for guid := range t.portals.selectedPortals {
+		delete(t.anchorPortals, guid)
+	}
+}
+func (t *onionTab) contextMenu() *menu {
+	var aSelectedGUID string
+	numSelectedEnabled := 0
+	numSelectedDisabled := 0
+	numSelectedAnchor := 0
+	numSelectedNotAnchor := 0
+	for guid := range t.portals.selectedPortals {
+		aSelectedGUID = guid
+		if _, ok := t.portals.disabledPortals[guid]; ok {
+			numSelectedDisabled++
+		} else {
+			numSelectedEnabled++
+		}
+		if _, ok := t.anchorPortals[guid]; ok {
+			numSelectedAnchor++
+		} else {
+			numSelectedNotAnchor++
+		}
+	}
+	menu := &menu{}
+	if len(t.portals.selectedPortals) > 1 {
+		menu.header = fmt.Sprintf("%d portals selected", len(t.portals.selectedPortals))
+	} else if len(t.portals.selectedPortals) == 1 {
+		menu.header = t.portals.portalMap[aSelectedGUID].Name
+	}
+	if numSelectedDisabled > 0 {
+		if len(t.portals.selectedPortals) == 1 {
+			menu.items = append(menu.items, menuItem{"Enable", t.enableSelectedPortals})
+		} else {
+			menu.items = append(menu.items, menuItem{"Enable All", t.enableSelectedPortals})
+		}
+	}
+	if numSelectedEnabled > 0 {
+		if len(t.portals.selectedPortals) == 1 {
+			menu.items = append(menu.items, menuItem{"Disable", t.disableSelectedPortals})
+		} else {
+			menu.items = append(menu.items, menuItem{"Disable All", t.disableSelectedPortals})
+		}
+	}
+	if numSelectedAnchor > 0 {
+		if len(t.portals.selectedPortals) == 1 {
+			menu.items = append(menu.items, menuItem{"Unmake anchor", t.unmakeSelectedPortalsAnchors})
+		} else {
+			menu.items = append(menu.items, menuItem{"Unmake all anchors", t.unmakeSelectedPortalsAnchors})
+		}
+	}
+	if numSelectedNotAnchor > 0 && numSelectedNotAnchor+len(t.anchorPortals) <= 3 {
+		if len(t.portals.selectedPortals) == 1 {
+			menu.items = append(menu.items, menuItem{"Make anchor", t.makeSelectedPortalsAnchors})
+		} else {
+			menu.items = append(menu.items, menuItem{"Make all anchors", t.makeSelectedPortalsAnchors})
+		}
+	}
+	return menu
+}
+
+type onionState struct {
+	AnchorPortals []string      `json:"anchorPortals"`
+	Solution      []indexedGuid `json:"solution"`
+	SolutionText  string        `json:"solutionText"`
+}
+
+func (t *onionTab) state() onionState {
+	state := onionState{}
+	for anchorGUID := range t.anchorPortals {
+		state.AnchorPortals = append(state.AnchorPortals, anchorGUID)
+	}
+	for _, solutionPortal := range t.solution {
+		state.Solution = append(state.Solution,
+			indexedGuid{Index: solutionPortal.Index, Guid: solutionPortal.Portal.Guid})
+	}
+	state.SolutionText = t.solutionText
+	return state
+}
+
+func (t *onionTab) load(state onionState) error {
+	t.anchorPortals = make(map[string]struct{})
+	for _, anchorGUID := range state.AnchorPortals {
+		if _, ok := t.portals.portalMap[anchorGUID]; !ok {
+			return fmt.Errorf("unknown onion anchor portal %s", anchorGUID)
+		}
+		t.anchorPortals[anchorGUID] = struct{}{}
+	}
+	t.solutions = nil
+	t.setNumAlternatives(0)
+	t.solution = nil
+	for _, solutionPortal := range state.Solution {
+		if portal, ok := t.portals.portalMap[solutionPortal.Guid]; !ok {
+			return fmt.Errorf("unknown onion solution portal %s", solutionPortal.Guid)
+		} else {
+			t.solution = append(t.solution, lib.IndexedPortal{Index: solutionPortal.Index, Portal: portal})
+		}
+	}
+	t.solutionText = state.SolutionText
+	return nil
+}
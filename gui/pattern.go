@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"image/color"
 
 	"github.com/golang/geo/s2"
+	"github.com/pwiecz/portal_patterns/lib"
 )
 
 type menuItem struct {
@@ -15,15 +17,19 @@ type menu struct {
 	items  []menuItem
 }
 
+// pattern - tab searching for one of the patterns, using its lib.Solver
 type pattern interface {
-	onSearch(func(int, int), func())
+	// onSearch runs the search with lib.SolveTop and calls the last function once it's done
+	onSearch(context.Context, func(int, int), func())
 	portalColor(string) (color.Color, color.Color)
 	portalLabel(string) string
 	finishedSearching() bool
 	hasSolution() bool
 	solutionInfoString() string
 	solutionPaths() [][]s2.Point
-	solutionDrawToolsString() string
+	result() lib.Result
+	// showAlternative makes i-th of the alternative solutions found the current one
+	showAlternative(i int)
 	onReset()
 	contextMenu() *menu
 }
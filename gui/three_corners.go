@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image/color"
 	"strconv"
@@ -14,6 +15,7 @@ import (
 type threeCornersTab struct {
 	*baseTab
 	searchingFinished                     bool
+	solutions                             [][]lib.IndexedPortal
 	solution                              []lib.IndexedPortal
 	solutionText                          string
 	portalsNot0, portalsNot1, portalsNot2 map[string]struct{}
@@ -33,36 +35,51 @@ func newThreeCornersTab(portals *Portals) *threeCornersTab {
 }
 
 func (t *threeCornersTab) onReset() {
+	t.setSearchError(nil)
 	t.portalsNot0 = make(map[string]struct{})
 	t.portalsNot1 = make(map[string]struct{})
 	t.portalsNot2 = make(map[string]struct{})
+	t.solutions = nil
 	t.solution = nil
 	t.solutionText = ""
+	t.setNumAlternatives(0)
 }
-func (t *threeCornersTab) onSearch(progressFunc func(int, int), onSearchDone func()) {
-	portals := t.enabledPortals()
-	var portals0, portals1, portals2 []lib.Portal
-	for _, portal := range portals {
+func (t *threeCornersTab) onSearch(ctx context.Context, progressFunc func(int, int), onSearchDone func()) {
+	portals := t.portals.portals
+	groups := [3][]int{{}, {}, {}}
+	for i, portal := range portals {
 		if _, ok := t.portalsNot0[portal.Guid]; !ok {
-			portals0 = append(portals0, portal)
+			groups[0] = append(groups[0], i)
 		}
 		if _, ok := t.portalsNot1[portal.Guid]; !ok {
-			portals1 = append(portals1, portal)
+			groups[1] = append(groups[1], i)
 		}
 		if _, ok := t.portalsNot2[portal.Guid]; !ok {
-			portals2 = append(portals2, portal)
+			groups[2] = append(groups[2], i)
 		}
 	}
+	disabledPortals := t.disabledPortals()
+	numResults := t.numResults()
 	t.searchingFinished = false
 	go func() {
-		solution := lib.LargestThreeCorner(portals0, portals1, portals2, progressFunc)
+		results, err := lib.SolveTop(ctx, lib.ThreeCornersSolver{Groups: groups, Options: []lib.ThreeCornersOption{lib.ThreeCornersDisabledPortals(disabledPortals)}}, portals, numResults, progressFunc)
+		solutions := lib.Solutions[[]lib.IndexedPortal](results)
 		fltk.Awake(func() {
-			t.solution = solution
+			t.setSearchError(err)
+			t.solutions = solutions
+			t.setNumAlternatives(len(solutions))
+			t.showAlternative(0)
 			t.searchingFinished = true
 			onSearchDone()
 		})
 	}()
 }
+func (t *threeCornersTab) showAlternative(i int) {
+	t.solution = nil
+	if i < len(t.solutions) {
+		t.solution = t.solutions[i]
+	}
+}
 func (t *threeCornersTab) finishedSearching() bool {
 	return t.searchingFinished
 }
@@ -70,13 +87,13 @@ func (t *threeCornersTab) hasSolution() bool {
 	return len(t.solution) > 0
 }
 func (t *threeCornersTab) solutionInfoString() string {
-	return t.solutionText
+	return t.solutionInfo(t.solutionText)
 }
-func (t *threeCornersTab) solutionDrawToolsString() string {
-	return lib.ThreeCornersDrawToolsString(t.solution)
+func (t *threeCornersTab) result() lib.Result {
+	return lib.ThreeCornersResult(t.solution)
 }
 func (t *threeCornersTab) solutionPaths() [][]s2.Point {
-	return [][]s2.Point{portalsToPoints(lib.ThreeCornersPolyline(t.solution))}
+	return t.result().Paths()
 }
 func (t *threeCornersTab) portalGroups(guid string) []int {
 	groups := []int{}
@@ -343,6 +360,8 @@ func (t *threeCornersTab) load(state threeCornersState) error {
 		}
 		t.portalsNot2[portal2GUID] = struct{}{}
 	}
+	t.solutions = nil
+	t.setNumAlternatives(0)
 	t.solution = nil
 	for _, solutionPortal := range state.Solution {
 		if portal, ok := t.portals.portalMap[solutionPortal.Guid]; !ok {
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+)
+
+// Segment - a segment between two points, e.g. an already existing link
+type Segment struct {
+	From, To s2.LatLng
+}
+
+// Blocker endpoints closer than this to a portal are considered to be anchored at the portal.
+const blockerEndpointTolerance = s1.Angle(1e-8)
+
+type drawToolsLatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// blockerEntry - an entry of either a draw tools export or an IITC link export
+type blockerEntry struct {
+	Type    string            `json:"type"`
+	LatLngs []drawToolsLatLng `json:"latLngs"`
+	OLatE6  *int64            `json:"oLatE6"`
+	OLngE6  *int64            `json:"oLngE6"`
+	DLatE6  *int64            `json:"dLatE6"`
+	DLngE6  *int64            `json:"dLngE6"`
+}
+
+func (e blockerEntry) segments() ([]Segment, error) {
+	if e.OLatE6 != nil || e.OLngE6 != nil || e.DLatE6 != nil || e.DLngE6 != nil {
+		if e.OLatE6 == nil || e.OLngE6 == nil || e.DLatE6 == nil || e.DLngE6 == nil {
+			return nil, errors.New("incomplete link coordinates")
+		}
+		return []Segment{{
+			From: s2.LatLngFromDegrees(float64(*e.OLatE6)/1e6, float64(*e.OLngE6)/1e6),
+			To:   s2.LatLngFromDegrees(float64(*e.DLatE6)/1e6, float64(*e.DLngE6)/1e6),
+		}}, nil
+	}
+	var result []Segment
+	switch e.Type {
+	case "polyline", "polygon":
+		for i := 1; i < len(e.LatLngs); i++ {
+			result = append(result, Segment{
+				From: s2.LatLngFromDegrees(e.LatLngs[i-1].Lat, e.LatLngs[i-1].Lng),
+				To:   s2.LatLngFromDegrees(e.LatLngs[i].Lat, e.LatLngs[i].Lng),
+			})
+		}
+		if e.Type == "polygon" && len(e.LatLngs) > 2 {
+			first, last := e.LatLngs[0], e.LatLngs[len(e.LatLngs)-1]
+			result = append(result, Segment{
+				From: s2.LatLngFromDegrees(last.Lat, last.Lng),
+				To:   s2.LatLngFromDegrees(first.Lat, first.Lng),
+			})
+		}
+	}
+	return result, nil
+}
+
+// ParseBlockers parses list of blocking segments.
+//
+// Supported formats are draw tools exports (polylines and polygons),
+// and IITC link exports (list or map of links with oLatE6, oLngE6, dLatE6, dLngE6 fields).
+func ParseBlockers(bytes []byte) ([]Segment, error) {
+	var entries []blockerEntry
+	if err := json.Unmarshal(bytes, &entries); err != nil {
+		var entryMap map[string]blockerEntry
+		if err := json.Unmarshal(bytes, &entryMap); err != nil {
+			return nil, fmt.Errorf("cannot parse blockers: %v", err)
+		}
+		for _, entry := range entryMap {
+			entries = append(entries, entry)
+		}
+	}
+	var result []Segment
+	for _, entry := range entries {
+		segments, err := entry.segments()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, segments...)
+	}
+	return result, nil
+}
+
+// ParseBlockersFile parses file with list of blocking segments.
+func ParseBlockersFile(filename string) ([]Segment, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	bytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBlockers(bytes)
+}
+
+// linkFilter tells which links between portals are possible to be made.
+type linkFilter struct {
+	// blocked links between pairs of portals, nil if no link is blocked
+	blocked []bool
+	// portals which cannot be linked at all, nil if all portals are enabled
+	disabled   []bool
+	numPortals uint
+}
+
+// newLinkFilter makes filter of links crossing any of the blockers, longer than
+// maxLinkLength meters (if positive) or starting from a disabled portal.
+func newLinkFilter(portals []portalData, blockers []Segment, disabled []bool, maxLinkLength float64) linkFilter {
+	if len(blockers) == 0 && maxLinkLength <= 0 {
+		return linkFilter{disabled: disabled}
+	}
+	numPortals := uint(len(portals))
+	blocked := make([]bool, numPortals*numPortals)
+	if maxLinkLength > 0 {
+		maxDistance := s1.Angle(maxLinkLength / RadiansToMeters)
+		for i, a := range portals {
+			for j := i + 1; j < len(portals); j++ {
+				if a.LatLng.Distance(portals[j].LatLng) > maxDistance {
+					blocked[uint(i)*numPortals+uint(j)] = true
+					blocked[uint(j)*numPortals+uint(i)] = true
+				}
+			}
+		}
+	}
+	side := make([]bool, len(portals))
+	anchored := make([]bool, len(portals))
+	for _, blocker := range blockers {
+		c, d := s2.PointFromLatLng(blocker.From), s2.PointFromLatLng(blocker.To)
+		cd := newCCWQuery(c, d)
+		for i, portal := range portals {
+			side[i] = cd.IsCCW(portal.LatLng)
+			anchored[i] = portal.LatLng.Distance(c) < blockerEndpointTolerance ||
+				portal.LatLng.Distance(d) < blockerEndpointTolerance
+		}
+		for i, a := range portals {
+			if anchored[i] {
+				continue
+			}
+			for j := i + 1; j < len(portals); j++ {
+				if anchored[j] || side[i] == side[j] {
+					continue
+				}
+				b := portals[j]
+				ab := newCCWQuery(a.LatLng, b.LatLng)
+				if ab.IsCCW(c) != ab.IsCCW(d) {
+					blocked[uint(i)*numPortals+uint(j)] = true
+					blocked[uint(j)*numPortals+uint(i)] = true
+				}
+			}
+		}
+	}
+	return linkFilter{blocked: blocked, disabled: disabled, numPortals: numPortals}
+}
+
+func (f linkFilter) allowed(a, b portalIndex) bool {
+	if f.disabled != nil && (f.disabled[a] || f.disabled[b]) {
+		return false
+	}
+	return f.blocked == nil || !f.blocked[uint(a)*f.numPortals+uint(b)]
+}
+
+// isActive returns true if some of the links are not possible to be made.
+func (f linkFilter) isActive() bool {
+	return f.blocked != nil || f.disabled != nil
+}
@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+func TestParseBlockers(t *testing.T) {
+	drawTools := `[{"type":"polyline","latLngs":[{"lat":20,"lng":20},{"lat":20,"lng":21},{"lat":21,"lng":21}],"color":"#a24ac3"},
+{"type":"polygon","latLngs":[{"lat":20,"lng":20},{"lat":20,"lng":21},{"lat":21,"lng":21}],"color":"#a24ac3"},
+{"type":"marker","latLng":{"lat":20,"lng":20},"color":"#a24ac3"}]`
+	blockers, err := ParseBlockers([]byte(drawTools))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blockers) != 5 {
+		t.Errorf("Expected 5 blocking segments, got %d", len(blockers))
+	}
+	iitcLinks := `{"a.9":{"oLatE6":20000000,"oLngE6":20000000,"dLatE6":21000000,"dLngE6":21500000,"team":"E"}}`
+	blockers, err = ParseBlockers([]byte(iitcLinks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blockers) != 1 || !blockers[0].To.ApproxEqual(s2.LatLngFromDegrees(21, 21.5)) {
+		t.Errorf("Unexpected blocking segments %v", blockers)
+	}
+	if _, err := ParseBlockers([]byte(`[{"oLatE6":20000000}]`)); err == nil {
+		t.Errorf("Expected error when parsing incomplete link")
+	}
+}
+
+// a blocker crossing the a-b edge of the synthetic homogeneous and cobweb fields
+var testBlockers = []Segment{{From: s2.LatLngFromDegrees(19.9, 21), To: s2.LatLngFromDegrees(20.05, 21)}}
+
+func checkNoLinkCrossesBlockers(polyline []Portal, blockers []Segment, t *testing.T) {
+	for i := 1; i < len(polyline); i++ {
+		a, b := s2.PointFromLatLng(polyline[i-1].LatLng), s2.PointFromLatLng(polyline[i].LatLng)
+		for _, blocker := range blockers {
+			if segmentsCross(a, b, s2.PointFromLatLng(blocker.From), s2.PointFromLatLng(blocker.To)) {
+				t.Errorf("Link %s-%s crosses a blocker", polyline[i-1].Guid, polyline[i].Guid)
+			}
+		}
+	}
+}
+
+func TestHomogeneousBlockers(t *testing.T) {
+	portals := generateHomogeneousPortals(4)
+	for _, option := range []HomogeneousOption{HomogeneousPure(false), HomogeneousPure(true), HomogeneousSpreadAround{}} {
+		result, depth, err := DeepestHomogeneous(context.Background(), portals, option, HomogeneousBlockers(testBlockers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth >= 4 {
+			t.Errorf("Expected blocker to prevent the deepest field, got depth %d", depth)
+		}
+		for _, polyline := range HomogeneousPolylines(depth, result) {
+			checkNoLinkCrossesBlockers(polyline, testBlockers, t)
+		}
+	}
+}
+
+func TestCobwebBlockers(t *testing.T) {
+	portals := generateCobwebPortals(6)
+	result, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {}, CobwebBlockers(testBlockers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) >= len(portals) {
+		t.Errorf("Expected blocker to prevent using all the portals, got %d portals", len(result))
+	}
+	checkNoLinkCrossesBlockers(CobwebPolyline(result), testBlockers, t)
+}
+
+func checkLongestLink(name string, plan Plan, err error, maxLinkLength float64, t *testing.T) {
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if plan.NumLinks() == 0 {
+		t.Errorf("%s: expected a non empty plan", name)
+	}
+	if longest := plan.LongestLink(); longest > maxLinkLength {
+		t.Errorf("%s: expected links not longer than %fm, got %fm", name, maxLinkLength, longest)
+	}
+}
+
+func TestMaxLinkLength(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:30]
+	const maxLinkLength = 300
+	unlimited, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan, _ := CobwebPlan(unlimited); plan.LongestLink() <= maxLinkLength {
+		t.Fatalf("Expected the unlimited cobweb to have links longer than %dm", maxLinkLength)
+	}
+
+	cobweb, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {}, CobwebMaxLinkLength(maxLinkLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := CobwebPlan(cobweb)
+	checkLongestLink("cobweb", plan, err, maxLinkLength, t)
+
+	b0, b1, backbone, err := LargestHerringbone(context.Background(), portals, []int{}, 1, func(int, int) {}, HerringboneMaxLinkLength(maxLinkLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = HerringbonePlan(b0, b1, backbone)
+	checkLongestLink("herringbone", plan, err, maxLinkLength, t)
+
+	for _, option := range []HomogeneousOption{HomogeneousPure(false), HomogeneousPure(true), HomogeneousSpreadAround{}} {
+		result, depth, err := DeepestHomogeneous(context.Background(), portals, option, HomogeneousMaxLinkLength(maxLinkLength))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := HomogeneousPlan(depth, result)
+		checkLongestLink(fmt.Sprintf("homogeneous %T", option), plan, err, maxLinkLength, t)
+	}
+
+	backbone, flipPortals, err := LargestFlipField(context.Background(), portals, FlipFieldMaxLinkLength(maxLinkLength),
+		FlipFieldBackbonePortalLimit{Value: 4, LimitType: LESS_EQUAL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = FlipFieldPlan(backbone, flipPortals)
+	checkLongestLink("flip field", plan, err, maxLinkLength, t)
+}
@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultCheckpointInterval - default time between consecutive checkpoints of a search
+const DefaultCheckpointInterval = 10 * time.Minute
+
+// Checkpoint - file the state of a long running search gets periodically saved to,
+// so that the search may be resumed from it after being interrupted.
+// A checkpoint saved by a search over different portals or with different options
+// is ignored and gets overwritten. The file is removed once the search finishes.
+type Checkpoint struct {
+	File string
+	// Time between consecutive checkpoints, DefaultCheckpointInterval if 0
+	Interval time.Duration
+}
+
+// CheckpointError is returned by a search which failed to save its checkpoint.
+// The search doesn't save any more checkpoints, but it isn't stopped, so it's returned
+// together with the result of the search.
+type CheckpointError struct {
+	Err error
+}
+
+func (e *CheckpointError) Error() string {
+	return fmt.Sprintf("cannot write checkpoint: %v", e.Err)
+}
+func (e *CheckpointError) Unwrap() error {
+	return e.Err
+}
+
+var checkpointMagic = [4]byte{'P', 'P', 'C', 'P'}
+
+const checkpointVersion = 2
+
+type checkpointHeader struct {
+	Magic       [4]byte
+	Version     uint32
+	Fingerprint [sha256.Size]byte
+}
+
+// checkpointFingerprint identifies the search a checkpoint belongs to.
+type checkpointFingerprint struct {
+	hash hash.Hash
+}
+
+func newCheckpointFingerprint(pattern string, portals []Portal) *checkpointFingerprint {
+	f := &checkpointFingerprint{hash: sha256.New()}
+	fmt.Fprintln(f.hash, pattern)
+	f.addPortals(portals)
+	return f
+}
+
+// Coordinates are written in radians with all their digits, so that
+// moving a portal even slightly changes the fingerprint.
+func (f *checkpointFingerprint) addPortals(portals []Portal) {
+	fmt.Fprintf(f.hash, "%d\n", len(portals))
+	for _, portal := range portals {
+		fmt.Fprintf(f.hash, "%q %v %v\n", portal.Guid, portal.LatLng.Lat.Radians(), portal.LatLng.Lng.Radians())
+	}
+}
+func (f *checkpointFingerprint) addSegments(segments []Segment) {
+	fmt.Fprintf(f.hash, "%d\n", len(segments))
+	for _, s := range segments {
+		fmt.Fprintf(f.hash, "%v %v %v %v\n", s.From.Lat.Radians(), s.From.Lng.Radians(), s.To.Lat.Radians(), s.To.Lng.Radians())
+	}
+}
+func (f *checkpointFingerprint) add(values ...interface{}) {
+	fmt.Fprintln(f.hash, values...)
+}
+func (f *checkpointFingerprint) sum() [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	copy(sum[:], f.hash.Sum(nil))
+	return sum
+}
+
+// checkpointer saves the state of a search to the checkpoint file, at most once per interval.
+type checkpointer struct {
+	file        string
+	interval    time.Duration
+	fingerprint [sha256.Size]byte
+	lastSave    time.Time
+	err         error
+}
+
+func newCheckpointer(checkpoint Checkpoint, fingerprint *checkpointFingerprint) *checkpointer {
+	interval := checkpoint.Interval
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	return &checkpointer{
+		file:        checkpoint.File,
+		interval:    interval,
+		fingerprint: fingerprint.sum(),
+		lastSave:    time.Now(),
+	}
+}
+
+func (c *checkpointer) enabled() bool {
+	return c.file != ""
+}
+
+// due returns true if it's time to save the next checkpoint.
+func (c *checkpointer) due() bool {
+	return c.enabled() && c.err == nil && time.Since(c.lastSave) >= c.interval
+}
+
+// load reads the state saved by a search with the same fingerprint.
+// Returns false if there's no such checkpoint.
+func (c *checkpointer) load(readState func(r io.Reader) error) (bool, error) {
+	if !c.enabled() {
+		return false, nil
+	}
+	f, err := os.Open(c.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot read checkpoint: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var header checkpointHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil ||
+		header.Magic != checkpointMagic || header.Version != checkpointVersion || header.Fingerprint != c.fingerprint {
+		// Checkpoint of some other search.
+		return false, nil
+	}
+	if err := readState(r); err != nil {
+		return false, fmt.Errorf("cannot read checkpoint %s: %w", c.file, err)
+	}
+	return true, nil
+}
+
+// save replaces the checkpoint file with the state written by writeState.
+// The new file is written aside and renamed, so that an interrupted save
+// doesn't destroy the previous checkpoint.
+func (c *checkpointer) save(writeState func(w io.Writer) error) error {
+	c.lastSave = time.Now()
+	tmpFile := c.file + ".tmp"
+	err := func() error {
+		f, err := os.Create(tmpFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		header := checkpointHeader{Magic: checkpointMagic, Version: checkpointVersion, Fingerprint: c.fingerprint}
+		if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+			return err
+		}
+		if err := writeState(w); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return f.Close()
+	}()
+	if err == nil {
+		err = os.Rename(tmpFile, c.file)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		c.err = &CheckpointError{Err: err}
+	}
+	return c.err
+}
+
+// remove deletes the checkpoint of a finished search.
+func (c *checkpointer) remove() {
+	if c.enabled() {
+		os.Remove(c.file)
+	}
+}
+
+// tripleBefore returns true if triple a comes before triple b in the lexicographical order.
+func tripleBefore(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
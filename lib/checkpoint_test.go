@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkSamePortals(name string, expected, actual []Portal, t *testing.T) {
+	if len(expected) != len(actual) {
+		t.Fatalf("%s: expected %d portals, got %d", name, len(expected), len(actual))
+	}
+	for i := range expected {
+		if expected[i].Guid != actual[i].Guid {
+			t.Errorf("%s: expected portal %d to be %s, got %s", name, i, expected[i].Guid, actual[i].Guid)
+		}
+	}
+}
+
+func TestCobwebCheckpoint(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:40]
+	checkpoint := Checkpoint{File: filepath.Join(t.TempDir(), "cobweb.checkpoint"), Interval: 1}
+	expected, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the search once it has saved a checkpoint.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = LargestCobweb(ctx, portals, []int{}, func(done, _ int) {
+		if _, err := os.Stat(checkpoint.File); err == nil && done > 0 {
+			cancel()
+		}
+	}, CobwebCheckpoint(checkpoint))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancellation error, got %v", err)
+	}
+
+	// A search over different portals ignores the checkpoint.
+	firstProgress := -1
+	other, err := LargestCobweb(context.Background(), portals[:39], []int{}, func(done, _ int) {
+		if firstProgress < 0 {
+			firstProgress = done
+		}
+	}, CobwebCheckpoint{File: checkpoint.File})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstProgress != 0 {
+		t.Errorf("Expected search over other portals to start from scratch, started from %d", firstProgress)
+	}
+	checkValidCobwebResult(len(other), other, t)
+
+	// The checkpoint has been removed by the finished search, so make it again.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	LargestCobweb(ctx, portals, []int{}, func(done, total int) {
+		if done > total/3 {
+			cancel()
+		}
+	}, CobwebCheckpoint(checkpoint))
+	firstProgress = -1
+	resumed, err := LargestCobweb(context.Background(), portals, []int{}, func(done, _ int) {
+		if firstProgress < 0 {
+			firstProgress = done
+		}
+	}, CobwebCheckpoint{File: checkpoint.File})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstProgress <= 0 {
+		t.Errorf("Expected search to resume from the checkpoint")
+	}
+	checkSamePortals("resumed cobweb", expected, resumed, t)
+	if _, err := os.Stat(checkpoint.File); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected checkpoint of the finished search to be removed, got %v", err)
+	}
+}
+
+func TestCobwebCheckpointWriteError(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:30]
+	expected, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checkpoint can't be written to a missing directory, but the search still finishes.
+	checkpoint := Checkpoint{File: filepath.Join(t.TempDir(), "missing", "cobweb.checkpoint"), Interval: 1}
+	result, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {}, CobwebCheckpoint(checkpoint))
+	var checkpointErr *CheckpointError
+	if !errors.As(err, &checkpointErr) {
+		t.Fatalf("Expected checkpoint error, got %v", err)
+	}
+	checkSamePortals("cobweb with failed checkpoint", expected, result, t)
+}
+
+func TestHomogeneousPureCheckpoint(t *testing.T) {
+	portals := generateHomogeneousPortals(5)
+	checkpoint := HomogeneousCheckpoint{File: filepath.Join(t.TempDir(), "homogeneous.checkpoint")}
+	expected, expectedDepth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousPure(true), HomogeneousMaxDepth(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the search when it starts merging the initial level triangles,
+	// after the initial progress report and the search for the initial level triangles.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	numPhases := 0
+	_, _, err = DeepestHomogeneous(ctx, portals, HomogeneousPure(true), HomogeneousMaxDepth(6), checkpoint,
+		HomogeneousProgressFunc(func(done, _ int) {
+			if done == 0 {
+				numPhases++
+				if numPhases == 3 {
+					cancel()
+				}
+			}
+		}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancellation error, got %v", err)
+	}
+
+	numPhases = 0
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousPure(true), HomogeneousMaxDepth(6), checkpoint,
+		HomogeneousProgressFunc(func(done, _ int) {
+			if done == 0 {
+				numPhases++
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numPhases != 2 {
+		t.Errorf("Expected resumed search to skip the search for the initial level triangles, got %d phases", numPhases)
+	}
+	if depth != expectedDepth {
+		t.Errorf("Expected depth %d, got %d", expectedDepth, depth)
+	}
+	checkSamePortals("resumed homogeneous", expected, result, t)
+}
+
+func TestTripleIndexReadWrite(t *testing.T) {
+	empty := bestSolution{Length: invalidLength}
+	for _, unordered := range []bool{false, true} {
+		dense := makeTripleIndex(10, unordered, empty, newMemoryBudget(DefaultMemoryBudget))
+		sparse := makeTripleIndex(10, unordered, empty, newMemoryBudget(0))
+		if dense.dense == nil || sparse.dense != nil {
+			t.Fatal("Unexpected kind of index")
+		}
+		for _, index := range []*tripleIndex[bestSolution]{dense, sparse} {
+			index.budget.limit = DefaultMemoryBudget
+			index.set(1, 2, 3, bestSolution{Index: 4, Length: 5})
+			index.set(7, 8, 9, bestSolution{Index: 6, Length: 0})
+			if !unordered {
+				index.set(9, 8, 7, bestSolution{Index: 3, Length: 1})
+			}
+		}
+		for _, from := range []*tripleIndex[bestSolution]{dense, sparse} {
+			for _, toDense := range []bool{true, false} {
+				var buf bytes.Buffer
+				if err := writeTripleIndex(&buf, from); err != nil {
+					t.Fatal(err)
+				}
+				budget := newMemoryBudget(0)
+				if toDense {
+					budget.limit = DefaultMemoryBudget
+				}
+				to := makeTripleIndex(10, unordered, empty, budget)
+				budget.limit = DefaultMemoryBudget
+				if err := readTripleIndex(&buf, to); err != nil {
+					t.Fatal(err)
+				}
+				for i := portalIndex(0); i < 10; i++ {
+					for j := portalIndex(0); j < 10; j++ {
+						for k := portalIndex(0); k < 10; k++ {
+							if unordered && (i >= j || j >= k) {
+								continue
+							}
+							if from.get(i, j, k) != to.get(i, j, k) {
+								t.Errorf("Expected entry %d,%d,%d to be %v, got %v", i, j, k, from.get(i, j, k), to.get(i, j, k))
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestUnorderedTripleIndexKeys(t *testing.T) {
+	const numPortals = 12
+	index := newUnorderedTripleIndex(numPortals, 0, newMemoryBudget(DefaultMemoryBudget))
+	if len(index.dense) != numPortals*(numPortals-1)*(numPortals-2)/6 {
+		t.Fatalf("Unexpected size of the index %d", len(index.dense))
+	}
+	seen := make(map[uint64]bool)
+	for k := portalIndex(2); k < numPortals; k++ {
+		for j := portalIndex(1); j < k; j++ {
+			for i := portalIndex(0); i < j; i++ {
+				key := index.key(i, j, k)
+				if key >= uint64(len(index.dense)) || seen[key] {
+					t.Fatalf("Invalid or repeated key %d of triple %d,%d,%d", key, i, j, k)
+				}
+				seen[key] = true
+			}
+		}
+	}
+}
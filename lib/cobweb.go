@@ -1,34 +1,51 @@
 package lib
 
+import (
+	"context"
+	"encoding/binary"
+	"io"
+)
+
 type bestCobwebQuery struct {
 	onFilledIndexEntry func()
+	cancellation       cancellation
 	portals            []portalData
-	index              []bestSolution
+	links              linkFilter
+	fields             fieldSizeFilter
+	index              *tripleIndex[bestSolution]
 	filteredPortals    [][]portalData
-	numPortals         uint
 	depth              uint16
+	// costs of the portals, nil if none of them has a cost
+	costs []float64
+	// total cost of the portals of the solution stored in index, nil if costs are nil
+	costIndex *tripleIndex[float32]
 }
 
-func newBestCobwebQuery(portals []portalData, onFilledIndexEntry func()) *bestCobwebQuery {
-	numPortals := uint(len(portals))
-	index := make([]bestSolution, numPortals*numPortals*numPortals)
-	for i := 0; i < len(index); i++ {
-		index[i].Length = invalidLength
-	}
-	return &bestCobwebQuery{
+func newBestCobwebQuery(ctx context.Context, portals []portalData, links linkFilter, fields fieldSizeFilter, costs []float64, budget *memoryBudget, onFilledIndexEntry func()) *bestCobwebQuery {
+	q := &bestCobwebQuery{
 		portals:            portals,
-		numPortals:         numPortals,
-		index:              index,
+		links:              links,
+		fields:             fields,
+		index:              newTripleIndex(len(portals), bestSolution{Length: invalidLength}, budget),
+		costs:              costs,
 		onFilledIndexEntry: onFilledIndexEntry,
+		cancellation:       newCancellation(ctx),
 		filteredPortals:    make([][]portalData, len(portals)),
 		depth:              0,
 	}
+	if costs != nil {
+		q.costIndex = newTripleIndex(len(portals), float32(0), budget)
+	}
+	return q
 }
 func (q *bestCobwebQuery) getIndex(i, j, k portalIndex) bestSolution {
-	return q.index[(uint(i)*q.numPortals+uint(j))*q.numPortals+uint(k)]
+	return q.index.get(i, j, k)
 }
-func (q *bestCobwebQuery) setIndex(i, j, k portalIndex, s bestSolution) {
-	q.index[(uint(i)*q.numPortals+uint(j))*q.numPortals+uint(k)] = s
+func (q *bestCobwebQuery) setIndex(i, j, k portalIndex, s bestSolution, cost float32) {
+	if !q.index.set(i, j, k, s) || (q.costIndex != nil && !q.costIndex.set(i, j, k, cost)) {
+		// Out of memory, stop the search the same way as if it got cancelled.
+		q.cancellation.cancelled = true
+	}
 }
 func (q *bestCobwebQuery) findBestCobweb(p0, p1, p2 portalData) {
 	if q.getIndex(p0.Index, p1.Index, p2.Index).Length != invalidLength {
@@ -44,10 +61,20 @@ func (q *bestCobwebQuery) findBestCobweb(p0, p1, p2 portalData) {
 }
 
 func (q *bestCobwebQuery) findBestCobwebAux(p0, p1, p2 portalData, candidates []portalData) bestSolution {
+	if q.cancellation.check() {
+		return bestSolution{Length: invalidLength}
+	}
 	q.depth++
 	q.filteredPortals[q.depth] = append(q.filteredPortals[q.depth][:0], candidates...)
 	var bestCobweb bestSolution
+	var bestCost float32
 	for _, portal := range q.filteredPortals[q.depth] {
+		if !q.links.allowed(portal.Index, p1.Index) || !q.links.allowed(portal.Index, p2.Index) {
+			continue
+		}
+		if !q.fields.allowed(portal, p1, p2) {
+			continue
+		}
 		if q.getIndex(portal.Index, p1.Index, p2.Index).Length == invalidLength {
 			candidatesInWedge := partitionPortalsInsideWedge(candidates, portal, p1, p2)
 			q.findBestCobwebAux(portal, p1, p2, candidatesInWedge)
@@ -57,27 +84,87 @@ func (q *bestCobwebQuery) findBestCobwebAux(p0, p1, p2 portalData, candidates []
 			q.findBestCobwebAux(p2, portal, p1, candidatesInWedge)
 			q.findBestCobwebAux(p2, p1, portal, candidatesInWedge)
 		}
+		if q.cancellation.cancelled {
+			// Leave the index entry unset, so that the index stays consistent.
+			q.depth--
+			return bestSolution{Length: invalidLength}
+		}
 
 		candidate := q.getIndex(p1.Index, p2.Index, portal.Index)
-		if candidate.Length+1 > bestCobweb.Length {
+		if candidate.Length+1 < bestCobweb.Length {
+			continue
+		}
+		var cost float32
+		if q.costs != nil {
+			cost = q.costIndex.get(p1.Index, p2.Index, portal.Index) + float32(q.costs[portal.Index])
+		}
+		if candidate.Length+1 > bestCobweb.Length || cost < bestCost {
 			bestCobweb.Length = candidate.Length + 1
-			bestCobweb.Index = portal.Index
+			bestCobweb.Index = memoPortalIndex(portal.Index)
+			bestCost = cost
 		}
 	}
 	q.onFilledIndexEntry()
 
-	q.setIndex(p0.Index, p1.Index, p2.Index, bestCobweb)
+	q.setIndex(p0.Index, p1.Index, p2.Index, bestCobweb, bestCost)
 	q.depth--
+	if q.cancellation.cancelled {
+		return bestSolution{Length: invalidLength}
+	}
 	return bestCobweb
 }
 
-// LargestCobweb - Find largest possible cobweb of portals to be made
-func LargestCobweb(portals []Portal, fixedCornerIndices []int, progressFunc func(int, int)) []Portal {
+// LargestCobweb - Find largest possible cobweb of portals to be made.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError,
+// if the search runs out of its memory budget returns the best solution found so far
+// and a *MemoryBudgetExceededError.
+func LargestCobweb(ctx context.Context, portals []Portal, fixedCornerIndices []int, progressFunc func(int, int), options ...CobwebOption) ([]Portal, error) {
+	results, err := TopCobwebs(ctx, portals, fixedCornerIndices, 1, progressFunc, options...)
+	if len(results) == 0 {
+		return []Portal{}, err
+	}
+	return results[0], err
+}
+
+type cobwebCandidate struct {
+	p0, p1, p2 portalIndex
+	length     uint16
+	cost       float64
+}
+
+func betterCobweb(a, b cobwebCandidate) bool {
+	return a.length > b.length || (a.length == b.length && a.cost < b.cost)
+}
+
+// TopCobwebs - Find up to numResults largest cobwebs having distinct sets of portals,
+// sorted from the largest one. Errors are reported the same way as by LargestCobweb.
+func TopCobwebs(ctx context.Context, portals []Portal, fixedCornerIndices []int, numResults int, progressFunc func(int, int), options ...CobwebOption) ([][]Portal, error) {
 	if len(portals) < 3 {
 		panic("Too short portal list")
 	}
+	if err := checkNumMemoPortals(len(portals)); err != nil {
+		return nil, err
+	}
+	params := defaultCobwebParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
 	portalsData := portalsToPortalData(portals)
+	links := newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength)
+	fingerprint := newCheckpointFingerprint("cobweb", portals)
+	fingerprint.addSegments(params.blockers)
+	fingerprint.addPortals(params.disabledPortals)
+	fingerprint.add(params.maxLinkLength, params.minFieldSize, fixedCornerIndices)
+	costs := portalCosts(portals)
+	if costs != nil {
+		fingerprint.add(costs)
+	}
+	checkpoints := newCheckpointer(params.checkpoint, fingerprint)
 
+	// The search resumed from a checkpoint starts from the top level triangle
+	// it has been processing when the checkpoint got saved.
+	var position [3]int
+	var q *bestCobwebQuery
 	numIndexEntries := len(portals) * (len(portals) - 1) * (len(portals) - 2)
 	everyNth := numIndexEntries / 1000
 	if everyNth < 1 {
@@ -85,16 +172,60 @@ func LargestCobweb(portals []Portal, fixedCornerIndices []int, progressFunc func
 	}
 	indexEntriesFilled := 0
 	indexEntriesFilledModN := 0
+	writeCheckpoint := func(w io.Writer) error {
+		state := cobwebCheckpointState{
+			Position:           [3]uint32{uint32(position[0]), uint32(position[1]), uint32(position[2])},
+			IndexEntriesFilled: uint64(indexEntriesFilled),
+		}
+		if err := binary.Write(w, binary.LittleEndian, state); err != nil {
+			return err
+		}
+		if err := writeTripleIndex(w, q.index); err != nil {
+			return err
+		}
+		if q.costIndex != nil {
+			return writeTripleIndex(w, q.costIndex)
+		}
+		return nil
+	}
 	onFilledIndexEntry := func() {
 		indexEntriesFilled++
 		indexEntriesFilledModN++
 		if indexEntriesFilledModN == everyNth {
 			indexEntriesFilledModN = 0
 			progressFunc(indexEntriesFilled, numIndexEntries)
+			if checkpoints.due() {
+				// On failure no more checkpoints are saved, and the error is returned with the result.
+				checkpoints.save(writeCheckpoint)
+			}
+		}
+	}
+	budget := newMemoryBudget(params.memoryBudget)
+	fields := newFieldSizeFilter(params.minFieldSize)
+	q = newBestCobwebQuery(ctx, portalsData, links, fields, costs, budget, onFilledIndexEntry)
+	if _, err := checkpoints.load(func(r io.Reader) error {
+		var state cobwebCheckpointState
+		if err := binary.Read(r, binary.LittleEndian, &state); err != nil {
+			return err
 		}
+		position = [3]int{int(state.Position[0]), int(state.Position[1]), int(state.Position[2])}
+		indexEntriesFilled = int(state.IndexEntriesFilled)
+		if err := readTripleIndex(r, q.index); err != nil {
+			return err
+		}
+		if q.costIndex != nil {
+			return readTripleIndex(r, q.costIndex)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if budget.exceeded {
+		// Don't overwrite the checkpoint with the part of it which fits in the budget.
+		return nil, budget.err(len(portals))
 	}
-	progressFunc(0, numIndexEntries)
-	q := newBestCobwebQuery(portalsData, onFilledIndexEntry)
+	progressFunc(indexEntriesFilled, numIndexEntries)
+mainLoop:
 	for i, p0 := range portalsData {
 		for j := i + 1; j < len(portalsData); j++ {
 			p1 := portalsData[j]
@@ -103,15 +234,28 @@ func LargestCobweb(portals []Portal, fixedCornerIndices []int, progressFunc func
 				if !hasAllElementsInTheTriple(fixedCornerIndices, i, j, k) {
 					continue
 				}
+				if tripleBefore([3]int{i, j, k}, position) {
+					continue
+				}
+				position = [3]int{i, j, k}
 				q.findBestCobweb(p0, p1, p2)
+				if q.cancellation.cancelled {
+					break mainLoop
+				}
 			}
 		}
 	}
 	q.filteredPortals = nil
+	if !q.cancellation.cancelled {
+		checkpoints.remove()
+	} else if checkpoints.enabled() && checkpoints.err == nil {
+		// Save the state of the interrupted search, so that it can be resumed.
+		checkpoints.save(writeCheckpoint)
+	}
 	progressFunc(numIndexEntries, numIndexEntries)
 
-	var bestP0, bestP1, bestP2 portalData
-	var bestLength uint16
+	minCost := minTotalCost(costs)
+	top := newTopSolutions(numResults, betterCobweb)
 	for i, p0 := range portalsData {
 		for j, p1 := range portalsData {
 			if i == j {
@@ -124,30 +268,66 @@ func LargestCobweb(portals []Portal, fixedCornerIndices []int, progressFunc func
 				if !hasAllElementsInTheTriple(fixedCornerIndices, i, j, k) {
 					continue
 				}
-				candidate := q.getIndex(p0.Index, p1.Index, p2.Index)
-				if candidate.Length+3 > bestLength {
-					bestP0, bestP1, bestP2 = p0, p1, p2
-					bestLength = candidate.Length + 3
+				if !links.allowed(p0.Index, p1.Index) || !links.allowed(p1.Index, p2.Index) || !links.allowed(p2.Index, p0.Index) {
+					continue
+				}
+				if !fields.allowed(p0, p1, p2) {
+					continue
+				}
+				solution := q.getIndex(p0.Index, p1.Index, p2.Index)
+				if solution.Length == invalidLength {
+					continue
+				}
+				// Check with the lowest possible cost first, so that the real cost
+				// is computed only for the solutions which may be kept.
+				candidate := cobwebCandidate{p0.Index, p1.Index, p2.Index, solution.Length + 3, minCost}
+				if top.accepts(candidate) {
+					cobwebPortals := q.cobwebPortals(candidate)
+					candidate.cost = totalCost(costs, cobwebPortals)
+					top.add(candidate, cobwebPortals)
 				}
 			}
 		}
 	}
 
-	largestCobweb := append(make([]portalIndex, 0, bestLength), bestP0.Index, bestP1.Index, bestP2.Index)
-	k0, k1, k2 := bestP0.Index, bestP1.Index, bestP2.Index
+	var err error
+	if checkpoints.err != nil {
+		err = checkpoints.err
+	} else if budget.exceeded {
+		err = budget.err(len(portals))
+	} else if q.cancellation.cancelled {
+		err = cancelledError(ctx)
+	}
+	results := make([][]Portal, 0, len(top.solutions))
+	for _, candidate := range top.solutions {
+		result := make([]Portal, 0, candidate.length)
+		for _, portalIx := range q.cobwebPortals(candidate) {
+			result = append(result, portals[portalIx])
+		}
+		results = append(results, result)
+	}
+	return results, err
+}
+
+// cobwebCheckpointState - position of the search saved in a checkpoint, followed by its index
+type cobwebCheckpointState struct {
+	Position           [3]uint32
+	IndexEntriesFilled uint64
+}
+
+// cobwebPortals returns portals of the cobweb starting with given triangle.
+func (q *bestCobwebQuery) cobwebPortals(candidate cobwebCandidate) []portalIndex {
+	cobweb := append(make([]portalIndex, 0, candidate.length), candidate.p0, candidate.p1, candidate.p2)
+	k0, k1, k2 := candidate.p0, candidate.p1, candidate.p2
 	for {
 		sol := q.getIndex(k0, k1, k2)
 		if sol.Length == 0 {
 			break
 		}
-		largestCobweb = append(largestCobweb, sol.Index)
-		k0, k1, k2 = k1, k2, sol.Index
-	}
-	result := make([]Portal, 0, len(largestCobweb))
-	for _, portalIx := range largestCobweb {
-		result = append(result, portals[portalIx])
+		cobweb = append(cobweb, sol.Index.portalIndex())
+		k0, k1, k2 = k1, k2, sol.Index.portalIndex()
 	}
-	return result
+	return cobweb
 }
 
 func CobwebPolyline(result []Portal) []Portal {
@@ -0,0 +1,58 @@
+package lib
+
+type CobwebOption interface {
+	apply(params *cobwebParams)
+}
+
+type CobwebBlockers []Segment
+
+func (c CobwebBlockers) apply(params *cobwebParams) {
+	params.blockers = []Segment(c)
+}
+
+type CobwebDisabledPortals []Portal
+
+func (c CobwebDisabledPortals) apply(params *cobwebParams) {
+	params.disabledPortals = []Portal(c)
+}
+
+// CobwebMaxLinkLength - don't make links longer than that many meters
+type CobwebMaxLinkLength float64
+
+func (c CobwebMaxLinkLength) apply(params *cobwebParams) {
+	params.maxLinkLength = float64(c)
+}
+
+// CobwebMinFieldSize - don't make fields smaller than that
+type CobwebMinFieldSize FieldSize
+
+func (c CobwebMinFieldSize) apply(params *cobwebParams) {
+	params.minFieldSize = FieldSize(c)
+}
+
+// CobwebMemoryBudget - limit in bytes of memory used by the index of partial solutions
+type CobwebMemoryBudget uint64
+
+func (c CobwebMemoryBudget) apply(params *cobwebParams) {
+	params.memoryBudget = uint64(c)
+}
+
+// CobwebCheckpoint - periodically save the state of the search to a file and resume from it
+type CobwebCheckpoint Checkpoint
+
+func (c CobwebCheckpoint) apply(params *cobwebParams) {
+	params.checkpoint = Checkpoint(c)
+}
+
+type cobwebParams struct {
+	blockers        []Segment
+	disabledPortals []Portal
+	maxLinkLength   float64
+	minFieldSize    FieldSize
+	memoryBudget    uint64
+	checkpoint      Checkpoint
+}
+
+func defaultCobwebParams() cobwebParams {
+	return cobwebParams{memoryBudget: DefaultMemoryBudget}
+}
@@ -1,8 +1,11 @@
 package lib
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"unsafe"
 
 	"github.com/golang/geo/s2"
 )
@@ -39,7 +42,10 @@ func TestCobweb(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	cobweb := LargestCobweb(portals, []int{}, func(int, int) {})
+	cobweb, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidCobwebResult(22, cobweb, t)
 }
 
@@ -72,20 +78,194 @@ func generateCobwebPortals(depth int) []Portal {
 
 func TestCobwebSyntheticPortals(t *testing.T) {
 	portals := generateCobwebPortals(10)
-	res := LargestCobweb(portals, []int{}, func(int, int) {})
+	res, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidCobwebResult(len(portals), res, t)
 }
 
+func TestCobwebCancelled(t *testing.T) {
+	portals := generateCobwebPortals(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := LargestCobweb(ctx, portals, []int{}, func(int, int) {})
+	var cancelledErr *CancelledError
+	if !errors.As(err, &cancelledErr) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation error, got %v", err)
+	}
+}
+
+func TestCobwebDisabledPortals(t *testing.T) {
+	portals := withUniqueGuids(generateCobwebPortals(6))
+	disabled := portals[0]
+	result, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {}, CobwebDisabledPortals{disabled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(portals)-1 {
+		t.Errorf("Expected length %d, actual length %d", len(portals)-1, len(result))
+	}
+	for _, portal := range result {
+		if portal.Guid == disabled.Guid {
+			t.Errorf("Disabled portal used as a vertex of the cobweb")
+		}
+	}
+	plan, err := CobwebPlan(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if covered := plan.PortalsInsideFields([]Portal{disabled}); len(covered) != 1 {
+		t.Errorf("Expected disabled portal to lie inside the cobweb, got %v", covered)
+	}
+}
+
+func TestCobwebPortalCosts(t *testing.T) {
+	// Every three corners of a square form an equally long cobweb.
+	portals := []Portal{
+		{Guid: "a", LatLng: s2.LatLngFromDegrees(50, 19)},
+		{Guid: "b", LatLng: s2.LatLngFromDegrees(50, 19.01)},
+		{Guid: "c", LatLng: s2.LatLngFromDegrees(50.01, 19.01)},
+		{Guid: "d", LatLng: s2.LatLngFromDegrees(50.01, 19)},
+	}
+	for _, costly := range []int{0, 3} {
+		withCost := append([]Portal(nil), portals...)
+		withCost[costly].Cost = 1
+		result, err := LargestCobweb(context.Background(), withCost, []int{}, func(int, int) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 3 {
+			t.Fatalf("Expected length 3, actual length %d", len(result))
+		}
+		for _, portal := range result {
+			if portal.Guid == portals[costly].Guid {
+				t.Errorf("Expected cobweb avoiding costly portal %s, got %v", portal.Guid, result)
+			}
+		}
+	}
+}
+
+func TestCobwebPortalCostsInside(t *testing.T) {
+	// Cobwebs of length 5 can be made with or without portal "b", which is not a corner
+	// of any of them, so it's the search of the inner portals which has to avoid it.
+	portals := []Portal{
+		{Guid: "a", LatLng: s2.LatLngFromDegrees(50.0085, 19.0027)},
+		{Guid: "b", LatLng: s2.LatLngFromDegrees(50.0023, 19.0022), Cost: 1},
+		{Guid: "c", LatLng: s2.LatLngFromDegrees(50.0071, 19.0032)},
+		{Guid: "d", LatLng: s2.LatLngFromDegrees(50.0060, 19.0021)},
+		{Guid: "e", LatLng: s2.LatLngFromDegrees(50.0057, 19.0062)},
+		{Guid: "f", LatLng: s2.LatLngFromDegrees(50.0002, 19.0001)},
+	}
+	result, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 5 {
+		t.Fatalf("Expected length 5, actual length %d", len(result))
+	}
+	for _, portal := range result {
+		if portal.Guid == "b" {
+			t.Errorf("Expected cobweb avoiding costly portal b, got %v", result)
+		}
+	}
+}
+
+func TestCobwebSparseIndex(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	if testing.Short() {
+		t.Skip()
+	}
+	fixedCornerIndices := []int{0, 5}
+	dense, err := LargestCobweb(context.Background(), portals, fixedCornerIndices, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Budget too small to fit the dense index.
+	n := uint64(len(portals))
+	sparse, err := LargestCobweb(context.Background(), portals, fixedCornerIndices, func(int, int) {}, CobwebMemoryBudget(n*n*n*4-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sparse) != len(dense) {
+		t.Errorf("Expected the same result for dense and sparse index, got lengths %d and %d", len(dense), len(sparse))
+	}
+	checkValidCobwebResult(len(dense), sparse, t)
+}
+
+func TestMemoEntriesCompact(t *testing.T) {
+	// Indices of partial solutions have a cubic number of entries, a wider
+	// entry would halve the number of portals fitting in a dense index.
+	if size := unsafe.Sizeof(bestSolution{}); size != 4 {
+		t.Errorf("Expected bestSolution to take 4 bytes, got %d", size)
+	}
+	if size := unsafe.Sizeof(maxFieldsSolution{}); size != 4 {
+		t.Errorf("Expected maxFieldsSolution to take 4 bytes, got %d", size)
+	}
+}
+
+func TestCobwebTooManyPortals(t *testing.T) {
+	portals := make([]Portal, maxMemoPortals+1)
+	_, err := LargestCobweb(context.Background(), portals, []int{0, 1, 2}, func(int, int) {})
+	var tooManyErr *TooManyPortalsError
+	if !errors.As(err, &tooManyErr) {
+		t.Errorf("Expected too many portals error, got %v", err)
+	}
+}
+
+func TestCobwebMemoryBudgetExceeded(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	result, err := LargestCobweb(context.Background(), portals[:50], []int{}, func(int, int) {}, CobwebMemoryBudget(100000))
+	var budgetErr *MemoryBudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("Expected memory budget error, got %v", err)
+	}
+	// The result found before running out of memory is still a valid cobweb.
+	checkValidCobwebResult(len(result), result, t)
+}
+
 func benchmarkCobweb(depth int, b *testing.B) {
 	portals := generateCobwebPortals(depth)
 	for n := 0; n < b.N; n++ {
-		res := LargestCobweb(portals, []int{}, func(int, int) {})
+		res, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+		if err != nil {
+			panic(err)
+		}
 		if len(res) != len(portals) {
 			panic(fmt.Sprintf("%d != %d: %v", len(res), len(portals), res))
 		}
 	}
 }
 
+// Benchmark of a search over a few thousand portals, whose index of partial solutions
+// doesn't fit in the default memory budget as an array.
+func BenchmarkCobwebManyPortals(b *testing.B) {
+	portals := generateCobwebPortals(10)
+	numInside := len(portals)
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 40; j++ {
+			portals = append(portals, Portal{Guid: fmt.Sprintf("outside%d_%d", i, j), LatLng: s2.LatLngFromDegrees(25+0.01*float64(i), 20+0.01*float64(j))})
+		}
+	}
+	// Corners of the largest cobweb of the synthetic portals.
+	fixedCornerIndices := []int{11, 20, 29}
+	for n := 0; n < b.N; n++ {
+		res, err := LargestCobweb(context.Background(), portals, fixedCornerIndices, func(int, int) {})
+		if err != nil {
+			panic(err)
+		}
+		if len(res) != numInside {
+			panic(fmt.Sprintf("%d != %d", len(res), numInside))
+		}
+	}
+}
+
 func BenchmarkCobweb20(b *testing.B) { benchmarkCobweb(20, b) }
 func BenchmarkCobweb30(b *testing.B) { benchmarkCobweb(30, b) }
 func BenchmarkCobweb40(b *testing.B) { benchmarkCobweb(40, b) }
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"strings"
@@ -9,15 +10,76 @@ import (
 	"golang.org/x/exp/constraints"
 )
 
-type portalIndex uint16
+type portalIndex uint32
 
-const invalidPortalIndex portalIndex = math.MaxUint16
+const invalidPortalIndex portalIndex = math.MaxUint32
 
 type portalData struct {
 	Index  portalIndex
 	LatLng s2.Point
 }
 
+// disabledPortalsMask marks portals which are on the list of disabled portals.
+// Disabled portals cannot be vertices of fields, but still count for the geometry of fields.
+// Returns nil if none of the portals is disabled.
+func disabledPortalsMask(portals []Portal, disabledPortals []Portal) []bool {
+	if len(disabledPortals) == 0 {
+		return nil
+	}
+	disabledGuids := make(map[string]struct{}, len(disabledPortals))
+	for _, portal := range disabledPortals {
+		disabledGuids[portal.Guid] = struct{}{}
+	}
+	var mask []bool
+	for i, portal := range portals {
+		if _, ok := disabledGuids[portal.Guid]; ok {
+			if mask == nil {
+				mask = make([]bool, len(portals))
+			}
+			mask[i] = true
+		}
+	}
+	return mask
+}
+
+// portalCosts returns costs of using the portals.
+// Returns nil if none of the portals has a cost.
+func portalCosts(portals []Portal) []float64 {
+	var costs []float64
+	for i, portal := range portals {
+		if portal.Cost != 0 {
+			if costs == nil {
+				costs = make([]float64, len(portals))
+			}
+			costs[i] = portal.Cost
+		}
+	}
+	return costs
+}
+
+// totalCost returns the sum of costs of given portals.
+func totalCost(costs []float64, portals []portalIndex) float64 {
+	if costs == nil {
+		return 0
+	}
+	var total float64
+	for _, portal := range portals {
+		total += costs[portal]
+	}
+	return total
+}
+
+// minTotalCost returns the lowest possible total cost of a set of portals.
+func minTotalCost(costs []float64) float64 {
+	var total float64
+	for _, cost := range costs {
+		if cost < 0 {
+			total += cost
+		}
+	}
+	return total
+}
+
 func portalsToPortalData(portals []Portal) []portalData {
 	portalsData := make([]portalData, 0, len(portals))
 	for i, portal := range portals {
@@ -30,11 +92,77 @@ func portalsToPortalData(portals []Portal) []portalData {
 
 const invalidLength uint16 = math.MaxUint16
 
+// memoPortalIndex - index of a portal as stored in the indices of partial solutions,
+// whose size grows with the cube of the number of portals. It's narrower than portalIndex
+// to keep the indices compact, so the searches using them accept at most maxMemoPortals portals.
+type memoPortalIndex uint16
+
+const invalidMemoPortalIndex memoPortalIndex = math.MaxUint16
+
+// The index just below the invalid one marks a triangle having no portal
+// splitting it, in both ranges.
+const maxMemoPortals = int(invalidMemoPortalIndex) - 1
+
+func newMemoPortalIndex(index portalIndex) memoPortalIndex {
+	if index >= invalidPortalIndex-1 {
+		return invalidMemoPortalIndex - memoPortalIndex(invalidPortalIndex-index)
+	}
+	return memoPortalIndex(index)
+}
+func (i memoPortalIndex) portalIndex() portalIndex {
+	if i >= invalidMemoPortalIndex-1 {
+		return invalidPortalIndex - portalIndex(invalidMemoPortalIndex-i)
+	}
+	return portalIndex(i)
+}
+
 type bestSolution struct {
-	Index  portalIndex
+	Index  memoPortalIndex
 	Length uint16
 }
 
+// CancelledError is returned by a search whose context got cancelled
+// before the search finished. The result returned along with the error
+// is the best one found until the cancellation.
+type CancelledError struct {
+	Err error
+}
+
+func (e *CancelledError) Error() string {
+	return "search cancelled: " + e.Err.Error()
+}
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+func cancelledError(ctx context.Context) error {
+	return &CancelledError{Err: ctx.Err()}
+}
+
+// cancellation is a cheap way of polling a context for cancellation
+// from within tight loops of the searches.
+type cancellation struct {
+	done      <-chan struct{}
+	cancelled bool
+}
+
+func newCancellation(ctx context.Context) cancellation {
+	return cancellation{done: ctx.Done()}
+}
+
+// check returns true if the context got cancelled. Once cancelled it keeps returning true.
+func (c *cancellation) check() bool {
+	if c.cancelled || c.done == nil {
+		return c.cancelled
+	}
+	select {
+	case <-c.done:
+		c.cancelled = true
+	default:
+	}
+	return c.cancelled
+}
+
 func portalsInsideWedge(portals []portalData, a, b, c portalData, result []portalData) []portalData {
 	wedge := newTriangleWedgeQuery(a.LatLng, b.LatLng, c.LatLng)
 	result = result[:0]
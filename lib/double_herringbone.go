@@ -1,22 +1,105 @@
 package lib
 
-// LargestDoubleHerringbone - Find largest possible multilayer of portals to be made
-func LargestDoubleHerringbone(portals []Portal, fixedBaseIndices []int, numWorkers int, progressFunc func(int, int)) (Portal, Portal, []Portal, []Portal) {
+import "context"
+
+// LargestDoubleHerringbone - Find largest possible multilayer of portals to be made.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError.
+func LargestDoubleHerringbone(ctx context.Context, portals []Portal, fixedBaseIndices []int, numWorkers int, progressFunc func(int, int), options ...HerringboneOption) (Portal, Portal, []Portal, []Portal, error) {
+	results, err := TopDoubleHerringbones(ctx, portals, fixedBaseIndices, 1, numWorkers, progressFunc, options...)
+	return firstDoubleHerringboneSolution(portals, results, err)
+}
+
+// DoubleHerringboneSolution - double herringbone field with base B0, B1
+type DoubleHerringboneSolution struct {
+	B0, B1    Portal
+	Backbone0 []Portal
+	Backbone1 []Portal
+}
+
+// TopDoubleHerringbones - Find up to numResults largest double multilayers having distinct sets of portals,
+// sorted from the largest one.
+// If ctx gets cancelled returns the best solutions found so far and a *CancelledError.
+func TopDoubleHerringbones(ctx context.Context, portals []Portal, fixedBaseIndices []int, numResults int, numWorkers int, progressFunc func(int, int), options ...HerringboneOption) ([]DoubleHerringboneSolution, error) {
 	if numWorkers == 1 {
-		return LargestDoubleHerringboneST(portals, fixedBaseIndices, progressFunc)
+		return topDoubleHerringbonesST(ctx, portals, fixedBaseIndices, numResults, progressFunc, options...)
+	}
+	return topDoubleHerringbonesMT(ctx, portals, fixedBaseIndices, numResults, numWorkers, progressFunc, options...)
+}
+
+func firstDoubleHerringboneSolution(portals []Portal, results []DoubleHerringboneSolution, err error) (Portal, Portal, []Portal, []Portal, error) {
+	if len(results) == 0 {
+		return portals[0], portals[0], []Portal{}, []Portal{}, err
+	}
+	return results[0].B0, results[0].B1, results[0].Backbone0, results[0].Backbone1, err
+}
+
+type doubleHerringboneCandidate struct {
+	b0, b1    portalIndex
+	backbone0 []portalIndex
+	backbone1 []portalIndex
+	cost      float64
+}
+
+func betterDoubleHerringbone(a, b doubleHerringboneCandidate) bool {
+	lenA, lenB := len(a.backbone0)+len(a.backbone1), len(b.backbone0)+len(b.backbone1)
+	return lenA > lenB || (lenA == lenB && a.cost < b.cost)
+}
+
+// addDoubleHerringbone adds a copy of the double herringbone to the top solutions.
+func addDoubleHerringbone(top *topSolutions[doubleHerringboneCandidate], costs []float64, b0, b1 portalIndex, backbone0, backbone1 []portalIndex) {
+	if len(backbone0)+len(backbone1) == 0 {
+		return
 	}
-	return LargestDoubleHerringboneMT(portals, fixedBaseIndices, numWorkers, progressFunc)
+	candidate := doubleHerringboneCandidate{b0: b0, b1: b1, backbone0: backbone0, backbone1: backbone1}
+	if costs != nil {
+		candidate.cost = costs[b0] + costs[b1] + totalCost(costs, backbone0) + totalCost(costs, backbone1)
+	}
+	if !top.accepts(candidate) {
+		return
+	}
+	candidate.backbone0 = append([]portalIndex(nil), backbone0...)
+	candidate.backbone1 = append([]portalIndex(nil), backbone1...)
+	top.add(candidate, append(append([]portalIndex{b0, b1}, backbone0...), backbone1...))
+}
+
+func doubleHerringboneSolutions(portals []Portal, candidates []doubleHerringboneCandidate) []DoubleHerringboneSolution {
+	solutions := make([]DoubleHerringboneSolution, 0, len(candidates))
+	for _, candidate := range candidates {
+		solution := DoubleHerringboneSolution{
+			B0:        portals[candidate.b0],
+			B1:        portals[candidate.b1],
+			Backbone0: make([]Portal, 0, len(candidate.backbone0)),
+			Backbone1: make([]Portal, 0, len(candidate.backbone1)),
+		}
+		for _, portalIx := range candidate.backbone0 {
+			solution.Backbone0 = append(solution.Backbone0, portals[portalIx])
+		}
+		for _, portalIx := range candidate.backbone1 {
+			solution.Backbone1 = append(solution.Backbone1, portals[portalIx])
+		}
+		solutions = append(solutions, solution)
+	}
+	return solutions
 }
 
 // LargestDoubleHerringboneST - Find largest possible multilayer of portals to be made, using a single thread
-func LargestDoubleHerringboneST(portals []Portal, fixedBaseIndices []int, progressFunc func(int, int)) (Portal, Portal, []Portal, []Portal) {
+func LargestDoubleHerringboneST(ctx context.Context, portals []Portal, fixedBaseIndices []int, progressFunc func(int, int), options ...HerringboneOption) (Portal, Portal, []Portal, []Portal, error) {
+	results, err := topDoubleHerringbonesST(ctx, portals, fixedBaseIndices, 1, progressFunc, options...)
+	return firstDoubleHerringboneSolution(portals, results, err)
+}
+
+func topDoubleHerringbonesST(ctx context.Context, portals []Portal, fixedBaseIndices []int, numResults int, progressFunc func(int, int), options ...HerringboneOption) ([]DoubleHerringboneSolution, error) {
 	if len(portals) < 3 {
 		panic("Too short portal list")
 	}
+	params := defaultHerringboneParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
 	portalsData := portalsToPortalData(portals)
 
-	var largestCCW, largestCW []portalIndex
-	var bestB0, bestB1 portalIndex
+	costs := portalCosts(portals)
+	top := newTopSolutions(numResults, betterDoubleHerringbone)
 	resultCacheCCW := make([]portalIndex, 0, len(portals))
 	resultCacheCW := make([]portalIndex, 0, len(portals))
 	numPairs := len(portals) * (len(portals) - 1) / 2
@@ -31,20 +114,21 @@ func LargestDoubleHerringboneST(portals []Portal, fixedBaseIndices []int, progre
 	}
 	numProcessedPairs := 0
 	progressFunc(0, numPairs)
-	q := newBestHerringboneQuery(portalsData)
+	q := newBestHerringboneQuery(portalsData, newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength), newFieldSizeFilter(params.minFieldSize), costs)
+	c := newCancellation(ctx)
+mainLoop:
 	for i, b0 := range portalsData {
 		for j := i + 1; j < len(portalsData); j++ {
 			b1 := portalsData[j]
 			if !hasAllElementsInThePair(fixedBaseIndices, i, j) {
 				continue
 			}
+			if c.check() {
+				break mainLoop
+			}
 			bestCCW := q.findBestHerringbone(b0, b1, resultCacheCCW)
 			bestCW := q.findBestHerringbone(b1, b0, resultCacheCW)
-			if len(bestCCW)+len(bestCW) > len(largestCCW)+len(largestCW) {
-				largestCCW = append(largestCCW[:0], bestCCW...)
-				largestCW = append(largestCW[:0], bestCW...)
-				bestB0, bestB1 = b0.Index, b1.Index
-			}
+			addDoubleHerringbone(top, costs, b0.Index, b1.Index, bestCCW, bestCW)
 			numProcessedPairs++
 			if numProcessedPairs%everyNth == 0 {
 				progressFunc(numProcessedPairs, numPairs)
@@ -52,16 +136,10 @@ func LargestDoubleHerringboneST(portals []Portal, fixedBaseIndices []int, progre
 		}
 	}
 	progressFunc(numPairs, numPairs)
-	resultCCW := make([]Portal, 0, len(largestCCW))
-	for _, portalIx := range largestCCW {
-		resultCCW = append(resultCCW, portals[portalIx])
-	}
-	resultCW := make([]Portal, 0, len(largestCW))
-	for _, portalIx := range largestCW {
-		resultCW = append(resultCW, portals[portalIx])
+	if c.cancelled {
+		return doubleHerringboneSolutions(portals, top.solutions), cancelledError(ctx)
 	}
-
-	return portals[bestB0], portals[bestB1], resultCCW, resultCW
+	return doubleHerringboneSolutions(portals, top.solutions), nil
 }
 
 func DoubleHerringbonePolyline(b0, b1 Portal, result0, result1 []Portal) []Portal {
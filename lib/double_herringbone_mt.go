@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"sync"
 )
@@ -13,12 +14,20 @@ type doubleHerringboneRequest struct {
 }
 
 func bestDoubleHerringboneWorker(
+	ctx context.Context,
 	q *bestHerringboneMtQuery,
 	requestChannel, responseChannel chan doubleHerringboneRequest,
 	doneChannel chan struct{}) {
 	nodes := make([]herringboneNode, 0, len(q.portals))
 	weights := make([]float32, len(q.portals))
 	for req := range requestChannel {
+		if ctx.Err() != nil {
+			// Just drain the request channel.
+			req.resultCCW = req.resultCCW[:0]
+			req.resultCW = req.resultCW[:0]
+			responseChannel <- req
+			continue
+		}
 		nodes = nodes[:0]
 		for i := 0; i < len(weights); i++ {
 			weights[i] = 0
@@ -31,17 +40,26 @@ func bestDoubleHerringboneWorker(
 }
 
 // LargestDoubleHerringboneMT - Find largest possible multilayer of portals to be made, parallel version
-func LargestDoubleHerringboneMT(portals []Portal, fixedBaseIndices []int, numWorkers int, progressFunc func(int, int)) (Portal, Portal, []Portal, []Portal) {
+func LargestDoubleHerringboneMT(ctx context.Context, portals []Portal, fixedBaseIndices []int, numWorkers int, progressFunc func(int, int), options ...HerringboneOption) (Portal, Portal, []Portal, []Portal, error) {
+	results, err := topDoubleHerringbonesMT(ctx, portals, fixedBaseIndices, 1, numWorkers, progressFunc, options...)
+	return firstDoubleHerringboneSolution(portals, results, err)
+}
+
+func topDoubleHerringbonesMT(ctx context.Context, portals []Portal, fixedBaseIndices []int, numResults int, numWorkers int, progressFunc func(int, int), options ...HerringboneOption) ([]DoubleHerringboneSolution, error) {
 	if numWorkers < 1 {
 		panic(fmt.Errorf("too few workers: %d", numWorkers))
 	}
 	if len(portals) < 3 {
 		panic(fmt.Errorf("too short portal list: %d", len(portals)))
 	}
+	params := defaultHerringboneParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
 	portalsData := portalsToPortalData(portals)
 
-	var largestCCW, largestCW []portalIndex
-	var bestB0, bestB1 portalIndex
+	costs := portalCosts(portals)
+	top := newTopSolutions(numResults, betterDoubleHerringbone)
 	resultCache := sync.Pool{
 		New: func() interface{} {
 			return make([]portalIndex, 0, len(portals))
@@ -57,44 +75,39 @@ func LargestDoubleHerringboneMT(portals []Portal, fixedBaseIndices []int, numWor
 	requestChannel := make(chan doubleHerringboneRequest, numWorkers)
 	responseChannel := make(chan doubleHerringboneRequest, numWorkers)
 	doneChannel := make(chan struct{}, numWorkers)
-	q := newBestHerringboneMtQuery(portalsData)
+	q := newBestHerringboneMtQuery(portalsData, newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength), newFieldSizeFilter(params.minFieldSize), costs)
 	for i := 0; i < numWorkers; i++ {
-		go bestDoubleHerringboneWorker(q, requestChannel, responseChannel, doneChannel)
+		go bestDoubleHerringboneWorker(ctx, q, requestChannel, responseChannel, doneChannel)
 	}
 	go func() {
+		defer close(requestChannel)
 		for i, b0 := range portalsData {
 			for j := i + 1; j < len(portalsData); j++ {
 				b1 := portalsData[j]
 				if !hasAllElementsInThePair(fixedBaseIndices, i, j) {
 					continue
 				}
-				requestChannel <- doubleHerringboneRequest{
+				select {
+				case requestChannel <- doubleHerringboneRequest{
 					p0:        b0,
 					p1:        b1,
 					resultCCW: resultCache.Get().([]portalIndex),
 					resultCW:  resultCache.Get().([]portalIndex),
+				}:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
-		close(requestChannel)
 	}()
 	progressFunc(0, numPairs)
 	numWorkersDone := 0
 	for numWorkersDone < numWorkers {
 		select {
 		case resp := <-responseChannel:
-			if len(resp.resultCCW)+len(resp.resultCW) > len(largestCCW)+len(largestCW) {
-				if len(largestCCW)+len(largestCW) > 0 {
-					resultCache.Put(largestCCW)
-					resultCache.Put(largestCW)
-				}
-				largestCCW = resp.resultCCW
-				largestCW = resp.resultCW
-				bestB0, bestB1 = resp.p0.Index, resp.p1.Index
-			} else {
-				resultCache.Put(resp.resultCCW)
-				resultCache.Put(resp.resultCW)
-			}
+			addDoubleHerringbone(top, costs, resp.p0.Index, resp.p1.Index, resp.resultCCW, resp.resultCW)
+			resultCache.Put(resp.resultCCW)
+			resultCache.Put(resp.resultCW)
 			numProcessedPairs++
 			if numProcessedPairs%everyNth == 0 {
 				progressFunc(numProcessedPairs, numPairs)
@@ -106,14 +119,8 @@ func LargestDoubleHerringboneMT(portals []Portal, fixedBaseIndices []int, numWor
 	progressFunc(numPairs, numPairs)
 	close(responseChannel)
 	close(doneChannel)
-	resultCCW := make([]Portal, 0, len(largestCCW))
-	for _, portalIx := range largestCCW {
-		resultCCW = append(resultCCW, portals[portalIx])
+	if ctx.Err() != nil {
+		return doubleHerringboneSolutions(portals, top.solutions), cancelledError(ctx)
 	}
-	resultCW := make([]Portal, 0, len(largestCW))
-	for _, portalIx := range largestCW {
-		resultCW = append(resultCW, portals[portalIx])
-	}
-
-	return portals[bestB0], portals[bestB1], resultCCW, resultCW
+	return doubleHerringboneSolutions(portals, top.solutions), nil
 }
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"testing"
 
 	"github.com/golang/geo/s2"
@@ -21,7 +22,10 @@ func TestHerringboneDoubleMultiThreaded(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	b0, b1, backbone0, backbone1 := LargestDoubleHerringbone(portals, []int{}, 6, func(int, int) {})
+	b0, b1, backbone0, backbone1, err := LargestDoubleHerringbone(context.Background(), portals, []int{}, 6, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidHerringboneResult(14, b0, b1, backbone0, t)
 	checkValidHerringboneResult(16, b0, b1, backbone1, t)
 	if !latLngSign(backbone0[0].LatLng, b0.LatLng, b1.LatLng) {
@@ -43,7 +47,10 @@ func TestHerringboneDoubleSingleThread(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	b0, b1, backbone0, backbone1 := LargestDoubleHerringbone(portals, []int{}, 1, func(int, int) {})
+	b0, b1, backbone0, backbone1, err := LargestDoubleHerringbone(context.Background(), portals, []int{}, 1, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidHerringboneResult(14, b0, b1, backbone0, t)
 	checkValidHerringboneResult(16, b0, b1, backbone1, t)
 	if !latLngSign(backbone0[0].LatLng, b0.LatLng, b1.LatLng) {
@@ -2,21 +2,137 @@ package lib
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
 
 	"github.com/golang/geo/s1"
 	"github.com/golang/geo/s2"
 )
 
-func LongestDroneFlight(portals []Portal, options ...DroneFlightOption) ([]Portal, []Portal) {
+// LongestDroneFlight - Find the longest drone flight, returns the portals on the flight path
+// and the portals whose keys are needed to make the flight.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError.
+func LongestDroneFlight(ctx context.Context, portals []Portal, options ...DroneFlightOption) ([]Portal, []Portal, error) {
+	results, err := TopDroneFlights(ctx, portals, 1, options...)
+	if len(results) == 0 {
+		return nil, nil, err
+	}
+	return results[0].Path, results[0].KeysNeeded, err
+}
+
+// DroneFlightSolution - portals on the drone flight path and the portals whose keys are needed to make the flight,
+// apart from the ones given in DroneFlightKeyInventory
+type DroneFlightSolution struct {
+	Path       []Portal
+	KeysNeeded []Portal
+}
+
+// TopDroneFlights - Find up to numResults longest drone flights having distinct sets of portals,
+// sorted from the longest one.
+// If ctx gets cancelled returns the best solutions found so far and a *CancelledError.
+func TopDroneFlights(ctx context.Context, portals []Portal, numResults int, options ...DroneFlightOption) ([]DroneFlightSolution, error) {
 	params := defaultDroneFlightParams()
 	for _, option := range options {
 		option.apply(&params)
 	}
+	if params.cellLevel < 0 || params.cellLevel > s2.MaxLevel {
+		panic(fmt.Errorf("invalid cell level: %d", params.cellLevel))
+	}
 	if params.numWorkers == 1 {
-		return longestDroneFlightST(portals, params)
+		return topDroneFlightsST(ctx, portals, numResults, params)
+	}
+	return topDroneFlightsMT(ctx, portals, numResults, params)
+}
+
+type droneFlightCandidate struct {
+	start, end portalIndex
+	distance   float64
+}
+
+func betterDroneFlight(a, b droneFlightCandidate) bool {
+	return a.distance > b.distance
+}
+
+func addDroneFlight(top *topSolutions[droneFlightCandidate], start, end portalIndex, distance float64) {
+	if end == invalidPortalIndex || end == start {
+		return
+	}
+	top.add(droneFlightCandidate{start: start, end: end, distance: distance}, []portalIndex{start, end})
+}
+
+type droneFlightPath struct {
+	distance   float64
+	path       []portalIndex
+	keysNeeded []portalIndex
+}
+
+func betterDroneFlightPath(a, b droneFlightPath) bool {
+	return a.distance > b.distance
+}
+
+// droneFlightSolutions finds optimal paths of the flights between the most distant pairs of portals.
+func droneFlightSolutions(q *longestDroneFlightQuery, portals []Portal, candidates []droneFlightCandidate, params droneFlightParams, reverseRoute bool) []DroneFlightSolution {
+	top := newTopSolutions(len(candidates), betterDroneFlightPath)
+	for _, candidate := range candidates {
+		// Now find the most optimal path between those two portals (in both ways).
+		// It's way faster two split the search into two parts, as the first one
+		// can be calculated using a trivial DFS on the reachability graph using
+		// only a simple FIFO queue instead of priority queue.
+		bestPath, bestKeysNeeded := q.optimalFlight(candidate.start, candidate.end, params.optimizeNumKeys)
+		if params.startPortalIndex == invalidPortalIndex {
+			path, keysNeeded := q.optimalFlight(candidate.end, candidate.start, params.optimizeNumKeys)
+			if len(path) > 1 {
+				if params.optimizeNumKeys {
+					if len(keysNeeded) < len(bestKeysNeeded) || (len(keysNeeded) == len(bestKeysNeeded) && len(path) < len(bestPath)) {
+						bestPath, bestKeysNeeded = path, keysNeeded
+					}
+				} else {
+					if len(path) < len(bestPath) {
+						bestPath, bestKeysNeeded = path, keysNeeded
+					}
+				}
+			}
+		}
+		if len(bestPath) < 2 {
+			continue
+		}
+		if reverseRoute {
+			reverse(bestPath)
+		}
+		top.add(droneFlightPath{distance: candidate.distance, path: bestPath, keysNeeded: bestKeysNeeded}, bestPath)
 	}
-	return longestDroneFlightMT(portals, params)
+
+	solutions := make([]DroneFlightSolution, 0, len(top.solutions))
+	for _, flight := range top.solutions {
+		portalPath := []Portal(nil)
+		for i := len(flight.path) - 1; i >= 0; i-- {
+			portalPath = append(portalPath, portals[flight.path[i]])
+		}
+		portalKeysNeeded := []Portal(nil)
+		for _, index := range flight.keysNeeded {
+			portalKeysNeeded = append(portalKeysNeeded, portals[index])
+		}
+		solutions = append(solutions, DroneFlightSolution{Path: portalPath, KeysNeeded: portalKeysNeeded})
+	}
+	return solutions
+}
+
+type droneFlightCost struct {
+	numKeysNeeded int
+	numJumps      int
+}
+
+func (c droneFlightCost) add(other droneFlightCost) droneFlightCost {
+	return droneFlightCost{numKeysNeeded: c.numKeysNeeded + other.numKeysNeeded, numJumps: c.numJumps + other.numJumps}
+}
+
+func (c droneFlightCost) less(other droneFlightCost, optimizeNumKeys bool) bool {
+	if optimizeNumKeys {
+		return c.numKeysNeeded < other.numKeysNeeded ||
+			(c.numKeysNeeded == other.numKeysNeeded && c.numJumps < other.numJumps)
+	}
+	return c.numJumps < other.numJumps ||
+		(c.numJumps == other.numJumps && c.numKeysNeeded < other.numKeysNeeded)
 }
 
 type droneFlightPrioQueueItem struct {
@@ -24,8 +140,14 @@ type droneFlightPrioQueueItem struct {
 	numJumps      int
 	queueIndex    int
 	index         portalIndex
-	prev          portalIndex
+	// state the flight comes from, -1 if none
+	prev int
+}
+
+func (i *droneFlightPrioQueueItem) cost() droneFlightCost {
+	return droneFlightCost{numKeysNeeded: i.numKeysNeeded, numJumps: i.numJumps}
 }
+
 type droneFlightPrioQueue struct {
 	items           []*droneFlightPrioQueueItem
 	optimizeNumKeys bool
@@ -33,10 +155,7 @@ type droneFlightPrioQueue struct {
 
 func (pq droneFlightPrioQueue) Len() int { return len(pq.items) }
 func (pq droneFlightPrioQueue) Less(i, j int) bool {
-	if pq.optimizeNumKeys && pq.items[i].numKeysNeeded != pq.items[j].numKeysNeeded {
-		return pq.items[i].numKeysNeeded < pq.items[j].numKeysNeeded
-	}
-	return pq.items[i].numJumps < pq.items[j].numJumps
+	return pq.items[i].cost().less(pq.items[j].cost(), pq.optimizeNumKeys)
 }
 func (pq droneFlightPrioQueue) Swap(i, j int) {
 	pq.items[i], pq.items[j] = pq.items[j], pq.items[i]
@@ -65,14 +184,19 @@ type droneFlightNeighbour struct {
 type longestDroneFlightQuery struct {
 	neighbours     [][]droneFlightNeighbour
 	portalDistance func(portalIndex, portalIndex) float64
-	queue          fifo
+	// don't use more keys than that, no limit if negative
+	maxKeys int
+	queue   fifo
+	// portals reachable by using one more key than the portals in the queue
+	nextKeyPortals []portalIndex
 	visited        []bool
 }
 
-func newLongestDroneFlightQuery(neighbours [][]droneFlightNeighbour, portalDistance func(portalIndex, portalIndex) float64) *longestDroneFlightQuery {
+func newLongestDroneFlightQuery(neighbours [][]droneFlightNeighbour, portalDistance func(portalIndex, portalIndex) float64, maxKeys int) *longestDroneFlightQuery {
 	q := &longestDroneFlightQuery{
 		neighbours:     neighbours,
 		portalDistance: portalDistance,
+		maxKeys:        maxKeys,
 		visited:        make([]bool, len(neighbours)),
 	}
 	return q
@@ -87,29 +211,56 @@ func (q *longestDroneFlightQuery) longestFlightFrom(start, end portalIndex) (por
 	for i := 0; i < len(q.neighbours); i++ {
 		q.visited[i] = false
 	}
+	visit := func(index portalIndex) bool {
+		q.queue.Enqueue(index)
+		q.visited[index] = true
+		distance := q.portalDistance(index, start)
+		if index == end {
+			bestEndPortal = end
+			bestDistance = distance
+			return true
+		}
+		if distance > bestDistance {
+			bestEndPortal = index
+			bestDistance = distance
+		}
+		return false
+	}
 	q.queue.Reset()
 	q.queue.Enqueue(start)
 	q.visited[start] = true
+	q.nextKeyPortals = q.nextKeyPortals[:0]
+	// With a limit of keys, search portals reachable using consecutive numbers of keys.
+	numKeys := 0
 mainloop:
-	for !q.queue.Empty() {
-		p := q.queue.Dequeue()
-		for _, n := range q.neighbours[p] {
-			if q.visited[n.index] {
-				continue
+	for {
+		for !q.queue.Empty() {
+			p := q.queue.Dequeue()
+			for _, n := range q.neighbours[p] {
+				if q.visited[n.index] {
+					continue
+				}
+				if n.keyNeeded && q.maxKeys >= 0 {
+					if numKeys < q.maxKeys {
+						q.nextKeyPortals = append(q.nextKeyPortals, n.index)
+					}
+					continue
+				}
+				if visit(n.index) {
+					break mainloop
+				}
 			}
-			q.queue.Enqueue(n.index)
-			q.visited[n.index] = true
-			distance := q.portalDistance(n.index, start)
-			if n.index == end {
-				bestEndPortal = end
-				bestDistance = distance
+		}
+		if len(q.nextKeyPortals) == 0 {
+			break
+		}
+		numKeys++
+		for _, index := range q.nextKeyPortals {
+			if !q.visited[index] && visit(index) {
 				break mainloop
 			}
-			if distance > bestDistance {
-				bestEndPortal = n.index
-				bestDistance = distance
-			}
 		}
+		q.nextKeyPortals = q.nextKeyPortals[:0]
 	}
 	if end != invalidPortalIndex && bestEndPortal != end {
 		return invalidPortalIndex, 0
@@ -121,17 +272,47 @@ func (q *longestDroneFlightQuery) optimalFlight(start, end portalIndex, optimize
 	if start == invalidPortalIndex || end == invalidPortalIndex {
 		panic(fmt.Errorf("%d, %d", int(start), int(end)))
 	}
-	queueItems := make([]droneFlightPrioQueueItem, len(q.neighbours))
+	return q.optimalFlights(start, end, optimizeNumKeys).path(end)
+}
+
+// droneFlights - optimal flights from a single start portal
+type droneFlights struct {
+	// items[portal*numLayers+layer] - state of the flight to the portal, where layer
+	// is the number of keys needed by the flight if there's more than one layer
+	items     []droneFlightPrioQueueItem
+	numLayers int
+	// sentinel number of keys needed to reach unreachable states
+	unreachable     int
+	optimizeNumKeys bool
+}
+
+// optimalFlights finds optimal flights from the start portal to all the reachable portals.
+// If end is != invalidPortalIndex the search stops once the flight to the end portal is found.
+func (q *longestDroneFlightQuery) optimalFlights(start, end portalIndex, optimizeNumKeys bool) droneFlights {
+	// Finding the least jumps within the limit of keys requires keeping track
+	// of flights to each portal needing different numbers of keys.
+	numLayers := 1
+	if q.maxKeys >= 0 && !optimizeNumKeys {
+		numLayers = q.maxKeys + 1
+	}
+	numPortals := len(q.neighbours)
+	flights := droneFlights{
+		items:           make([]droneFlightPrioQueueItem, numPortals*numLayers),
+		numLayers:       numLayers,
+		unreachable:     numPortals + 1,
+		optimizeNumKeys: optimizeNumKeys,
+	}
+	queueItems := flights.items
+	visited := make([]bool, len(queueItems))
 	queue := droneFlightPrioQueue{
-		items:           make([]*droneFlightPrioQueueItem, 0, len(q.neighbours)),
+		items:           make([]*droneFlightPrioQueueItem, 0, len(queueItems)),
 		optimizeNumKeys: optimizeNumKeys}
-	for i := 0; i < len(q.neighbours); i++ {
-		q.visited[i] = false
-		queueItems[i].index = portalIndex(i)
-		queueItems[i].prev = invalidPortalIndex
-		queueItems[i].numKeysNeeded = len(q.neighbours) + 1
-		queueItems[i].numJumps = len(q.neighbours) + 1
-		if portalIndex(i) == start {
+	for i := 0; i < len(queueItems); i++ {
+		queueItems[i].index = portalIndex(i / numLayers)
+		queueItems[i].prev = -1
+		queueItems[i].numKeysNeeded = flights.unreachable
+		queueItems[i].numJumps = flights.unreachable
+		if i == int(start)*numLayers {
 			queueItems[i].numKeysNeeded = 0
 			queueItems[i].numJumps = 0
 		}
@@ -141,79 +322,121 @@ func (q *longestDroneFlightQuery) optimalFlight(start, end portalIndex, optimize
 	heap.Init(&queue)
 	for queue.Len() > 0 {
 		p := heap.Pop(&queue).(*droneFlightPrioQueueItem)
-		if q.visited[p.index] || p.numKeysNeeded > len(q.neighbours) {
+		if p.numKeysNeeded >= flights.unreachable {
+			continue
+		}
+		state := flights.state(p.index, p.numKeysNeeded)
+		if visited[state] {
 			continue
 		}
-		q.visited[p.index] = true
-		if p.index == end {
+		visited[state] = true
+		if p.index == end && flights.numLayers == 1 {
+			// With more layers keep searching for flights to the end needing more keys.
 			break
 		}
 		for _, n := range q.neighbours[p.index] {
-			if q.visited[n.index] {
-				continue
-			}
 			keysNeeded := p.numKeysNeeded
 			if n.keyNeeded {
 				keysNeeded++
 			}
+			if q.maxKeys >= 0 && keysNeeded > q.maxKeys {
+				continue
+			}
+			nState := flights.state(n.index, keysNeeded)
+			if visited[nState] {
+				continue
+			}
 			numJumps := p.numJumps + 1
 			betterPath := false
 			if optimizeNumKeys {
-				if keysNeeded < queueItems[n.index].numKeysNeeded ||
-					(keysNeeded == queueItems[n.index].numKeysNeeded && numJumps < queueItems[n.index].numJumps) {
+				if keysNeeded < queueItems[nState].numKeysNeeded ||
+					(keysNeeded == queueItems[nState].numKeysNeeded && numJumps < queueItems[nState].numJumps) {
 					betterPath = true
 				}
 			} else {
-				if numJumps < queueItems[n.index].numJumps {
+				if numJumps < queueItems[nState].numJumps {
 					betterPath = true
 				}
 			}
 			if betterPath {
-				queueItems[n.index].numKeysNeeded = keysNeeded
-				queueItems[n.index].numJumps = numJumps
-				queueItems[n.index].prev = p.index
-				heap.Fix(&queue, queueItems[n.index].queueIndex)
+				queueItems[nState].numKeysNeeded = keysNeeded
+				queueItems[nState].numJumps = numJumps
+				queueItems[nState].prev = state
+				heap.Fix(&queue, queueItems[nState].queueIndex)
 			}
 		}
 	}
-	bestPath := []portalIndex{end}
+	return flights
+}
+
+func (f droneFlights) state(index portalIndex, numKeysNeeded int) int {
+	if f.numLayers == 1 {
+		return int(index)
+	}
+	return int(index)*f.numLayers + numKeysNeeded
+}
+
+// best returns the state of the optimal flight to the end portal.
+func (f droneFlights) best(end portalIndex) int {
+	first := int(end) * f.numLayers
+	best := first
+	for state := first + 1; state < first+f.numLayers; state++ {
+		if f.items[state].cost().less(f.items[best].cost(), f.optimizeNumKeys) {
+			best = state
+		}
+	}
+	return best
+}
+
+// reachable returns true if there's a flight to the end portal.
+func (f droneFlights) reachable(end portalIndex) bool {
+	return f.items[f.best(end)].numKeysNeeded < f.unreachable
+}
+
+// path returns portals on the optimal flight to the end portal, and portals whose keys
+// are needed, both in reverse order.
+func (f droneFlights) path(end portalIndex) ([]portalIndex, []portalIndex) {
+	return f.pathFrom(f.best(end))
+}
+
+// pathFrom returns portals on the flight ending in the given state, and portals whose keys
+// are needed, both in reverse order.
+func (f droneFlights) pathFrom(end int) ([]portalIndex, []portalIndex) {
+	bestPath := []portalIndex{f.items[end].index}
 	keysNeeded := []portalIndex{}
-	for {
-		lastPortal := bestPath[len(bestPath)-1]
-		if prev := queueItems[lastPortal].prev; prev != invalidPortalIndex {
-			bestPath = append(bestPath, prev)
-			if queueItems[lastPortal].numKeysNeeded > queueItems[prev].numKeysNeeded {
-				keysNeeded = append(keysNeeded, lastPortal)
-			}
-		} else {
-			break
+	for state := end; f.items[state].prev >= 0; state = f.items[state].prev {
+		prev := f.items[state].prev
+		bestPath = append(bestPath, f.items[prev].index)
+		if f.items[state].numKeysNeeded > f.items[prev].numKeysNeeded {
+			keysNeeded = append(keysNeeded, f.items[state].index)
 		}
 	}
 	return bestPath, keysNeeded
 }
 
-const droneFlightNeighbourCellRange = 500
-const droneFlightMaxRange = 1250
-
-func prepareDroneGraph(portalsData []portalData, useLongJumps bool, reverseRoute bool) [][]droneFlightNeighbour {
+func prepareDroneGraph(portalsData []portalData, params droneFlightParams, reverseRoute bool) [][]droneFlightNeighbour {
 	cellPortals := make(map[s2.CellID][]portalData)
 	portalCells := make([]s2.CellID, len(portalsData))
 	for _, p := range portalsData {
 		cellId := s2.CellFromPoint(p.LatLng).ID()
-		if cellId.Level() < 16 {
+		if cellId.Level() < params.cellLevel {
 			panic(fmt.Errorf("got cell level: %d", cellId.Level()))
 		}
-		cellId = cellId.Parent(16)
+		cellId = cellId.Parent(params.cellLevel)
 		cellPortals[cellId] = append(cellPortals[cellId], p)
 		portalCells[p.Index] = cellId
 	}
 	neighbours := make([][]droneFlightNeighbour, len(portalsData))
+	keyHeld := make([]bool, len(portalsData))
+	for _, index := range params.keyInventory {
+		keyHeld[index] = true
+	}
 
 	for _, p := range portalsData {
 		cellsInSmallCircle := make(map[s2.CellID]struct{})
 		{
 			// A circle for which we don't require key.
-			circle := s2.CapFromCenterAngle(p.LatLng, s1.Angle(droneFlightNeighbourCellRange/RadiansToMeters))
+			circle := s2.CapFromCenterAngle(p.LatLng, s1.Angle(params.freeMoveRange/RadiansToMeters))
 			cellsInCircle := s2.FloodFillRegionCovering(circle, portalCells[p.Index])
 			for _, cellId := range cellsInCircle {
 				cellsInSmallCircle[cellId] = struct{}{}
@@ -229,9 +452,9 @@ func prepareDroneGraph(portalsData []portalData, useLongJumps bool, reverseRoute
 				}
 			}
 		}
-		if useLongJumps {
+		if params.useLongJumps && params.keyJumpRange > params.freeMoveRange {
 			// We need a key to fly to portals in this larger circle.
-			circle := s2.CapFromCenterAngle(p.LatLng, s1.Angle(droneFlightMaxRange/RadiansToMeters))
+			circle := s2.CapFromCenterAngle(p.LatLng, s1.Angle(params.keyJumpRange/RadiansToMeters))
 			cellsInCircle := s2.FloodFillRegionCovering(circle, portalCells[p.Index])
 			for _, cellId := range cellsInCircle {
 				if _, ok := cellsInSmallCircle[cellId]; ok {
@@ -241,13 +464,13 @@ func prepareDroneGraph(portalsData []portalData, useLongJumps bool, reverseRoute
 					if np.Index == p.Index {
 						continue
 					}
-					if p.LatLng.Distance(np.LatLng) > droneFlightMaxRange/RadiansToMeters {
+					if p.LatLng.Distance(np.LatLng) > s1.Angle(params.keyJumpRange/RadiansToMeters) {
 						continue
 					}
 					if !reverseRoute {
-						neighbours[p.Index] = append(neighbours[p.Index], droneFlightNeighbour{index: np.Index, keyNeeded: true})
+						neighbours[p.Index] = append(neighbours[p.Index], droneFlightNeighbour{index: np.Index, keyNeeded: !keyHeld[np.Index]})
 					} else {
-						neighbours[np.Index] = append(neighbours[np.Index], droneFlightNeighbour{index: p.Index, keyNeeded: true})
+						neighbours[np.Index] = append(neighbours[np.Index], droneFlightNeighbour{index: p.Index, keyNeeded: !keyHeld[np.Index]})
 					}
 				}
 			}
@@ -256,7 +479,7 @@ func prepareDroneGraph(portalsData []portalData, useLongJumps bool, reverseRoute
 	return neighbours
 }
 
-func longestDroneFlightST(portals []Portal, params droneFlightParams) ([]Portal, []Portal) {
+func topDroneFlightsST(ctx context.Context, portals []Portal, numResults int, params droneFlightParams) ([]DroneFlightSolution, error) {
 	if len(portals) < 2 {
 		panic("Too short portal list")
 	}
@@ -271,7 +494,7 @@ func longestDroneFlightST(portals []Portal, params droneFlightParams) ([]Portal,
 		params.startPortalIndex, params.endPortalIndex = params.endPortalIndex, params.startPortalIndex
 	}
 
-	neighbours := prepareDroneGraph(portalsData, params.useLongJumps, reverseRoute)
+	neighbours := prepareDroneGraph(portalsData, params, reverseRoute)
 	portalDistanceInRadians := func(i, j portalIndex) float64 {
 		return distanceSq(portalsData[i], portalsData[j])
 	}
@@ -284,22 +507,22 @@ func longestDroneFlightST(portals []Portal, params droneFlightParams) ([]Portal,
 	indexEntriesFilledModN := 0
 	params.progressFunc(0, numIndexEntries)
 
-	q := newLongestDroneFlightQuery(neighbours, portalDistanceInRadians)
+	q := newLongestDroneFlightQuery(neighbours, portalDistanceInRadians, params.maxKeys)
 
 	// First find most distant pair of portals reachable from one another.
 	// We assume that there is not better solution for a different pair with exactly
 	// the same distance.
-	bestDistance := -1.0
-	bestStart, bestEnd := invalidPortalIndex, invalidPortalIndex
+	top := newTopSolutions(numResults, betterDroneFlight)
+	c := newCancellation(ctx)
 	for _, p := range portalsData {
 		if params.startPortalIndex != invalidPortalIndex && p.Index != params.startPortalIndex {
 			continue
 		}
-		end, distance := q.longestFlightFrom(p.Index, params.endPortalIndex)
-		if end != invalidPortalIndex && distance > bestDistance {
-			bestDistance = distance
-			bestStart, bestEnd = p.Index, end
+		if c.check() {
+			break
 		}
+		end, distance := q.longestFlightFrom(p.Index, params.endPortalIndex)
+		addDroneFlight(top, p.Index, end, distance)
 		indexEntriesFilled++
 		indexEntriesFilledModN++
 		if indexEntriesFilledModN == everyNth {
@@ -307,43 +530,11 @@ func longestDroneFlightST(portals []Portal, params droneFlightParams) ([]Portal,
 			params.progressFunc(indexEntriesFilled, numIndexEntries)
 		}
 	}
-	if bestStart == invalidPortalIndex || bestEnd == invalidPortalIndex {
-		return nil, nil
-	}
-	// Now find the most optimal path between those two portals (in both ways).
-	// It's way faster two split the search into two parts, as the first one
-	// can be calculated using a trivial DFS on the reachability graph using
-	// only a simple FIFO queue instead of priority queue.
-	bestPath, bestKeysNeeded := q.optimalFlight(bestStart, bestEnd, params.optimizeNumKeys)
-	if params.startPortalIndex == invalidPortalIndex {
-		path, keysNeeded := q.optimalFlight(bestEnd, bestStart, params.optimizeNumKeys)
-		if len(path) > 1 {
-			if params.optimizeNumKeys {
-				if len(keysNeeded) < len(bestKeysNeeded) || (len(keysNeeded) == len(bestKeysNeeded) && len(path) < len(bestPath)) {
-					bestPath, bestKeysNeeded = path, keysNeeded
-				}
-			} else {
-				if len(path) < len(bestPath) {
-					bestPath, bestKeysNeeded = path, keysNeeded
-				}
-			}
-		}
+	var err error
+	if c.cancelled {
+		err = cancelledError(ctx)
 	}
+	solutions := droneFlightSolutions(q, portals, top.solutions, params, reverseRoute)
 	params.progressFunc(numIndexEntries, numIndexEntries)
-	if len(bestPath) < 2 {
-		return nil, nil
-	}
-
-	if reverseRoute {
-		reverse(bestPath)
-	}
-	bestPortalPath := []Portal(nil)
-	for i := len(bestPath) - 1; i >= 0; i-- {
-		bestPortalPath = append(bestPortalPath, portals[bestPath[i]])
-	}
-	bestPortalKeysNeeded := []Portal(nil)
-	for _, index := range bestKeysNeeded {
-		bestPortalKeysNeeded = append(bestPortalKeysNeeded, portals[index])
-	}
-	return bestPortalPath, bestPortalKeysNeeded
+	return solutions, err
 }
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"sync"
 )
@@ -11,13 +12,24 @@ type droneFlightResponse struct {
 }
 
 func longestDroneFlightWorker(
+	ctx context.Context,
 	neighbours [][]droneFlightNeighbour,
 	portalDistance func(portalIndex, portalIndex) float64,
+	maxKeys int,
 	targetPortal portalIndex,
 	requestChannel chan portalIndex, responseChannel chan droneFlightResponse,
 	wg *sync.WaitGroup) {
-	q := newLongestDroneFlightQuery(neighbours, portalDistance)
+	q := newLongestDroneFlightQuery(neighbours, portalDistance, maxKeys)
 	for start := range requestChannel {
+		if ctx.Err() != nil {
+			// Just drain the request channel.
+			responseChannel <- droneFlightResponse{
+				start:    start,
+				end:      invalidPortalIndex,
+				distance: -1,
+			}
+			continue
+		}
 		end, distance := q.longestFlightFrom(start, targetPortal)
 		responseChannel <- droneFlightResponse{
 			start:    start,
@@ -28,7 +40,7 @@ func longestDroneFlightWorker(
 	wg.Done()
 }
 
-func longestDroneFlightMT(portals []Portal, params droneFlightParams) ([]Portal, []Portal) {
+func topDroneFlightsMT(ctx context.Context, portals []Portal, numResults int, params droneFlightParams) ([]DroneFlightSolution, error) {
 	if params.numWorkers < 1 {
 		panic(fmt.Errorf("too few workers: %d", params.numWorkers))
 	}
@@ -45,7 +57,7 @@ func longestDroneFlightMT(portals []Portal, params droneFlightParams) ([]Portal,
 		reverseRoute = true
 		params.startPortalIndex, params.endPortalIndex = params.endPortalIndex, params.startPortalIndex
 	}
-	neighbours := prepareDroneGraph(portalsData, params.useLongJumps, reverseRoute)
+	neighbours := prepareDroneGraph(portalsData, params, reverseRoute)
 	portalDistanceInRadians := func(i, j portalIndex) float64 {
 		return distanceSq(portalsData[i], portalsData[j])
 	}
@@ -57,17 +69,21 @@ func longestDroneFlightMT(portals []Portal, params droneFlightParams) ([]Portal,
 	wg.Add(params.numWorkers)
 
 	for i := 0; i < params.numWorkers; i++ {
-		go longestDroneFlightWorker(neighbours, portalDistanceInRadians, params.endPortalIndex,
+		go longestDroneFlightWorker(ctx, neighbours, portalDistanceInRadians, params.maxKeys, params.endPortalIndex,
 			requestChannel, responseChannel, &wg)
 	}
 	go func() {
+		defer close(requestChannel)
 		for _, p := range portalsData {
 			if params.startPortalIndex != invalidPortalIndex && p.Index != params.startPortalIndex {
 				continue
 			}
-			requestChannel <- p.Index
+			select {
+			case requestChannel <- p.Index:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(requestChannel)
 	}()
 	go func() {
 		wg.Wait()
@@ -82,13 +98,9 @@ func longestDroneFlightMT(portals []Portal, params droneFlightParams) ([]Portal,
 	indexEntriesFilledModN := 0
 	params.progressFunc(0, numIndexEntries)
 
-	bestDistance := -1.0
-	bestStart, bestEnd := invalidPortalIndex, invalidPortalIndex
+	top := newTopSolutions(numResults, betterDroneFlight)
 	for resp := range responseChannel {
-		if resp.distance > bestDistance {
-			bestDistance = resp.distance
-			bestStart, bestEnd = resp.start, resp.end
-		}
+		addDroneFlight(top, resp.start, resp.end, resp.distance)
 
 		indexEntriesFilled++
 		indexEntriesFilledModN++
@@ -97,40 +109,12 @@ func longestDroneFlightMT(portals []Portal, params droneFlightParams) ([]Portal,
 			params.progressFunc(indexEntriesFilled, numIndexEntries)
 		}
 	}
-	if bestStart == invalidPortalIndex || bestEnd == invalidPortalIndex {
-		return nil, nil
-	}
-	q := newLongestDroneFlightQuery(neighbours, portalDistanceInRadians)
-	bestPath, bestKeysNeeded := q.optimalFlight(bestStart, bestEnd, params.optimizeNumKeys)
-	if params.startPortalIndex == invalidPortalIndex {
-		path, keysNeeded := q.optimalFlight(bestEnd, bestStart, params.optimizeNumKeys)
-		if len(path) > 1 {
-			if params.optimizeNumKeys {
-				if len(keysNeeded) < len(bestKeysNeeded) || (len(keysNeeded) == len(bestKeysNeeded) && len(path) < len(bestPath)) {
-					bestPath, bestKeysNeeded = path, keysNeeded
-				}
-			} else {
-				if len(path) < len(bestPath) {
-					bestPath, bestKeysNeeded = path, keysNeeded
-				}
-			}
-		}
+	var err error
+	if ctx.Err() != nil {
+		err = cancelledError(ctx)
 	}
+	q := newLongestDroneFlightQuery(neighbours, portalDistanceInRadians, params.maxKeys)
+	solutions := droneFlightSolutions(q, portals, top.solutions, params, reverseRoute)
 	params.progressFunc(numIndexEntries, numIndexEntries)
-	if len(bestPath) < 2 {
-		return nil, nil
-	}
-
-	if reverseRoute {
-		reverse(bestPath)
-	}
-	bestPortalPath := []Portal(nil)
-	for i := len(bestPath) - 1; i >= 0; i-- {
-		bestPortalPath = append(bestPortalPath, portals[bestPath[i]])
-	}
-	bestPortalKeysNeeded := []Portal(nil)
-	for _, index := range bestKeysNeeded {
-		bestPortalKeysNeeded = append(bestPortalKeysNeeded, portals[index])
-	}
-	return bestPortalPath, bestPortalKeysNeeded
+	return solutions, err
 }
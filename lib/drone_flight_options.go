@@ -2,6 +2,13 @@ package lib
 
 import "runtime"
 
+// Drone movement rules of the game.
+const (
+	DefaultDroneFlightFreeMoveRange = 500
+	DefaultDroneFlightKeyJumpRange  = 1250
+	DefaultDroneFlightCellLevel     = 16
+)
+
 type DroneFlightOption interface {
 	apply(params *droneFlightParams)
 }
@@ -43,6 +50,51 @@ func (d DroneFlightLeastKeys) apply(params *droneFlightParams) {
 	params.optimizeNumKeys = true
 }
 
+// DroneFlightFreeMoveRange - in meters, the drone may fly without a key to portals
+// in s2 cells closer than that
+type DroneFlightFreeMoveRange float64
+
+func (d DroneFlightFreeMoveRange) apply(params *droneFlightParams) {
+	params.freeMoveRange = float64(d)
+}
+
+// DroneFlightKeyJumpRange - in meters, with a key the drone may fly to portals closer than that
+type DroneFlightKeyJumpRange float64
+
+func (d DroneFlightKeyJumpRange) apply(params *droneFlightParams) {
+	params.keyJumpRange = float64(d)
+}
+
+// DroneFlightCellLevel - level of the s2 cells used to check the free move range
+type DroneFlightCellLevel int
+
+func (d DroneFlightCellLevel) apply(params *droneFlightParams) {
+	params.cellLevel = int(d)
+}
+
+// DroneFlightKeyInventory - indices of portals whose keys are already held,
+// long jumps to those portals don't need any additional keys
+type DroneFlightKeyInventory []int
+
+func (d DroneFlightKeyInventory) apply(params *droneFlightParams) {
+	params.keyInventory = []int(d)
+}
+
+// DroneFlightMaxKeys - don't make flights needing more additional keys than that,
+// no limit if negative. Flights through waypoints count keys needed in several legs separately.
+type DroneFlightMaxKeys int
+
+func (d DroneFlightMaxKeys) apply(params *droneFlightParams) {
+	params.maxKeys = int(d)
+}
+
+// DroneFlightUnorderedWaypoints - let DroneFlightThroughWaypoints visit the waypoints in any order
+type DroneFlightUnorderedWaypoints bool
+
+func (d DroneFlightUnorderedWaypoints) apply(params *droneFlightParams) {
+	params.unorderedWaypoints = bool(d)
+}
+
 type DroneFlightNumWorkers int
 
 func (d DroneFlightNumWorkers) apply(params *droneFlightParams) {
@@ -56,12 +108,18 @@ func (d DroneFlightProgressFunc) apply(params *droneFlightParams) {
 }
 
 type droneFlightParams struct {
-	progressFunc     func(int, int)
-	numWorkers       int
-	startPortalIndex portalIndex
-	endPortalIndex   portalIndex
-	useLongJumps     bool
-	optimizeNumKeys  bool
+	progressFunc       func(int, int)
+	numWorkers         int
+	startPortalIndex   portalIndex
+	endPortalIndex     portalIndex
+	useLongJumps       bool
+	optimizeNumKeys    bool
+	freeMoveRange      float64
+	keyJumpRange       float64
+	cellLevel          int
+	unorderedWaypoints bool
+	keyInventory       []int
+	maxKeys            int
 }
 
 func defaultDroneFlightParams() droneFlightParams {
@@ -70,6 +128,10 @@ func defaultDroneFlightParams() droneFlightParams {
 		endPortalIndex:   invalidPortalIndex,
 		useLongJumps:     false,
 		optimizeNumKeys:  true,
+		freeMoveRange:    DefaultDroneFlightFreeMoveRange,
+		keyJumpRange:     DefaultDroneFlightKeyJumpRange,
+		cellLevel:        DefaultDroneFlightCellLevel,
+		maxKeys:          -1,
 		numWorkers:       runtime.GOMAXPROCS(0),
 		progressFunc:     func(int, int) {},
 	}
@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang/geo/s2"
+)
+
+// DroneFlightReachablePortal - portal the drone can fly to from the start portal
+type DroneFlightReachablePortal struct {
+	Portal Portal
+	// Previous portal on the optimal flight from the start portal,
+	// the start portal itself in case of the start portal
+	Prev          Portal
+	NumJumps      int
+	NumKeysNeeded int
+}
+
+// DroneFlightReachability - Find all the portals the drone can fly to from the start portal,
+// together with the least keys (or the least jumps) needed to get to each of them, i.e. the tree
+// of optimal flights from the start portal. Respects the DroneFlightMaxKeys limit.
+// The limit is supported only together with DroneFlightLeastKeys, as the least jumps
+// flights to different portals may go through the same portal in different ways (a slower one
+// saving a key for later), so they wouldn't form a tree.
+// The reachable portals are sorted from the ones needing the least keys (or jumps), starting with the start portal.
+// If ctx gets cancelled returns no portals and a *CancelledError.
+func DroneFlightReachability(ctx context.Context, portals []Portal, startPortalIndex int, options ...DroneFlightOption) ([]DroneFlightReachablePortal, error) {
+	params := defaultDroneFlightParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
+	if params.cellLevel < 0 || params.cellLevel > s2.MaxLevel {
+		panic(fmt.Errorf("invalid cell level: %d", params.cellLevel))
+	}
+	if startPortalIndex < 0 || startPortalIndex >= len(portals) {
+		panic(fmt.Errorf("invalid start portal index: %d", startPortalIndex))
+	}
+	if params.maxKeys >= 0 && !params.optimizeNumKeys {
+		return nil, errors.New("drone flight reachability with max keys limit requires the least keys flights")
+	}
+	params.progressFunc(0, 1)
+	portalsData := portalsToPortalData(portals)
+	neighbours := prepareDroneGraph(portalsData, params, false)
+	if ctx.Err() != nil {
+		return nil, cancelledError(ctx)
+	}
+	q := newLongestDroneFlightQuery(neighbours, func(i, j portalIndex) float64 {
+		return distanceSq(portalsData[i], portalsData[j])
+	}, params.maxKeys)
+	flights := q.optimalFlights(portalIndex(startPortalIndex), invalidPortalIndex, params.optimizeNumKeys)
+
+	reachable := []DroneFlightReachablePortal{}
+	costs := []droneFlightCost{}
+	for i, portal := range portals {
+		if !flights.reachable(portalIndex(i)) {
+			continue
+		}
+		item := flights.items[flights.best(portalIndex(i))]
+		prev := portal
+		if item.prev >= 0 {
+			prev = portals[flights.items[item.prev].index]
+		}
+		reachable = append(reachable, DroneFlightReachablePortal{
+			Portal:        portal,
+			Prev:          prev,
+			NumJumps:      item.numJumps,
+			NumKeysNeeded: item.numKeysNeeded,
+		})
+		costs = append(costs, item.cost())
+	}
+	sort.Sort(droneFlightReachablePortals{reachable, costs, params.optimizeNumKeys})
+	params.progressFunc(1, 1)
+	return reachable, nil
+}
+
+type droneFlightReachablePortals struct {
+	portals         []DroneFlightReachablePortal
+	costs           []droneFlightCost
+	optimizeNumKeys bool
+}
+
+func (p droneFlightReachablePortals) Len() int { return len(p.portals) }
+func (p droneFlightReachablePortals) Less(i, j int) bool {
+	return p.costs[i].less(p.costs[j], p.optimizeNumKeys)
+}
+func (p droneFlightReachablePortals) Swap(i, j int) {
+	p.portals[i], p.portals[j] = p.portals[j], p.portals[i]
+	p.costs[i], p.costs[j] = p.costs[j], p.costs[i]
+}
+
+// DroneFlightReachabilityResult - result of DroneFlightReachability as a generic Result.
+// The score is the number of portals reachable from the start portal.
+func DroneFlightReachabilityResult(reachable []DroneFlightReachablePortal) Result {
+	r := Result{Pattern: "drone_flight", Solution: reachable}
+	for _, portal := range reachable {
+		r.addPortals(RoleVertex, []Portal{portal.Portal})
+		if portal.NumJumps > 0 {
+			r.Polylines = append(r.Polylines, []Portal{portal.Prev, portal.Portal})
+		}
+	}
+	r.Score = float64(len(reachable))
+	return r
+}
+
+func geoJSONPosition(portal Portal) []float64 {
+	// GeoJSON coordinates are in lng,lat order.
+	return []float64{portal.LatLng.Lng.Degrees(), portal.LatLng.Lat.Degrees()}
+}
+
+// DroneFlightReachabilityGeoJSON - result of DroneFlightReachability as a GeoJSON FeatureCollection
+// of reachable portals (Point features with the number of jumps and keys needed to get there)
+// and jumps of the optimal flights (LineString features).
+func DroneFlightReachabilityGeoJSON(reachable []DroneFlightReachablePortal) string {
+	var features []geoJSONFeature
+	addFeature := func(id interface{}, geometryType string, coordinates interface{}, properties map[string]interface{}) {
+		coordinatesJSON, err := json.Marshal(coordinates)
+		if err != nil {
+			panic(err)
+		}
+		features = append(features, geoJSONFeature{
+			Type:       "Feature",
+			ID:         id,
+			Geometry:   &geoJSONGeometry{Type: geometryType, Coordinates: coordinatesJSON},
+			Properties: properties,
+		})
+	}
+	for _, portal := range reachable {
+		addFeature(portal.Portal.Guid, "Point", geoJSONPosition(portal.Portal), map[string]interface{}{
+			"guid":        portal.Portal.Guid,
+			"name":        portal.Portal.Name,
+			"jumps":       portal.NumJumps,
+			"keys_needed": portal.NumKeysNeeded,
+		})
+	}
+	for _, portal := range reachable {
+		if portal.NumJumps == 0 {
+			continue
+		}
+		addFeature(nil, "LineString", [][]float64{geoJSONPosition(portal.Prev), geoJSONPosition(portal.Portal)}, map[string]interface{}{
+			"from": portal.Prev.Guid,
+			"to":   portal.Portal.Guid,
+		})
+	}
+	collection := geoJSONObject{
+		geoJSONFeature: geoJSONFeature{Type: "FeatureCollection"},
+		Features:       features,
+	}
+	bytes, err := json.Marshal(collection)
+	if err != nil {
+		panic(err)
+	}
+	return string(bytes)
+}
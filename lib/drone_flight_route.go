@@ -0,0 +1,396 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/geo/s2"
+)
+
+// MaxUnorderedDroneFlightWaypoints - the largest number of waypoints of a drone flight
+// visiting them in any order, including the fixed start and end portals.
+const MaxUnorderedDroneFlightWaypoints = 16
+
+// DroneFlightRoute - drone flight visiting a number of waypoint portals
+type DroneFlightRoute struct {
+	// Waypoints in the order of visiting them
+	Waypoints []Portal
+	// Legs[i] - flight from Waypoints[i] to Waypoints[i+1]
+	Legs []DroneFlightSolution
+}
+
+// Path - portals on the whole route
+func (r DroneFlightRoute) Path() []Portal {
+	var path []Portal
+	for i, leg := range r.Legs {
+		if i > 0 {
+			path = append(path, leg.Path[1:]...)
+		} else {
+			path = append(path, leg.Path...)
+		}
+	}
+	return path
+}
+
+// KeysNeeded - distinct portals whose keys are needed to fly the whole route
+func (r DroneFlightRoute) KeysNeeded() []Portal {
+	var keysNeeded []Portal
+	for _, leg := range r.Legs {
+		for _, key := range leg.KeysNeeded {
+			if !portalIsOnList(key, keysNeeded) {
+				keysNeeded = append(keysNeeded, key)
+			}
+		}
+	}
+	return keysNeeded
+}
+
+func portalIsOnList(portal Portal, list []Portal) bool {
+	for _, p := range list {
+		if portal.Guid == p.Guid {
+			return true
+		}
+	}
+	return false
+}
+
+// UnreachableWaypointError is returned by DroneFlightThroughWaypoints if the drone
+// cannot fly between waypoints.
+type UnreachableWaypointError struct {
+	From, To Portal
+}
+
+func (e *UnreachableWaypointError) Error() string {
+	return fmt.Sprintf("drone cannot fly from \"%s\" to \"%s\"", e.From.Name, e.To.Name)
+}
+
+// TooManyKeysNeededError is returned by DroneFlightThroughWaypoints if the drone
+// cannot visit all the waypoints within the DroneFlightMaxKeys limit.
+type TooManyKeysNeededError struct {
+	MaxKeys int
+}
+
+func (e *TooManyKeysNeededError) Error() string {
+	return fmt.Sprintf("drone cannot visit all the waypoints needing at most %d keys", e.MaxKeys)
+}
+
+type droneFlightLeg struct {
+	// path and keysNeeded are in reverse order, as returned by droneFlights.path
+	path       []portalIndex
+	keysNeeded []portalIndex
+}
+
+func (l droneFlightLeg) cost() droneFlightCost {
+	return droneFlightCost{numKeysNeeded: len(l.keysNeeded), numJumps: len(l.path) - 1}
+}
+
+// legs returns flights to the end portal needing consecutive numbers of keys,
+// each of them needing less jumps than the ones needing fewer keys.
+// Without a limit of keys there is at most one, optimal, flight.
+func (f droneFlights) legs(end portalIndex) []droneFlightLeg {
+	var legs []droneFlightLeg
+	first := int(end) * f.numLayers
+	for state := first; state < first+f.numLayers; state++ {
+		if f.items[state].numKeysNeeded >= f.unreachable {
+			continue
+		}
+		if len(legs) > 0 && legs[len(legs)-1].cost().numJumps <= f.items[state].numJumps {
+			continue
+		}
+		path, keysNeeded := f.pathFrom(state)
+		legs = append(legs, droneFlightLeg{path: path, keysNeeded: keysNeeded})
+	}
+	return legs
+}
+
+// droneFlightRouteLabel - flight visiting a number of waypoints
+type droneFlightRouteLabel struct {
+	cost droneFlightCost
+	// previously visited waypoint, -1 for the first waypoint
+	prev int
+	// index of the label of the flight to the previous waypoint
+	prevLabel int
+	// index of the leg from the previous waypoint
+	leg int
+}
+
+// addRouteLabel adds the label to labels of flights visiting the same waypoints.
+// Without a limit of keys only the best flight is kept, otherwise all the flights within
+// the limit, apart from the ones needing both not fewer keys and not fewer jumps than another one,
+// as keys saved in one leg of the flight may be used in the following ones.
+func addRouteLabel(labels []droneFlightRouteLabel, label droneFlightRouteLabel, params droneFlightParams) []droneFlightRouteLabel {
+	if params.maxKeys < 0 {
+		if len(labels) == 0 || label.cost.less(labels[0].cost, params.optimizeNumKeys) {
+			return append(labels[:0], label)
+		}
+		return labels
+	}
+	if label.cost.numKeysNeeded > params.maxKeys {
+		return labels
+	}
+	for _, l := range labels {
+		if l.cost.numKeysNeeded <= label.cost.numKeysNeeded && l.cost.numJumps <= label.cost.numJumps {
+			return labels
+		}
+	}
+	kept := labels[:0]
+	for _, l := range labels {
+		if l.cost.numKeysNeeded < label.cost.numKeysNeeded || l.cost.numJumps < label.cost.numJumps {
+			kept = append(kept, l)
+		}
+	}
+	return append(kept, label)
+}
+
+// bestRouteLabel returns index of the best of the labels, -1 if there are no labels.
+func bestRouteLabel(labels []droneFlightRouteLabel, optimizeNumKeys bool) int {
+	best := -1
+	for i, label := range labels {
+		if best < 0 || label.cost.less(labels[best].cost, optimizeNumKeys) {
+			best = i
+		}
+	}
+	return best
+}
+
+// DroneFlightThroughWaypoints - Find a drone flight visiting all the waypoints, in the given order
+// or in any order if DroneFlightUnorderedWaypoints is set, requiring the least keys (or the least jumps).
+// Keys needed in several legs of the flight are counted separately in each of them,
+// also when checking the DroneFlightMaxKeys limit.
+// If DroneFlightStartPortalIndex or DroneFlightEndPortalIndex is set the flight
+// starts or ends at the given portal.
+// If the drone cannot visit all the waypoints returns an *UnreachableWaypointError,
+// if it cannot visit them within the DroneFlightMaxKeys limit returns a *TooManyKeysNeededError.
+// If ctx gets cancelled returns an empty route and a *CancelledError.
+func DroneFlightThroughWaypoints(ctx context.Context, portals []Portal, waypointIndices []int, options ...DroneFlightOption) (DroneFlightRoute, error) {
+	params := defaultDroneFlightParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
+	if params.cellLevel < 0 || params.cellLevel > s2.MaxLevel {
+		panic(fmt.Errorf("invalid cell level: %d", params.cellLevel))
+	}
+	waypoints := []portalIndex{}
+	if params.startPortalIndex != invalidPortalIndex {
+		waypoints = append(waypoints, params.startPortalIndex)
+	}
+	for _, index := range waypointIndices {
+		waypoints = append(waypoints, portalIndex(index))
+	}
+	if params.endPortalIndex != invalidPortalIndex {
+		waypoints = append(waypoints, params.endPortalIndex)
+	}
+	if len(waypoints) < 2 {
+		return DroneFlightRoute{}, fmt.Errorf("too short waypoint list: %d", len(waypoints))
+	}
+	if params.unorderedWaypoints && len(waypoints) > MaxUnorderedDroneFlightWaypoints {
+		return DroneFlightRoute{}, fmt.Errorf("too many unordered waypoints: %d", len(waypoints))
+	}
+	portalsData := portalsToPortalData(portals)
+	neighbours := prepareDroneGraph(portalsData, params, false)
+	q := newLongestDroneFlightQuery(neighbours, func(i, j portalIndex) float64 {
+		return distanceSq(portalsData[i], portalsData[j])
+	}, params.maxKeys)
+
+	var order []int
+	var legs []droneFlightLeg
+	var err error
+	if params.unorderedWaypoints {
+		order, legs, err = unorderedDroneFlightRoute(ctx, q, portals, waypoints, params)
+	} else {
+		order, legs, err = orderedDroneFlightRoute(ctx, q, portals, waypoints, params)
+	}
+	if err != nil {
+		return DroneFlightRoute{}, err
+	}
+
+	route := DroneFlightRoute{}
+	for i, waypoint := range order {
+		route.Waypoints = append(route.Waypoints, portals[waypoints[waypoint]])
+		if i == 0 {
+			continue
+		}
+		leg := legs[i-1]
+		solution := DroneFlightSolution{}
+		for j := len(leg.path) - 1; j >= 0; j-- {
+			solution.Path = append(solution.Path, portals[leg.path[j]])
+		}
+		for j := len(leg.keysNeeded) - 1; j >= 0; j-- {
+			solution.KeysNeeded = append(solution.KeysNeeded, portals[leg.keysNeeded[j]])
+		}
+		route.Legs = append(route.Legs, solution)
+	}
+	return route, nil
+}
+
+// orderedDroneFlightRoute finds flights between consecutive waypoints.
+// Returns the order of visiting the waypoints and the legs between them.
+func orderedDroneFlightRoute(ctx context.Context, q *longestDroneFlightQuery, portals []Portal, waypoints []portalIndex, params droneFlightParams) ([]int, []droneFlightLeg, error) {
+	numLegs := len(waypoints) - 1
+	// legs[i] - flights from i-th to (i+1)-th waypoint
+	legs := make([][]droneFlightLeg, numLegs)
+	params.progressFunc(0, numLegs)
+	for i := 1; i < len(waypoints); i++ {
+		if ctx.Err() != nil {
+			return nil, nil, cancelledError(ctx)
+		}
+		legs[i-1] = q.optimalFlights(waypoints[i-1], waypoints[i], params.optimizeNumKeys).legs(waypoints[i])
+		if len(legs[i-1]) == 0 {
+			return nil, nil, &UnreachableWaypointError{
+				From: portals[waypoints[i-1]],
+				To:   portals[waypoints[i]],
+			}
+		}
+		params.progressFunc(i, numLegs)
+	}
+
+	// labels[i] - flights to the i-th waypoint
+	labels := make([][]droneFlightRouteLabel, len(waypoints))
+	labels[0] = []droneFlightRouteLabel{{prev: -1}}
+	for i := 1; i < len(waypoints); i++ {
+		for j, label := range labels[i-1] {
+			for k, leg := range legs[i-1] {
+				labels[i] = addRouteLabel(labels[i], droneFlightRouteLabel{
+					cost:      label.cost.add(leg.cost()),
+					prev:      i - 1,
+					prevLabel: j,
+					leg:       k,
+				}, params)
+			}
+		}
+	}
+	best := bestRouteLabel(labels[numLegs], params.optimizeNumKeys)
+	if best < 0 {
+		return nil, nil, &TooManyKeysNeededError{MaxKeys: params.maxKeys}
+	}
+	order := make([]int, 0, len(waypoints))
+	routeLegs := make([]droneFlightLeg, numLegs)
+	for i := numLegs; i >= 0; i-- {
+		order = append(order, i)
+		label := labels[i][best]
+		if i > 0 {
+			routeLegs[i-1] = legs[i-1][label.leg]
+		}
+		best = label.prevLabel
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order, routeLegs, nil
+}
+
+// unorderedDroneFlightRoute finds flights between all pairs of waypoints and the order
+// of visiting the waypoints minimizing the total cost of the flights, using the
+// Held-Karp dynamic programming algorithm.
+// Returns the order of visiting the waypoints and the legs between them.
+func unorderedDroneFlightRoute(ctx context.Context, q *longestDroneFlightQuery, portals []Portal, waypoints []portalIndex, params droneFlightParams) ([]int, []droneFlightLeg, error) {
+	numWaypoints := len(waypoints)
+	// legs[i][j] - flights from i-th to j-th waypoint
+	legs := make([][][]droneFlightLeg, numWaypoints)
+	params.progressFunc(0, numWaypoints)
+	for i, from := range waypoints {
+		if ctx.Err() != nil {
+			return nil, nil, cancelledError(ctx)
+		}
+		flights := q.optimalFlights(from, invalidPortalIndex, params.optimizeNumKeys)
+		legs[i] = make([][]droneFlightLeg, numWaypoints)
+		for j, to := range waypoints {
+			legs[i][j] = flights.legs(to)
+		}
+		params.progressFunc(i+1, numWaypoints)
+	}
+
+	// labels[set*numWaypoints+last] - flights visiting the set of waypoints, ending at the last one.
+	hasStart := params.startPortalIndex != invalidPortalIndex
+	hasEnd := params.endPortalIndex != invalidPortalIndex
+	numSets := 1 << numWaypoints
+	labels := make([][]droneFlightRouteLabel, numSets*numWaypoints)
+	for i := 0; i < numWaypoints; i++ {
+		if (hasStart && i != 0) || (hasEnd && i == numWaypoints-1) {
+			continue
+		}
+		labels[(1<<i)*numWaypoints+i] = []droneFlightRouteLabel{{prev: -1}}
+	}
+	for set := 1; set < numSets; set++ {
+		for last := 0; last < numWaypoints; last++ {
+			entry := set*numWaypoints + last
+			for next := 0; next < numWaypoints; next++ {
+				if set&(1<<next) != 0 {
+					continue
+				}
+				nextEntry := (set|(1<<next))*numWaypoints + next
+				for j, label := range labels[entry] {
+					for k, leg := range legs[last][next] {
+						labels[nextEntry] = addRouteLabel(labels[nextEntry], droneFlightRouteLabel{
+							cost:      label.cost.add(leg.cost()),
+							prev:      last,
+							prevLabel: j,
+							leg:       k,
+						}, params)
+					}
+				}
+			}
+		}
+	}
+	bestLast, bestLabel := -1, -1
+	for last := 0; last < numWaypoints; last++ {
+		if hasEnd && last != numWaypoints-1 {
+			continue
+		}
+		entryLabels := labels[(numSets-1)*numWaypoints+last]
+		best := bestRouteLabel(entryLabels, params.optimizeNumKeys)
+		if best < 0 {
+			continue
+		}
+		if bestLast < 0 || entryLabels[best].cost.less(labels[(numSets-1)*numWaypoints+bestLast][bestLabel].cost, params.optimizeNumKeys) {
+			bestLast, bestLabel = last, best
+		}
+	}
+	if bestLast < 0 {
+		if pair := unreachableWaypoints(legs); pair != nil {
+			return nil, nil, &UnreachableWaypointError{
+				From: portals[waypoints[pair[0]]],
+				To:   portals[waypoints[pair[1]]],
+			}
+		}
+		return nil, nil, &TooManyKeysNeededError{MaxKeys: params.maxKeys}
+	}
+	order := make([]int, 0, numWaypoints)
+	routeLegs := make([]droneFlightLeg, 0, numWaypoints-1)
+	for set, last, index := numSets-1, bestLast, bestLabel; ; {
+		order = append(order, last)
+		label := labels[set*numWaypoints+last][index]
+		if label.prev < 0 {
+			break
+		}
+		routeLegs = append(routeLegs, legs[label.prev][last][label.leg])
+		set, last, index = set&^(1<<last), label.prev, label.prevLabel
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	for i, j := 0, len(routeLegs)-1; i < j; i, j = i+1, j-1 {
+		routeLegs[i], routeLegs[j] = routeLegs[j], routeLegs[i]
+	}
+	return order, routeLegs, nil
+}
+
+// unreachableWaypoints returns a pair of waypoints preventing from visiting all the waypoints,
+// preferably the one the drone cannot fly between in any direction.
+func unreachableWaypoints(legs [][][]droneFlightLeg) []int {
+	var pair []int
+	for i := range legs {
+		for j := range legs[i] {
+			if len(legs[i][j]) > 0 {
+				continue
+			}
+			if len(legs[j][i]) == 0 {
+				return []int{i, j}
+			}
+			if pair == nil {
+				pair = []int{i, j}
+			}
+		}
+	}
+	return pair
+}
@@ -1,39 +1,39 @@
 package lib
 
 import (
+	"context"
+	"errors"
 	"math"
+	"strings"
 	"testing"
 
 	"github.com/golang/geo/s1"
 	"github.com/golang/geo/s2"
 )
 
-func portalIsOnList(portal Portal, list []Portal) bool {
-	for _, p := range list {
-		if portal.Guid == p.Guid {
-			return true
-		}
-	}
-	return false
-}
 func isCorrectDroneFlight(route, keys []Portal) bool {
+	return isCorrectDroneFlightWithRules(route, keys, DefaultDroneFlightFreeMoveRange, DefaultDroneFlightKeyJumpRange, DefaultDroneFlightCellLevel)
+}
+func isCorrectDroneFlightWithRules(route, keys []Portal, freeMoveRange, keyJumpRange float64, cellLevel int) bool {
 	if len(route) <= 1 {
 		return true
 	}
 	secondPortalCellId := s2.CellIDFromLatLng(route[1].LatLng)
-	if secondPortalCellId.Level() < 16 {
+	if secondPortalCellId.Level() < cellLevel {
 		panic(secondPortalCellId.Level())
 	}
-	secondPortalCellLvl16 := s2.CellFromCellID(secondPortalCellId.Parent(16))
-	distance := secondPortalCellLvl16.Distance(s2.PointFromLatLng(route[0].LatLng)).Angle()
-	if distance > s1.Angle(1250/RadiansToMeters) {
-		return false
-	}
-	if distance > s1.Angle(500/RadiansToMeters) && !portalIsOnList(route[1], keys) {
-		return false
+	secondPortalCell := s2.CellFromCellID(secondPortalCellId.Parent(cellLevel))
+	cellDistance := secondPortalCell.Distance(s2.PointFromLatLng(route[0].LatLng)).Angle()
+	if cellDistance > s1.Angle(freeMoveRange/RadiansToMeters) {
+		if !portalIsOnList(route[1], keys) {
+			return false
+		}
+		if route[0].LatLng.Distance(route[1].LatLng) > s1.Angle(keyJumpRange/RadiansToMeters) {
+			return false
+		}
 	}
 
-	return isCorrectDroneFlight(route[1:], keys)
+	return isCorrectDroneFlightWithRules(route[1:], keys, freeMoveRange, keyJumpRange, cellLevel)
 }
 
 func checkValidDroneFlight(expectedLength float64, route, keys []Portal, t *testing.T) {
@@ -61,7 +61,10 @@ func TestDroneFlight(t *testing.T) {
 	if len(portals) < 2 {
 		t.FailNow()
 	}
-	route, keys := LongestDroneFlight(portals, DroneFlightNumWorkers(1))
+	route, keys, err := LongestDroneFlight(context.Background(), portals, DroneFlightNumWorkers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidDroneFlight(542.555248, route, keys, t)
 }
 
@@ -76,7 +79,10 @@ func TestDroneFlightLeastJumps(t *testing.T) {
 	if len(portals) < 2 {
 		t.FailNow()
 	}
-	route, keys := LongestDroneFlight(portals, DroneFlightNumWorkers(1), DroneFlightLeastJumps{})
+	route, keys, err := LongestDroneFlight(context.Background(), portals, DroneFlightNumWorkers(1), DroneFlightLeastJumps{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidDroneFlight(542.555248, route, keys, t)
 }
 
@@ -91,7 +97,10 @@ func TestDroneFlightFrom(t *testing.T) {
 	if len(portals) < 2 {
 		t.FailNow()
 	}
-	route, keys := LongestDroneFlight(portals, DroneFlightStartPortalIndex(1), DroneFlightNumWorkers(6))
+	route, keys, err := LongestDroneFlight(context.Background(), portals, DroneFlightStartPortalIndex(1), DroneFlightNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if route[0].Guid != portals[1].Guid {
 		t.Errorf("Expected %s as first route portal, got %s", portals[1].Guid, route[0].Guid)
 	}
@@ -109,7 +118,10 @@ func TestDroneFlightTo(t *testing.T) {
 	if len(portals) < 2 {
 		t.FailNow()
 	}
-	route, keys := LongestDroneFlight(portals, DroneFlightEndPortalIndex(2), DroneFlightNumWorkers(6))
+	route, keys, err := LongestDroneFlight(context.Background(), portals, DroneFlightEndPortalIndex(2), DroneFlightNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if route[len(route)-1].Guid != portals[2].Guid {
 		t.Errorf("Expected %s as last route portal, got %s", portals[2].Guid, route[len(route)-1].Guid)
 	}
@@ -127,7 +139,10 @@ func TestDroneFlightFromTo(t *testing.T) {
 	if len(portals) < 2 {
 		t.FailNow()
 	}
-	route, keys := LongestDroneFlight(portals, DroneFlightStartPortalIndex(3), DroneFlightEndPortalIndex(4), DroneFlightNumWorkers(6))
+	route, keys, err := LongestDroneFlight(context.Background(), portals, DroneFlightStartPortalIndex(3), DroneFlightEndPortalIndex(4), DroneFlightNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if route[0].Guid != portals[3].Guid {
 		t.Errorf("Expected %s as first route portal, got %s", portals[3].Guid, route[0].Guid)
 	}
@@ -136,3 +151,270 @@ func TestDroneFlightFromTo(t *testing.T) {
 	}
 	checkValidDroneFlight(139.842564, route, keys, t)
 }
+
+func TestDroneFlightCustomRules(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	if testing.Short() {
+		t.Skip()
+	}
+	route, keys, err := LongestDroneFlight(context.Background(), portals, DroneFlightNumWorkers(1),
+		DroneFlightUseLongJumps(true), DroneFlightFreeMoveRange(300), DroneFlightKeyJumpRange(800), DroneFlightCellLevel(17))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(route) < 2 {
+		t.Fatalf("Expected at least 2 portals in route, got %d", len(route))
+	}
+	if !isCorrectDroneFlightWithRules(route, keys, 300, 800, 17) {
+		t.Errorf("Result is not a correct drone flight route")
+	}
+
+	// With a free move range covering all the portals the flight connects the most distant ones.
+	maxDistance := s1.Angle(0)
+	for i, p0 := range portals {
+		for _, p1 := range portals[i+1:] {
+			if distance := p0.LatLng.Distance(p1.LatLng); distance > maxDistance {
+				maxDistance = distance
+			}
+		}
+	}
+	route, keys, err = LongestDroneFlight(context.Background(), portals, DroneFlightNumWorkers(6),
+		DroneFlightFreeMoveRange(float64(maxDistance)*RadiansToMeters), DroneFlightCellLevel(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(route) != 2 || len(keys) != 0 {
+		t.Errorf("Expected a single jump requiring no keys, got %d portals and %d keys", len(route), len(keys))
+	}
+	if math.Abs(float64(route[0].LatLng.Distance(route[len(route)-1].LatLng)-maxDistance)*RadiansToMeters) > 0.0001 {
+		t.Errorf("Expected flight length %f, got %f", float64(maxDistance)*RadiansToMeters,
+			float64(route[0].LatLng.Distance(route[len(route)-1].LatLng))*RadiansToMeters)
+	}
+}
+
+func checkValidDroneFlightRoute(waypoints []Portal, route DroneFlightRoute, freeMoveRange float64, t *testing.T) {
+	if len(route.Legs) != len(route.Waypoints)-1 {
+		t.Fatalf("Expected %d legs, got %d", len(route.Waypoints)-1, len(route.Legs))
+	}
+	if len(route.Waypoints) != len(waypoints) {
+		t.Fatalf("Expected %d waypoints, got %d", len(waypoints), len(route.Waypoints))
+	}
+	for _, waypoint := range waypoints {
+		if !portalIsOnList(waypoint, route.Waypoints) {
+			t.Errorf("Waypoint %s is not visited", waypoint.Guid)
+		}
+	}
+	for i, leg := range route.Legs {
+		if leg.Path[0].Guid != route.Waypoints[i].Guid || leg.Path[len(leg.Path)-1].Guid != route.Waypoints[i+1].Guid {
+			t.Errorf("Leg %d doesn't connect consecutive waypoints", i)
+		}
+		if !isCorrectDroneFlightWithRules(leg.Path, leg.KeysNeeded, freeMoveRange, DefaultDroneFlightKeyJumpRange, DefaultDroneFlightCellLevel) {
+			t.Errorf("Leg %d is not a correct drone flight route", i)
+		}
+	}
+	if !isCorrectDroneFlightWithRules(route.Path(), route.KeysNeeded(), freeMoveRange, DefaultDroneFlightKeyJumpRange, DefaultDroneFlightCellLevel) {
+		t.Errorf("Result is not a correct drone flight route")
+	}
+}
+
+func TestDroneFlightThroughWaypoints(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	// Portals at the edges of the test area, far from one another given the short free move range.
+	waypointIndices := []int{66, 53, 88, 94}
+	waypoints := []Portal{}
+	for _, index := range waypointIndices {
+		waypoints = append(waypoints, portals[index])
+	}
+	ordered, err := DroneFlightThroughWaypoints(context.Background(), portals, waypointIndices,
+		DroneFlightFreeMoveRange(60), DroneFlightLeastJumps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidDroneFlightRoute(waypoints, ordered, 60, t)
+	checkSamePortals("ordered waypoints", waypoints, ordered.Waypoints, t)
+
+	unordered, err := DroneFlightThroughWaypoints(context.Background(), portals, waypointIndices[1:],
+		DroneFlightFreeMoveRange(60), DroneFlightLeastJumps{}, DroneFlightUnorderedWaypoints(true), DroneFlightStartPortalIndex(66))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidDroneFlightRoute(waypoints, unordered, 60, t)
+	if unordered.Waypoints[0].Guid != portals[66].Guid {
+		t.Errorf("Expected %s as first route portal, got %s", portals[66].Guid, unordered.Waypoints[0].Guid)
+	}
+	if len(unordered.Path()) >= len(ordered.Path()) {
+		t.Errorf("Expected flight through unordered waypoints to be shorter than %d jumps, got %d", len(ordered.Path())-1, len(unordered.Path())-1)
+	}
+
+	_, err = DroneFlightThroughWaypoints(context.Background(), portals, waypointIndices, DroneFlightFreeMoveRange(0))
+	var unreachableErr *UnreachableWaypointError
+	if !errors.As(err, &unreachableErr) {
+		t.Errorf("Expected unreachable waypoint error, got %v", err)
+	}
+}
+
+func TestDroneFlightThroughWaypointsMaxKeys(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	// Short free move range, so that every leg of the flight needs keys.
+	options := []DroneFlightOption{
+		DroneFlightUseLongJumps(true), DroneFlightLeastJumps{},
+		DroneFlightFreeMoveRange(5), DroneFlightKeyJumpRange(200)}
+	waypointIndices := []int{66, 53, 88, 94}
+	legKeys := func(route DroneFlightRoute) int {
+		numKeys := 0
+		for _, leg := range route.Legs {
+			numKeys += len(leg.KeysNeeded)
+		}
+		return numKeys
+	}
+	for _, unordered := range []bool{false, true} {
+		unlimited, err := DroneFlightThroughWaypoints(context.Background(), portals, waypointIndices, append(options, DroneFlightUnorderedWaypoints(unordered))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numKeys := legKeys(unlimited)
+		for maxKeys := 0; maxKeys <= numKeys; maxKeys++ {
+			route, err := DroneFlightThroughWaypoints(context.Background(), portals, waypointIndices,
+				append(options, DroneFlightUnorderedWaypoints(unordered), DroneFlightMaxKeys(maxKeys))...)
+			var unreachableErr *UnreachableWaypointError
+			var tooManyKeysErr *TooManyKeysNeededError
+			if errors.As(err, &unreachableErr) || errors.As(err, &tooManyKeysErr) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if legKeys(route) > maxKeys || !isCorrectDroneFlightWithRules(route.Path(), route.KeysNeeded(), 5, 200, DefaultDroneFlightCellLevel) {
+				t.Errorf("Expected a correct flight needing at most %d keys, got %d keys", maxKeys, legKeys(route))
+			}
+			if len(route.Path()) < len(unlimited.Path()) {
+				t.Errorf("Expected flight needing at most %d keys not shorter than %d jumps, got %d", maxKeys, len(unlimited.Path())-1, len(route.Path())-1)
+			}
+		}
+	}
+
+	// Every leg can be flown with 2 keys, but not all of them together.
+	_, err = DroneFlightThroughWaypoints(context.Background(), portals, waypointIndices, append(options, DroneFlightMaxKeys(2))...)
+	var tooManyKeysErr *TooManyKeysNeededError
+	if !errors.As(err, &tooManyKeysErr) {
+		t.Errorf("Expected too many keys needed error, got %v", err)
+	}
+}
+
+func TestDroneFlightKeyInventoryAndMaxKeys(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	// Short ranges, so that the flight between portals at the edges of the test area needs keys.
+	options := []DroneFlightOption{
+		DroneFlightNumWorkers(1), DroneFlightUseLongJumps(true), DroneFlightLeastJumps{},
+		DroneFlightFreeMoveRange(20), DroneFlightKeyJumpRange(200),
+		DroneFlightStartPortalIndex(66), DroneFlightEndPortalIndex(94)}
+	isCorrect := func(route, keys []Portal) bool {
+		return isCorrectDroneFlightWithRules(route, keys, 20, 200, DefaultDroneFlightCellLevel)
+	}
+	route, keys, err := LongestDroneFlight(context.Background(), portals, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) < 2 || !isCorrect(route, keys) {
+		t.Fatalf("Expected a correct flight needing at least 2 keys, got %d keys", len(keys))
+	}
+
+	// Held keys don't need to be obtained.
+	inventory := []int{}
+	for i, portal := range portals {
+		if portalIsOnList(portal, keys) {
+			inventory = append(inventory, i)
+		}
+	}
+	heldRoute, heldKeys, err := LongestDroneFlight(context.Background(), portals, append(options, DroneFlightKeyInventory(inventory))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heldKeys) != 0 || len(heldRoute) != len(route) || !isCorrect(heldRoute, keys) {
+		t.Errorf("Expected a flight of %d jumps needing no more keys, got %d jumps needing %d keys", len(route)-1, len(heldRoute)-1, len(heldKeys))
+	}
+
+	for maxKeys := 0; maxKeys < len(keys); maxKeys++ {
+		limitedRoute, limitedKeys, err := LongestDroneFlight(context.Background(), portals, append(options, DroneFlightMaxKeys(maxKeys))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(limitedKeys) > maxKeys || !isCorrect(limitedRoute, limitedKeys) {
+			t.Errorf("Expected a correct flight needing at most %d keys, got %d keys", maxKeys, len(limitedKeys))
+		}
+		if len(limitedRoute) <= len(route) {
+			t.Errorf("Expected flight needing at most %d keys to be longer than %d jumps, got %d", maxKeys, len(route)-1, len(limitedRoute)-1)
+		}
+	}
+}
+
+func TestDroneFlightReachability(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	options := []DroneFlightOption{
+		DroneFlightNumWorkers(1), DroneFlightUseLongJumps(true), DroneFlightFreeMoveRange(5), DroneFlightKeyJumpRange(200)}
+	reachable, err := DroneFlightReachability(context.Background(), portals, 66, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reachable) != len(portals) {
+		t.Fatalf("Expected all %d portals to be reachable, got %d", len(portals), len(reachable))
+	}
+	if reachable[0].Portal.Guid != portals[66].Guid || reachable[0].NumJumps != 0 || reachable[0].NumKeysNeeded != 0 {
+		t.Errorf("Expected the start portal first, got %v", reachable[0])
+	}
+	for i, portal := range portals {
+		if i == 66 {
+			continue
+		}
+		route, keys, err := LongestDroneFlight(context.Background(), portals, append(options, DroneFlightStartPortalIndex(66), DroneFlightEndPortalIndex(i))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range reachable {
+			if r.Portal.Guid == portal.Guid && (r.NumJumps != len(route)-1 || r.NumKeysNeeded != len(keys)) {
+				t.Errorf("Expected portal %s to need %d jumps and %d keys, got %d jumps and %d keys",
+					portal.Guid, len(route)-1, len(keys), r.NumJumps, r.NumKeysNeeded)
+			}
+		}
+	}
+
+	withoutKeys, err := DroneFlightReachability(context.Background(), portals, 66, append(options, DroneFlightMaxKeys(0))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withoutKeys) == 0 || len(withoutKeys) >= len(reachable) {
+		t.Errorf("Expected fewer than %d portals reachable without keys, got %d", len(reachable), len(withoutKeys))
+	}
+	for _, r := range withoutKeys {
+		if r.NumKeysNeeded != 0 {
+			t.Errorf("Expected portal %s reachable without keys, got %d keys", r.Portal.Guid, r.NumKeysNeeded)
+		}
+	}
+
+	if _, err := DroneFlightReachability(context.Background(), portals, 66, append(options, DroneFlightLeastJumps{}, DroneFlightMaxKeys(0))...); err == nil {
+		t.Errorf("Expected an error of reachability of the least jumps flights with max keys limit")
+	}
+
+	geoJSONPortals, err := parseGeoJSONAsPortalInfo(strings.NewReader(DroneFlightReachabilityGeoJSON(withoutKeys)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(geoJSONPortals) != len(withoutKeys) {
+		t.Errorf("Expected %d portals in GeoJSON, got %d", len(withoutKeys), len(geoJSONPortals))
+	}
+}
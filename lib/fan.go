@@ -0,0 +1,254 @@
+package lib
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// FanSolution - fan field of fields between the anchor and consecutive fan portals
+type FanSolution struct {
+	Anchor Portal
+	// Fan portals in counter clockwise order around the anchor
+	Fan []Portal
+}
+
+type fanCandidate struct {
+	anchor portalIndex
+	fan    []portalIndex
+	cost   float64
+}
+
+func betterFan(a, b fanCandidate) bool {
+	return len(a.fan) > len(b.fan) || (len(a.fan) == len(b.fan) && a.cost < b.cost)
+}
+
+type bestFanQuery struct {
+	portals []portalData
+	links   linkFilter
+	fields  fieldSizeFilter
+	// preallocated storage of the search for a single anchor
+	fanPortals []portalData
+	angles     []float64
+	// triangle[i*len(fanPortals)+j] - whether fan portals i and j can make a field with the anchor
+	triangle []bool
+	length   []int
+	prev     []int
+	// cost[i] - total cost of the portals of the fan ending with i-th fan portal
+	cost []float64
+	// costs of the portals, nil if none of them has a cost
+	costs []float64
+}
+
+func newBestFanQuery(portals []portalData, links linkFilter, fields fieldSizeFilter, costs []float64) *bestFanQuery {
+	return &bestFanQuery{
+		portals: portals,
+		links:   links,
+		fields:  fields,
+		costs:   costs,
+	}
+}
+
+func (q *bestFanQuery) portalCost(i int) float64 {
+	if q.costs == nil {
+		return 0
+	}
+	return q.costs[q.fanPortals[i].Index]
+}
+
+// prepareAnchor sorts portals which may be linked with the anchor by their angle around it.
+func (q *bestFanQuery) prepareAnchor(anchor portalData) {
+	q.fanPortals = q.fanPortals[:0]
+	for _, portal := range q.portals {
+		if portal.Index != anchor.Index && q.links.allowed(anchor.Index, portal.Index) {
+			q.fanPortals = append(q.fanPortals, portal)
+		}
+	}
+	// Angles in the plane tangent to the sphere at the anchor.
+	u := anchor.LatLng.Ortho()
+	v := anchor.LatLng.Vector.Cross(u)
+	angle := func(p portalData) float64 {
+		return math.Atan2(p.LatLng.Dot(v), p.LatLng.Dot(u))
+	}
+	sort.Slice(q.fanPortals, func(i, j int) bool {
+		return angle(q.fanPortals[i]) < angle(q.fanPortals[j])
+	})
+	numFanPortals := len(q.fanPortals)
+	q.angles = q.angles[:0]
+	for _, portal := range q.fanPortals {
+		q.angles = append(q.angles, angle(portal))
+	}
+	if cap(q.triangle) < numFanPortals*numFanPortals {
+		q.triangle = make([]bool, numFanPortals*numFanPortals)
+		q.length = make([]int, numFanPortals)
+		q.prev = make([]int, numFanPortals)
+		q.cost = make([]float64, numFanPortals)
+	}
+	q.triangle = q.triangle[:numFanPortals*numFanPortals]
+	for i, p0 := range q.fanPortals {
+		for j, p1 := range q.fanPortals {
+			q.triangle[i*numFanPortals+j] = i != j &&
+				q.links.allowed(p0.Index, p1.Index) && q.fields.allowed(anchor, p0, p1)
+		}
+	}
+}
+
+// angleBetween returns the counter clockwise angle from i-th to j-th fan portal.
+func (q *bestFanQuery) angleBetween(i, j int) float64 {
+	angle := q.angles[j] - q.angles[i]
+	if angle < 0 {
+		angle += 2 * math.Pi
+	}
+	return angle
+}
+
+// findBestFan returns the longest fan starting at the start-th fan portal,
+// going counter clockwise around the anchor, the cheapest one among equally long ones.
+func (q *bestFanQuery) findBestFan(start int, result []portalIndex) []portalIndex {
+	numFanPortals := len(q.fanPortals)
+	bestEnd := start
+	q.length[start] = 1
+	q.cost[start] = q.portalCost(start)
+	for jj := 1; jj < numFanPortals; jj++ {
+		j := (start + jj) % numFanPortals
+		q.length[j] = 0
+		startAngle := q.angleBetween(start, j)
+		if startAngle == 0 {
+			// Portals in the same direction as the first one can't be part of the fan.
+			continue
+		}
+		for ii := 0; ii < jj; ii++ {
+			i := (start + ii) % numFanPortals
+			if q.length[i] == 0 || q.length[i]+1 < q.length[j] || !q.triangle[i*numFanPortals+j] {
+				continue
+			}
+			cost := q.cost[i] + q.portalCost(j)
+			if q.length[i]+1 == q.length[j] && cost >= q.cost[j] {
+				continue
+			}
+			// Field must be a proper triangle, on the counter clockwise side of the previous one.
+			if angle := startAngle - q.angleBetween(start, i); angle <= 0 || angle >= math.Pi {
+				continue
+			}
+			q.length[j] = q.length[i] + 1
+			q.prev[j] = i
+			q.cost[j] = cost
+		}
+		if q.length[j] > q.length[bestEnd] || (q.length[j] == q.length[bestEnd] && q.cost[j] < q.cost[bestEnd]) {
+			bestEnd = j
+		}
+	}
+	result = result[:0]
+	for i := bestEnd; ; i = q.prev[i] {
+		result = append(result, q.fanPortals[i].Index)
+		if i == start {
+			break
+		}
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// LargestFan - Find largest fan field, i.e. fields between an anchor portal and
+// consecutive pairs of fan portals ordered by their direction from the anchor.
+// If fixedAnchorIndices are given the anchor is one of them.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError.
+func LargestFan(ctx context.Context, portals []Portal, fixedAnchorIndices []int, progressFunc func(int, int), options ...FanOption) (Portal, []Portal, error) {
+	results, err := TopFans(ctx, portals, fixedAnchorIndices, 1, progressFunc, options...)
+	if len(results) == 0 {
+		return Portal{}, []Portal{}, err
+	}
+	return results[0].Anchor, results[0].Fan, err
+}
+
+// TopFans - Find up to numResults largest fans having distinct sets of portals,
+// sorted from the largest one. Errors are reported the same way as by LargestFan.
+func TopFans(ctx context.Context, portals []Portal, fixedAnchorIndices []int, numResults int, progressFunc func(int, int), options ...FanOption) ([]FanSolution, error) {
+	if len(portals) < 3 {
+		panic("Too short portal list")
+	}
+	params := defaultFanParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
+	portalsData := portalsToPortalData(portals)
+	links := newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength)
+	costs := portalCosts(portals)
+	q := newBestFanQuery(portalsData, links, newFieldSizeFilter(params.minFieldSize), costs)
+
+	minCost := minTotalCost(costs)
+	top := newTopSolutions(numResults, betterFan)
+	c := newCancellation(ctx)
+	var fan []portalIndex
+	progressFunc(0, len(portals))
+mainLoop:
+	for i, anchor := range portalsData {
+		progressFunc(i, len(portals))
+		if len(fixedAnchorIndices) > 0 && !sliceContains(fixedAnchorIndices, i) {
+			continue
+		}
+		q.prepareAnchor(anchor)
+		maxLength := len(q.fanPortals)
+		if params.maxOutboundLinks > 0 {
+			maxLength = min(maxLength, params.maxOutboundLinks)
+		}
+		// The largest possible fan of this anchor, with the lowest possible cost.
+		upperBound := fanCandidate{anchor: anchor.Index, fan: make([]portalIndex, maxLength), cost: minCost}
+		for start := range q.fanPortals {
+			if c.check() {
+				break mainLoop
+			}
+			if !top.accepts(upperBound) {
+				break
+			}
+			fan = q.findBestFan(start, fan)
+			if len(fan) < 2 {
+				continue
+			}
+			if len(fan) > maxLength {
+				fan = fan[:maxLength]
+			}
+			candidate := fanCandidate{anchor: anchor.Index, fan: fan, cost: minCost}
+			if !top.accepts(candidate) {
+				continue
+			}
+			candidate.fan = append([]portalIndex{}, fan...)
+			fanPortals := append([]portalIndex{anchor.Index}, fan...)
+			candidate.cost = totalCost(costs, fanPortals)
+			top.add(candidate, fanPortals)
+		}
+	}
+	progressFunc(len(portals), len(portals))
+
+	var err error
+	if c.cancelled {
+		err = cancelledError(ctx)
+	}
+	results := make([]FanSolution, 0, len(top.solutions))
+	for _, candidate := range top.solutions {
+		solution := FanSolution{Anchor: portals[candidate.anchor]}
+		for _, portal := range candidate.fan {
+			solution.Fan = append(solution.Fan, portals[portal])
+		}
+		results = append(results, solution)
+	}
+	return results, err
+}
+
+// FanPolylines - links of a fan as a polyline connecting consecutive fan portals,
+// and polylines from the anchor to each of the fan portals.
+func FanPolylines(anchor Portal, fan []Portal) [][]Portal {
+	if len(fan) == 0 {
+		return nil
+	}
+	polylines := [][]Portal{fan}
+	for _, portal := range fan {
+		polylines = append(polylines, []Portal{anchor, portal})
+	}
+	return polylines
+}
+func FanDrawToolsString(anchor Portal, fan []Portal) string {
+	return FanResult(anchor, fan).DrawToolsString()
+}
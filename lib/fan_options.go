@@ -0,0 +1,52 @@
+package lib
+
+type FanOption interface {
+	apply(params *fanParams)
+}
+
+type FanBlockers []Segment
+
+func (f FanBlockers) apply(params *fanParams) {
+	params.blockers = []Segment(f)
+}
+
+type FanDisabledPortals []Portal
+
+func (f FanDisabledPortals) apply(params *fanParams) {
+	params.disabledPortals = []Portal(f)
+}
+
+// FanMaxLinkLength - don't make links longer than that many meters
+type FanMaxLinkLength float64
+
+func (f FanMaxLinkLength) apply(params *fanParams) {
+	params.maxLinkLength = float64(f)
+}
+
+// FanMinFieldSize - don't make fields smaller than that
+type FanMinFieldSize FieldSize
+
+func (f FanMinFieldSize) apply(params *fanParams) {
+	params.minFieldSize = FieldSize(f)
+}
+
+// FanMaxOutboundLinks - limit of links thrown from the anchor portal, which is
+// also the limit of portals of the fan, 0 means no limit
+type FanMaxOutboundLinks int
+
+func (f FanMaxOutboundLinks) apply(params *fanParams) {
+	params.maxOutboundLinks = int(f)
+}
+
+type fanParams struct {
+	blockers        []Segment
+	disabledPortals []Portal
+	maxLinkLength   float64
+	minFieldSize    FieldSize
+	// 0 means no limit
+	maxOutboundLinks int
+}
+
+func defaultFanParams() fanParams {
+	return fanParams{}
+}
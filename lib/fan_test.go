@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"context"
+	"testing"
+)
+
+func checkValidFanResult(name string, anchor Portal, fan []Portal, t *testing.T) {
+	plan, err := FanPlan(anchor, fan)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if plan.NumFields() != len(fan)-1 {
+		t.Errorf("%s: expected plan of fan of %d portals to make %d fields, got %d", name, len(fan), len(fan)-1, plan.NumFields())
+	}
+	if keys := PlanKeys(plan); len(fan) > 0 && (keys[0].Portal.Guid != anchor.Guid || keys[0].OutboundLinks != len(fan)) {
+		t.Errorf("%s: expected anchor to throw %d links, got %d", name, len(fan), keys[0].OutboundLinks)
+	}
+}
+
+func TestFan(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:30]
+	anchor, fan, err := LargestFan(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidFanResult("fan", anchor, fan, t)
+
+	// A portal lying inside the convex hull of the others can be anchor of a fan of all of them.
+	onHull := make(map[portalIndex]struct{})
+	for _, portal := range convexHull(portalsToPortalData(portals)) {
+		onHull[portal.Index] = struct{}{}
+	}
+	insideIndex := -1
+	for i := range portals {
+		if _, ok := onHull[portalIndex(i)]; !ok {
+			insideIndex = i
+			break
+		}
+	}
+	anchor, fan, err = LargestFan(context.Background(), portals, []int{insideIndex}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidFanResult("fan with anchor", anchor, fan, t)
+	if anchor.Guid != portals[insideIndex].Guid {
+		t.Errorf("Expected anchor %s, got %s", portals[insideIndex].Name, anchor.Name)
+	}
+	if len(fan) != len(portals)-1 {
+		t.Errorf("Expected fan of %d portals, got %d", len(portals)-1, len(fan))
+	}
+
+	// With two fixed anchors the anchor is either of them.
+	anchors := []int{(insideIndex + 1) % len(portals), insideIndex}
+	anchor, fan, err = LargestFan(context.Background(), portals, anchors, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidFanResult("fan with two anchors", anchor, fan, t)
+	if anchor.Guid != portals[anchors[0]].Guid && anchor.Guid != portals[anchors[1]].Guid {
+		t.Errorf("Expected anchor %s or %s, got %s", portals[anchors[0]].Name, portals[anchors[1]].Name, anchor.Name)
+	}
+	if len(fan) != len(portals)-1 {
+		t.Errorf("Expected fan of %d portals, got %d", len(portals)-1, len(fan))
+	}
+}
+
+func TestFanMaxOutboundLinks(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:30]
+	anchor, fan, err := LargestFan(context.Background(), portals, []int{}, func(int, int) {}, FanMaxOutboundLinks(MaxOutboundLinks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidFanResult("fan with outbound link limit", anchor, fan, t)
+	if len(fan) != MaxOutboundLinks {
+		t.Errorf("Expected fan of %d portals, got %d", MaxOutboundLinks, len(fan))
+	}
+}
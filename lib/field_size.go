@@ -0,0 +1,46 @@
+package lib
+
+import "github.com/golang/geo/s1"
+
+// FieldSize - lower limit of the size of every field of a pattern, zero means no limit
+type FieldSize struct {
+	// Area in square meters
+	Area float64
+	// Height in meters, the shortest of the three heights of the field
+	Height float64
+}
+
+// fieldSizeFilter tells which fields are large enough to be made.
+// Both the area and the shortest height of a triangle are never larger
+// than those of a triangle containing it, so checking the innermost fields
+// of nested patterns is enough.
+type fieldSizeFilter struct {
+	// area in steradians
+	minArea float64
+	// height in radians
+	minHeight float64
+}
+
+func newFieldSizeFilter(size FieldSize) fieldSizeFilter {
+	return fieldSizeFilter{
+		minArea:   size.Area / (RadiansToMeters * RadiansToMeters),
+		minHeight: size.Height / RadiansToMeters,
+	}
+}
+
+func (f fieldSizeFilter) allowed(a, b, c portalData) bool {
+	if f.minArea <= 0 && f.minHeight <= 0 {
+		return true
+	}
+	area := triangleArea(a, b, c)
+	if area < f.minArea {
+		return false
+	}
+	if f.minHeight > 0 {
+		longestSide := max(max(a.LatLng.Distance(b.LatLng), b.LatLng.Distance(c.LatLng)), c.LatLng.Distance(a.LatLng))
+		if longestSide == s1.Angle(0) || 2*area/longestSide.Radians() < f.minHeight {
+			return false
+		}
+	}
+	return true
+}
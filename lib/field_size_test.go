@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+var testMinFieldSize = FieldSize{Area: 3000, Height: 30}
+
+func checkFieldSizes(name string, plan Plan, err error, minSize FieldSize, t *testing.T) {
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if plan.NumFields() == 0 {
+		t.Errorf("%s: expected a non empty plan", name)
+	}
+	filter := newFieldSizeFilter(minSize)
+	for _, step := range plan.Steps {
+		for _, field := range step.Fields {
+			data := portalsToPortalData(field[:])
+			if !filter.allowed(data[0], data[1], data[2]) {
+				t.Errorf("%s: field %s,%s,%s is too small", name, field[0].Guid, field[1].Guid, field[2].Guid)
+			}
+		}
+	}
+}
+
+func TestMinFieldSize(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:30]
+	unlimited, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cobweb, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {}, CobwebMinFieldSize(testMinFieldSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cobweb) >= len(unlimited) {
+		t.Errorf("Expected the field size limit to shorten the cobweb, got lengths %d and %d", len(unlimited), len(cobweb))
+	}
+	plan, err := CobwebPlan(cobweb)
+	checkFieldSizes("cobweb", plan, err, testMinFieldSize, t)
+
+	b0, b1, backbone, err := LargestHerringbone(context.Background(), portals, []int{}, 1, func(int, int) {}, HerringboneMinFieldSize(testMinFieldSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = HerringbonePlan(b0, b1, backbone)
+	checkFieldSizes("herringbone", plan, err, testMinFieldSize, t)
+
+	threeCorners, err := LargestThreeCorner(context.Background(), portals[:10], portals[10:20], portals[20:], func(int, int) {}, ThreeCornersMinFieldSize(testMinFieldSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = ThreeCornersPlan(threeCorners)
+	checkFieldSizes("three corners", plan, err, testMinFieldSize, t)
+
+	for _, option := range []HomogeneousOption{HomogeneousPure(false), HomogeneousPure(true), HomogeneousSpreadAround{}} {
+		result, depth, err := DeepestHomogeneous(context.Background(), portals, option, HomogeneousMinFieldSize(testMinFieldSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := HomogeneousPlan(depth, result)
+		checkFieldSizes(fmt.Sprintf("homogeneous %T", option), plan, err, testMinFieldSize, t)
+	}
+}
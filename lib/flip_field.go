@@ -1,19 +1,177 @@
 package lib
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/golang/geo/s2"
 )
 
-// LargestFlipField -
-func LargestFlipField(portals []Portal, options ...FlipFieldOption) ([]Portal, []Portal) {
+// LargestFlipField - Find flip field with the largest number of fields.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError.
+func LargestFlipField(ctx context.Context, portals []Portal, options ...FlipFieldOption) ([]Portal, []Portal, error) {
+	results, err := TopFlipFields(ctx, portals, 1, options...)
+	return firstFlipFieldSolution(results, err)
+}
+
+// FlipFieldSolution - flip field consisting of a backbone and portals to be flipped
+type FlipFieldSolution struct {
+	Backbone    []Portal
+	FlipPortals []Portal
+}
+
+// TopFlipFields - Find up to numResults flip fields with the largest number of fields
+// having distinct sets of portals, sorted from the largest one.
+// If ctx gets cancelled returns the best solutions found so far and a *CancelledError.
+func TopFlipFields(ctx context.Context, portals []Portal, numResults int, options ...FlipFieldOption) ([]FlipFieldSolution, error) {
 	params := defaultFlipFieldParams()
 	for _, option := range options {
 		option.apply(&params)
 	}
+	if params.maxFlipPortals > 0 && len(params.forcedFlipPortalIndices) > params.maxFlipPortals {
+		panic(fmt.Errorf("more forced flip portals than the max flip portals: %d > %d", len(params.forcedFlipPortalIndices), params.maxFlipPortals))
+	}
+	for _, i := range params.forcedFlipPortalIndices {
+		if sliceContains(params.excludedFlipPortalIndices, i) || sliceContains(params.fixedBaseIndices, i) {
+			panic(fmt.Errorf("forced flip portal %d is also excluded from flipping or fixed as a base portal", i))
+		}
+	}
 	if params.numWorkers == 1 {
-		return LargestFlipFieldST(portals, params)
+		return topFlipFieldsST(ctx, portals, numResults, params)
+	}
+	return topFlipFieldsMT(ctx, portals, numResults, params)
+}
+
+func firstFlipFieldSolution(results []FlipFieldSolution, err error) ([]Portal, []Portal, error) {
+	if len(results) == 0 {
+		return []Portal{}, []Portal{}, err
+	}
+	return results[0].Backbone, results[0].FlipPortals, err
+}
+
+type flipFieldCandidate struct {
+	backbone       []portalIndex
+	flipPortals    []portalIndex
+	numFields      int
+	cost           float64
+	backboneLength float64
+}
+
+// betterFlipField compares flip fields by the number of fields, then by cost, then by
+// backbone length. The backbone is extended greedily without looking at the costs,
+// so the cost decides just between flip fields grown from different base portals.
+func betterFlipField(a, b flipFieldCandidate) bool {
+	if a.numFields != b.numFields {
+		return a.numFields > b.numFields
+	}
+	if a.cost != b.cost {
+		return a.cost < b.cost
+	}
+	return a.backboneLength < b.backboneLength
+}
+
+// addFlipField adds a copy of the flip field to the top solutions.
+func addFlipField(top *topSolutions[flipFieldCandidate], costs []float64, backbone, flipPortals []portalData, numFields int, backboneLength float64) {
+	if numFields == 0 {
+		return
+	}
+	candidate := flipFieldCandidate{numFields: numFields, backboneLength: backboneLength}
+	if costs != nil {
+		for _, p := range backbone {
+			candidate.cost += costs[p.Index]
+		}
+		for _, p := range flipPortals {
+			candidate.cost += costs[p.Index]
+		}
+	}
+	if !top.accepts(candidate) {
+		return
+	}
+	for _, p := range backbone {
+		candidate.backbone = append(candidate.backbone, p.Index)
+	}
+	for _, p := range flipPortals {
+		candidate.flipPortals = append(candidate.flipPortals, p.Index)
+	}
+	top.add(candidate, append(append([]portalIndex(nil), candidate.backbone...), candidate.flipPortals...))
+}
+
+// flipFieldPruningThreshold returns the number of fields below which a flip field
+// can't become one of the top solutions.
+func flipFieldPruningThreshold(top *topSolutions[flipFieldCandidate]) int {
+	if len(top.solutions) < top.numSolutions {
+		return 0
 	}
-	return LargestFlipFieldMT(portals, params)
+	return top.solutions[len(top.solutions)-1].numFields
+}
+
+func flipFieldSolutions(portals []Portal, candidates []flipFieldCandidate) []FlipFieldSolution {
+	solutions := make([]FlipFieldSolution, 0, len(candidates))
+	for _, candidate := range candidates {
+		backbone := make([]Portal, 0, len(candidate.backbone))
+		for _, portalIx := range candidate.backbone {
+			backbone = append(backbone, portals[portalIx])
+		}
+		flipPortals := make([]Portal, 0, len(candidate.flipPortals))
+		for _, portalIx := range candidate.flipPortals {
+			flipPortals = append(flipPortals, portals[portalIx])
+		}
+		solutions = append(solutions, FlipFieldSolution{Backbone: backbone, FlipPortals: flipPortals})
+	}
+	return solutions
+}
+
+// flipPortalRules - portals which must or must not be flip portals
+type flipPortalRules struct {
+	forced []portalData
+	// excluded[i] - portal i must not be flipped, nil if no portal is excluded
+	excluded []bool
+}
+
+func newFlipPortalRules(portals []portalData, params flipFieldParams) flipPortalRules {
+	rules := flipPortalRules{}
+	for _, i := range params.forcedFlipPortalIndices {
+		rules.forced = append(rules.forced, portals[i])
+	}
+	if len(params.excludedFlipPortalIndices) > 0 {
+		rules.excluded = make([]bool, len(portals))
+		for _, i := range params.excludedFlipPortalIndices {
+			rules.excluded[i] = true
+		}
+	}
+	return rules
+}
+
+func (r flipPortalRules) isForced(ix portalIndex) bool {
+	for _, p := range r.forced {
+		if p.Index == ix {
+			return true
+		}
+	}
+	return false
+}
+
+// choose returns up to maxFlipPortals of the flip portals (all of them if maxFlipPortals <= 0),
+// starting with the forced ones.
+func (r flipPortalRules) choose(flipPortals []portalData, maxFlipPortals int, result []portalData) []portalData {
+	if maxFlipPortals <= 0 || len(flipPortals) <= maxFlipPortals {
+		return flipPortals
+	}
+	result = result[:0]
+	for _, p := range flipPortals {
+		if r.isForced(p.Index) {
+			result = append(result, p)
+		}
+	}
+	for _, p := range flipPortals {
+		if len(result) >= maxFlipPortals {
+			break
+		}
+		if !r.isForced(p.Index) {
+			result = append(result, p)
+		}
+	}
+	return result
 }
 
 type PortalLimit int
@@ -28,6 +186,9 @@ type bestFlipFieldQuery struct {
 	candidates  []portalData
 	flipPortals []portalData
 	portals     []portalData
+	// preallocated storage for flip portals which can be linked to a backbone candidate
+	linkable []portalData
+	links    linkFilter
 	// Best solution found so far, we can abort early if we're sure we won't improve current best solution
 	bestSolution       int
 	maxBackbonePortals int
@@ -35,16 +196,19 @@ type bestFlipFieldQuery struct {
 	maxFlipPortals     int
 	simpleBackbone     bool
 	fixedBaseIndices   []portalIndex
+	rules              flipPortalRules
 }
 
-func newBestFlipFieldQuery(portals []portalData, fixedBaseIndices []portalIndex, maxBackbonePortals int, numPortalLimit PortalLimit, maxFlipPortals int, simpleBackbone bool) bestFlipFieldQuery {
+func newBestFlipFieldQuery(portals []portalData, links linkFilter, fixedBaseIndices []portalIndex, rules flipPortalRules, maxBackbonePortals int, numPortalLimit PortalLimit, maxFlipPortals int, simpleBackbone bool) bestFlipFieldQuery {
 	return bestFlipFieldQuery{
 		maxBackbonePortals: maxBackbonePortals,
 		numPortalLimit:     numPortalLimit,
 		maxFlipPortals:     maxFlipPortals,
 		simpleBackbone:     simpleBackbone,
 		fixedBaseIndices:   fixedBaseIndices,
+		rules:              rules,
 		portals:            portals,
+		links:              links,
 		backbone:           make([]portalData, 0, maxBackbonePortals),
 		candidates:         make([]portalData, 0, len(portals)),
 		flipPortals:        make([]portalData, 0, len(portals)),
@@ -110,7 +274,7 @@ func numFlipFields(numFlipPortals, numBackbonePortals int) int {
 	return numFlipPortals * (2*numBackbonePortals - 3)
 }
 
-func sliceContains(slice []portalIndex, ix portalIndex) bool {
+func sliceContains[T comparable](slice []T, ix T) bool {
 	for _, val := range slice {
 		if val == ix {
 			return true
@@ -118,13 +282,98 @@ func sliceContains(slice []portalIndex, ix portalIndex) bool {
 	}
 	return false
 }
+
+// linkableFlipPortals returns flip portals which can be linked to portal p.
+func (f *bestFlipFieldQuery) linkableFlipPortals(p portalData) []portalData {
+	if !f.links.isActive() {
+		return f.flipPortals
+	}
+	f.linkable = f.linkable[:0]
+	for _, flipPortal := range f.flipPortals {
+		if f.links.allowed(flipPortal.Index, p.Index) {
+			f.linkable = append(f.linkable, flipPortal)
+		}
+	}
+	return f.linkable
+}
+
+// removeUnlinkableFlipPortals removes flip portals which cannot be linked to a new backbone portal p.
+func (f *bestFlipFieldQuery) removeUnlinkableFlipPortals(p portalData) {
+	if !f.links.isActive() {
+		return
+	}
+	flipPortals := f.flipPortals[:0]
+	for _, flipPortal := range f.flipPortals {
+		if f.links.allowed(flipPortal.Index, p.Index) {
+			flipPortals = append(flipPortals, flipPortal)
+		}
+	}
+	f.flipPortals = flipPortals
+}
+
+// removeExcludedFlipPortals removes flip portals which must not be flipped.
+func (f *bestFlipFieldQuery) removeExcludedFlipPortals() {
+	if f.rules.excluded == nil {
+		return
+	}
+	flipPortals := f.flipPortals[:0]
+	for _, flipPortal := range f.flipPortals {
+		if !f.rules.excluded[flipPortal.Index] {
+			flipPortals = append(flipPortals, flipPortal)
+		}
+	}
+	f.flipPortals = flipPortals
+}
+
+// hasForcedFlipPortals checks if all the forced flip portals are among the flip portals.
+func (f *bestFlipFieldQuery) hasForcedFlipPortals() bool {
+	for _, forced := range f.rules.forced {
+		found := false
+		for _, flipPortal := range f.flipPortals {
+			if flipPortal.Index == forced.Index {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// keepsForcedFlipPortals checks if all the forced flip portals remain flip portals
+// after adding a new backbone portal p, making new backbone segments given by the lines.
+func (f *bestFlipFieldQuery) keepsForcedFlipPortals(p portalData, lines ...ccwQuery) bool {
+	for _, forced := range f.rules.forced {
+		if !f.links.allowed(forced.Index, p.Index) {
+			return false
+		}
+		for _, line := range lines {
+			if !line.IsCCW(forced.LatLng) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (f *bestFlipFieldQuery) findBestFlipField(p0, p1 portalData, ccw bool) ([]portalData, []portalData, float64) {
+	if !f.links.allowed(p0.Index, p1.Index) || f.rules.isForced(p0.Index) || f.rules.isForced(p1.Index) {
+		return f.backbone[:0], f.flipPortals[:0], 0
+	}
 	if ccw {
 		f.candidates = portalsLeftOfLine(f.portals, p0, p1, f.candidates[:0])
 	} else {
 		f.candidates = portalsLeftOfLine(f.portals, p1, p0, f.candidates[:0])
 	}
 	f.flipPortals = append(f.flipPortals[:0], f.candidates...)
+	f.removeUnlinkableFlipPortals(p0)
+	f.removeUnlinkableFlipPortals(p1)
+	f.removeExcludedFlipPortals()
+	if !f.hasForcedFlipPortals() {
+		return f.backbone[:0], f.flipPortals[:0], 0
+	}
 	f.backbone = append(f.backbone[:0], p0, p1)
 	backboneLength := distance(p0, p1)
 	nonBeneficialTriples := make(map[uint64]struct{})
@@ -149,7 +398,7 @@ func (f *bestFlipFieldQuery) findBestFlipField(p0, p1 portalData, ccw bool) ([]p
 			segCCW := newCCWQuery(f.backbone[pos-1].LatLng, f.backbone[pos].LatLng)
 			tripleIndexBase := (uint64(f.backbone[pos-1].Index)*numAllPortals + uint64(f.backbone[pos].Index)) * numAllPortals
 			for i, candidate := range f.candidates {
-				if sliceContains(f.fixedBaseIndices, candidate.Index) {
+				if sliceContains(f.fixedBaseIndices, candidate.Index) || f.rules.isForced(candidate.Index) {
 					continue
 				}
 				tripleIndex := tripleIndexBase + uint64(candidate.Index)
@@ -170,10 +419,24 @@ func (f *bestFlipFieldQuery) findBestFlipField(p0, p1 portalData, ccw bool) ([]p
 				if ccw != segCCW.IsCCW(candidate.LatLng) {
 					continue
 				}
+				if !f.links.allowed(f.backbone[pos-1].Index, candidate.Index) || !f.links.allowed(candidate.Index, f.backbone[pos].Index) {
+					continue
+				}
+				if len(f.rules.forced) > 0 {
+					var keepsForced bool
+					if ccw {
+						keepsForced = f.keepsForcedFlipPortals(candidate, newCCWQuery(f.backbone[pos-1].LatLng, candidate.LatLng), newCCWQuery(candidate.LatLng, f.backbone[pos].LatLng))
+					} else {
+						keepsForced = f.keepsForcedFlipPortals(candidate, newCCWQuery(f.backbone[pos].LatLng, candidate.LatLng), newCCWQuery(candidate.LatLng, f.backbone[pos-1].LatLng))
+					}
+					if !keepsForced {
+						continue
+					}
+				}
 				if ccw {
-					numFlipPortals = numPortalsLeftOfTwoLines(f.flipPortals, f.backbone[pos-1], candidate, f.backbone[pos])
+					numFlipPortals = numPortalsLeftOfTwoLines(f.linkableFlipPortals(candidate), f.backbone[pos-1], candidate, f.backbone[pos])
 				} else {
-					numFlipPortals = numPortalsLeftOfTwoLines(f.flipPortals, f.backbone[pos], candidate, f.backbone[pos-1])
+					numFlipPortals = numPortalsLeftOfTwoLines(f.linkableFlipPortals(candidate), f.backbone[pos], candidate, f.backbone[pos-1])
 				}
 				if numFlipFields(numFlipPortals, f.maxBackbonePortals) < f.bestSolution {
 					nonBeneficialTriples[tripleIndex] = struct{}{}
@@ -203,11 +466,25 @@ func (f *bestFlipFieldQuery) findBestFlipField(p0, p1 portalData, ccw bool) ([]p
 				if ccw == zeroLast.IsCCW(candidate.LatLng) {
 					continue
 				}
+				if !f.links.allowed(f.backbone[pos].Index, candidate.Index) || f.rules.isForced(candidate.Index) {
+					continue
+				}
+				if len(f.rules.forced) > 0 {
+					var keepsForced bool
+					if ccw {
+						keepsForced = f.keepsForcedFlipPortals(candidate, newCCWQuery(f.backbone[pos].LatLng, candidate.LatLng))
+					} else {
+						keepsForced = f.keepsForcedFlipPortals(candidate, newCCWQuery(candidate.LatLng, f.backbone[pos].LatLng))
+					}
+					if !keepsForced {
+						continue
+					}
+				}
 				var numFlipPortals int
 				if ccw {
-					numFlipPortals = numPortalsLeftOfLine(f.flipPortals, f.backbone[pos], candidate)
+					numFlipPortals = numPortalsLeftOfLine(f.linkableFlipPortals(candidate), f.backbone[pos], candidate)
 				} else {
-					numFlipPortals = numPortalsLeftOfLine(f.flipPortals, candidate, f.backbone[pos])
+					numFlipPortals = numPortalsLeftOfLine(f.linkableFlipPortals(candidate), candidate, f.backbone[pos])
 				}
 				if numFlipFields(numFlipPortals, f.maxBackbonePortals) < f.bestSolution {
 					continue
@@ -235,6 +512,20 @@ func (f *bestFlipFieldQuery) findBestFlipField(p0, p1 portalData, ccw bool) ([]p
 				if ccw == zeroLast.IsCCW(candidate.LatLng) {
 					continue
 				}
+				if !f.links.allowed(candidate.Index, f.backbone[0].Index) || f.rules.isForced(candidate.Index) {
+					continue
+				}
+				if len(f.rules.forced) > 0 {
+					var keepsForced bool
+					if ccw {
+						keepsForced = f.keepsForcedFlipPortals(candidate, newCCWQuery(candidate.LatLng, f.backbone[0].LatLng))
+					} else {
+						keepsForced = f.keepsForcedFlipPortals(candidate, newCCWQuery(f.backbone[0].LatLng, candidate.LatLng))
+					}
+					if !keepsForced {
+						continue
+					}
+				}
 				if f.simpleBackbone {
 					ok := true
 					for j := 1; j < len(f.backbone); j++ {
@@ -249,9 +540,9 @@ func (f *bestFlipFieldQuery) findBestFlipField(p0, p1 portalData, ccw bool) ([]p
 				}
 				var numFlipPortals int
 				if ccw {
-					numFlipPortals = numPortalsLeftOfLine(f.flipPortals, candidate, f.backbone[0])
+					numFlipPortals = numPortalsLeftOfLine(f.linkableFlipPortals(candidate), candidate, f.backbone[0])
 				} else {
-					numFlipPortals = numPortalsLeftOfLine(f.flipPortals, f.backbone[0], candidate)
+					numFlipPortals = numPortalsLeftOfLine(f.linkableFlipPortals(candidate), f.backbone[0], candidate)
 				}
 				if numFlipFields(numFlipPortals, f.maxBackbonePortals) < f.bestSolution {
 					continue
@@ -329,6 +620,7 @@ func (f *bestFlipFieldQuery) findBestFlipField(p0, p1 portalData, ccw bool) ([]p
 				f.candidates = partitionPortalsLeftOfLine(f.candidates, f.backbone[len(f.backbone)-1], f.backbone[len(f.backbone)-2])
 			}
 		}
+		f.removeUnlinkableFlipPortals(f.backbone[bestInsertPosition])
 	}
 	if f.numPortalLimit != EQUAL || len(f.backbone) == f.maxBackbonePortals {
 		numFlipPortals := len(f.flipPortals)
@@ -343,7 +635,12 @@ func (f *bestFlipFieldQuery) findBestFlipField(p0, p1 portalData, ccw bool) ([]p
 	return f.backbone, f.flipPortals, backboneLength
 }
 
-func LargestFlipFieldST(portals []Portal, params flipFieldParams) ([]Portal, []Portal) {
+func LargestFlipFieldST(ctx context.Context, portals []Portal, params flipFieldParams) ([]Portal, []Portal, error) {
+	results, err := topFlipFieldsST(ctx, portals, 1, params)
+	return firstFlipFieldSolution(results, err)
+}
+
+func topFlipFieldsST(ctx context.Context, portals []Portal, numResults int, params flipFieldParams) ([]FlipFieldSolution, error) {
 	if len(portals) < 3 {
 		panic("Too short portal list")
 	}
@@ -362,32 +659,34 @@ func LargestFlipFieldST(portals []Portal, params flipFieldParams) ([]Portal, []P
 	numProcessedPairsModN := 0
 	params.progressFunc(0, numPairs)
 
-	var bestNumFields int
-	bestBackbone, bestFlipPortals := []portalData(nil), []portalData(nil)
-	var bestBackboneLength float64
-	q := newBestFlipFieldQuery(portalsData, fixedBaseIndices, params.maxBackbonePortals, params.backbonePortalLimit, params.maxFlipPortals, params.simpleBackbone)
+	costs := portalCosts(portals)
+	top := newTopSolutions(numResults, betterFlipField)
+	rules := newFlipPortalRules(portalsData, params)
+	chosenFlipPortals := make([]portalData, 0, params.maxFlipPortals)
+	q := newBestFlipFieldQuery(portalsData, newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength), fixedBaseIndices, rules, params.maxBackbonePortals, params.backbonePortalLimit, params.maxFlipPortals, params.simpleBackbone)
+	c := newCancellation(ctx)
+mainLoop:
 	for _, p0 := range portalsData {
 		for _, p1 := range portalsData {
 			if p0.Index == p1.Index {
 				continue
 			}
+			if c.check() {
+				break mainLoop
+			}
 			for _, ccw := range []bool{true, false} {
+				if numResults > 1 {
+					// Don't prune solutions worse than the best one,
+					// they still may become one of the top ones.
+					q.bestSolution = flipFieldPruningThreshold(top)
+				}
 				b, f, bl := q.findBestFlipField(p0, p1, ccw)
 				if len(b) <= 2 || !hasAllElementsInThePair(fixedBaseIndices, b[0].Index, b[len(b)-1].Index) {
 					continue
 				}
 				if params.backbonePortalLimit != EQUAL || len(b) == params.maxBackbonePortals {
-					numFlipPortals := len(f)
-					if params.maxFlipPortals > 0 && numFlipPortals > params.maxFlipPortals {
-						numFlipPortals = params.maxFlipPortals
-					}
-					numFields := numFlipFields(numFlipPortals, len(b))
-					if numFields > bestNumFields || (numFields == bestNumFields && bl < bestBackboneLength) {
-						bestNumFields = numFields
-						bestBackbone = append(bestBackbone[:0], b...)
-						bestFlipPortals = append(bestFlipPortals[:0], f...)
-						bestBackboneLength = bl
-					}
+					chosenFlipPortals = rules.choose(f, params.maxFlipPortals, chosenFlipPortals)
+					addFlipField(top, costs, b, chosenFlipPortals, numFlipFields(len(chosenFlipPortals), len(b)), bl)
 				}
 			}
 			numProcessedPairs++
@@ -400,13 +699,8 @@ func LargestFlipFieldST(portals []Portal, params flipFieldParams) ([]Portal, []P
 	}
 	params.progressFunc(numPairs, numPairs)
 
-	resultBackbone := make([]Portal, 0, len(bestBackbone))
-	for _, p := range bestBackbone {
-		resultBackbone = append(resultBackbone, portals[p.Index])
-	}
-	resultFlipPortals := make([]Portal, 0, len(bestFlipPortals))
-	for _, p := range bestFlipPortals {
-		resultFlipPortals = append(resultFlipPortals, portals[p.Index])
+	if c.cancelled {
+		return flipFieldSolutions(portals, top.solutions), cancelledError(ctx)
 	}
-	return resultBackbone, resultFlipPortals
+	return flipFieldSolutions(portals, top.solutions), nil
 }
@@ -1,13 +1,21 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 type bestFlipFieldMtQuery struct {
+	// number of fields below which a flip field can't become one of the top
+	// solutions, accessed atomically, used only if numResults > 1
+	pruningThreshold   int64
+	numResults         int
 	portals            []portalData
+	links              linkFilter
 	fixedBaseIndices   []portalIndex
+	rules              flipPortalRules
 	maxBackbonePortals int
 	maxFlipPortals     int
 	numPortalLimit     PortalLimit
@@ -22,7 +30,9 @@ func (f *bestFlipFieldMtQuery) findBestFlipField(p0, p1 portalData, ccw bool, ba
 		simpleBackbone:     f.simpleBackbone,
 		bestSolution:       bestSolution,
 		portals:            f.portals,
+		links:              f.links,
 		fixedBaseIndices:   f.fixedBaseIndices,
+		rules:              f.rules,
 		backbone:           backbone,
 		candidates:         candidates,
 		flipPortals:        flipPortals,
@@ -40,13 +50,25 @@ type flipFieldRequest struct {
 }
 
 func bestFlipFieldWorker(
+	ctx context.Context,
 	q *bestFlipFieldMtQuery,
 	requestChannel, responseChannel chan flipFieldRequest,
 	wg *sync.WaitGroup) {
 	var localBestNumFields int
 	candidates := make([]portalData, 0, len(q.portals))
 	for req := range requestChannel {
-		b, f, bl := q.findBestFlipField(req.p0, req.p1, req.ccw, req.backbone, req.flipPortals, candidates, localBestNumFields)
+		if ctx.Err() != nil {
+			// Just drain the request channel.
+			req.backbone = req.backbone[:0]
+			req.flipPortals = req.flipPortals[:0]
+			responseChannel <- req
+			continue
+		}
+		bestNumFields := localBestNumFields
+		if q.numResults > 1 {
+			bestNumFields = int(atomic.LoadInt64(&q.pruningThreshold))
+		}
+		b, f, bl := q.findBestFlipField(req.p0, req.p1, req.ccw, req.backbone, req.flipPortals, candidates, bestNumFields)
 		if len(b) >= 2 &&
 			hasAllElementsInThePair(q.fixedBaseIndices, b[0].Index, b[len(b)-1].Index) &&
 			(q.numPortalLimit != EQUAL || len(b) == q.maxBackbonePortals) {
@@ -67,7 +89,12 @@ func bestFlipFieldWorker(
 	wg.Done()
 }
 
-func LargestFlipFieldMT(portals []Portal, params flipFieldParams) ([]Portal, []Portal) {
+func LargestFlipFieldMT(ctx context.Context, portals []Portal, params flipFieldParams) ([]Portal, []Portal, error) {
+	results, err := topFlipFieldsMT(ctx, portals, 1, params)
+	return firstFlipFieldSolution(results, err)
+}
+
+func topFlipFieldsMT(ctx context.Context, portals []Portal, numResults int, params flipFieldParams) ([]FlipFieldSolution, error) {
 	if params.numWorkers < 1 {
 		panic(fmt.Errorf("too few workers: %d", params.numWorkers))
 	}
@@ -96,33 +123,40 @@ func LargestFlipFieldMT(portals []Portal, params flipFieldParams) ([]Portal, []P
 	var wg sync.WaitGroup
 	wg.Add(params.numWorkers)
 	q := &bestFlipFieldMtQuery{
+		numResults:         numResults,
 		maxBackbonePortals: params.maxBackbonePortals,
 		numPortalLimit:     params.backbonePortalLimit,
 		maxFlipPortals:     params.maxFlipPortals,
 		simpleBackbone:     params.simpleBackbone,
 		portals:            portalsData,
-		fixedBaseIndices:   fixedBaseIndices}
+		links:              newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength),
+		fixedBaseIndices:   fixedBaseIndices,
+		rules:              newFlipPortalRules(portalsData, params)}
 	for i := 0; i < params.numWorkers; i++ {
-		go bestFlipFieldWorker(q, requestChannel, responseChannel, &wg)
+		go bestFlipFieldWorker(ctx, q, requestChannel, responseChannel, &wg)
 	}
 	go func() {
+		defer close(requestChannel)
 		for _, p0 := range portalsData {
 			for _, p1 := range portalsData {
 				if p0.Index == p1.Index {
 					continue
 				}
 				for _, ccw := range []bool{true, false} {
-					requestChannel <- flipFieldRequest{
+					select {
+					case requestChannel <- flipFieldRequest{
 						p0:          p0,
 						p1:          p1,
 						ccw:         ccw,
 						backbone:    backboneCache.Get().([]portalData),
 						flipPortals: flipPortalsCache.Get().([]portalData),
+					}:
+					case <-ctx.Done():
+						return
 					}
 				}
 			}
 		}
-		close(requestChannel)
 	}()
 	go func() {
 		wg.Wait()
@@ -137,23 +171,17 @@ func LargestFlipFieldMT(portals []Portal, params flipFieldParams) ([]Portal, []P
 	numProcessedPairsModN := 0
 	params.progressFunc(0, numPairs)
 
-	var bestNumFields int
-	bestBackbone, bestFlipPortals := []portalData(nil), []portalData(nil)
-	var bestBackboneLength float64
+	costs := portalCosts(portals)
+	top := newTopSolutions(numResults, betterFlipField)
+	chosenFlipPortals := make([]portalData, 0, params.maxFlipPortals)
 	for resp := range responseChannel {
 		if len(resp.backbone) >= 2 &&
 			hasAllElementsInThePair(fixedBaseIndices, resp.backbone[0].Index, resp.backbone[len(resp.backbone)-1].Index) &&
 			(params.backbonePortalLimit != EQUAL || len(resp.backbone) == params.maxBackbonePortals) {
-			numFlipPortals := len(resp.flipPortals)
-			if params.maxFlipPortals > 0 && numFlipPortals > params.maxFlipPortals {
-				numFlipPortals = params.maxFlipPortals
-			}
-			numFields := numFlipFields(numFlipPortals, len(resp.backbone))
-			if numFields > bestNumFields || (numFields == bestNumFields && resp.backboneLength < bestBackboneLength) {
-				bestNumFields = numFields
-				bestBackbone = append(bestBackbone[:0], resp.backbone...)
-				bestFlipPortals = append(bestFlipPortals[:0], resp.flipPortals...)
-				bestBackboneLength = resp.backboneLength
+			chosenFlipPortals = q.rules.choose(resp.flipPortals, params.maxFlipPortals, chosenFlipPortals)
+			addFlipField(top, costs, resp.backbone, chosenFlipPortals, numFlipFields(len(chosenFlipPortals), len(resp.backbone)), resp.backboneLength)
+			if numResults > 1 {
+				atomic.StoreInt64(&q.pruningThreshold, int64(flipFieldPruningThreshold(top)))
 			}
 		}
 		backboneCache.Put(resp.backbone)
@@ -167,13 +195,8 @@ func LargestFlipFieldMT(portals []Portal, params flipFieldParams) ([]Portal, []P
 	}
 	params.progressFunc(numPairs, numPairs)
 
-	resultBackbone := make([]Portal, 0, len(bestBackbone))
-	for _, p := range bestBackbone {
-		resultBackbone = append(resultBackbone, portals[p.Index])
-	}
-	resultFlipPortals := make([]Portal, 0, len(bestFlipPortals))
-	for _, p := range bestFlipPortals {
-		resultFlipPortals = append(resultFlipPortals, portals[p.Index])
+	if ctx.Err() != nil {
+		return flipFieldSolutions(portals, top.solutions), cancelledError(ctx)
 	}
-	return resultBackbone, resultFlipPortals
+	return flipFieldSolutions(portals, top.solutions), nil
 }
@@ -45,14 +45,53 @@ func (f FlipFieldFixedBaseIndices) apply(params *flipFieldParams) {
 	params.fixedBaseIndices = []int(f)
 }
 
+type FlipFieldBlockers []Segment
+
+func (f FlipFieldBlockers) apply(params *flipFieldParams) {
+	params.blockers = []Segment(f)
+}
+
+type FlipFieldDisabledPortals []Portal
+
+func (f FlipFieldDisabledPortals) apply(params *flipFieldParams) {
+	params.disabledPortals = []Portal(f)
+}
+
+// FlipFieldMaxLinkLength - don't make links longer than that many meters
+type FlipFieldMaxLinkLength float64
+
+func (f FlipFieldMaxLinkLength) apply(params *flipFieldParams) {
+	params.maxLinkLength = float64(f)
+}
+
+// FlipFieldForcedFlipPortalIndices - portals which must be among the flip portals of the flip field
+type FlipFieldForcedFlipPortalIndices []int
+
+func (f FlipFieldForcedFlipPortalIndices) apply(params *flipFieldParams) {
+	params.forcedFlipPortalIndices = []int(f)
+}
+
+// FlipFieldExcludedFlipPortalIndices - portals which must not be flipped,
+// they still may be used as backbone portals
+type FlipFieldExcludedFlipPortalIndices []int
+
+func (f FlipFieldExcludedFlipPortalIndices) apply(params *flipFieldParams) {
+	params.excludedFlipPortalIndices = []int(f)
+}
+
 type flipFieldParams struct {
-	progressFunc        func(int, int)
-	maxBackbonePortals  int
-	backbonePortalLimit PortalLimit
-	fixedBaseIndices    []int
-	maxFlipPortals      int
-	numWorkers          int
-	simpleBackbone      bool
+	progressFunc              func(int, int)
+	maxBackbonePortals        int
+	backbonePortalLimit       PortalLimit
+	fixedBaseIndices          []int
+	forcedFlipPortalIndices   []int
+	excludedFlipPortalIndices []int
+	blockers                  []Segment
+	disabledPortals           []Portal
+	maxLinkLength             float64
+	maxFlipPortals            int
+	numWorkers                int
+	simpleBackbone            bool
 }
 
 func defaultFlipFieldParams() flipFieldParams {
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"testing"
 
 	"github.com/golang/geo/s2"
@@ -74,7 +75,10 @@ func TestFlipFieldMultiThreaded(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	backbone, flipPortals := LargestFlipField(portals, FlipFieldBackbonePortalLimit{8, EQUAL}, FlipFieldMaxFlipPortals(0), FlipFieldNumWorkers(6))
+	backbone, flipPortals, err := LargestFlipField(context.Background(), portals, FlipFieldBackbonePortalLimit{8, EQUAL}, FlipFieldMaxFlipPortals(0), FlipFieldNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidFlipFieldResult(8, 105, false, backbone, flipPortals, t)
 }
 
@@ -89,7 +93,10 @@ func TestFlipFieldSingleThread(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	backbone, flipPortals := LargestFlipField(portals, FlipFieldBackbonePortalLimit{8, EQUAL}, FlipFieldMaxFlipPortals(0), FlipFieldNumWorkers(1))
+	backbone, flipPortals, err := LargestFlipField(context.Background(), portals, FlipFieldBackbonePortalLimit{8, EQUAL}, FlipFieldMaxFlipPortals(0), FlipFieldNumWorkers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidFlipFieldResult(8, 105, false, backbone, flipPortals, t)
 }
 
@@ -104,7 +111,10 @@ func TestFlipFieldLessEqual(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	backbone, flipPortals := LargestFlipField(portals, FlipFieldBackbonePortalLimit{16, LESS_EQUAL}, FlipFieldMaxFlipPortals(0), FlipFieldNumWorkers(6))
+	backbone, flipPortals, err := LargestFlipField(context.Background(), portals, FlipFieldBackbonePortalLimit{16, LESS_EQUAL}, FlipFieldMaxFlipPortals(0), FlipFieldNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidFlipFieldResult(9, 103, false, backbone, flipPortals, t)
 }
 
@@ -119,6 +129,99 @@ func TestFlipFieldSimple(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	backbone, flipPortals := LargestFlipField(portals, FlipFieldBackbonePortalLimit{8, EQUAL}, FlipFieldMaxFlipPortals(0), FlipFieldNumWorkers(6), FlipFieldSimpleBackbone(true))
+	backbone, flipPortals, err := LargestFlipField(context.Background(), portals, FlipFieldBackbonePortalLimit{8, EQUAL}, FlipFieldMaxFlipPortals(0), FlipFieldNumWorkers(6), FlipFieldSimpleBackbone(true))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidFlipFieldResult(8, 105, true, backbone, flipPortals, t)
 }
+
+func TestFlipFieldForcedAndExcludedFlipPortals(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	if testing.Short() {
+		t.Skip()
+	}
+	backbone, allFlipPortals, err := LargestFlipField(context.Background(), portals, FlipFieldBackbonePortalLimit{4, EQUAL}, FlipFieldNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allFlipPortals) < 4 {
+		t.Fatalf("Expected at least 4 flip portals, got %d", len(allFlipPortals))
+	}
+	_, flipPortals, err := LargestFlipField(context.Background(), portals, FlipFieldBackbonePortalLimit{4, EQUAL}, FlipFieldMaxFlipPortals(2), FlipFieldNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flipPortals) != 2 {
+		t.Errorf("Expected 2 flip portals, got %d", len(flipPortals))
+	}
+	// Force a flip portal of the best backbone which didn't get chosen, and exclude one which did.
+	forced, excluded := -1, -1
+	for i, portal := range portals {
+		if forced < 0 && portalIsOnList(portal, allFlipPortals) && !portalIsOnList(portal, flipPortals) {
+			forced = i
+		}
+		if excluded < 0 && portalIsOnList(portal, flipPortals) {
+			excluded = i
+		}
+	}
+	if forced < 0 || excluded < 0 {
+		t.Fatalf("Cannot choose forced and excluded flip portals")
+	}
+	for _, numWorkers := range []int{1, 6} {
+		backbone, flipPortals, err := LargestFlipField(context.Background(), portals,
+			FlipFieldBackbonePortalLimit{4, EQUAL},
+			FlipFieldMaxFlipPortals(2),
+			FlipFieldNumWorkers(numWorkers),
+			FlipFieldForcedFlipPortalIndices{forced},
+			FlipFieldExcludedFlipPortalIndices{excluded})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValidFlipFieldResult(4, 2, false, backbone, flipPortals, t)
+		if !portalIsOnList(portals[forced], flipPortals) {
+			t.Errorf("Forced flip portal %s is not among the flip portals", portals[forced].Name)
+		}
+		if portalIsOnList(portals[excluded], flipPortals) {
+			t.Errorf("Excluded flip portal %s is among the flip portals", portals[excluded].Name)
+		}
+	}
+
+	execution, err := FlipFieldExecutionPlan(backbone, allFlipPortals[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	numSteps := map[FlipFieldPhase]int{}
+	for i, step := range execution.Steps {
+		numSteps[step.Phase]++
+		if step.Phase == FlipFieldFlipPhase {
+			if step.NumFields != 0 {
+				t.Errorf("Expected no fields after flip, got %d", step.NumFields)
+			}
+			if execution.Steps[i-1].NumFields != len(backbone)-1 {
+				t.Errorf("Expected %d fields before flip, got %d", len(backbone)-1, execution.Steps[i-1].NumFields)
+			}
+		}
+	}
+	expectedNumSteps := map[FlipFieldPhase]int{
+		FlipFieldBackbonePhase:   len(backbone) - 1,
+		FlipFieldInitialFanPhase: len(backbone),
+		FlipFieldFlipPhase:       4,
+		FlipFieldReLinkPhase:     3 * len(backbone),
+	}
+	for phase, expected := range expectedNumSteps {
+		if numSteps[phase] != expected {
+			t.Errorf("Expected %d %s steps, got %d", expected, phase, numSteps[phase])
+		}
+	}
+	if len(execution.FlipOrder) != 4 {
+		t.Errorf("Expected 4 flip portals in the flip order, got %d", len(execution.FlipOrder))
+	}
+	lastStep := execution.Steps[len(execution.Steps)-1]
+	if lastStep.NumFieldsCreated != 4*(len(backbone)-1) {
+		t.Errorf("Expected %d fields created, got %d", 4*(len(backbone)-1), lastStep.NumFieldsCreated)
+	}
+}
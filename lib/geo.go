@@ -22,6 +22,14 @@ func (c ccwQuery) IsCCW(p s2.Point) bool {
 	return r3.Vector(c).Dot(p.Vector) > 0
 }
 
+// segmentsCross returns true if segments ab and cd intersect.
+// Segments sharing an endpoint should not be passed to it.
+func segmentsCross(a, b, c, d s2.Point) bool {
+	ab := newCCWQuery(a, b)
+	cd := newCCWQuery(c, d)
+	return ab.IsCCW(c) != ab.IsCCW(d) && cd.IsCCW(a) != cd.IsCCW(b)
+}
+
 // triangleQuery helps to answer question whethen a point is contained
 // inside triangle.
 type triangleQuery struct {
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"sort"
 
 	"github.com/golang/geo/r3"
@@ -8,12 +9,76 @@ import (
 	"github.com/golang/geo/s2"
 )
 
-// LargestHerringbone - Find largest possible multilayer of portals to be made
-func LargestHerringbone(portals []Portal, fixedBaseIndices []int, numWorkers int, progressFunc func(int, int)) (Portal, Portal, []Portal) {
+// LargestHerringbone - Find largest possible multilayer of portals to be made.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError.
+func LargestHerringbone(ctx context.Context, portals []Portal, fixedBaseIndices []int, numWorkers int, progressFunc func(int, int), options ...HerringboneOption) (Portal, Portal, []Portal, error) {
+	results, err := TopHerringbones(ctx, portals, fixedBaseIndices, 1, numWorkers, progressFunc, options...)
+	return firstHerringboneSolution(portals, results, err)
+}
+
+// HerringboneSolution - herringbone field with base B0, B1
+type HerringboneSolution struct {
+	B0, B1   Portal
+	Backbone []Portal
+}
+
+// TopHerringbones - Find up to numResults largest multilayers having distinct sets of portals,
+// sorted from the largest one.
+// If ctx gets cancelled returns the best solutions found so far and a *CancelledError.
+func TopHerringbones(ctx context.Context, portals []Portal, fixedBaseIndices []int, numResults int, numWorkers int, progressFunc func(int, int), options ...HerringboneOption) ([]HerringboneSolution, error) {
 	if numWorkers == 1 {
-		return LargestHerringboneST(portals, fixedBaseIndices, progressFunc)
+		return topHerringbonesST(ctx, portals, fixedBaseIndices, numResults, progressFunc, options...)
+	}
+	return topHerringbonesMT(ctx, portals, fixedBaseIndices, numResults, numWorkers, progressFunc, options...)
+}
+
+func firstHerringboneSolution(portals []Portal, results []HerringboneSolution, err error) (Portal, Portal, []Portal, error) {
+	if len(results) == 0 {
+		return portals[0], portals[0], []Portal{}, err
+	}
+	return results[0].B0, results[0].B1, results[0].Backbone, err
+}
+
+type herringboneCandidate struct {
+	b0, b1   portalIndex
+	backbone []portalIndex
+	cost     float64
+}
+
+func betterHerringbone(a, b herringboneCandidate) bool {
+	return len(a.backbone) > len(b.backbone) || (len(a.backbone) == len(b.backbone) && a.cost < b.cost)
+}
+
+func (c herringboneCandidate) portals() []portalIndex {
+	return append([]portalIndex{c.b0, c.b1}, c.backbone...)
+}
+
+// addHerringbone adds a copy of the herringbone to the top solutions.
+func addHerringbone(top *topSolutions[herringboneCandidate], costs []float64, b0, b1 portalIndex, backbone []portalIndex) {
+	if len(backbone) == 0 {
+		return
+	}
+	candidate := herringboneCandidate{b0: b0, b1: b1, backbone: backbone}
+	if costs != nil {
+		candidate.cost = costs[b0] + costs[b1] + totalCost(costs, backbone)
 	}
-	return LargestHerringboneMT(portals, fixedBaseIndices, numWorkers, progressFunc)
+	if !top.accepts(candidate) {
+		return
+	}
+	candidate.backbone = append([]portalIndex(nil), backbone...)
+	top.add(candidate, candidate.portals())
+}
+
+func herringboneSolutions(portals []Portal, candidates []herringboneCandidate) []HerringboneSolution {
+	solutions := make([]HerringboneSolution, 0, len(candidates))
+	for _, candidate := range candidates {
+		backbone := make([]Portal, 0, len(candidate.backbone))
+		for _, portalIx := range candidate.backbone {
+			backbone = append(backbone, portals[portalIx])
+		}
+		solutions = append(solutions, HerringboneSolution{B0: portals[candidate.b0], B1: portals[candidate.b1], Backbone: backbone})
+	}
+	return solutions
 }
 
 type herringboneNode struct {
@@ -23,17 +88,23 @@ type herringboneNode struct {
 	index    portalIndex
 	length   uint16
 	next     portalIndex
+	// total cost of the portals of the backbone starting with the node
+	cost float32
 }
 
 type bestHerringboneQuery struct {
 	portals []portalData
+	links   linkFilter
+	fields  fieldSizeFilter
 	nodes   []herringboneNode
 	weights []float32
 	// Array of normalized direction vectors between all the pairs of portals
 	norms []r3.Vector
+	// costs of the portals, nil if none of them has a cost
+	costs []float64
 }
 
-func newBestHerringboneQuery(portals []portalData) *bestHerringboneQuery {
+func newBestHerringboneQuery(portals []portalData, links linkFilter, fields fieldSizeFilter, costs []float64) *bestHerringboneQuery {
 	norms := make([]r3.Vector, len(portals)*len(portals))
 	for i, p0 := range portals {
 		for j, p1 := range portals {
@@ -46,9 +117,12 @@ func newBestHerringboneQuery(portals []portalData) *bestHerringboneQuery {
 	}
 	return &bestHerringboneQuery{
 		portals: portals,
+		links:   links,
+		fields:  fields,
 		nodes:   make([]herringboneNode, 0, len(portals)),
 		weights: make([]float32, len(portals)),
 		norms:   norms,
+		costs:   costs,
 	}
 }
 
@@ -63,15 +137,24 @@ func (q *bestHerringboneQuery) normalizedVector(b0, b1 portalData) r3.Vector {
 }
 func (q *bestHerringboneQuery) findBestHerringbone(b0, b1 portalData, result []portalIndex) []portalIndex {
 	q.nodes = q.nodes[:0]
+	if !q.links.allowed(b0.Index, b1.Index) {
+		return result[:0]
+	}
 	b01, b10 := q.normalizedVector(b0, b1), q.normalizedVector(b1, b0)
 	distQuery := newDistanceQuery(b0.LatLng, b1.LatLng)
 	for _, portal := range q.portals {
 		if portal == b0 || portal == b1 {
 			continue
 		}
+		if !q.links.allowed(portal.Index, b0.Index) || !q.links.allowed(portal.Index, b1.Index) {
+			continue
+		}
 		if !s2.Sign(portal.LatLng, b0.LatLng, b1.LatLng) {
 			continue
 		}
+		if !q.fields.allowed(b0, b1, portal) {
+			continue
+		}
 		a0 := b01.Dot(q.normalizedVector(b1, portal)) // acos of angle b0,b1,portal
 		a1 := b10.Dot(q.normalizedVector(b0, portal)) // acos of angle b1,b0,portal
 		dist := distQuery.ChordAngle(portal.LatLng)
@@ -92,14 +175,16 @@ func (q *bestHerringboneQuery) findBestHerringbone(b0, b1 portalData, result []p
 		var bestLength uint16 = 1
 		bestNext := invalidPortalIndex
 		var bestWeight float32
+		var bestNextCost float32
 		for j := 0; j < i; j++ {
 			if q.nodes[j].start < node.start && q.nodes[j].end < node.end {
-				if q.nodes[j].length >= bestLength {
+				if q.nodes[j].length >= bestLength || (q.nodes[j].length+1 == bestLength && q.nodes[j].cost < bestNextCost) {
 					bestLength = q.nodes[j].length + 1
 					bestNext = portalIndex(j)
 					scaledDistance := float32(distance(q.portals[node.index], q.portals[q.nodes[j].index]) * RadiansToMeters)
 					bestWeight = q.weights[q.nodes[j].index] + scaledDistance
-				} else if q.nodes[j].length+1 == bestLength {
+					bestNextCost = q.nodes[j].cost
+				} else if q.nodes[j].length+1 == bestLength && q.nodes[j].cost == bestNextCost {
 					scaledDistance := float32(distance(q.portals[node.index], q.portals[q.nodes[j].index]) * RadiansToMeters)
 					if q.weights[node.index]+scaledDistance < bestWeight {
 						bestLength = q.nodes[j].length + 1
@@ -111,6 +196,9 @@ func (q *bestHerringboneQuery) findBestHerringbone(b0, b1 portalData, result []p
 		}
 		q.nodes[i].length = bestLength
 		q.nodes[i].next = bestNext
+		if q.costs != nil {
+			q.nodes[i].cost = float32(q.costs[node.index]) + bestNextCost
+		}
 		if bestLength > 0 {
 			q.weights[node.index] = bestWeight
 		} else {
@@ -123,11 +211,13 @@ func (q *bestHerringboneQuery) findBestHerringbone(b0, b1 portalData, result []p
 	start := invalidPortalIndex
 	var length uint16
 	var weight float32
+	var cost float32
 	for i, node := range q.nodes {
-		if node.length > length || (node.length == length && q.weights[node.index] < weight) {
+		if node.length > length || (node.length == length && (node.cost < cost || (node.cost == cost && q.weights[node.index] < weight))) {
 			length = node.length
 			start = portalIndex(i)
 			weight = q.weights[node.index]
+			cost = node.cost
 		}
 	}
 	result = result[:0]
@@ -142,14 +232,23 @@ func (q *bestHerringboneQuery) findBestHerringbone(b0, b1 portalData, result []p
 }
 
 // LargestHerringboneST - Find largest possible multilayer of portals to be made, using a single thread
-func LargestHerringboneST(portals []Portal, fixedBaseIndices []int, progressFunc func(int, int)) (Portal, Portal, []Portal) {
+func LargestHerringboneST(ctx context.Context, portals []Portal, fixedBaseIndices []int, progressFunc func(int, int), options ...HerringboneOption) (Portal, Portal, []Portal, error) {
+	results, err := topHerringbonesST(ctx, portals, fixedBaseIndices, 1, progressFunc, options...)
+	return firstHerringboneSolution(portals, results, err)
+}
+
+func topHerringbonesST(ctx context.Context, portals []Portal, fixedBaseIndices []int, numResults int, progressFunc func(int, int), options ...HerringboneOption) ([]HerringboneSolution, error) {
 	if len(portals) < 3 {
 		panic("Too short portal list")
 	}
+	params := defaultHerringboneParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
 	portalsData := portalsToPortalData(portals)
 
-	var largestHerringbone []portalIndex
-	var bestB0, bestB1 portalData
+	costs := portalCosts(portals)
+	top := newTopSolutions(numResults, betterHerringbone)
 	resultCache := make([]portalIndex, 0, len(portals))
 
 	numPairs := len(portals) * (len(portals) - 1) / 2
@@ -165,25 +264,22 @@ func LargestHerringboneST(portals []Portal, fixedBaseIndices []int, progressFunc
 	numProcessedPairs := 0
 	numProcessedPairsModN := 0
 	progressFunc(0, numPairs)
-	q := newBestHerringboneQuery(portalsData)
+	q := newBestHerringboneQuery(portalsData, newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength), newFieldSizeFilter(params.minFieldSize), costs)
+	c := newCancellation(ctx)
+mainLoop:
 	for i, b0 := range portalsData {
 		for j := i + 1; j < len(portalsData); j++ {
 			if !hasAllElementsInThePair(fixedBaseIndices, i, j) {
 				continue
 			}
+			if c.check() {
+				break mainLoop
+			}
 			b1 := portalsData[j]
 			bestCCW := q.findBestHerringbone(b0, b1, resultCache)
-			if len(bestCCW) > len(largestHerringbone) {
-				largestHerringbone = append(largestHerringbone[:0], bestCCW...)
-				bestB0 = b0
-				bestB1 = b1
-			}
+			addHerringbone(top, costs, b0.Index, b1.Index, bestCCW)
 			bestCW := q.findBestHerringbone(b1, b0, resultCache)
-			if len(bestCW) > len(largestHerringbone) {
-				largestHerringbone = append(largestHerringbone[:0], bestCW...)
-				bestB0 = b1
-				bestB1 = b0
-			}
+			addHerringbone(top, costs, b1.Index, b0.Index, bestCW)
 			numProcessedPairs++
 			numProcessedPairsModN++
 			if numProcessedPairsModN == everyNth {
@@ -193,11 +289,10 @@ func LargestHerringboneST(portals []Portal, fixedBaseIndices []int, progressFunc
 		}
 	}
 	progressFunc(numPairs, numPairs)
-	result := make([]Portal, 0, len(largestHerringbone))
-	for _, portalIx := range largestHerringbone {
-		result = append(result, portals[portalIx])
+	if c.cancelled {
+		return herringboneSolutions(portals, top.solutions), cancelledError(ctx)
 	}
-	return portals[bestB0.Index], portals[bestB1.Index], result
+	return herringboneSolutions(portals, top.solutions), nil
 }
 
 func HerringbonePolyline(b0, b1 Portal, result []Portal) []Portal {
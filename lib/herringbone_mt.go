@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -9,11 +10,15 @@ import (
 
 type bestHerringboneMtQuery struct {
 	portals []portalData
+	links   linkFilter
+	fields  fieldSizeFilter
 	// Array of normalized direction vectors between all the pairs of portals
 	norms []r3.Vector
+	// costs of the portals, nil if none of them has a cost
+	costs []float64
 }
 
-func newBestHerringboneMtQuery(portals []portalData) *bestHerringboneMtQuery {
+func newBestHerringboneMtQuery(portals []portalData, links linkFilter, fields fieldSizeFilter, costs []float64) *bestHerringboneMtQuery {
 	norms := make([]r3.Vector, len(portals)*len(portals))
 	for i, p0 := range portals {
 		for j, p1 := range portals {
@@ -26,7 +31,10 @@ func newBestHerringboneMtQuery(portals []portalData) *bestHerringboneMtQuery {
 	}
 	return &bestHerringboneMtQuery{
 		portals: portals,
+		links:   links,
+		fields:  fields,
 		norms:   norms,
+		costs:   costs,
 	}
 }
 
@@ -39,20 +47,30 @@ type herringboneRequest struct {
 func (q *bestHerringboneMtQuery) findBestHerringbone(b0, b1 portalData, nodes []herringboneNode, weights []float32, result []portalIndex) []portalIndex {
 	hq := bestHerringboneQuery{
 		portals: q.portals,
+		links:   q.links,
+		fields:  q.fields,
 		nodes:   nodes,
 		weights: weights,
 		norms:   q.norms,
+		costs:   q.costs,
 	}
 	return hq.findBestHerringbone(b0, b1, result)
 }
 
 func bestHerringboneWorker(
+	ctx context.Context,
 	q *bestHerringboneMtQuery,
 	requestChannel, responseChannel chan herringboneRequest,
 	wg *sync.WaitGroup) {
 	nodes := make([]herringboneNode, 0, len(q.portals))
 	weights := make([]float32, len(q.portals))
 	for req := range requestChannel {
+		if ctx.Err() != nil {
+			// Just drain the request channel.
+			req.result = req.result[:0]
+			responseChannel <- req
+			continue
+		}
 		nodes = nodes[:0]
 		for i := 0; i < len(weights); i++ {
 			weights[i] = 0
@@ -64,14 +82,24 @@ func bestHerringboneWorker(
 }
 
 // LargestHerringboneMT - Find largest possible multilayer of portals to be made, parallel version
-func LargestHerringboneMT(portals []Portal, fixedBaseIndices []int, numWorkers int, progressFunc func(int, int)) (Portal, Portal, []Portal) {
+func LargestHerringboneMT(ctx context.Context, portals []Portal, fixedBaseIndices []int, numWorkers int, progressFunc func(int, int), options ...HerringboneOption) (Portal, Portal, []Portal, error) {
+	results, err := topHerringbonesMT(ctx, portals, fixedBaseIndices, 1, numWorkers, progressFunc, options...)
+	return firstHerringboneSolution(portals, results, err)
+}
+
+func topHerringbonesMT(ctx context.Context, portals []Portal, fixedBaseIndices []int, numResults int, numWorkers int, progressFunc func(int, int), options ...HerringboneOption) ([]HerringboneSolution, error) {
 	if numWorkers < 1 {
 		panic(fmt.Errorf("too few workers: %d", numWorkers))
 	}
 	if len(portals) < 3 {
 		panic(fmt.Errorf("too short portal list: %d", len(portals)))
 	}
+	params := defaultHerringboneParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
 	portalsData := portalsToPortalData(portals)
+	costs := portalCosts(portals)
 
 	resultCache := sync.Pool{
 		New: func() interface{} {
@@ -83,30 +111,28 @@ func LargestHerringboneMT(portals []Portal, fixedBaseIndices []int, numWorkers i
 	responseChannel := make(chan herringboneRequest, numWorkers)
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
-	q := newBestHerringboneMtQuery(portalsData)
+	q := newBestHerringboneMtQuery(portalsData, newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength), newFieldSizeFilter(params.minFieldSize), costs)
 	for i := 0; i < numWorkers; i++ {
-		go bestHerringboneWorker(q, requestChannel, responseChannel, &wg)
+		go bestHerringboneWorker(ctx, q, requestChannel, responseChannel, &wg)
 	}
 	go func() {
+		defer close(requestChannel)
 		for i, b0 := range portalsData {
 			for j := i + 1; j < len(portalsData); j++ {
 				b1 := portalsData[j]
 				if !hasAllElementsInThePair(fixedBaseIndices, i, j) {
 					continue
 				}
-				requestChannel <- herringboneRequest{
-					p0:     b0,
-					p1:     b1,
-					result: resultCache.Get().([]portalIndex),
-				}
-				requestChannel <- herringboneRequest{
-					p0:     b1,
-					p1:     b0,
-					result: resultCache.Get().([]portalIndex),
+				for _, req := range [2]herringboneRequest{{p0: b0, p1: b1}, {p0: b1, p1: b0}} {
+					req.result = resultCache.Get().([]portalIndex)
+					select {
+					case requestChannel <- req:
+					case <-ctx.Done():
+						return
+					}
 				}
 			}
 		}
-		close(requestChannel)
 	}()
 	go func() {
 		wg.Wait()
@@ -121,27 +147,18 @@ func LargestHerringboneMT(portals []Portal, fixedBaseIndices []int, numWorkers i
 	progressFunc(0, numPairs)
 	numProcessedPairs := 0
 
-	var largestHerringbone []portalIndex
-	var bestB0, bestB1 portalIndex
+	top := newTopSolutions(numResults, betterHerringbone)
 	for resp := range responseChannel {
-		if len(resp.result) > len(largestHerringbone) {
-			if len(largestHerringbone) > 0 {
-				resultCache.Put(largestHerringbone)
-			}
-			largestHerringbone = resp.result
-			bestB0, bestB1 = resp.p0.Index, resp.p1.Index
-		} else {
-			resultCache.Put(resp.result)
-		}
+		addHerringbone(top, costs, resp.p0.Index, resp.p1.Index, resp.result)
+		resultCache.Put(resp.result)
 		numProcessedPairs++
 		if numProcessedPairs%everyNth == 0 {
 			progressFunc(numProcessedPairs, numPairs)
 		}
 	}
 	progressFunc(numPairs, numPairs)
-	result := make([]Portal, 0, len(largestHerringbone))
-	for _, portalIx := range largestHerringbone {
-		result = append(result, portals[portalIx])
+	if ctx.Err() != nil {
+		return herringboneSolutions(portals, top.solutions), cancelledError(ctx)
 	}
-	return portals[bestB0], portals[bestB1], result
+	return herringboneSolutions(portals, top.solutions), nil
 }
@@ -0,0 +1,43 @@
+package lib
+
+// HerringboneOption - option of both herringbone and double herringbone searches
+type HerringboneOption interface {
+	apply(params *herringboneParams)
+}
+
+type HerringboneBlockers []Segment
+
+func (h HerringboneBlockers) apply(params *herringboneParams) {
+	params.blockers = []Segment(h)
+}
+
+type HerringboneDisabledPortals []Portal
+
+func (h HerringboneDisabledPortals) apply(params *herringboneParams) {
+	params.disabledPortals = []Portal(h)
+}
+
+// HerringboneMaxLinkLength - don't make links longer than that many meters
+type HerringboneMaxLinkLength float64
+
+func (h HerringboneMaxLinkLength) apply(params *herringboneParams) {
+	params.maxLinkLength = float64(h)
+}
+
+// HerringboneMinFieldSize - don't make fields smaller than that
+type HerringboneMinFieldSize FieldSize
+
+func (h HerringboneMinFieldSize) apply(params *herringboneParams) {
+	params.minFieldSize = FieldSize(h)
+}
+
+type herringboneParams struct {
+	blockers        []Segment
+	disabledPortals []Portal
+	maxLinkLength   float64
+	minFieldSize    FieldSize
+}
+
+func defaultHerringboneParams() herringboneParams {
+	return herringboneParams{}
+}
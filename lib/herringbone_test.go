@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"testing"
 
 	"github.com/golang/geo/s2"
@@ -38,7 +39,10 @@ func TestHerringboneMultiThreaded(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	b0, b1, backbone := LargestHerringbone(portals, []int{}, 6, func(int, int) {})
+	b0, b1, backbone, err := LargestHerringbone(context.Background(), portals, []int{}, 6, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidHerringboneResult(19, b0, b1, backbone, t)
 }
 
@@ -53,6 +57,9 @@ func TestHerringboneSingleThread(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	b0, b1, backbone := LargestHerringbone(portals, []int{}, 1, func(int, int) {})
+	b0, b1, backbone, err := LargestHerringbone(context.Background(), portals, []int{}, 1, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidHerringboneResult(19, b0, b1, backbone, t)
 }
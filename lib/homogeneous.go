@@ -1,7 +1,7 @@
 package lib
 
 import (
-	"math"
+	"context"
 	"strings"
 )
 
@@ -15,48 +15,53 @@ type bestHomogeneousNonPureQuery struct {
 	onFilledIndexEntry func()
 	// all the portals
 	portals []portalData
+	// links which are possible to be made
+	links linkFilter
+	// fields large enough to be made
+	fields fieldSizeFilter
+	// used to stop the search early
+	cancellation cancellation
 	// index of triple of portals to a solution
-	// solution for every triple is store six times - for each of the permutations of portals
-	index []bestSolution
+	// solution for every triple is stored once - for the sorted permutation of portals
+	index *tripleIndex[bestSolution]
 	// preallocated storage for lists of portals within triangles at consecutive recursion depths
 	portalsInTriangle [][]portalData
-	// count of portals (used to compute a solution index from indices of three portals)
-	numPortals uint
 	// current recursion depth
 	depth uint16
 	// maxDepth of solution to be found
 	maxDepth uint16
 }
 
-func newBestHomogeneousQuery(portals []portalData, maxDepth int, onFilledIndexEntry func()) bestHomogeneousQuery {
-	numPortals := uint(len(portals))
-	index := make([]bestSolution, numPortals*numPortals*numPortals)
-	for i := 0; i < len(index); i++ {
-		index[i].Index = invalidPortalIndex
-		index[i].Length = invalidLength
-	}
+func newBestHomogeneousQuery(ctx context.Context, portals []portalData, links linkFilter, fields fieldSizeFilter, maxDepth int, budget *memoryBudget, onFilledIndexEntry func()) bestHomogeneousQuery {
 	return &bestHomogeneousNonPureQuery{
 		portals:            portals,
-		index:              index,
-		numPortals:         numPortals,
+		links:              links,
+		fields:             fields,
+		index:              newUnorderedTripleIndex(len(portals), bestSolution{Index: invalidMemoPortalIndex, Length: invalidLength}, budget),
 		onFilledIndexEntry: onFilledIndexEntry,
+		cancellation:       newCancellation(ctx),
 		portalsInTriangle:  make([][]portalData, len(portals)),
 		maxDepth:           uint16(maxDepth),
 	}
 }
 
 func (q *bestHomogeneousNonPureQuery) getIndex(i, j, k portalIndex) bestSolution {
-	return q.index[(uint(i)*q.numPortals+uint(j))*q.numPortals+uint(k)]
+	s0, s1, s2 := sortedIndices(i, j, k)
+	return q.index.get(s0, s1, s2)
 }
 func (q *bestHomogeneousNonPureQuery) bestMidpointAtDepth(i, j, k portalIndex, depth int) portalIndex {
 	solution := q.getIndex(i, j, k)
 	if int(solution.Length) < depth {
 		return invalidPortalIndex
 	}
-	return solution.Index
+	return solution.Index.portalIndex()
 }
 func (q *bestHomogeneousNonPureQuery) setIndex(i, j, k portalIndex, s bestSolution) {
-	q.index[(uint(i)*q.numPortals+uint(j))*q.numPortals+uint(k)] = s
+	s0, s1, s2 := sortedIndices(i, j, k)
+	if !q.index.set(s0, s1, s2, s) {
+		// Out of memory, stop the search the same way as if it got cancelled.
+		q.cancellation.cancelled = true
+	}
 }
 func (q *bestHomogeneousNonPureQuery) findBestHomogeneous(p0, p1, p2 portalData) {
 	if q.getIndex(p0.Index, p1.Index, p2.Index).Length != invalidLength {
@@ -67,13 +72,22 @@ func (q *bestHomogeneousNonPureQuery) findBestHomogeneous(p0, p1, p2 portalData)
 }
 
 func (q *bestHomogeneousNonPureQuery) findBestHomogeneousAux(p0, p1, p2 portalData, candidates []portalData) bestSolution {
+	if q.cancellation.check() {
+		return bestSolution{Index: invalidMemoPortalIndex, Length: invalidLength}
+	}
 	q.depth++
 	// make a copy of input slice to slice we'll be iterating over,
 	// as we're going to keep modifying the input slice by calling
 	//  partitionPortalsInsideWedge().
 	q.portalsInTriangle[q.depth] = append(q.portalsInTriangle[q.depth][:0], candidates...)
-	bestMidpoint := bestSolution{Index: invalidPortalIndex, Length: 1}
+	bestMidpoint := bestSolution{Index: invalidMemoPortalIndex, Length: 1}
 	for _, portal := range q.portalsInTriangle[q.depth] {
+		if !q.links.allowed(portal.Index, p0.Index) || !q.links.allowed(portal.Index, p1.Index) || !q.links.allowed(portal.Index, p2.Index) {
+			continue
+		}
+		if !q.fields.allowed(portal, p1, p2) || !q.fields.allowed(portal, p0, p2) || !q.fields.allowed(portal, p0, p1) {
+			continue
+		}
 		candidate0 := q.getIndex(portal.Index, p1.Index, p2.Index)
 		if candidate0.Length == invalidLength {
 			candidatesInWedge := partitionPortalsInsideWedge(candidates, portal, p1, p2)
@@ -98,28 +112,57 @@ func (q *bestHomogeneousNonPureQuery) findBestHomogeneousAux(p0, p1, p2 portalDa
 		if candidate2.Length < minDepth {
 			minDepth = candidate2.Length
 		}
+		if q.cancellation.cancelled {
+			break
+		}
 
 		if minDepth+1 > q.maxDepth {
 			minDepth = q.maxDepth - 1
 		}
 		if minDepth+1 > bestMidpoint.Length {
-			bestMidpoint.Index = portal.Index
+			bestMidpoint.Index = memoPortalIndex(portal.Index)
 			bestMidpoint.Length = minDepth + 1
 		}
 	}
+	if q.cancellation.cancelled {
+		// Don't store incomplete solutions, the index has to stay consistent
+		// so that we can still return the best solution found so far.
+		q.depth--
+		return bestSolution{Index: invalidMemoPortalIndex, Length: invalidLength}
+	}
 	q.onFilledIndexEntry()
 	q.setIndex(p0.Index, p1.Index, p2.Index, bestMidpoint)
-	q.setIndex(p0.Index, p2.Index, p1.Index, bestMidpoint)
-	q.setIndex(p1.Index, p0.Index, p2.Index, bestMidpoint)
-	q.setIndex(p1.Index, p2.Index, p0.Index, bestMidpoint)
-	q.setIndex(p2.Index, p0.Index, p1.Index, bestMidpoint)
-	q.setIndex(p2.Index, p1.Index, p0.Index, bestMidpoint)
 	q.depth--
+	if q.cancellation.cancelled {
+		return bestSolution{Index: invalidMemoPortalIndex, Length: invalidLength}
+	}
 	return bestMidpoint
 }
 
-// DeepestHomogeneous - Find deepest homogeneous field that can be made out of portals
-func DeepestHomogeneous(portals []Portal, options ...HomogeneousOption) ([]Portal, uint16) {
+// DeepestHomogeneous - Find deepest homogeneous field that can be made out of portals.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError,
+// if the search runs out of its memory budget returns the best solution found so far
+// and a *MemoryBudgetExceededError.
+func DeepestHomogeneous(ctx context.Context, portals []Portal, options ...HomogeneousOption) ([]Portal, uint16, error) {
+	results, err := TopHomogeneous(ctx, portals, 1, options...)
+	if len(results) == 0 {
+		return []Portal{}, 0, err
+	}
+	return results[0].Portals, results[0].Depth, err
+}
+
+// HomogeneousSolution - homogeneous field of given depth, first three portals are its corners
+type HomogeneousSolution struct {
+	Portals []Portal
+	Depth   uint16
+}
+
+// TopHomogeneous - Find up to numResults deepest homogeneous fields having distinct sets of portals,
+// sorted from the deepest one.
+// If ctx gets cancelled returns the best solutions found so far and a *CancelledError,
+// if the search runs out of its memory budget returns the best solutions found so far
+// and a *MemoryBudgetExceededError.
+func TopHomogeneous(ctx context.Context, portals []Portal, numResults int, options ...HomogeneousOption) ([]HomogeneousSolution, error) {
 	if len(portals) < 3 {
 		panic("Too short portal list")
 	}
@@ -178,28 +221,52 @@ func DeepestHomogeneous(portals []Portal, options ...HomogeneousOption) ([]Porta
 
 	params.progressFunc(0, numIndexEntries)
 	var q bestHomogeneousQuery
+	var links linkFilter
+	var budget *memoryBudget
 	if pure {
 		paramsPure := defaultHomogeneousPureParams()
 		for _, option := range options {
 			option.applyPure(&paramsPure)
 		}
-		resultIndices, bestDepth := deepestPureHomogeneous(portalsData, paramsPure)
-		result := []Portal{}
-		for _, index := range resultIndices {
-			result = append(result, portals[index])
+		disabled := disabledPortalsMask(portals, paramsPure.disabledPortals)
+		// Scorer and fixed corners are used only to pick the best fields of the deepest level,
+		// so the checkpointed state doesn't depend on them.
+		fingerprint := newCheckpointFingerprint("homogeneous_pure", portals)
+		fingerprint.addSegments(paramsPure.blockers)
+		fingerprint.addPortals(paramsPure.disabledPortals)
+		fingerprint.add(paramsPure.maxLinkLength, paramsPure.minFieldSize, paramsPure.maxDepth)
+		checkpoints := newCheckpointer(paramsPure.checkpoint, fingerprint)
+		resultIndices, bestDepth, err := topPureHomogeneous(ctx, portalsData, disabled, paramsPure, portalCosts(portals), numResults, checkpoints)
+		results := make([]HomogeneousSolution, 0, len(resultIndices))
+		for _, indices := range resultIndices {
+			results = append(results, homogeneousSolution(portals, indices, bestDepth))
 		}
-
-		return result, uint16(bestDepth)
-	} else if requires2 {
-		params2 := defaultHomogeneous2Params(len(portals))
+		return results, err
+	}
+	// Only the pure search manages without the indices of partial solutions.
+	if err := checkNumMemoPortals(len(portals)); err != nil {
+		return nil, err
+	}
+	if requires2 {
+		params2 := defaultHomogeneous2Params()
 		for _, option := range options {
 			option.apply2(&params2)
 		}
 		params = params2.homogeneousParams
-		q = newBestHomogeneous2Query(portalsData, params2.scorer, params2.maxDepth, onFilledIndexEntry)
+		budget = newMemoryBudget(params.memoryBudget)
+		scorer := params2.newScorer(len(portals), budget)
+		if params.topLevelScorer == nil {
+			params.topLevelScorer = scorer
+		}
+		links = newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength)
+		q = newBestHomogeneous2Query(ctx, portalsData, links, newFieldSizeFilter(params.minFieldSize), scorer, params2.maxDepth, budget, onFilledIndexEntry)
 	} else {
-		q = newBestHomogeneousQuery(portalsData, params.maxDepth, onFilledIndexEntry)
+		budget = newMemoryBudget(params.memoryBudget)
+		links = newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength)
+		q = newBestHomogeneousQuery(ctx, portalsData, links, newFieldSizeFilter(params.minFieldSize), params.maxDepth, budget, onFilledIndexEntry)
 	}
+	done := ctx.Done()
+mainLoop:
 	for i, p0 := range portalsData {
 		for j := i + 1; j < len(portalsData); j++ {
 			p1 := portalsData[j]
@@ -210,51 +277,112 @@ func DeepestHomogeneous(portals []Portal, options ...HomogeneousOption) ([]Porta
 				}
 				q.findBestHomogeneous(p0, p1, p2)
 			}
+			if budget.exceeded {
+				break mainLoop
+			}
+			select {
+			case <-done:
+				break mainLoop
+			default:
+			}
 		}
 	}
 	params.progressFunc(numIndexEntries, numIndexEntries)
 
-	bestP, bestDepth := pickBestTopLevelTriangle(portalsData, params, q)
-	resultIndices := []portalIndex{bestP[0].Index, bestP[1].Index, bestP[2].Index}
-	resultIndices = append(resultIndices, homogeneousResultIndices(bestP[0].Index, bestP[1].Index, bestP[2].Index, bestDepth, q)...)
-	result := []Portal{}
-	for _, index := range resultIndices {
-		result = append(result, portals[index])
+	triangles := pickTopLevelTriangles(portalsData, params, links, q, portalCosts(portals), numResults)
+	results := make([]HomogeneousSolution, 0, len(triangles))
+	for _, t := range triangles {
+		results = append(results, homogeneousSolution(portals, t.portals, t.depth))
 	}
 
-	return result, uint16(bestDepth)
+	if budget.exceeded {
+		return results, budget.err(len(portals))
+	}
+	if ctx.Err() != nil {
+		return results, cancelledError(ctx)
+	}
+	return results, nil
+}
+
+type homogeneousCandidate struct {
+	p0, p1, p2 portalIndex
+	depth      int
+	score      float32
+	cost       float64
+	// all the portals of the field, starting with the corners
+	portals []portalIndex
+}
+
+// betterHomogeneous compares fields by depth, then by cost, then by score.
+// The midpoints of a non pure field are picked by depth and score only,
+// so the cost decides just between fields having different corners.
+func betterHomogeneous(a, b homogeneousCandidate) bool {
+	if a.depth != b.depth {
+		return a.depth > b.depth
+	}
+	if a.cost != b.cost {
+		return a.cost < b.cost
+	}
+	return a.score > b.score
+}
+
+func homogeneousSolution(portals []Portal, indices []portalIndex, depth int) HomogeneousSolution {
+	result := make([]Portal, 0, len(indices))
+	for _, index := range indices {
+		result = append(result, portals[index])
+	}
+	return HomogeneousSolution{Portals: result, Depth: uint16(depth)}
 }
 
-func pickBestTopLevelTriangle(portalsData []portalData, params homogeneousParams, q bestHomogeneousQuery) ([3]portalData, int) {
-	bestDepth := 1
-	bestTriangle := [3]portalData{}
-	bestScore := float32(-math.MaxFloat32)
+func pickTopLevelTriangles(portalsData []portalData, params homogeneousParams, links linkFilter, q bestHomogeneousQuery, costs []float64, numResults int) []homogeneousCandidate {
+	fields := newFieldSizeFilter(params.minFieldSize)
+	minCost := minTotalCost(costs)
+	top := newTopSolutions(numResults, betterHomogeneous)
 	for i, p0 := range portalsData {
 		for j := i + 1; j < len(portalsData); j++ {
 			p1 := portalsData[j]
+			if !links.allowed(p0.Index, p1.Index) {
+				continue
+			}
 			for k := j + 1; k < len(portalsData); k++ {
 				if !hasAllElementsInTheTriple(params.fixedCornerIndices, i, j, k) {
 					continue
 				}
 				p2 := portalsData[k]
-				for depth := params.maxDepth; depth >= bestDepth; depth-- {
+				if !links.allowed(p0.Index, p2.Index) || !links.allowed(p1.Index, p2.Index) {
+					continue
+				}
+				if !fields.allowed(p0, p1, p2) {
+					continue
+				}
+				minDepth := 1
+				if len(top.solutions) == top.numSolutions {
+					minDepth = top.solutions[len(top.solutions)-1].depth
+				}
+				for depth := params.maxDepth; depth >= minDepth; depth-- {
 					if depth >= 2 {
 						if q.bestMidpointAtDepth(p0.Index, p1.Index, p2.Index, depth) >= invalidPortalIndex-1 {
 							continue
 						}
 					}
-					score := params.topLevelScorer.scoreTriangle(p0, p1, p2)
-					if depth > bestDepth || (depth == bestDepth && score > bestScore) {
-						bestTriangle = [3]portalData{p0, p1, p2}
-						bestDepth = depth
-						bestScore = score
+					candidate := homogeneousCandidate{
+						p0: p0.Index, p1: p1.Index, p2: p2.Index,
+						depth: depth,
+						score: params.topLevelScorer.scoreTriangle(p0, p1, p2),
+						cost:  minCost,
 					}
+					if top.accepts(candidate) {
+						candidate.portals = append([]portalIndex{p0.Index, p1.Index, p2.Index},
+							homogeneousResultIndices(p0.Index, p1.Index, p2.Index, depth, q)...)
+						candidate.cost = totalCost(costs, candidate.portals)
+						top.add(candidate, candidate.portals)
+					}
+					break
 				}
 			}
 		}
 	}
-	return bestTriangle, bestDepth
-
+	return top.solutions
 }
 
 func homogeneousResultIndices(p0, p1, p2 portalIndex, depth int, q bestHomogeneousQuery) []portalIndex {
@@ -1,10 +1,14 @@
 package lib
 
+import "context"
+
 type homogeneousTriangleScorer interface {
 	// resets scorer to compute scores for this triangle
 	reset(a, b, c portalData, numCandidates int)
 	scoreCandidate(p portalData)
-	bestMidpoints() [6]portalIndex
+	// returns best midpoints of the triangle for depths 2..7 and stores the scores
+	// of the triangle, returns false if they didn't fit in the memory budget
+	bestMidpoints() ([6]portalIndex, bool)
 }
 
 type homogeneousScorer interface {
@@ -19,37 +23,38 @@ type bestHomogeneous2Query struct {
 	onFilledIndexEntry func()
 	// all the portals
 	portals []portalData
+	// links which are possible to be made
+	links linkFilter
+	// fields large enough to be made
+	fields fieldSizeFilter
+	// used to stop the search early
+	cancellation cancellation
 	// index of triple of portals to a solution
 	// each permutations of the three portals stores the best solution
 	// for different depth - 2..7
-	index []portalIndex
+	index *tripleIndex[memoPortalIndex]
 	// preallocated storage for lists of portals within triangles at consecutive recursion depths
 	portalsInTriangle [][]portalData
 	// preallocated storage for triangle scorers at consecutive recursion depths
 	triangleScorers []homogeneousTriangleScorer
 	// maxDepth of solution to be found
 	maxDepth int
-	// count of portals (used to compute a solution index from indices of three portals)
-	numPortals uint
 	// current recursion depth
 	depth uint16
 }
 
-func newBestHomogeneous2Query(portals []portalData, scorer homogeneousScorer, maxDepth int, onFilledIndexEntry func()) *bestHomogeneous2Query {
-	numPortals := uint(len(portals))
-	index := make([]portalIndex, numPortals*numPortals*numPortals)
-	for i := 0; i < len(index); i++ {
-		index[i] = invalidPortalIndex
-	}
+func newBestHomogeneous2Query(ctx context.Context, portals []portalData, links linkFilter, fields fieldSizeFilter, scorer homogeneousScorer, maxDepth int, budget *memoryBudget, onFilledIndexEntry func()) *bestHomogeneous2Query {
 	triangleScorers := make([]homogeneousTriangleScorer, len(portals))
 	for i := 0; i < len(portals); i++ {
 		triangleScorers[i] = scorer.newTriangleScorer(maxDepth)
 	}
 	return &bestHomogeneous2Query{
 		portals:            portals,
-		index:              index,
-		numPortals:         numPortals,
+		links:              links,
+		fields:             fields,
+		index:              newTripleIndex(len(portals), invalidMemoPortalIndex, budget),
 		onFilledIndexEntry: onFilledIndexEntry,
+		cancellation:       newCancellation(ctx),
 		triangleScorers:    triangleScorers,
 		portalsInTriangle:  make([][]portalData, len(portals)),
 		maxDepth:           maxDepth,
@@ -58,7 +63,7 @@ func newBestHomogeneous2Query(portals []portalData, scorer homogeneousScorer, ma
 }
 
 func (q *bestHomogeneous2Query) getIndex(i, j, k portalIndex) portalIndex {
-	return q.index[(uint(i)*q.numPortals+uint(j))*q.numPortals+uint(k)]
+	return q.index.get(i, j, k).portalIndex()
 }
 func (q *bestHomogeneous2Query) bestMidpointAtDepth(i, j, k portalIndex, depth int) portalIndex {
 	s0, s1, s2 := sortedIndices(i, j, k)
@@ -67,7 +72,10 @@ func (q *bestHomogeneous2Query) bestMidpointAtDepth(i, j, k portalIndex, depth i
 }
 
 func (q *bestHomogeneous2Query) setIndex(i, j, k portalIndex, index portalIndex) {
-	q.index[(uint(i)*q.numPortals+uint(j))*q.numPortals+uint(k)] = index
+	if !q.index.set(i, j, k, newMemoPortalIndex(index)) {
+		// Out of memory, stop the search the same way as if it got cancelled.
+		q.cancellation.cancelled = true
+	}
 }
 
 func (q *bestHomogeneous2Query) findBestHomogeneous(p0, p1, p2 portalData) {
@@ -79,11 +87,20 @@ func (q *bestHomogeneous2Query) findBestHomogeneous(p0, p1, p2 portalData) {
 }
 
 func (q *bestHomogeneous2Query) findBestHomogeneousAux(p0, p1, p2 portalData, candidates []portalData) {
+	if q.cancellation.check() {
+		return
+	}
 	q.depth++
 	q.portalsInTriangle[q.depth] = append(q.portalsInTriangle[q.depth][:0], candidates...)
 	triangleScorer := q.triangleScorers[q.depth]
 	triangleScorer.reset(p0, p1, p2, len(candidates))
 	for _, portal := range q.portalsInTriangle[q.depth] {
+		if !q.links.allowed(portal.Index, p0.Index) || !q.links.allowed(portal.Index, p1.Index) || !q.links.allowed(portal.Index, p2.Index) {
+			continue
+		}
+		if !q.fields.allowed(portal, p1, p2) || !q.fields.allowed(portal, p0, p2) || !q.fields.allowed(portal, p0, p1) {
+			continue
+		}
 		if q.getIndex(portal.Index, p1.Index, p2.Index) == invalidPortalIndex {
 			candidatesInWedge := partitionPortalsInsideWedge(candidates, portal, p1, p2)
 			q.findBestHomogeneousAux(portal, p1, p2, candidatesInWedge)
@@ -96,10 +113,21 @@ func (q *bestHomogeneous2Query) findBestHomogeneousAux(p0, p1, p2 portalData, ca
 			candidatesInWedge := partitionPortalsInsideWedge(candidates, portal, p0, p1)
 			q.findBestHomogeneousAux(portal, p0, p1, candidatesInWedge)
 		}
+		if q.cancellation.cancelled {
+			// Leave the index entry unset, so that the index stays consistent.
+			q.depth--
+			return
+		}
 		triangleScorer.scoreCandidate(portal)
 	}
+	bestMidpoints, ok := triangleScorer.bestMidpoints()
+	if !ok {
+		// Out of memory, stop the search the same way as if it got cancelled.
+		q.cancellation.cancelled = true
+		q.depth--
+		return
+	}
 	q.onFilledIndexEntry()
-	bestMidpoints := triangleScorer.bestMidpoints()
 	s0, s1, s2 := sortedIndices(p0.Index, p1.Index, p2.Index)
 	q.setIndex(s0, s1, s2, bestMidpoints[0])
 	q.setIndex(s0, s2, s1, bestMidpoints[1])
@@ -5,82 +5,67 @@ import "math"
 // a scorer that picks a solution that maximises minimal height of a triangle
 // being part of the final solution.
 type thickTrianglesScorer struct {
-	minHeight  []float32
-	numPortals uint
+	minHeight *tripleIndex[float32]
 }
 
 type clumpPortalsScorer struct {
-	minDistance []float32
-	numPortals  uint
+	minDistance *tripleIndex[float32]
 }
 
-func newThickTrianglesScorer(numPortals int) *thickTrianglesScorer {
-	numPortals64 := uint(numPortals)
-	minHeight := make([]float32, numPortals64*numPortals64*numPortals64)
+func newThickTrianglesScorer(numPortals int, budget *memoryBudget) homogeneousScorer {
 	return &thickTrianglesScorer{
-		minHeight:  minHeight,
-		numPortals: numPortals64,
+		minHeight: newTripleIndex(numPortals, float32(0), budget),
 	}
 }
 
-func newClumpPortalsScorer(numPortals int) *clumpPortalsScorer {
-	numPortals64 := uint(numPortals)
-	minDistance := make([]float32, numPortals64*numPortals64*numPortals64)
-	for i := 0; i < len(minDistance); i++ {
-		minDistance[i] = -math.MaxFloat32
-	}
+func newClumpPortalsScorer(numPortals int, budget *memoryBudget) homogeneousScorer {
 	return &clumpPortalsScorer{
-		minDistance: minDistance,
-		numPortals:  numPortals64,
+		minDistance: newTripleIndex(numPortals, float32(-math.MaxFloat32), budget),
 	}
 }
 
 func (s *thickTrianglesScorer) scoreTriangle(a, b, c portalData) float32 {
-	return s.minHeight[(uint(a.Index)*s.numPortals+uint(b.Index))*s.numPortals+uint(c.Index)]
+	return s.minHeight.get(a.Index, b.Index, c.Index)
 }
 
 func (s *clumpPortalsScorer) scoreTriangle(a, b, c portalData) float32 {
-	return s.minDistance[(uint(a.Index)*s.numPortals+uint(b.Index))*s.numPortals+uint(c.Index)]
+	return s.minDistance.get(a.Index, b.Index, c.Index)
 }
 
 // scorer for picking the best midpoint of triangle a,b,c
 type thickTrianglesTriangleScorer struct {
-	scorePtrs  [6]*float32
-	minHeight  []float32
+	minHeight  *tripleIndex[float32]
 	acDistance distanceQuery
 	bcDistance distanceQuery
 	b          portalData
 	c          portalData
 	abDistance distanceQuery
 	a          portalData
-	numPortals uint
 	maxDepth   int
+	scores     [6]float32
 	candidates [6]portalIndex
 }
 
 type clumpPortalsTriangleScorer struct {
-	scorePtrs   [6]*float32
-	minDistance []float32
+	minDistance *tripleIndex[float32]
 	a           portalData
 	b           portalData
 	c           portalData
-	numPortals  uint
 	maxDepth    int
+	scores      [6]float32
 	candidates  [6]portalIndex
 }
 
 func (s *thickTrianglesScorer) newTriangleScorer(maxDepth int) homogeneousTriangleScorer {
 	return &thickTrianglesTriangleScorer{
-		minHeight:  s.minHeight,
-		numPortals: s.numPortals,
-		maxDepth:   maxDepth,
+		minHeight: s.minHeight,
+		maxDepth:  maxDepth,
 	}
 }
 
 func (s *clumpPortalsScorer) newTriangleScorer(maxDepth int) homogeneousTriangleScorer {
 	return &clumpPortalsTriangleScorer{
 		minDistance: s.minDistance,
-		numPortals:  s.numPortals,
 		maxDepth:    maxDepth,
 	}
 }
@@ -89,7 +74,7 @@ func (s *thickTrianglesTriangleScorer) reset(a, b, c portalData, numCandidates i
 	a, b, c = sorted(a, b, c)
 	for level := 2; level <= s.maxDepth; level++ {
 		i, j, k := indexOrdering(a.Index, b.Index, c.Index, level)
-		s.scorePtrs[level-2] = &s.minHeight[(uint(i)*s.numPortals+uint(j))*s.numPortals+uint(k)]
+		s.scores[level-2] = s.minHeight.get(i, j, k)
 	}
 	for i := 0; i < 6; i++ {
 		s.candidates[i] = invalidPortalIndex - 1
@@ -104,7 +89,7 @@ func (s *clumpPortalsTriangleScorer) reset(a, b, c portalData, numCandidates int
 	a, b, c = sorted(a, b, c)
 	for level := 2; level <= s.maxDepth; level++ {
 		i, j, k := indexOrdering(a.Index, b.Index, c.Index, level)
-		s.scorePtrs[level-2] = &s.minDistance[(uint(i)*s.numPortals+uint(j))*s.numPortals+uint(k)]
+		s.scores[level-2] = s.minDistance.get(i, j, k)
 	}
 	for i := 0; i < 6; i++ {
 		s.candidates[i] = invalidPortalIndex - 1
@@ -113,10 +98,22 @@ func (s *clumpPortalsTriangleScorer) reset(a, b, c portalData, numCandidates int
 }
 
 func (s *thickTrianglesTriangleScorer) getHeight(a, b, c portalIndex) float32 {
-	return s.minHeight[(uint(a)*s.numPortals+uint(b))*s.numPortals+uint(c)]
+	return s.minHeight.get(a, b, c)
 }
 func (s *clumpPortalsTriangleScorer) getDistance(a, b, c portalIndex) float32 {
-	return s.minDistance[(uint(a)*s.numPortals+uint(b))*s.numPortals+uint(c)]
+	return s.minDistance.get(a, b, c)
+}
+
+// storeScores stores the scores of the triangle at each of the levels in the index,
+// returns false if they don't fit in the memory budget.
+func storeScores(index *tripleIndex[float32], a, b, c portalIndex, scores *[6]float32, maxDepth int) bool {
+	for level := 2; level <= maxDepth; level++ {
+		i, j, k := indexOrdering(a, b, c, level)
+		if !index.set(i, j, k, scores[level-2]) {
+			return false
+		}
+	}
+	return true
 }
 
 // assuming a,b are ordered(sorted), return sorted triple of (p, a, b)
@@ -140,8 +137,8 @@ func (s *thickTrianglesTriangleScorer) scoreCandidate(p portalData) {
 			min(
 				float64(s.acDistance.ChordAngle(p.LatLng)),
 				float64(s.bcDistance.ChordAngle(p.LatLng)))) * RadiansToMeters)
-	if lvl2Height > *s.scorePtrs[0] {
-		*s.scorePtrs[0] = lvl2Height
+	if lvl2Height > s.scores[0] {
+		s.scores[0] = lvl2Height
 		s.candidates[0] = p.Index
 	}
 	s0, s1, s2 := merge(p.Index, s.a.Index, s.b.Index)
@@ -159,8 +156,8 @@ func (s *thickTrianglesTriangleScorer) scoreCandidate(p portalData) {
 		if minHeight == 0 {
 			break
 		}
-		if minHeight > *s.scorePtrs[level-2] {
-			*s.scorePtrs[level-2] = minHeight
+		if minHeight > s.scores[level-2] {
+			s.scores[level-2] = minHeight
 			s.candidates[level-2] = p.Index
 		}
 	}
@@ -175,8 +172,8 @@ func (s *clumpPortalsTriangleScorer) scoreCandidate(p portalData) {
 			min(
 				distance(s.b, p),
 				distance(s.c, p))) * RadiansToMeters)
-	if minDistance > *s.scorePtrs[0] {
-		*s.scorePtrs[0] = minDistance
+	if minDistance > s.scores[0] {
+		s.scores[0] = minDistance
 		s.candidates[0] = p.Index
 	}
 	s0, s1, s2 := merge(p.Index, s.a.Index, s.b.Index)
@@ -199,16 +196,16 @@ func (s *clumpPortalsTriangleScorer) scoreCandidate(p portalData) {
 			return
 		}
 		dist := minDistance + sDist + tDist + uDist
-		if dist > *s.scorePtrs[level-2] {
-			*s.scorePtrs[level-2] = dist
+		if dist > s.scores[level-2] {
+			s.scores[level-2] = dist
 			s.candidates[level-2] = p.Index
 		}
 	}
 }
 
-func (s *thickTrianglesTriangleScorer) bestMidpoints() [6]portalIndex {
-	return s.candidates
+func (s *thickTrianglesTriangleScorer) bestMidpoints() ([6]portalIndex, bool) {
+	return s.candidates, storeScores(s.minHeight, s.a.Index, s.b.Index, s.c.Index, &s.scores, s.maxDepth)
 }
-func (s *clumpPortalsTriangleScorer) bestMidpoints() [6]portalIndex {
-	return s.candidates
+func (s *clumpPortalsTriangleScorer) bestMidpoints() ([6]portalIndex, bool) {
+	return s.candidates, storeScores(s.minDistance, s.a.Index, s.b.Index, s.c.Index, &s.scores, s.maxDepth)
 }
@@ -31,8 +31,8 @@ type HomogeneousSpreadAround struct{}
 func (h HomogeneousSpreadAround) requires2() bool                 { return true }
 func (h HomogeneousSpreadAround) apply(params *homogeneousParams) { panic("unsupported") }
 func (h HomogeneousSpreadAround) apply2(params *homogeneous2Params) {
-	params.scorer = newThickTrianglesScorer(params.numPortals)
-	params.topLevelScorer = params.scorer
+	params.newScorer = newThickTrianglesScorer
+	params.topLevelScorer = nil
 }
 func (h HomogeneousSpreadAround) applyPure(params *homogeneousPureParams) {
 	params.scorer = thickTrianglesPureScorer{}
@@ -43,8 +43,8 @@ type HomogeneousClumpTogether struct{}
 func (h HomogeneousClumpTogether) requires2() bool                 { return true }
 func (h HomogeneousClumpTogether) apply(params *homogeneousParams) { panic("unsupported") }
 func (h HomogeneousClumpTogether) apply2(params *homogeneous2Params) {
-	params.scorer = newClumpPortalsScorer(params.numPortals)
-	params.topLevelScorer = params.scorer
+	params.newScorer = newClumpPortalsScorer
+	params.topLevelScorer = nil
 }
 func (h HomogeneousClumpTogether) applyPure(params *homogeneousPureParams) {
 	panic("not implemented")
@@ -162,18 +162,92 @@ func (h HomogeneousPure) applyPure(params *homogeneousPureParams) {}
 
 type HomogeneousDisabledPortals []Portal
 
-func (h HomogeneousDisabledPortals) requires2() bool                   { return false }
-func (h HomogeneousDisabledPortals) apply(params *homogeneousParams)   {}
-func (h HomogeneousDisabledPortals) apply2(params *homogeneous2Params) {}
+func (h HomogeneousDisabledPortals) requires2() bool { return false }
+func (h HomogeneousDisabledPortals) apply(params *homogeneousParams) {
+	params.disabledPortals = []Portal(h)
+}
+func (h HomogeneousDisabledPortals) apply2(params *homogeneous2Params) {
+	params.disabledPortals = []Portal(h)
+}
 func (h HomogeneousDisabledPortals) applyPure(params *homogeneousPureParams) {
-	params.disabledPortals = portalsToPortalData(h)
+	params.disabledPortals = []Portal(h)
+}
+
+type HomogeneousBlockers []Segment
+
+func (h HomogeneousBlockers) requires2() bool { return false }
+func (h HomogeneousBlockers) apply(params *homogeneousParams) {
+	params.blockers = []Segment(h)
+}
+func (h HomogeneousBlockers) apply2(params *homogeneous2Params) {
+	params.blockers = []Segment(h)
+}
+func (h HomogeneousBlockers) applyPure(params *homogeneousPureParams) {
+	params.blockers = []Segment(h)
+}
+
+// HomogeneousMaxLinkLength - don't make links longer than that many meters
+type HomogeneousMaxLinkLength float64
+
+func (h HomogeneousMaxLinkLength) requires2() bool { return false }
+func (h HomogeneousMaxLinkLength) apply(params *homogeneousParams) {
+	params.maxLinkLength = float64(h)
+}
+func (h HomogeneousMaxLinkLength) apply2(params *homogeneous2Params) {
+	params.maxLinkLength = float64(h)
+}
+func (h HomogeneousMaxLinkLength) applyPure(params *homogeneousPureParams) {
+	params.maxLinkLength = float64(h)
+}
+
+// HomogeneousMinFieldSize - don't make fields smaller than that
+type HomogeneousMinFieldSize FieldSize
+
+func (h HomogeneousMinFieldSize) requires2() bool { return false }
+func (h HomogeneousMinFieldSize) apply(params *homogeneousParams) {
+	params.minFieldSize = FieldSize(h)
+}
+func (h HomogeneousMinFieldSize) apply2(params *homogeneous2Params) {
+	params.minFieldSize = FieldSize(h)
+}
+func (h HomogeneousMinFieldSize) applyPure(params *homogeneousPureParams) {
+	params.minFieldSize = FieldSize(h)
+}
+
+// HomogeneousMemoryBudget - limit in bytes of memory used by the index of partial solutions.
+// Ignored by the pure homogeneous search.
+type HomogeneousMemoryBudget uint64
+
+func (h HomogeneousMemoryBudget) requires2() bool { return false }
+func (h HomogeneousMemoryBudget) apply(params *homogeneousParams) {
+	params.memoryBudget = uint64(h)
+}
+func (h HomogeneousMemoryBudget) apply2(params *homogeneous2Params) {
+	params.memoryBudget = uint64(h)
+}
+func (h HomogeneousMemoryBudget) applyPure(params *homogeneousPureParams) {}
+
+// HomogeneousCheckpoint - periodically save the state of the search to a file and resume from it.
+// Used only by the pure homogeneous search.
+type HomogeneousCheckpoint Checkpoint
+
+func (h HomogeneousCheckpoint) requires2() bool                   { return false }
+func (h HomogeneousCheckpoint) apply(params *homogeneousParams)   {}
+func (h HomogeneousCheckpoint) apply2(params *homogeneous2Params) {}
+func (h HomogeneousCheckpoint) applyPure(params *homogeneousPureParams) {
+	params.checkpoint = Checkpoint(h)
 }
 
 type homogeneousParams struct {
 	topLevelScorer     homogeneousTopLevelScorer
 	progressFunc       func(int, int)
 	fixedCornerIndices []int
+	blockers           []Segment
+	disabledPortals    []Portal
+	maxLinkLength      float64
+	minFieldSize       FieldSize
 	maxDepth           int
+	memoryBudget       uint64
 }
 
 func defaultHomogeneousParams() homogeneousParams {
@@ -181,36 +255,40 @@ func defaultHomogeneousParams() homogeneousParams {
 		maxDepth:       6,
 		topLevelScorer: smallestTriangleScorer{},
 		progressFunc:   func(int, int) {},
+		memoryBudget:   DefaultMemoryBudget,
 	}
 }
 
 type homogeneous2Params struct {
-	scorer homogeneousScorer
+	// scorer is created only once the memory budget is known
+	newScorer func(numPortals int, budget *memoryBudget) homogeneousScorer
 	homogeneousParams
-	numPortals int
 }
 
-func defaultHomogeneous2Params(numPortals int) homogeneous2Params {
-	defaultScorer := newThickTrianglesScorer(numPortals)
+func defaultHomogeneous2Params() homogeneous2Params {
 	return homogeneous2Params{
 		homogeneousParams: homogeneousParams{
 			maxDepth: 6,
-			// by default pick top level triangle with the highest score
-			topLevelScorer: defaultScorer,
+			// by default (if nil) pick top level triangle with the highest score
+			topLevelScorer: nil,
 			progressFunc:   func(int, int) {},
+			memoryBudget:   DefaultMemoryBudget,
 		},
-		numPortals: numPortals,
-		scorer:     defaultScorer,
+		newScorer: newThickTrianglesScorer,
 	}
 }
 
 type homogeneousPureParams struct {
 	scorer             homogeneousPureScorer
 	progressFunc       func(int, int)
-	disabledPortals    []portalData
+	disabledPortals    []Portal
 	fixedCornerIndices []int
+	blockers           []Segment
+	maxLinkLength      float64
+	minFieldSize       FieldSize
 	maxDepth           int
 	numWorkers         int
+	checkpoint         Checkpoint
 }
 
 func defaultHomogeneousPureParams() homogeneousPureParams {
@@ -1,8 +1,10 @@
 package lib
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
-	"math"
+	"io"
 	"sync"
 
 	"github.com/golang/geo/r3"
@@ -49,10 +51,12 @@ func sortHomogeneousPureNodesByDistance(nodes []homogeneousPureNode) {
 type lvlNTriangleQuery struct {
 	portals                      []portalData
 	disabledPortals              []portalData
+	links                        linkFilter
+	fields                       fieldSizeFilter
 	expectedNumPortalsInTriangle int
 }
 
-func newLvlNTriangleQuery(portals []portalData, disabledPortals []portalData, level int) *lvlNTriangleQuery {
+func newLvlNTriangleQuery(portals []portalData, disabledPortals []portalData, links linkFilter, fields fieldSizeFilter, level int) *lvlNTriangleQuery {
 	expectedNumPortalsInTriangle := 0
 	for i := 1; i < level; i++ {
 		expectedNumPortalsInTriangle = expectedNumPortalsInTriangle*3 + 1
@@ -60,6 +64,8 @@ func newLvlNTriangleQuery(portals []portalData, disabledPortals []portalData, le
 	return &lvlNTriangleQuery{
 		portals:                      portals,
 		disabledPortals:              disabledPortals,
+		links:                        links,
+		fields:                       fields,
 		expectedNumPortalsInTriangle: expectedNumPortalsInTriangle,
 	}
 }
@@ -71,6 +77,7 @@ type lvlNTriangleRequest struct {
 }
 
 func lvlNTriangleWorker(
+	ctx context.Context,
 	q *lvlNTriangleQuery,
 	requestChannel, responseChannel chan lvlNTriangleRequest,
 	wg *sync.WaitGroup) {
@@ -85,7 +92,16 @@ func lvlNTriangleWorker(
 	portalsInTriangle := []portalIndex{}
 	for req := range requestChannel {
 		req.third = req.third[:0]
+		if ctx.Err() != nil {
+			// Just drain the request channel.
+			responseChannel <- req
+			continue
+		}
 		p0, p1 := req.p0, req.p1
+		if !q.links.allowed(p0.Index, p1.Index) {
+			responseChannel <- req
+			continue
+		}
 		portalsLeftOfLine = portalsLeftOfLine[:0]
 		disabledPortalsLeftOfLine = disabledPortalsLeftOfLine[:0]
 		p01, p10 := normalizedVector(p0.LatLng, p1.LatLng), normalizedVector(p1.LatLng, p0.LatLng)
@@ -124,6 +140,9 @@ func lvlNTriangleWorker(
 			if node.index <= p0.Index {
 				continue
 			}
+			if !q.links.allowed(p1.Index, node.index) || !q.links.allowed(node.index, p0.Index) {
+				continue
+			}
 			for _, disabledPortal := range disabledPortalsLeftOfLine {
 				// Triangle contains a disabled portal so cannot make a pure field.
 				if disabledPortal.start <= node.start && disabledPortal.end <= node.end && disabledPortal.distance <= node.distance {
@@ -141,7 +160,7 @@ func lvlNTriangleWorker(
 					}
 				}
 			}
-			if numPortalsInTriangle == q.expectedNumPortalsInTriangle && areValidPureHomogeneousPortals(p0.Index, p1.Index, node.index, portalsInTriangle, q.portals) {
+			if numPortalsInTriangle == q.expectedNumPortalsInTriangle && areValidPureHomogeneousPortals(p0.Index, p1.Index, node.index, portalsInTriangle, q.portals, q.links, q.fields) {
 				req.third = append(req.third, node.index)
 			}
 		}
@@ -163,18 +182,24 @@ type mergeTrianglesRequest struct {
 }
 
 func mergeTrianglesWorker(
+	ctx context.Context,
 	portals []portalData,
 	triangles [][]portalIndex,
 	requestChannel, responseChannel chan mergeTrianglesRequest,
 	wg *sync.WaitGroup) {
-	numPortals := uint32(len(portals))
+	numPortals := uint(len(portals))
 	for req := range requestChannel {
 		req.triangles = req.triangles[:0]
+		if ctx.Err() != nil {
+			// Just drain the request channel.
+			responseChannel <- req
+			continue
+		}
 		// p0 is the central portal of the triangle, p1 is one of the corners.
 		// Find two remaining corners.
 		p0, p1 := req.p0, req.p1
-		edgeIndex := uint32(p0)*numPortals + uint32(p1)
-		revEdgeIndex := uint32(p1)*numPortals + uint32(p0)
+		edgeIndex := uint(p0)*numPortals + uint(p1)
+		revEdgeIndex := uint(p1)*numPortals + uint(p0)
 		for _, third0 := range triangles[edgeIndex] {
 			// Emit each triangle only once to make sure we have consistent
 			// data, even in the face of duplicate or colinear portals.
@@ -187,7 +212,7 @@ func mergeTrianglesWorker(
 				if third0 >= third1 || !s2.Sign(portals[p0].LatLng, portals[third0].LatLng, portals[third1].LatLng) {
 					continue
 				}
-				thirdEdgeIndex := uint32(third0)*numPortals + uint32(third1)
+				thirdEdgeIndex := uint(third0)*numPortals + uint(third1)
 				for _, third2 := range triangles[thirdEdgeIndex] {
 					if third2 == p0 {
 						req.triangles = append(req.triangles, triangle{p1, third0, third1})
@@ -200,7 +225,7 @@ func mergeTrianglesWorker(
 	wg.Done()
 }
 
-func findAllLvlNTriangles(portals []portalData, params homogeneousPureParams, level int) ([][]portalIndex, []edge) {
+func findAllLvlNTriangles(ctx context.Context, portals []portalData, links linkFilter, params homogeneousPureParams, level int) ([][]portalIndex, []edge) {
 	resultCache := sync.Pool{
 		New: func() interface{} {
 			return []portalIndex{}
@@ -211,21 +236,25 @@ func findAllLvlNTriangles(portals []portalData, params homogeneousPureParams, le
 	responseChannel := make(chan lvlNTriangleRequest, params.numWorkers)
 	var wg sync.WaitGroup
 	wg.Add(params.numWorkers)
-	q := newLvlNTriangleQuery(portals, params.disabledPortals, level)
+	q := newLvlNTriangleQuery(portals, portalsToPortalData(params.disabledPortals), links, newFieldSizeFilter(params.minFieldSize), level)
 	for i := 0; i < params.numWorkers; i++ {
-		go lvlNTriangleWorker(q, requestChannel, responseChannel, &wg)
+		go lvlNTriangleWorker(ctx, q, requestChannel, responseChannel, &wg)
 	}
 	go func() {
+		defer close(requestChannel)
 		for i, p0 := range portals {
 			for _, p1 := range portals[i+1:] {
-				requestChannel <- lvlNTriangleRequest{
+				select {
+				case requestChannel <- lvlNTriangleRequest{
 					p0:    p0,
 					p1:    p1,
 					third: resultCache.Get().([]portalIndex),
+				}:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
-		close(requestChannel)
 	}()
 	go func() {
 		wg.Wait()
@@ -244,22 +273,22 @@ func findAllLvlNTriangles(portals []portalData, params homogeneousPureParams, le
 	numProcessedPairs := 0
 	numProcessedPairsModN := 0
 
-	numPortals := uint32(len(portals))
+	numPortals := uint(len(portals))
 	numLvlNTriangles := 0
 	for resp := range responseChannel {
 		if len(resp.third) > 0 {
-			edge0Index := uint32(resp.p0.Index)*numPortals + uint32(resp.p1.Index)
+			edge0Index := uint(resp.p0.Index)*numPortals + uint(resp.p1.Index)
 			if len(lvlNTriangles[edge0Index]) == 0 {
 				lvlNEdges = append(lvlNEdges, edge{resp.p0.Index, resp.p1.Index})
 			}
 			lvlNTriangles[edge0Index] = append(lvlNTriangles[edge0Index], resp.third...)
 			for _, third := range resp.third {
-				edge1Index := uint32(resp.p1.Index)*numPortals + uint32(third)
+				edge1Index := uint(resp.p1.Index)*numPortals + uint(third)
 				if len(lvlNTriangles[edge1Index]) == 0 {
 					lvlNEdges = append(lvlNEdges, edge{resp.p1.Index, third})
 				}
 				lvlNTriangles[edge1Index] = append(lvlNTriangles[edge1Index], resp.p0.Index)
-				edge2Index := uint32(third)*numPortals + uint32(resp.p0.Index)
+				edge2Index := uint(third)*numPortals + uint(resp.p0.Index)
 				if len(lvlNTriangles[edge2Index]) == 0 {
 					lvlNEdges = append(lvlNEdges, edge{third, resp.p0.Index})
 				}
@@ -280,20 +309,96 @@ func findAllLvlNTriangles(portals []portalData, params homogeneousPureParams, le
 	return lvlNTriangles, lvlNEdges
 }
 
-func deepestPureHomogeneous(portals []portalData, params homogeneousPureParams) ([]portalIndex, int) {
+// writePureHomogeneousLevel writes all the triangles of a level of the search,
+// in a format readable by readPureHomogeneousLevel.
+func writePureHomogeneousLevel(w io.Writer, numPortals int, depth int, triangles [][]portalIndex, edges []edge) error {
+	if err := binary.Write(w, binary.LittleEndian, [2]uint64{uint64(depth), uint64(len(edges))}); err != nil {
+		return err
+	}
+	for _, e := range edges {
+		thirds := triangles[int(e.p0)*numPortals+int(e.p1)]
+		if err := binary.Write(w, binary.LittleEndian, [3]uint32{uint32(e.p0), uint32(e.p1), uint32(len(thirds))}); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, thirds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPureHomogeneousLevel(r io.Reader, numPortals int) (int, [][]portalIndex, []edge, error) {
+	var header [2]uint64
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return 0, nil, nil, err
+	}
+	triangles := make([][]portalIndex, numPortals*numPortals)
+	edges := make([]edge, 0, header[1])
+	for i := uint64(0); i < header[1]; i++ {
+		var edgeHeader [3]uint32
+		if err := binary.Read(r, binary.LittleEndian, &edgeHeader); err != nil {
+			return 0, nil, nil, err
+		}
+		if edgeHeader[0] >= uint32(numPortals) || edgeHeader[1] >= uint32(numPortals) || edgeHeader[2] > uint32(numPortals) {
+			return 0, nil, nil, fmt.Errorf("invalid edge %d-%d", edgeHeader[0], edgeHeader[1])
+		}
+		thirds := make([]portalIndex, edgeHeader[2])
+		if err := binary.Read(r, binary.LittleEndian, thirds); err != nil {
+			return 0, nil, nil, err
+		}
+		e := edge{portalIndex(edgeHeader[0]), portalIndex(edgeHeader[1])}
+		triangles[int(e.p0)*numPortals+int(e.p1)] = thirds
+		edges = append(edges, e)
+	}
+	return int(header[0]), triangles, edges, nil
+}
+
+// Every triangle found at any of the levels is a valid solution of that depth,
+// so if ctx gets cancelled we return the best of the triangles found at the deepest level reached.
+// Returns up to numResults best fields of the deepest level, all of them have distinct sets of portals,
+// as two different pure homogeneous fields of the same depth never share all their portals.
+// Triangles of the last completed level get checkpointed, so that the search may resume from the next level.
+func topPureHomogeneous(ctx context.Context, portals []portalData, disabled []bool, params homogeneousPureParams, costs []float64, numResults int, checkpoints *checkpointer) ([][]portalIndex, int, error) {
 	var prevTriangles [][]portalIndex
 	var prevEdges []edge
+	// Edges of merged triangles are edges of triangles of the lower level,
+	// so it's enough to check links while looking for the initial level triangles.
+	// Disabled portals cannot be linked, so no triangle containing them is found.
+	links := newLinkFilter(portals, params.blockers, disabled, params.maxLinkLength)
 	initialLevel := 4
 	if params.maxDepth < initialLevel {
 		initialLevel = params.maxDepth
 	}
-	for {
-		prevTriangles, prevEdges = findAllLvlNTriangles(portals, params, initialLevel)
-		if len(prevEdges) > 0 || initialLevel <= 1 {
+	resumed, err := checkpoints.load(func(r io.Reader) error {
+		var err error
+		initialLevel, prevTriangles, prevEdges, err = readPureHomogeneousLevel(r, len(portals))
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for !resumed {
+		prevTriangles, prevEdges = findAllLvlNTriangles(ctx, portals, links, params, initialLevel)
+		if len(prevEdges) > 0 || initialLevel <= 1 || ctx.Err() != nil {
 			break
 		}
 		initialLevel--
 	}
+	// The last level found without getting cancelled, and whether it's been checkpointed.
+	completeDepth, completeTriangles, completeEdges := initialLevel, prevTriangles, prevEdges
+	completeLevelSaved := resumed
+	if ctx.Err() != nil {
+		completeDepth = 0
+	}
+	saveCompleteLevel := func() {
+		checkpoints.save(func(w io.Writer) error {
+			return writePureHomogeneousLevel(w, len(portals), completeDepth, completeTriangles, completeEdges)
+		})
+		completeLevelSaved = true
+	}
+	if completeDepth > 0 && checkpoints.due() {
+		saveCompleteLevel()
+	}
 
 	resultCache := sync.Pool{
 		New: func() interface{} {
@@ -302,26 +407,30 @@ func deepestPureHomogeneous(portals []portalData, params homogeneousPureParams)
 	}
 
 	bestDepth := initialLevel
-	for depth := initialLevel + 1; depth < params.maxDepth; depth++ {
+	for depth := initialLevel + 1; depth < params.maxDepth && ctx.Err() == nil; depth++ {
 		requestChannel := make(chan mergeTrianglesRequest, params.numWorkers)
 		responseChannel := make(chan mergeTrianglesRequest, params.numWorkers)
 		var wg sync.WaitGroup
 		wg.Add(params.numWorkers)
 		for i := 0; i < params.numWorkers; i++ {
-			go mergeTrianglesWorker(portals, prevTriangles, requestChannel, responseChannel, &wg)
+			go mergeTrianglesWorker(ctx, portals, prevTriangles, requestChannel, responseChannel, &wg)
 		}
 
 		newTriangles := 0
 
 		go func() {
+			defer close(requestChannel)
 			for _, commonEdge := range prevEdges {
-				requestChannel <- mergeTrianglesRequest{
+				select {
+				case requestChannel <- mergeTrianglesRequest{
 					p0:        commonEdge.p0,
 					p1:        commonEdge.p1,
 					triangles: resultCache.Get().([]triangle),
+				}:
+				case <-ctx.Done():
+					return
 				}
 			}
-			close(requestChannel)
 		}()
 		go func() {
 			wg.Wait()
@@ -340,22 +449,22 @@ func deepestPureHomogeneous(portals []portalData, params homogeneousPureParams)
 
 		lvlNTriangles := make([][]portalIndex, len(portals)*len(portals))
 		lvlNEdges := []edge{}
-		numPortals := uint32(len(portals))
+		numPortals := uint(len(portals))
 
 		for resp := range responseChannel {
 			for _, triangle := range resp.triangles {
 				newTriangles++
-				edgeIndex0 := uint32(triangle.p0)*numPortals + uint32(triangle.p1)
+				edgeIndex0 := uint(triangle.p0)*numPortals + uint(triangle.p1)
 				lvlNTriangles[edgeIndex0] = append(lvlNTriangles[edgeIndex0], triangle.p2)
 				if len(lvlNTriangles[edgeIndex0]) == 1 {
 					lvlNEdges = append(lvlNEdges, edge{triangle.p0, triangle.p1})
 				}
-				edgeIndex1 := uint32(triangle.p1)*numPortals + uint32(triangle.p2)
+				edgeIndex1 := uint(triangle.p1)*numPortals + uint(triangle.p2)
 				lvlNTriangles[edgeIndex1] = append(lvlNTriangles[edgeIndex1], triangle.p0)
 				if len(lvlNTriangles[edgeIndex1]) == 1 {
 					lvlNEdges = append(lvlNEdges, edge{triangle.p1, triangle.p2})
 				}
-				edgeIndex2 := uint32(triangle.p2)*numPortals + uint32(triangle.p0)
+				edgeIndex2 := uint(triangle.p2)*numPortals + uint(triangle.p0)
 				lvlNTriangles[edgeIndex2] = append(lvlNTriangles[edgeIndex2], triangle.p1)
 				if len(lvlNTriangles[edgeIndex2]) == 1 {
 					lvlNEdges = append(lvlNEdges, edge{triangle.p2, triangle.p0})
@@ -378,11 +487,49 @@ func deepestPureHomogeneous(portals []portalData, params homogeneousPureParams)
 		prevTriangles = lvlNTriangles
 		prevEdges = lvlNEdges
 		bestDepth = depth
+		if ctx.Err() == nil {
+			completeDepth, completeTriangles, completeEdges = depth, lvlNTriangles, lvlNEdges
+			completeLevelSaved = false
+			if checkpoints.due() {
+				saveCompleteLevel()
+			}
+		}
+	}
+	if ctx.Err() == nil {
+		checkpoints.remove()
+	} else if checkpoints.enabled() && checkpoints.err == nil && completeDepth > 0 && !completeLevelSaved {
+		// Save the last complete level of the interrupted search, so that it can be resumed.
+		saveCompleteLevel()
+	}
+
+	var triangleVertices func(p0, p1, p2 portalData, depth int, portals []portalData) []portalIndex
+	triangleVertices = func(p0, p1, p2 portalData, depth int, portals []portalData) []portalIndex {
+		if depth == 1 {
+			return []portalIndex{}
+		}
+		portalsInTriangle := portalsInsideTriangle(portals, p0, p1, p2, nil)
+		center := findHomogeneousCenterPortal(p0, p1, p2, portalsInTriangle)
+		result := []portalIndex{portalIndex(center.Index)}
+		result = append(result, triangleVertices(center, p1, p2, depth-1, portalsInTriangle)...)
+		result = append(result, triangleVertices(p0, center, p2, depth-1, portalsInTriangle)...)
+		result = append(result, triangleVertices(p0, p1, center, depth-1, portalsInTriangle)...)
+		return result
+
+	}
+	// Disabled portals lying on the border of the triangle may be counted as inside
+	// by portalsInsideTriangle, skip them as they cannot be the center portals anyway.
+	candidatePortals := portals
+	if disabled != nil {
+		candidatePortals = make([]portalData, 0, len(portals))
+		for _, portal := range portals {
+			if !disabled[portal.Index] {
+				candidatePortals = append(candidatePortals, portal)
+			}
+		}
 	}
 
-	var bestP0, bestP1, bestP2 int
-	foundSolution := false
-	bestTriangleScore := float32(-math.MaxFloat32)
+	minCost := minTotalCost(costs)
+	top := newTopSolutions(numResults, betterHomogeneous)
 	for edge, edgeTriangles := range prevTriangles {
 		if len(edgeTriangles) == 0 {
 			continue
@@ -402,34 +549,36 @@ func deepestPureHomogeneous(portals []portalData, params homogeneousPureParams)
 			}
 			score := params.scorer.scoreTrianglePure(
 				portals[p0], portals[p1], portals[p2], bestDepth, portals)
-			if score > bestTriangleScore {
-				bestTriangleScore = score
-				bestP0, bestP1, bestP2 = p0, p1, int(p2)
-				foundSolution = true
+			candidate := homogeneousCandidate{
+				p0: portalIndex(p0), p1: portalIndex(p1), p2: p2,
+				depth: bestDepth, score: score, cost: minCost,
+			}
+			if costs != nil {
+				if !top.accepts(candidate) {
+					continue
+				}
+				candidate.cost = totalCost(costs, append([]portalIndex{candidate.p0, candidate.p1, candidate.p2},
+					triangleVertices(portals[p0], portals[p1], portals[p2], bestDepth, candidatePortals)...))
 			}
+			top.add(candidate, []portalIndex{candidate.p0, candidate.p1, candidate.p2})
 		}
 	}
 
-	if !foundSolution {
-		return []portalIndex{}, 0
+	if checkpoints.err != nil {
+		err = checkpoints.err
+	} else if ctx.Err() != nil {
+		err = cancelledError(ctx)
+	}
+	if len(top.solutions) == 0 {
+		return nil, 0, err
 	}
 
-	var triangleVertices func(p0, p1, p2 portalData, depth int, portals []portalData) []portalIndex
-	triangleVertices = func(p0, p1, p2 portalData, depth int, portals []portalData) []portalIndex {
-		if depth == 1 {
-			return []portalIndex{}
-		}
-		portalsInTriangle := portalsInsideTriangle(portals, p0, p1, p2, nil)
-		center := findHomogeneousCenterPortal(p0, p1, p2, portalsInTriangle)
-		result := []portalIndex{portalIndex(center.Index)}
-		result = append(result, triangleVertices(center, p1, p2, depth-1, portalsInTriangle)...)
-		result = append(result, triangleVertices(p0, center, p2, depth-1, portalsInTriangle)...)
-		result = append(result, triangleVertices(p0, p1, center, depth-1, portalsInTriangle)...)
-		return result
-
+	results := make([][]portalIndex, 0, len(top.solutions))
+	for _, t := range top.solutions {
+		results = append(results, append([]portalIndex{t.p0, t.p1, t.p2},
+			triangleVertices(portals[t.p0], portals[t.p1], portals[t.p2], bestDepth, candidatePortals)...))
 	}
-	return append([]portalIndex{portalIndex(bestP0), portalIndex(bestP1), portalIndex(bestP2)},
-		triangleVertices(portals[bestP0], portals[bestP1], portals[bestP2], bestDepth, portals)...), bestDepth
+	return results, bestDepth, err
 }
 
 // Assuming p0, p1, p2 are corners of a pure homogeneous field, find its center portal.
@@ -461,9 +610,15 @@ func findHomogeneousCenterPortal(p0, p1, p2 portalData, portalsInTriangle []port
 	panic("Could not find center portal")
 }
 
-func areValidPureHomogeneousPortals(p0, p1, p2 portalIndex, inside []portalIndex, portals []portalData) bool {
-	if len(inside) <= 1 {
-		return true
+// Fields of higher levels contain the fields checked here, so they're never smaller than them.
+func areValidPureHomogeneousPortals(p0, p1, p2 portalIndex, inside []portalIndex, portals []portalData, links linkFilter, fields fieldSizeFilter) bool {
+	if len(inside) == 0 {
+		return fields.allowed(portals[p0], portals[p1], portals[p2])
+	}
+	if len(inside) == 1 {
+		c := portals[inside[0]]
+		return links.allowed(inside[0], p0) && links.allowed(inside[0], p1) && links.allowed(inside[0], p2) &&
+			fields.allowed(c, portals[p1], portals[p2]) && fields.allowed(portals[p0], c, portals[p2]) && fields.allowed(portals[p0], portals[p1], c)
 	}
 	insideCopy := make([]portalIndex, len(inside)-1)
 	for candidate := 0; candidate < len(inside); candidate++ {
@@ -498,9 +653,10 @@ func areValidPureHomogeneousPortals(p0, p1, p2 portalIndex, inside []portalIndex
 			panic(fmt.Errorf("%d,%d,%d,%d", c0, c1, c2, len(inside)))
 		}
 		if c0 == c2 && c0 == c1 &&
-			areValidPureHomogeneousPortals(p0, p1, inside[candidate], insideCopy[:c0], portals) &&
-			areValidPureHomogeneousPortals(p1, p2, inside[candidate], insideCopy[c0:c0+c1], portals) &&
-			areValidPureHomogeneousPortals(p2, p0, inside[candidate], insideCopy[c0+c1:], portals) {
+			links.allowed(inside[candidate], p0) && links.allowed(inside[candidate], p1) && links.allowed(inside[candidate], p2) &&
+			areValidPureHomogeneousPortals(p0, p1, inside[candidate], insideCopy[:c0], portals, links, fields) &&
+			areValidPureHomogeneousPortals(p1, p2, inside[candidate], insideCopy[c0:c0+c1], portals, links, fields) &&
+			areValidPureHomogeneousPortals(p2, p0, inside[candidate], insideCopy[c0+c1:], portals, links, fields) {
 			return true
 		}
 		inside[0], inside[candidate] = inside[candidate], inside[0]
@@ -1,6 +1,9 @@
 package lib
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math"
 	"testing"
 
@@ -77,7 +80,10 @@ func TestHomogeneous(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	result, depth := DeepestHomogeneous(portals, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidHomogeneousResult(5, result, depth, t)
 }
 
@@ -92,7 +98,10 @@ func TestHomogeneousPure(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	result, depth := DeepestHomogeneous(portals, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousPure(true), HomogeneousNumWorkers(6))
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousPure(true), HomogeneousNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidPureHomogeneousResult(4, result, depth, portals, t)
 }
 
@@ -107,7 +116,10 @@ func TestHomogeneousPretty(t *testing.T) {
 	if len(portals) < 3 {
 		t.FailNow()
 	}
-	result, depth := DeepestHomogeneous(portals, HomogeneousSpreadAround{}, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousSpreadAround{}, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidHomogeneousResult(5, result, depth, t)
 }
 
@@ -140,26 +152,113 @@ func generateHomogeneousPortals(depth int) []Portal {
 
 func TestHomogeneousSyntheticPortals(t *testing.T) {
 	portals := generateHomogeneousPortals(5)
-	result, depth := DeepestHomogeneous(portals, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidHomogeneousResult(5, result, depth, t)
 }
 
 func TestHomogeneousPrettySyntheticPortals(t *testing.T) {
 	portals := generateHomogeneousPortals(5)
-	result, depth := DeepestHomogeneous(portals, HomogeneousSpreadAround{}, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousSpreadAround{}, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidHomogeneousResult(5, result, depth, t)
 }
 
 func TestHomogeneousPureSyntheticPortals(t *testing.T) {
 	portals := generateHomogeneousPortals(5)
-	result, depth := DeepestHomogeneous(portals, HomogeneousPure(true), HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousPure(true), HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidPureHomogeneousResult(5, result, depth, portals, t)
 }
 
+func TestHomogeneousCancelled(t *testing.T) {
+	portals := generateHomogeneousPortals(5)
+	for _, pure := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := DeepestHomogeneous(ctx, portals, HomogeneousPure(pure), HomogeneousMaxDepth(6))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected cancellation error (pure: %t), got %v", pure, err)
+		}
+	}
+}
+
+func TestHomogeneousDisabledPortals(t *testing.T) {
+	portals := withUniqueGuids(generateHomogeneousPortals(3))
+	// the central portal of one of the second level triangles
+	disabled := portals[4]
+	for _, pure := range []bool{false, true} {
+		result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousPure(pure), HomogeneousDisabledPortals{disabled})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth >= 3 {
+			t.Errorf("Expected disabled portal to prevent the deepest field (pure: %t), got depth %d", pure, depth)
+		}
+		for _, portal := range result {
+			if portal.Guid == disabled.Guid {
+				t.Errorf("Disabled portal used as a vertex of a field (pure: %t)", pure)
+			}
+		}
+		if pure {
+			plan, err := HomogeneousPlan(depth, result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.PortalsInsideFields([]Portal{disabled})) != 0 {
+				t.Errorf("Disabled portal lies inside a pure field")
+			}
+		}
+	}
+}
+
+func TestHomogeneousSparseIndex(t *testing.T) {
+	portals := generateHomogeneousPortals(4)
+	// Portals outside of the field make the dense index large, while the search
+	// visits only the triangles inside the fixed corners.
+	for i := 0; i < 30; i++ {
+		portals = append(portals, Portal{Guid: fmt.Sprintf("outside%d", i), LatLng: s2.LatLngFromDegrees(25+0.1*float64(i), 21)})
+	}
+	// Budget too small to fit the dense index of sorted triples.
+	n := uint64(len(portals))
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousMemoryBudget(n*(n-1)*(n-2)/6*4-1), HomogeneousFixedCornerIndices{0, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidHomogeneousResult(4, result, depth, t)
+}
+
+func TestHomogeneousMemoryBudgetExceeded(t *testing.T) {
+	portals := generateHomogeneousPortals(4)
+	for _, spreadAround := range []bool{false, true} {
+		options := []HomogeneousOption{HomogeneousMemoryBudget(1000)}
+		if spreadAround {
+			options = append(options, HomogeneousSpreadAround{})
+		}
+		_, depth, err := DeepestHomogeneous(context.Background(), portals, options...)
+		var budgetErr *MemoryBudgetExceededError
+		if !errors.As(err, &budgetErr) {
+			t.Errorf("Expected memory budget error (spread around: %t), got %v", spreadAround, err)
+		}
+		if depth >= 4 {
+			t.Errorf("Expected only a partial result (spread around: %t), got depth %d", spreadAround, depth)
+		}
+	}
+}
+
 func benchmarkHomogeneous(depth int, b *testing.B) {
 	portals := generateHomogeneousPortals(depth)
 	for n := 0; n < b.N; n++ {
-		_, resDepth := DeepestHomogeneous(portals, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(7))
+		_, resDepth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(7))
+		if err != nil {
+			panic(err)
+		}
 		if depth != int(resDepth) {
 			panic(resDepth)
 		}
@@ -172,7 +271,10 @@ func BenchmarkHomogeneous6(b *testing.B) { benchmarkHomogeneous(6, b) }
 func benchmarkHomogeneousPretty(depth int, b *testing.B) {
 	portals := generateHomogeneousPortals(depth)
 	for n := 0; n < b.N; n++ {
-		_, resDepth := DeepestHomogeneous(portals, HomogeneousSpreadAround{}, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+		_, resDepth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousSpreadAround{}, HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+		if err != nil {
+			panic(err)
+		}
 		if depth != int(resDepth) {
 			panic(resDepth)
 		}
@@ -185,7 +287,10 @@ func BenchmarkHomogeneousPretty6(b *testing.B) { benchmarkHomogeneousPretty(6, b
 func benchmarkHomogeneousPure(depth int, b *testing.B) {
 	portals := generateHomogeneousPortals(depth)
 	for n := 0; n < b.N; n++ {
-		_, resDepth := DeepestHomogeneous(portals, HomogeneousPure(true), HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+		_, resDepth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousPure(true), HomogeneousMaxDepth(6), HomogeneousLargestArea{}, HomogeneousNumWorkers(6))
+		if err != nil {
+			panic(err)
+		}
 		if depth != int(resDepth) {
 			panic(resDepth)
 		}
@@ -0,0 +1,54 @@
+package lib
+
+// MaxOutboundLinks - number of outbound links a portal can have without link amps
+const MaxOutboundLinks = 8
+
+// PortalKeys - number of keys of a portal needed to execute a plan
+// and number of links thrown from the portal.
+type PortalKeys struct {
+	Portal        Portal
+	Keys          int
+	OutboundLinks int
+}
+
+// ExceedsOutboundLimit returns true if the portal throws more links
+// than it's possible without link amps.
+func (k PortalKeys) ExceedsOutboundLimit() bool {
+	return k.OutboundLinks > MaxOutboundLinks
+}
+
+// PlanKeys computes the number of keys and outbound links of every portal of a plan.
+// Portals are returned in the order of their first appearance in the plan.
+func PlanKeys(plan Plan) []PortalKeys {
+	var result []PortalKeys
+	indices := make(map[string]int)
+	portalKeys := func(portal Portal) *PortalKeys {
+		ix, ok := indices[portal.Guid]
+		if !ok {
+			ix = len(result)
+			indices[portal.Guid] = ix
+			result = append(result, PortalKeys{Portal: portal})
+		}
+		return &result[ix]
+	}
+	for _, step := range plan.Steps {
+		if step.Type != LINK {
+			continue
+		}
+		portalKeys(step.Origin).OutboundLinks++
+		portalKeys(step.Destination).Keys++
+	}
+	return result
+}
+
+// PortalsExceedingOutboundLimit returns portals which throw more links than
+// it's possible without link amps.
+func PortalsExceedingOutboundLimit(keys []PortalKeys) []PortalKeys {
+	var result []PortalKeys
+	for _, k := range keys {
+		if k.ExceedsOutboundLimit() {
+			result = append(result, k)
+		}
+	}
+	return result
+}
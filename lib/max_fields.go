@@ -0,0 +1,402 @@
+package lib
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/golang/geo/s2"
+)
+
+// maxFieldsSolution - portal splitting a triangle and the number of portals splitting
+// the fields inside it. The number of fields may exceed the range of uint16, but as each
+// split adds three fields it's 1+3*NumSplits, and NumSplits is less than the number of portals.
+type maxFieldsSolution struct {
+	Index     memoPortalIndex
+	NumSplits uint16
+}
+
+const invalidNumSplits uint16 = math.MaxUint16
+const invalidNumFields uint32 = math.MaxUint32
+
+func (s maxFieldsSolution) numFields() uint32 {
+	if s.NumSplits == invalidNumSplits {
+		return invalidNumFields
+	}
+	return 1 + 3*uint32(s.NumSplits)
+}
+
+type maxFieldsQuery struct {
+	cancellation    cancellation
+	links           linkFilter
+	fields          fieldSizeFilter
+	index           *tripleIndex[maxFieldsSolution]
+	filteredPortals [][]portalData
+	// preallocated storage for smallestSplitArea of the filtered portals
+	splitAreas [][]float64
+	depth      int
+}
+
+func newMaxFieldsQuery(ctx context.Context, numPortals int, links linkFilter, fields fieldSizeFilter, budget *memoryBudget) *maxFieldsQuery {
+	return &maxFieldsQuery{
+		cancellation:    newCancellation(ctx),
+		links:           links,
+		fields:          fields,
+		index:           newUnorderedTripleIndex(numPortals, maxFieldsSolution{Index: invalidMemoPortalIndex, NumSplits: invalidNumSplits}, budget),
+		filteredPortals: make([][]portalData, numPortals+1),
+		splitAreas:      make([][]float64, numPortals+1),
+	}
+}
+
+// Fields of a triangle don't depend on the order of its vertices,
+// so all the orders share a single index entry.
+func (q *maxFieldsQuery) getIndex(i, j, k portalIndex) maxFieldsSolution {
+	key := sortedTriple(i, j, k)
+	return q.index.get(key[0], key[1], key[2])
+}
+func (q *maxFieldsQuery) setIndex(i, j, k portalIndex, s maxFieldsSolution) {
+	key := sortedTriple(i, j, k)
+	if !q.index.set(key[0], key[1], key[2], s) {
+		// Out of memory, stop the search the same way as if it got cancelled.
+		q.cancellation.cancelled = true
+	}
+}
+
+func (q *maxFieldsQuery) canMakeField(p0, p1, p2 portalData) bool {
+	return q.links.allowed(p0.Index, p1.Index) && q.links.allowed(p1.Index, p2.Index) &&
+		q.links.allowed(p2.Index, p0.Index) && q.fields.allowed(p0, p1, p2)
+}
+
+// findMaxFields returns the largest number of fields which can be made inside
+// triangle p0, p1, p2, including the triangle itself.
+// Candidates must contain all the portals lying inside the triangle.
+func (q *maxFieldsQuery) findMaxFields(p0, p1, p2 portalData, candidates []portalData) uint32 {
+	if solution := q.getIndex(p0.Index, p1.Index, p2.Index); solution.NumSplits != invalidNumSplits {
+		return solution.numFields()
+	}
+	if q.cancellation.check() {
+		return invalidNumFields
+	}
+	q.depth++
+	inside := portalsInsideTriangle(candidates, p0, p1, p2, q.filteredPortals[q.depth])
+	q.filteredPortals[q.depth] = inside
+	// Every portal inside a triangle can add at most three fields, and if no link
+	// is blocked splitting the triangle at any of them achieves it. Try the portals
+	// splitting the triangle most evenly first, to avoid long and thin fields.
+	splitAreas := q.splitAreas[q.depth][:0]
+	for _, portal := range inside {
+		splitAreas = append(splitAreas, smallestSplitArea(p0, p1, p2, portal))
+	}
+	q.splitAreas[q.depth] = splitAreas
+	sort.Sort(portalsBySplitArea{inside, splitAreas})
+	best := maxFieldsSolution{Index: invalidMemoPortalIndex, NumSplits: 0}
+	for _, portal := range inside {
+		if int(best.NumSplits) == len(inside) {
+			break
+		}
+		if !q.links.allowed(portal.Index, p0.Index) || !q.links.allowed(portal.Index, p1.Index) || !q.links.allowed(portal.Index, p2.Index) {
+			continue
+		}
+		if !q.fields.allowed(portal, p1, p2) || !q.fields.allowed(p0, portal, p2) || !q.fields.allowed(p0, p1, portal) {
+			continue
+		}
+		l0 := q.findMaxFields(portal, p1, p2, inside)
+		l1 := q.findMaxFields(p0, portal, p2, inside)
+		l2 := q.findMaxFields(p0, p1, portal, inside)
+		if q.cancellation.cancelled {
+			// Leave the index entry unset, so that the index stays consistent.
+			q.depth--
+			return invalidNumFields
+		}
+		if numFields := 1 + l0 + l1 + l2; numFields > best.numFields() {
+			best.NumSplits = uint16((numFields - 1) / 3)
+			best.Index = newMemoPortalIndex(portal.Index)
+		}
+	}
+	q.setIndex(p0.Index, p1.Index, p2.Index, best)
+	q.depth--
+	if q.cancellation.cancelled {
+		return invalidNumFields
+	}
+	return best.numFields()
+}
+
+// portalsBySplitArea - portals sorted by their precomputed smallestSplitArea, largest first
+type portalsBySplitArea struct {
+	portals []portalData
+	areas   []float64
+}
+
+func (p portalsBySplitArea) Len() int           { return len(p.portals) }
+func (p portalsBySplitArea) Less(i, j int) bool { return p.areas[i] > p.areas[j] }
+func (p portalsBySplitArea) Swap(i, j int) {
+	p.portals[i], p.portals[j] = p.portals[j], p.portals[i]
+	p.areas[i], p.areas[j] = p.areas[j], p.areas[i]
+}
+
+// smallestSplitArea returns area of the smallest of the three triangles
+// triangle p0, p1, p2 gets split into by the portal.
+func smallestSplitArea(p0, p1, p2, portal portalData) float64 {
+	return min(min(triangleArea(portal, p1, p2), triangleArea(p0, portal, p2)), triangleArea(p0, p1, portal))
+}
+
+// convexHull returns vertices of the convex hull of the portals in counter clockwise order,
+// or nil if the portals don't span a triangle.
+func convexHull(portals []portalData) []portalData {
+	query := s2.NewConvexHullQuery()
+	byPoint := make(map[s2.Point]portalData, len(portals))
+	for _, portal := range portals {
+		query.AddPoint(portal.LatLng)
+		byPoint[portal.LatLng] = portal
+	}
+	loop := query.ConvexHull()
+	var hull []portalData
+	for _, vertex := range loop.Vertices() {
+		portal, ok := byPoint[vertex]
+		if !ok {
+			// A degenerate hull made up by the query.
+			return nil
+		}
+		hull = append(hull, portal)
+	}
+	if len(hull) < 3 {
+		return nil
+	}
+	return hull
+}
+
+// MaxFields - Find the plan making the largest number of fields over the portals.
+// The convex hull of the portals gets triangulated, and each of the fields gets split
+// by one of the portals inside it into three smaller fields, which are in turn split
+// the same way, so that every portal not on the hull adds three fields.
+// Blocked links and too small fields may force leaving out some of the portals.
+// Fields are returned in the order of nesting - each field before the fields inside it.
+// If ctx gets cancelled returns the fields found so far and a *CancelledError,
+// if the search runs out of its memory budget returns the fields found so far
+// and a *MemoryBudgetExceededError.
+func MaxFields(ctx context.Context, portals []Portal, progressFunc func(int, int), options ...MaxFieldsOption) ([]Field, error) {
+	results, err := TopMaxFields(ctx, portals, 1, progressFunc, options...)
+	if len(results) == 0 {
+		return []Field{}, err
+	}
+	return results[0], err
+}
+
+// hullTriangulation - one of the best triangulations of the part of the convex hull
+// cut off by a diagonal from vertex i to vertex j
+type hullTriangulation struct {
+	numFields int
+	// vertex making a triangle with the diagonal
+	split int
+	// positions of the triangulations of the parts cut off by the diagonals
+	// from i to split and from split to j in their lists of alternatives
+	left, right int
+}
+
+// addHullTriangulation inserts the triangulation into the list sorted from the one
+// making the most fields, keeping at most numResults of them.
+func addHullTriangulation(triangulations []hullTriangulation, t hullTriangulation, numResults int) []hullTriangulation {
+	pos := len(triangulations)
+	for pos > 0 && triangulations[pos-1].numFields < t.numFields {
+		pos--
+	}
+	if pos >= numResults {
+		return triangulations
+	}
+	if len(triangulations) < numResults {
+		triangulations = append(triangulations, hullTriangulation{})
+	}
+	copy(triangulations[pos+1:], triangulations[pos:])
+	triangulations[pos] = t
+	return triangulations
+}
+
+// TopMaxFields - Find up to numResults plans making the largest numbers of fields,
+// sorted from the one making the most fields. The plans triangulate the convex hull
+// of the portals in different ways, fields inside the triangles of the hull are split
+// the same way as by MaxFields. Errors are reported the same way as by MaxFields.
+func TopMaxFields(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int), options ...MaxFieldsOption) ([][]Field, error) {
+	if numResults < 1 {
+		numResults = 1
+	}
+	if err := checkNumMemoPortals(len(portals)); err != nil {
+		return nil, err
+	}
+	params := defaultMaxFieldsParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
+	portalsData := portalsToPortalData(portals)
+	disabled := disabledPortalsMask(portals, params.disabledPortals)
+	links := newLinkFilter(portalsData, params.blockers, disabled, params.maxLinkLength)
+	enabledPortals := make([]portalData, 0, len(portalsData))
+	for _, portal := range portalsData {
+		if disabled == nil || !disabled[portal.Index] {
+			enabledPortals = append(enabledPortals, portal)
+		}
+	}
+	hull := convexHull(enabledPortals)
+
+	budget := newMemoryBudget(params.memoryBudget)
+	q := newMaxFieldsQuery(ctx, len(portals), links, newFieldSizeFilter(params.minFieldSize), budget)
+	topLevelFields := func(p0, p1, p2 portalData) int {
+		if !q.canMakeField(p0, p1, p2) {
+			return 0
+		}
+		numFields := q.findMaxFields(p0, p1, p2, enabledPortals)
+		if numFields == invalidNumFields {
+			return 0
+		}
+		return int(numFields)
+	}
+
+	numHull := len(hull)
+	numTriangles := max(numHull*(numHull-1)*(numHull-2)/6, 1)
+	everyNth := max(numTriangles/1000, 1)
+	trianglesDone := 0
+	progressFunc(0, numTriangles)
+	// Triangulations of the hull polygon maximizing the number of fields.
+	// triangulations[i][j] - up to numResults triangulations of the part of the polygon
+	// cut off by the diagonal from vertex i to vertex j, making the most fields.
+	triangulations := make([][][]hullTriangulation, numHull)
+	for i := range triangulations {
+		triangulations[i] = make([][]hullTriangulation, numHull)
+		if i+1 < numHull {
+			triangulations[i][i+1] = []hullTriangulation{{}}
+		}
+	}
+	for length := 2; length < numHull; length++ {
+		for i := 0; i+length < numHull; i++ {
+			j := i + length
+			var best []hullTriangulation
+			for k := i + 1; k < j; k++ {
+				fields := topLevelFields(hull[i], hull[k], hull[j])
+				for l, left := range triangulations[i][k] {
+					for r, right := range triangulations[k][j] {
+						numFields := left.numFields + right.numFields + fields
+						if len(best) == numResults && numFields <= best[numResults-1].numFields {
+							// Triangulations of the right part are sorted from the best one.
+							break
+						}
+						best = addHullTriangulation(best, hullTriangulation{numFields: numFields, split: k, left: l, right: r}, numResults)
+					}
+				}
+				trianglesDone++
+				if trianglesDone%everyNth == 0 {
+					progressFunc(trianglesDone, numTriangles)
+				}
+			}
+			triangulations[i][j] = best
+		}
+	}
+	q.filteredPortals = nil
+	q.splitAreas = nil
+	progressFunc(numTriangles, numTriangles)
+
+	var err error
+	if budget.exceeded {
+		err = budget.err(len(portals))
+	} else if q.cancellation.cancelled {
+		err = cancelledError(ctx)
+	}
+	if numHull < 3 {
+		return [][]Field{}, err
+	}
+	// Fields inside a triangle of the hull are always the same, so two triangulations
+	// make the same fields if the same triangles of theirs can be made.
+	var hullFields [][3]portalIndex
+	var appendHullFields func(i, j, alternative int)
+	appendHullFields = func(i, j, alternative int) {
+		if j-i < 2 {
+			return
+		}
+		t := triangulations[i][j][alternative]
+		if q.canMakeField(hull[i], hull[t.split], hull[j]) {
+			hullFields = append(hullFields, [3]portalIndex{hull[i].Index, hull[t.split].Index, hull[j].Index})
+		}
+		appendHullFields(i, t.split, t.left)
+		appendHullFields(t.split, j, t.right)
+	}
+	var results [][]Field
+	var resultKeys [][][3]portalIndex
+nextTriangulation:
+	for alternative := range triangulations[0][numHull-1] {
+		hullFields = nil
+		appendHullFields(0, numHull-1, alternative)
+		key := make([][3]portalIndex, 0, len(hullFields))
+		for _, field := range hullFields {
+			key = append(key, sortedTriple(field[0], field[1], field[2]))
+		}
+		sort.Slice(key, func(i, j int) bool {
+			a, b := key[i], key[j]
+			return a[0] < b[0] || (a[0] == b[0] && (a[1] < b[1] || (a[1] == b[1] && a[2] < b[2])))
+		})
+		for _, resultKey := range resultKeys {
+			if sameTriples(key, resultKey) {
+				continue nextTriangulation
+			}
+		}
+		result := []Field{}
+		for _, field := range hullFields {
+			result = q.appendFields(portalsData[field[0]], portalsData[field[1]], portalsData[field[2]], portals, portalsData, result)
+		}
+		results = append(results, result)
+		resultKeys = append(resultKeys, key)
+	}
+	return results, err
+}
+
+func sameTriples(a, b [][3]portalIndex) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// appendFields appends the field p0, p1, p2 together with all the fields inside it.
+func (q *maxFieldsQuery) appendFields(p0, p1, p2 portalData, portals []Portal, portalsData []portalData, result []Field) []Field {
+	solution := q.getIndex(p0.Index, p1.Index, p2.Index)
+	if solution.NumSplits == invalidNumSplits {
+		// Search got interrupted before reaching the triangle.
+		return result
+	}
+	result = append(result, Field{portals[p0.Index], portals[p1.Index], portals[p2.Index]})
+	if solution.Index == invalidMemoPortalIndex {
+		return result
+	}
+	portal := portalsData[solution.Index.portalIndex()]
+	result = q.appendFields(portal, p1, p2, portals, portalsData, result)
+	result = q.appendFields(p0, portal, p2, portals, portalsData, result)
+	result = q.appendFields(p0, p1, portal, portals, portalsData, result)
+	return result
+}
+
+// MaxFieldsPolylines - links of the fields returned by MaxFields, each as a separate polyline.
+func MaxFieldsPolylines(fields []Field) [][]Portal {
+	type link struct{ a, b string }
+	seen := make(map[link]struct{})
+	var polylines [][]Portal
+	for _, field := range fields {
+		for i := 0; i < 3; i++ {
+			p0, p1 := field[i], field[(i+1)%3]
+			key := link{p0.Guid, p1.Guid}
+			if p0.Guid > p1.Guid {
+				key = link{p1.Guid, p0.Guid}
+			}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			polylines = append(polylines, []Portal{p0, p1})
+		}
+	}
+	return polylines
+}
+func MaxFieldsDrawToolsString(fields []Field) string {
+	return MaxFieldsResult(fields).DrawToolsString()
+}
@@ -0,0 +1,50 @@
+package lib
+
+type MaxFieldsOption interface {
+	apply(params *maxFieldsParams)
+}
+
+type MaxFieldsBlockers []Segment
+
+func (m MaxFieldsBlockers) apply(params *maxFieldsParams) {
+	params.blockers = []Segment(m)
+}
+
+type MaxFieldsDisabledPortals []Portal
+
+func (m MaxFieldsDisabledPortals) apply(params *maxFieldsParams) {
+	params.disabledPortals = []Portal(m)
+}
+
+// MaxFieldsMaxLinkLength - don't make links longer than that many meters
+type MaxFieldsMaxLinkLength float64
+
+func (m MaxFieldsMaxLinkLength) apply(params *maxFieldsParams) {
+	params.maxLinkLength = float64(m)
+}
+
+// MaxFieldsMinFieldSize - don't make fields smaller than that
+type MaxFieldsMinFieldSize FieldSize
+
+func (m MaxFieldsMinFieldSize) apply(params *maxFieldsParams) {
+	params.minFieldSize = FieldSize(m)
+}
+
+// MaxFieldsMemoryBudget - limit in bytes of memory used by the index of partial solutions
+type MaxFieldsMemoryBudget uint64
+
+func (m MaxFieldsMemoryBudget) apply(params *maxFieldsParams) {
+	params.memoryBudget = uint64(m)
+}
+
+type maxFieldsParams struct {
+	blockers        []Segment
+	disabledPortals []Portal
+	maxLinkLength   float64
+	minFieldSize    FieldSize
+	memoryBudget    uint64
+}
+
+func defaultMaxFieldsParams() maxFieldsParams {
+	return maxFieldsParams{memoryBudget: DefaultMemoryBudget}
+}
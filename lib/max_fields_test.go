@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func checkValidMaxFieldsResult(name string, fields []Field, expectedNumFields int, t *testing.T) {
+	if len(fields) != expectedNumFields {
+		t.Errorf("%s: expected %d fields, got %d", name, expectedNumFields, len(fields))
+	}
+	plan, err := MaxFieldsPlan(fields)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if plan.NumFields() != len(fields) {
+		t.Errorf("%s: expected plan to make %d fields, got %d", name, len(fields), plan.NumFields())
+	}
+}
+
+func TestMaxFields(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	fields, err := MaxFields(context.Background(), portals, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every portal inside the convex hull adds three fields
+	// to the triangulation of the hull.
+	numHull := len(convexHull(portalsToPortalData(portals)))
+	checkValidMaxFieldsResult("all portals", fields, numHull-2+3*(len(portals)-numHull), t)
+
+	const maxLinkLength = 300
+	limited, err := MaxFields(context.Background(), portals, func(int, int) {}, MaxFieldsMaxLinkLength(maxLinkLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limited) == 0 || len(limited) >= len(fields) {
+		t.Errorf("Expected the link length limit to reduce number of fields from %d, got %d", len(fields), len(limited))
+	}
+	checkValidMaxFieldsResult("max link length", limited, len(limited), t)
+	plan, err := MaxFieldsPlan(limited)
+	checkLongestLink("max fields", plan, err, maxLinkLength, t)
+}
+
+func TestTopMaxFields(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	best, err := MaxFields(context.Background(), portals, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plans, err := TopMaxFields(context.Background(), portals, 3, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 3 {
+		t.Fatalf("Expected 3 plans, got %d", len(plans))
+	}
+	// Without blocked links every triangulation of the hull makes as many fields.
+	for i, fields := range plans {
+		checkValidMaxFieldsResult(fmt.Sprintf("plan %d", i), fields, len(best), t)
+	}
+	if !reflect.DeepEqual(plans[0], best) {
+		t.Errorf("Expected the first plan to be the one found by MaxFields")
+	}
+	for i := 1; i < len(plans); i++ {
+		for j := 0; j < i; j++ {
+			if reflect.DeepEqual(plans[i], plans[j]) {
+				t.Errorf("Expected plans %d and %d to differ", j, i)
+			}
+		}
+	}
+}
+
+func TestMaxFieldsTooFewPortals(t *testing.T) {
+	portals := generateCobwebPortals(1)
+	fields, err := MaxFields(context.Background(), portals[:2], func(int, int) {})
+	if err != nil || len(fields) != 0 {
+		t.Errorf("Expected no fields over two portals, got %v, %v", fields, err)
+	}
+	fields, err = MaxFields(context.Background(), portals, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidMaxFieldsResult("three portals", fields, 1, t)
+}
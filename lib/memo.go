@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// DefaultMemoryBudget - default limit of memory in bytes used by the indices
+// of partial solutions of the cobweb and homogeneous searches.
+const DefaultMemoryBudget uint64 = 4 << 30
+
+// MemoryBudgetExceededError is returned by a search whose index of partial
+// solutions did not fit in the memory budget. The result returned along
+// with the error is the best one found before the budget got exhausted.
+type MemoryBudgetExceededError struct {
+	Budget     uint64
+	NumPortals int
+}
+
+func (e *MemoryBudgetExceededError) Error() string {
+	return fmt.Sprintf("search over %d portals exceeded the memory budget of %d bytes, try a smaller set of portals or a larger budget",
+		e.NumPortals, e.Budget)
+}
+
+// TooManyPortalsError is returned by a search using indices of partial solutions
+// if it's given more portals than the indices can tell apart.
+type TooManyPortalsError struct {
+	NumPortals int
+	MaxPortals int
+}
+
+func (e *TooManyPortalsError) Error() string {
+	return fmt.Sprintf("search over %d portals exceeds the limit of %d portals, try a smaller set of portals",
+		e.NumPortals, e.MaxPortals)
+}
+
+func checkNumMemoPortals(numPortals int) error {
+	if numPortals > maxMemoPortals {
+		return &TooManyPortalsError{NumPortals: numPortals, MaxPortals: maxMemoPortals}
+	}
+	return nil
+}
+
+// memoryBudget keeps track of memory used by all the indices of a single search.
+type memoryBudget struct {
+	limit    uint64
+	used     uint64
+	exceeded bool
+}
+
+func newMemoryBudget(limit uint64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+// reserve marks size bytes as used, returns false if they don't fit in the budget.
+func (b *memoryBudget) reserve(size uint64) bool {
+	if size > b.limit-b.used {
+		b.exceeded = true
+		return false
+	}
+	b.used += size
+	return true
+}
+
+func (b *memoryBudget) err(numPortals int) error {
+	return &MemoryBudgetExceededError{Budget: b.limit, NumPortals: numPortals}
+}
+
+// tripleIndex maps triples of portals to values of type T.
+// An index of ordered triples has an entry for every triple, an index of unordered
+// triples (see newUnorderedTripleIndex) only for sorted ones, i < j < k, needing
+// a sixth of the memory.
+// If an array with entries for all the triples fits in the memory budget
+// the index is dense, otherwise it is a hash map holding only the entries set.
+// An entry of the hash map takes about three times as much memory as an entry
+// of the array, so it lets the search run only if it visits a small part of all
+// the triples (e.g. with fixed corner portals). Otherwise the search stops
+// when the hash map exhausts the budget.
+type tripleIndex[T any] struct {
+	dense  []T
+	sparse map[uint64]T
+	budget *memoryBudget
+	// value of entries not set yet
+	empty      T
+	numPortals uint64
+	unordered  bool
+	// number of all the entries of the index
+	size uint64
+	// approximate memory used by a single entry of the sparse index
+	sparseEntrySize uint64
+}
+
+func newTripleIndex[T any](numPortals int, empty T, budget *memoryBudget) *tripleIndex[T] {
+	return makeTripleIndex(numPortals, false, empty, budget)
+}
+
+// newUnorderedTripleIndex - index of triples of portals whose order doesn't matter,
+// the triples have to be sorted, e.g. with sortedIndices.
+func newUnorderedTripleIndex[T any](numPortals int, empty T, budget *memoryBudget) *tripleIndex[T] {
+	return makeTripleIndex(numPortals, true, empty, budget)
+}
+
+func makeTripleIndex[T any](numPortals int, unordered bool, empty T, budget *memoryBudget) *tripleIndex[T] {
+	n := uint64(numPortals)
+	entrySize := uint64(unsafe.Sizeof(empty))
+	size := n * n * n
+	if unordered {
+		size = n * (n - 1) * (n - 2) / 6
+		if n < 3 {
+			size = 0
+		}
+	}
+	index := &tripleIndex[T]{
+		budget:     budget,
+		empty:      empty,
+		numPortals: n,
+		unordered:  unordered,
+		size:       size,
+		// Key, value and the per entry overhead of a map, assuming it's on average
+		// filled in 2/3rd.
+		sparseEntrySize: (8 + entrySize + 1) * 3 / 2,
+	}
+	// Check for overflow of the array size as well as for the budget.
+	if n < 1<<16 && budget.limit-budget.used >= size*entrySize {
+		budget.reserve(size * entrySize)
+		index.dense = make([]T, size)
+		for i := 0; i < len(index.dense); i++ {
+			index.dense[i] = empty
+		}
+	} else {
+		index.sparse = make(map[uint64]T)
+	}
+	return index
+}
+
+func (t *tripleIndex[T]) key(i, j, k portalIndex) uint64 {
+	if t.unordered {
+		// Position of the sorted triple in the lexicographic order of (k, j, i).
+		ui, uj, uk := uint64(i), uint64(j), uint64(k)
+		return uk*(uk-1)*(uk-2)/6 + uj*(uj-1)/2 + ui
+	}
+	return (uint64(i)*t.numPortals+uint64(j))*t.numPortals + uint64(k)
+}
+
+func (t *tripleIndex[T]) get(i, j, k portalIndex) T {
+	if t.dense != nil {
+		return t.dense[t.key(i, j, k)]
+	}
+	if value, ok := t.sparse[t.key(i, j, k)]; ok {
+		return value
+	}
+	return t.empty
+}
+
+// set stores the value of given triple. Returns false if there's not enough
+// memory left in the budget, in which case the entry is left unset.
+func (t *tripleIndex[T]) set(i, j, k portalIndex, value T) bool {
+	if t.dense != nil {
+		t.dense[t.key(i, j, k)] = value
+		return true
+	}
+	key := t.key(i, j, k)
+	if _, ok := t.sparse[key]; !ok && !t.budget.reserve(t.sparseEntrySize) {
+		return false
+	}
+	t.sparse[key] = value
+	return true
+}
+
+// Number of entries of a dense index written or read at once.
+const tripleIndexChunkSize = 1 << 16
+
+// writeTripleIndex writes all the entries set in the index, in a format readable by readTripleIndex.
+func writeTripleIndex[T comparable](w io.Writer, t *tripleIndex[T]) error {
+	if t.dense != nil {
+		if err := binary.Write(w, binary.LittleEndian, true); err != nil {
+			return err
+		}
+		for start := 0; start < len(t.dense); start += tripleIndexChunkSize {
+			end := min(start+tripleIndexChunkSize, len(t.dense))
+			if err := binary.Write(w, binary.LittleEndian, t.dense[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := binary.Write(w, binary.LittleEndian, false); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(t.sparse))); err != nil {
+		return err
+	}
+	for key, value := range t.sparse {
+		if err := binary.Write(w, binary.LittleEndian, key); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTripleIndex sets entries of the index to the ones written by writeTripleIndex
+// for an index of the same number of portals. The index written may be dense
+// while the one read is sparse, or the other way round.
+// If the entries don't fit in the memory budget, stops reading them and leaves
+// the budget marked as exceeded.
+func readTripleIndex[T comparable](r io.Reader, t *tripleIndex[T]) error {
+	var dense bool
+	if err := binary.Read(r, binary.LittleEndian, &dense); err != nil {
+		return err
+	}
+	if dense {
+		numEntries := int(t.size)
+		chunk := make([]T, tripleIndexChunkSize)
+		for start := 0; start < numEntries; start += tripleIndexChunkSize {
+			end := min(start+tripleIndexChunkSize, numEntries)
+			if t.dense != nil {
+				if err := binary.Read(r, binary.LittleEndian, t.dense[start:end]); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := binary.Read(r, binary.LittleEndian, chunk[:end-start]); err != nil {
+				return err
+			}
+			for i, value := range chunk[:end-start] {
+				if value == t.empty {
+					continue
+				}
+				if _, ok := t.sparse[uint64(start+i)]; !ok && !t.budget.reserve(t.sparseEntrySize) {
+					return nil
+				}
+				t.sparse[uint64(start+i)] = value
+			}
+		}
+		return nil
+	}
+	var numEntries uint64
+	if err := binary.Read(r, binary.LittleEndian, &numEntries); err != nil {
+		return err
+	}
+	for i := uint64(0); i < numEntries; i++ {
+		var key uint64
+		var value T
+		if err := binary.Read(r, binary.LittleEndian, &key); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+			return err
+		}
+		if key >= t.size {
+			return fmt.Errorf("invalid index entry %d", key)
+		}
+		if t.dense != nil {
+			t.dense[key] = value
+		} else if _, ok := t.sparse[key]; !ok && !t.budget.reserve(t.sparseEntrySize) {
+			return nil
+		} else {
+			t.sparse[key] = value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package lib
+
+import "context"
+
+type bestOnionQuery struct {
+	onFilledIndexEntry func()
+	cancellation       cancellation
+	portals            []portalData
+	links              linkFilter
+	fields             fieldSizeFilter
+	index              *tripleIndex[bestSolution]
+	// costs of the portals, nil if none of them has a cost
+	costs []float64
+	// total cost of the portals of the solution stored in index, nil if costs are nil
+	costIndex *tripleIndex[float32]
+	// preallocated storage for lists of portals within triangles at consecutive recursion depths
+	filteredPortals [][]portalData
+	depth           uint16
+}
+
+func newBestOnionQuery(ctx context.Context, portals []portalData, links linkFilter, fields fieldSizeFilter, costs []float64, budget *memoryBudget, onFilledIndexEntry func()) *bestOnionQuery {
+	q := &bestOnionQuery{
+		portals:            portals,
+		links:              links,
+		fields:             fields,
+		index:              newUnorderedTripleIndex(len(portals), bestSolution{Index: invalidMemoPortalIndex, Length: invalidLength}, budget),
+		costs:              costs,
+		onFilledIndexEntry: onFilledIndexEntry,
+		cancellation:       newCancellation(ctx),
+		filteredPortals:    make([][]portalData, len(portals)+1),
+		depth:              0,
+	}
+	if costs != nil {
+		q.costIndex = newUnorderedTripleIndex(len(portals), float32(0), budget)
+	}
+	return q
+}
+
+// Any portal of an onion may replace any of the corners of the previous field,
+// so onion inside a triangle doesn't depend on the order of its vertices,
+// and all the orders share a single index entry.
+func (q *bestOnionQuery) getIndex(i, j, k portalIndex) bestSolution {
+	key := sortedTriple(i, j, k)
+	return q.index.get(key[0], key[1], key[2])
+}
+func (q *bestOnionQuery) getCost(i, j, k portalIndex) float32 {
+	if q.costIndex == nil {
+		return 0
+	}
+	key := sortedTriple(i, j, k)
+	return q.costIndex.get(key[0], key[1], key[2])
+}
+func (q *bestOnionQuery) setIndex(i, j, k portalIndex, s bestSolution, cost float32) {
+	key := sortedTriple(i, j, k)
+	if !q.index.set(key[0], key[1], key[2], s) || (q.costIndex != nil && !q.costIndex.set(key[0], key[1], key[2], cost)) {
+		// Out of memory, stop the search the same way as if it got cancelled.
+		q.cancellation.cancelled = true
+	}
+}
+
+func (q *bestOnionQuery) portalCost(index portalIndex) float32 {
+	if q.costs == nil {
+		return 0
+	}
+	return float32(q.costs[index])
+}
+
+func (q *bestOnionQuery) canMakeField(p0, p1, p2 portalData) bool {
+	return q.links.allowed(p0.Index, p1.Index) && q.links.allowed(p1.Index, p2.Index) &&
+		q.links.allowed(p2.Index, p0.Index) && q.fields.allowed(p0, p1, p2)
+}
+
+// canReplaceCorner returns true if portal may replace i-th of the corners,
+// making a field with the other two.
+func (q *bestOnionQuery) canReplaceCorner(corners [3]portalData, i int, portal portalData) bool {
+	a, b := corners[(i+1)%3], corners[(i+2)%3]
+	return q.links.allowed(portal.Index, a.Index) && q.links.allowed(portal.Index, b.Index) && q.fields.allowed(portal, a, b)
+}
+
+// bestReplacedCorner returns which of the corners replaced by portal leaves the deepest
+// (and among them the cheapest) onion inside, together with its length and cost.
+// Returns -1 if portal can't replace any of the corners.
+func (q *bestOnionQuery) bestReplacedCorner(corners [3]portalData, portal portalData, candidates []portalData) (int, uint16, float32) {
+	best, bestLength, bestCost := -1, uint16(0), float32(0)
+	for i := 0; i < 3; i++ {
+		if !q.canReplaceCorner(corners, i, portal) {
+			continue
+		}
+		a, b := corners[(i+1)%3], corners[(i+2)%3]
+		length := q.findBestOnion(portal, a, b, candidates)
+		if q.cancellation.cancelled {
+			return -1, 0, 0
+		}
+		cost := q.getCost(portal.Index, a.Index, b.Index)
+		if best < 0 || length > bestLength || (length == bestLength && cost < bestCost) {
+			best, bestLength, bestCost = i, length, cost
+		}
+	}
+	return best, bestLength, bestCost
+}
+
+// findBestOnion returns the number of portals of the deepest onion inside triangle p0, p1, p2.
+// Candidates must contain all the portals lying inside the triangle.
+func (q *bestOnionQuery) findBestOnion(p0, p1, p2 portalData, candidates []portalData) uint16 {
+	if solution := q.getIndex(p0.Index, p1.Index, p2.Index); solution.Length != invalidLength {
+		return solution.Length
+	}
+	if q.cancellation.check() {
+		return invalidLength
+	}
+	q.depth++
+	inside := portalsInsideTriangle(candidates, p0, p1, p2, q.filteredPortals[q.depth])
+	q.filteredPortals[q.depth] = inside
+	corners := [3]portalData{p0, p1, p2}
+	bestOnion := bestSolution{Index: invalidMemoPortalIndex}
+	var bestCost float32
+	for _, portal := range inside {
+		if q.costs == nil && int(bestOnion.Length) == len(inside) {
+			// All the portals inside are already used.
+			break
+		}
+		replaced, length, cost := q.bestReplacedCorner(corners, portal, inside)
+		if q.cancellation.cancelled {
+			// Leave the index entry unset, so that the index stays consistent.
+			q.depth--
+			return invalidLength
+		}
+		if replaced < 0 {
+			continue
+		}
+		cost += q.portalCost(portal.Index)
+		if length+1 > bestOnion.Length || (length+1 == bestOnion.Length && cost < bestCost) {
+			bestOnion.Length = length + 1
+			bestOnion.Index = newMemoPortalIndex(portal.Index)
+			bestCost = cost
+		}
+	}
+	q.onFilledIndexEntry()
+
+	q.setIndex(p0.Index, p1.Index, p2.Index, bestOnion, bestCost)
+	q.depth--
+	if q.cancellation.cancelled {
+		return invalidLength
+	}
+	return bestOnion.Length
+}
+
+// LargestOnion - Find deepest onion of fields, i.e. a sequence of nested fields
+// each of which shares an edge with the field enclosing it.
+// Each portal of the result following the first three replaces the corner of the previous field
+// given by its index. If fixedAnchorIndices are given, they are the corners of the outermost field.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError,
+// if the search runs out of its memory budget returns the best solution found so far
+// and a *MemoryBudgetExceededError.
+func LargestOnion(ctx context.Context, portals []Portal, fixedAnchorIndices []int, progressFunc func(int, int), options ...OnionOption) ([]IndexedPortal, error) {
+	results, err := TopOnions(ctx, portals, fixedAnchorIndices, 1, progressFunc, options...)
+	if len(results) == 0 {
+		return []IndexedPortal{}, err
+	}
+	return results[0], err
+}
+
+type onionCandidate struct {
+	p0, p1, p2 portalIndex
+	length     uint16
+	cost       float64
+}
+
+func betterOnion(a, b onionCandidate) bool {
+	return a.length > b.length || (a.length == b.length && a.cost < b.cost)
+}
+
+// TopOnions - Find up to numResults deepest onions having distinct sets of portals,
+// sorted from the deepest one. Errors are reported the same way as by LargestOnion.
+func TopOnions(ctx context.Context, portals []Portal, fixedAnchorIndices []int, numResults int, progressFunc func(int, int), options ...OnionOption) ([][]IndexedPortal, error) {
+	if len(portals) < 3 {
+		panic("Too short portal list")
+	}
+	if err := checkNumMemoPortals(len(portals)); err != nil {
+		return nil, err
+	}
+	params := defaultOnionParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
+	portalsData := portalsToPortalData(portals)
+	links := newLinkFilter(portalsData, params.blockers, disabledPortalsMask(portals, params.disabledPortals), params.maxLinkLength)
+
+	numIndexEntries := len(portals) * (len(portals) - 1) * (len(portals) - 2) / 6
+	everyNth := numIndexEntries / 1000
+	if everyNth < 1 {
+		everyNth = 1
+	}
+	indexEntriesFilled := 0
+	indexEntriesFilledModN := 0
+	onFilledIndexEntry := func() {
+		indexEntriesFilled++
+		indexEntriesFilledModN++
+		if indexEntriesFilledModN == everyNth {
+			indexEntriesFilledModN = 0
+			progressFunc(indexEntriesFilled, numIndexEntries)
+		}
+	}
+	progressFunc(0, numIndexEntries)
+	budget := newMemoryBudget(params.memoryBudget)
+	fields := newFieldSizeFilter(params.minFieldSize)
+	costs := portalCosts(portals)
+	q := newBestOnionQuery(ctx, portalsData, links, fields, costs, budget, onFilledIndexEntry)
+mainLoop:
+	for i, p0 := range portalsData {
+		for j := i + 1; j < len(portalsData); j++ {
+			p1 := portalsData[j]
+			for k := j + 1; k < len(portalsData); k++ {
+				p2 := portalsData[k]
+				if !hasAllElementsInTheTriple(fixedAnchorIndices, i, j, k) {
+					continue
+				}
+				if !q.canMakeField(p0, p1, p2) {
+					continue
+				}
+				q.findBestOnion(p0, p1, p2, portalsData)
+				if q.cancellation.cancelled {
+					break mainLoop
+				}
+			}
+		}
+	}
+	q.filteredPortals = nil
+	progressFunc(numIndexEntries, numIndexEntries)
+
+	minCost := minTotalCost(costs)
+	top := newTopSolutions(numResults, betterOnion)
+	for i, p0 := range portalsData {
+		for j := i + 1; j < len(portalsData); j++ {
+			p1 := portalsData[j]
+			for k := j + 1; k < len(portalsData); k++ {
+				p2 := portalsData[k]
+				if !hasAllElementsInTheTriple(fixedAnchorIndices, i, j, k) || !q.canMakeField(p0, p1, p2) {
+					continue
+				}
+				solution := q.getIndex(p0.Index, p1.Index, p2.Index)
+				if solution.Length == invalidLength {
+					continue
+				}
+				// Check with the lowest possible cost first, so that the real cost
+				// is computed only for the solutions which may be kept.
+				candidate := onionCandidate{p0.Index, p1.Index, p2.Index, solution.Length + 3, minCost}
+				if top.accepts(candidate) {
+					_, onionPortals := q.onionPortals(candidate, portals)
+					candidate.cost = totalCost(costs, onionPortals)
+					top.add(candidate, onionPortals)
+				}
+			}
+		}
+	}
+
+	var err error
+	if budget.exceeded {
+		err = budget.err(len(portals))
+	} else if q.cancellation.cancelled {
+		err = cancelledError(ctx)
+	}
+	results := make([][]IndexedPortal, 0, len(top.solutions))
+	for _, candidate := range top.solutions {
+		result, _ := q.onionPortals(candidate, portals)
+		results = append(results, result)
+	}
+	return results, err
+}
+
+// onionPortals returns portals of the onion starting with given triangle, together with their indices.
+func (q *bestOnionQuery) onionPortals(candidate onionCandidate, portals []Portal) ([]IndexedPortal, []portalIndex) {
+	corners := [3]portalData{q.portals[candidate.p0], q.portals[candidate.p1], q.portals[candidate.p2]}
+	result := make([]IndexedPortal, 0, candidate.length)
+	indices := make([]portalIndex, 0, candidate.length)
+	for i, corner := range corners {
+		result = append(result, IndexedPortal{Index: i, Portal: portals[corner.Index]})
+		indices = append(indices, corner.Index)
+	}
+	for {
+		sol := q.getIndex(corners[0].Index, corners[1].Index, corners[2].Index)
+		if sol.Length == 0 || sol.Length == invalidLength {
+			break
+		}
+		portal := q.portals[sol.Index.portalIndex()]
+		// Find which of the corners got replaced by the portal, choosing the same
+		// way as bestReplacedCorner.
+		replaced, bestLength, bestCost := -1, uint16(0), float32(0)
+		for i := 0; i < 3; i++ {
+			if !q.canReplaceCorner(corners, i, portal) {
+				continue
+			}
+			a, b := corners[(i+1)%3], corners[(i+2)%3]
+			length, cost := q.getIndex(portal.Index, a.Index, b.Index).Length, q.getCost(portal.Index, a.Index, b.Index)
+			if length == invalidLength {
+				continue
+			}
+			if replaced < 0 || length > bestLength || (length == bestLength && cost < bestCost) {
+				replaced, bestLength, bestCost = i, length, cost
+			}
+		}
+		if replaced < 0 || bestLength+1 != sol.Length {
+			panic("inconsistent onion index")
+		}
+		corners[replaced] = portal
+		result = append(result, IndexedPortal{Index: replaced, Portal: portals[portal.Index]})
+		indices = append(indices, portal.Index)
+	}
+	return result, indices
+}
+
+// OnionPolyline - onion fields drawn as a single polyline.
+// Onion is drawn the same way as a three corners field, as in both of them
+// every portal replaces one of the corners of the previous field.
+func OnionPolyline(result []IndexedPortal) []Portal {
+	return ThreeCornersPolyline(result)
+}
+func OnionDrawToolsString(result []IndexedPortal) string {
+	return "[\n" + PolylineFromPortalList(OnionPolyline(result)) + "\n]"
+}
@@ -0,0 +1,50 @@
+package lib
+
+type OnionOption interface {
+	apply(params *onionParams)
+}
+
+type OnionBlockers []Segment
+
+func (o OnionBlockers) apply(params *onionParams) {
+	params.blockers = []Segment(o)
+}
+
+type OnionDisabledPortals []Portal
+
+func (o OnionDisabledPortals) apply(params *onionParams) {
+	params.disabledPortals = []Portal(o)
+}
+
+// OnionMaxLinkLength - don't make links longer than that many meters
+type OnionMaxLinkLength float64
+
+func (o OnionMaxLinkLength) apply(params *onionParams) {
+	params.maxLinkLength = float64(o)
+}
+
+// OnionMinFieldSize - don't make fields smaller than that
+type OnionMinFieldSize FieldSize
+
+func (o OnionMinFieldSize) apply(params *onionParams) {
+	params.minFieldSize = FieldSize(o)
+}
+
+// OnionMemoryBudget - limit in bytes of memory used by the index of partial solutions
+type OnionMemoryBudget uint64
+
+func (o OnionMemoryBudget) apply(params *onionParams) {
+	params.memoryBudget = uint64(o)
+}
+
+type onionParams struct {
+	blockers        []Segment
+	disabledPortals []Portal
+	maxLinkLength   float64
+	minFieldSize    FieldSize
+	memoryBudget    uint64
+}
+
+func defaultOnionParams() onionParams {
+	return onionParams{memoryBudget: DefaultMemoryBudget}
+}
@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func checkValidOnionResult(name string, result []IndexedPortal, t *testing.T) {
+	plan, err := OnionPlan(result)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if plan.NumFields() != len(result)-2 {
+		t.Errorf("%s: expected plan of onion of %d portals to make %d fields, got %d", name, len(result), len(result)-2, plan.NumFields())
+	}
+	guids := make(map[string]bool)
+	for _, portal := range result {
+		if guids[portal.Portal.Guid] {
+			t.Errorf("%s: portal %s used more than once", name, portal.Portal.Guid)
+		}
+		guids[portal.Portal.Guid] = true
+	}
+}
+
+func TestOnion(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:30]
+	onion, err := LargestOnion(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidOnionResult("onion", onion, t)
+	cobweb, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onion) < len(cobweb) {
+		t.Errorf("Expected onion not shorter than the cobweb of %d portals, got %d", len(cobweb), len(onion))
+	}
+}
+
+func TestOnionFixedAnchors(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:30]
+	anchors := []int{3, 17}
+	onion, err := LargestOnion(context.Background(), portals, anchors, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidOnionResult("onion with anchors", onion, t)
+	for _, anchor := range anchors {
+		found := false
+		for _, corner := range onion[:3] {
+			if corner.Portal.Guid == portals[anchor].Guid {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected anchor portal %s to be a corner of the outermost field", portals[anchor].Name)
+		}
+	}
+}
+
+func TestTopOnions(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	portals = portals[:30]
+	onions, err := TopOnions(context.Background(), portals, []int{}, 5, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onions) != 5 {
+		t.Fatalf("Expected 5 onions, got %d", len(onions))
+	}
+	portalSets := make(map[string]bool)
+	for i, onion := range onions {
+		checkValidOnionResult(fmt.Sprintf("onion %d", i), onion, t)
+		if i > 0 && len(onion) > len(onions[i-1]) {
+			t.Errorf("Expected onions sorted from the deepest one, got %d portals after %d", len(onion), len(onions[i-1]))
+		}
+		guids := make([]string, 0, len(onion))
+		for _, portal := range onion {
+			guids = append(guids, portal.Portal.Guid)
+		}
+		sort.Strings(guids)
+		portalSet := strings.Join(guids, ",")
+		if portalSets[portalSet] {
+			t.Errorf("Onion %d has the same portals as one of the previous onions", i)
+		}
+		portalSets[portalSet] = true
+	}
+}
+
+func TestOnionMemoryBudgetExceeded(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		panic(err)
+	}
+	result, err := LargestOnion(context.Background(), portals[:30], []int{}, func(int, int) {}, OnionMemoryBudget(1000))
+	var budgetErr *MemoryBudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("Expected memory budget error, got %v", err)
+	}
+	// The result found before running out of memory is still a valid onion.
+	if len(result) > 0 {
+		checkValidOnionResult("onion within budget", result, t)
+	}
+}
@@ -0,0 +1,661 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/golang/geo/s2"
+)
+
+// Field - three portals forming a triangular field
+type Field [3]Portal
+
+type PlanStepType int
+
+const (
+	// LINK - throw a link from the Origin portal to the Destination portal
+	LINK PlanStepType = 0
+	// FLIP - flip the Origin portal, destroying all its links and fields
+	FLIP PlanStepType = 1
+)
+
+// PlanStep - single action of a plan together with the fields it creates
+type PlanStep struct {
+	Type        PlanStepType
+	Origin      Portal
+	Destination Portal
+	Fields      []Field
+}
+
+// Plan - ordered list of actions building a pattern
+type Plan struct {
+	Steps []PlanStep
+}
+
+// NumFields returns the total number of fields created by the plan.
+func (p Plan) NumFields() int {
+	numFields := 0
+	for _, step := range p.Steps {
+		numFields += len(step.Fields)
+	}
+	return numFields
+}
+
+// NumLinks returns the total number of links thrown by the plan.
+func (p Plan) NumLinks() int {
+	numLinks := 0
+	for _, step := range p.Steps {
+		if step.Type == LINK {
+			numLinks++
+		}
+	}
+	return numLinks
+}
+
+// LongestLink returns the length in meters of the longest link thrown by the plan.
+func (p Plan) LongestLink() float64 {
+	var longest float64
+	for _, step := range p.Steps {
+		if step.Type == LINK {
+			longest = math.Max(longest, float64(step.Origin.LatLng.Distance(step.Destination.LatLng))*RadiansToMeters)
+		}
+	}
+	return longest
+}
+
+// PortalsInsideFields returns those of the portals which lie inside any of the fields
+// created by the plan, e.g. disabled portals getting covered by the pattern.
+func (p Plan) PortalsInsideFields(portals []Portal) []Portal {
+	var result []Portal
+	covered := make([]bool, len(portals))
+	for _, step := range p.Steps {
+		for _, field := range step.Fields {
+			triangle := newTriangleQuery(
+				s2.PointFromLatLng(field[0].LatLng),
+				s2.PointFromLatLng(field[1].LatLng),
+				s2.PointFromLatLng(field[2].LatLng))
+			for i, portal := range portals {
+				if covered[i] || portal.Guid == field[0].Guid || portal.Guid == field[1].Guid || portal.Guid == field[2].Guid {
+					continue
+				}
+				if triangle.ContainsPoint(s2.PointFromLatLng(portal.LatLng)) {
+					covered[i] = true
+					result = append(result, portal)
+				}
+			}
+		}
+	}
+	return result
+}
+
+type planLink struct {
+	from, to portalIndex
+}
+
+type planField struct {
+	vertices [3]portalIndex
+	triangle triangleQuery
+}
+
+func sortedTriple(a, b, c portalIndex) [3]portalIndex {
+	if a > b {
+		a, b = b, a
+	}
+	if b > c {
+		b, c = c, b
+	}
+	if a > b {
+		a, b = b, a
+	}
+	return [3]portalIndex{a, b, c}
+}
+
+// planSimulator keeps track of links and fields existing on the map
+// while the steps of a plan are being executed.
+type planSimulator struct {
+	portals   []Portal
+	data      []portalData
+	neighbors []map[portalIndex]struct{}
+	links     []planLink
+	fields    []planField
+	created   map[[3]portalIndex]struct{}
+	steps     []PlanStep
+}
+
+func newPlanSimulator(portals []Portal) *planSimulator {
+	neighbors := make([]map[portalIndex]struct{}, len(portals))
+	for i := range neighbors {
+		neighbors[i] = make(map[portalIndex]struct{})
+	}
+	return &planSimulator{
+		portals:   portals,
+		data:      portalsToPortalData(portals),
+		neighbors: neighbors,
+		created:   make(map[[3]portalIndex]struct{}),
+	}
+}
+
+func (s *planSimulator) insideField(p portalIndex) bool {
+	for _, field := range s.fields {
+		if field.vertices[0] != p && field.vertices[1] != p && field.vertices[2] != p &&
+			field.triangle.ContainsPoint(s.data[p].LatLng) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *planSimulator) hasLink(a, b portalIndex) bool {
+	_, ok := s.neighbors[a][b]
+	return ok
+}
+
+func (s *planSimulator) link(from, to portalIndex) error {
+	if from == to {
+		return fmt.Errorf("cannot link portal \"%s\" to itself", s.portals[from].Name)
+	}
+	if s.hasLink(from, to) {
+		return fmt.Errorf("link between \"%s\" and \"%s\" already exists", s.portals[from].Name, s.portals[to].Name)
+	}
+	if s.insideField(from) {
+		return fmt.Errorf("cannot link from \"%s\", it lies inside a field", s.portals[from].Name)
+	}
+	a, b := s.data[from].LatLng, s.data[to].LatLng
+	for _, l := range s.links {
+		if l.from == from || l.from == to || l.to == from || l.to == to {
+			continue
+		}
+		if segmentsCross(a, b, s.data[l.from].LatLng, s.data[l.to].LatLng) {
+			return fmt.Errorf("link from \"%s\" to \"%s\" crosses link from \"%s\" to \"%s\"",
+				s.portals[from].Name, s.portals[to].Name, s.portals[l.from].Name, s.portals[l.to].Name)
+		}
+	}
+	// A link creates at most one field on each of its sides - the largest one.
+	ccw := newCCWQuery(a, b)
+	bestOnSide := [2]portalIndex{invalidPortalIndex, invalidPortalIndex}
+	bestArea := [2]float64{}
+	for third := range s.neighbors[from] {
+		if !s.hasLink(third, to) {
+			continue
+		}
+		side := 0
+		if ccw.IsCCW(s.data[third].LatLng) {
+			side = 1
+		}
+		area := triangleArea(s.data[from], s.data[to], s.data[third])
+		if bestOnSide[side] == invalidPortalIndex || area > bestArea[side] {
+			bestOnSide[side] = third
+			bestArea[side] = area
+		}
+	}
+	s.neighbors[from][to] = struct{}{}
+	s.neighbors[to][from] = struct{}{}
+	s.links = append(s.links, planLink{from: from, to: to})
+	step := PlanStep{Type: LINK, Origin: s.portals[from], Destination: s.portals[to]}
+	for _, third := range bestOnSide {
+		if third == invalidPortalIndex {
+			continue
+		}
+		s.fields = append(s.fields, planField{
+			vertices: [3]portalIndex{from, to, third},
+			triangle: newTriangleQuery(a, b, s.data[third].LatLng),
+		})
+		s.created[sortedTriple(from, to, third)] = struct{}{}
+		step.Fields = append(step.Fields, Field{s.portals[from], s.portals[to], s.portals[third]})
+	}
+	s.steps = append(s.steps, step)
+	return nil
+}
+
+func (s *planSimulator) flip(p portalIndex) {
+	links := s.links[:0]
+	for _, l := range s.links {
+		if l.from != p && l.to != p {
+			links = append(links, l)
+		}
+	}
+	s.links = links
+	for neighbor := range s.neighbors[p] {
+		delete(s.neighbors[neighbor], p)
+	}
+	s.neighbors[p] = make(map[portalIndex]struct{})
+	fields := s.fields[:0]
+	for _, f := range s.fields {
+		if f.vertices[0] != p && f.vertices[1] != p && f.vertices[2] != p {
+			fields = append(fields, f)
+		}
+	}
+	s.fields = fields
+	s.steps = append(s.steps, PlanStep{Type: FLIP, Origin: s.portals[p]})
+}
+
+// verify checks that all the intended fields have been created during the simulation.
+func (s *planSimulator) verify(intended [][3]portalIndex) error {
+	for _, f := range intended {
+		if _, ok := s.created[sortedTriple(f[0], f[1], f[2])]; !ok {
+			return fmt.Errorf("field \"%s\", \"%s\", \"%s\" doesn't get created",
+				s.portals[f[0]].Name, s.portals[f[1]].Name, s.portals[f[2]].Name)
+		}
+	}
+	return nil
+}
+
+func (s *planSimulator) plan() Plan {
+	return Plan{Steps: s.steps}
+}
+
+// planPortals assigns consecutive indices to distinct portals of a pattern.
+type planPortals struct {
+	portals []Portal
+	indices map[string]portalIndex
+}
+
+func newPlanPortals() *planPortals {
+	return &planPortals{indices: make(map[string]portalIndex)}
+}
+
+func (p *planPortals) index(portal Portal) portalIndex {
+	if ix, ok := p.indices[portal.Guid]; ok {
+		return ix
+	}
+	ix := portalIndex(len(p.portals))
+	p.indices[portal.Guid] = ix
+	p.portals = append(p.portals, portal)
+	return ix
+}
+
+func (p *planPortals) field(p0, p1, p2 Portal) [3]portalIndex {
+	return [3]portalIndex{p.index(p0), p.index(p1), p.index(p2)}
+}
+
+// planFromNestedFields builds a plan for a set of fields, such that any two fields
+// are either nested or have disjoint interiors.
+//
+// Links having both ends deep inside fields have to be thrown first, before the
+// fields enclosing them get closed. Among links which can be thrown at the same stage
+// the links of the outer fields go first, so that a link never closes two fields
+// on the same side at once (in which case only the larger one would get created).
+func planFromNestedFields(portals []Portal, fields [][3]portalIndex) (Plan, error) {
+	data := portalsToPortalData(portals)
+	triangles := make([]triangleQuery, 0, len(fields))
+	for _, f := range fields {
+		triangles = append(triangles, newTriangleQuery(data[f[0]].LatLng, data[f[1]].LatLng, data[f[2]].LatLng))
+	}
+	// number of fields containing given portal
+	numContaining := make([]int, len(portals))
+	for i, p := range data {
+		for j, f := range fields {
+			if f[0] != p.Index && f[1] != p.Index && f[2] != p.Index &&
+				triangles[j].ContainsPoint(p.LatLng) {
+				numContaining[i]++
+			}
+		}
+	}
+	// number of fields containing given field
+	fieldDepth := make([]int, len(fields))
+	for i, f := range fields {
+		for j, g := range fields {
+			if i == j {
+				continue
+			}
+			contained := true
+			for _, v := range f {
+				if v != g[0] && v != g[1] && v != g[2] && !triangles[j].ContainsPoint(data[v].LatLng) {
+					contained = false
+					break
+				}
+			}
+			if contained && sortedTriple(f[0], f[1], f[2]) != sortedTriple(g[0], g[1], g[2]) {
+				fieldDepth[i]++
+			}
+		}
+	}
+	type nestedLink struct {
+		a, b  portalIndex
+		key   int
+		level int
+	}
+	linkIndices := make(map[planLink]int)
+	var links []nestedLink
+	for i, f := range fields {
+		for j := 0; j < 3; j++ {
+			a, b := f[j], f[(j+1)%3]
+			if a > b {
+				a, b = b, a
+			}
+			if ix, ok := linkIndices[planLink{a, b}]; ok {
+				links[ix].level = min(links[ix].level, fieldDepth[i])
+				continue
+			}
+			linkIndices[planLink{a, b}] = len(links)
+			links = append(links, nestedLink{
+				a:     a,
+				b:     b,
+				key:   min(numContaining[a], numContaining[b]),
+				level: fieldDepth[i],
+			})
+		}
+	}
+	sort.SliceStable(links, func(i, j int) bool {
+		if links[i].key != links[j].key {
+			return links[i].key > links[j].key
+		}
+		return links[i].level < links[j].level
+	})
+	simulator := newPlanSimulator(portals)
+	numOutbound := make([]int, len(portals))
+	for _, l := range links {
+		from, to := l.a, l.b
+		if numContaining[to] < numContaining[from] ||
+			(numContaining[to] == numContaining[from] && numOutbound[to] < numOutbound[from]) {
+			from, to = to, from
+		}
+		if simulator.insideField(from) && !simulator.insideField(to) {
+			from, to = to, from
+		}
+		if err := simulator.link(from, to); err != nil {
+			return simulator.plan(), err
+		}
+		numOutbound[from]++
+	}
+	return simulator.plan(), simulator.verify(fields)
+}
+
+func appendHomogeneousFields(p0, p1, p2 Portal, maxDepth uint16, fields [][3]Portal, portals []Portal) ([][3]Portal, []Portal) {
+	fields = append(fields, [3]Portal{p0, p1, p2})
+	if maxDepth == 1 {
+		return fields, portals
+	}
+	portal := portals[0]
+	fields, portals = appendHomogeneousFields(portal, p1, p2, maxDepth-1, fields, portals[1:])
+	fields, portals = appendHomogeneousFields(p0, portal, p2, maxDepth-1, fields, portals)
+	fields, portals = appendHomogeneousFields(p0, p1, portal, maxDepth-1, fields, portals)
+	return fields, portals
+}
+
+func planFromPortalFields(portalFields [][3]Portal) (Plan, error) {
+	planPortals := newPlanPortals()
+	fields := make([][3]portalIndex, 0, len(portalFields))
+	for _, f := range portalFields {
+		fields = append(fields, planPortals.field(f[0], f[1], f[2]))
+	}
+	return planFromNestedFields(planPortals.portals, fields)
+}
+
+// HomogeneousPlan - link plan for a homogeneous field returned by DeepestHomogeneous.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func HomogeneousPlan(depth uint16, result []Portal) (Plan, error) {
+	if len(result) < 3 {
+		return Plan{}, nil
+	}
+	fields, _ := appendHomogeneousFields(result[0], result[1], result[2], depth, nil, result[3:])
+	return planFromPortalFields(fields)
+}
+
+// CobwebPlan - link plan for a cobweb field returned by LargestCobweb.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func CobwebPlan(result []Portal) (Plan, error) {
+	fields := [][3]Portal{}
+	for i := 2; i < len(result); i++ {
+		fields = append(fields, [3]Portal{result[i-2], result[i-1], result[i]})
+	}
+	return planFromPortalFields(fields)
+}
+
+// MaxFieldsPlan - link plan for fields returned by MaxFields.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func MaxFieldsPlan(fields []Field) (Plan, error) {
+	portalFields := make([][3]Portal, 0, len(fields))
+	for _, field := range fields {
+		portalFields = append(portalFields, [3]Portal(field))
+	}
+	return planFromPortalFields(portalFields)
+}
+
+// ThreeCornersPlan - link plan for a field returned by LargestThreeCorner.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func ThreeCornersPlan(result []IndexedPortal) (Plan, error) {
+	fields := [][3]Portal{}
+	var corners [3]Portal
+	var cornerSet [3]bool
+	for _, indexedPortal := range result {
+		corners[indexedPortal.Index] = indexedPortal.Portal
+		cornerSet[indexedPortal.Index] = true
+		if cornerSet[0] && cornerSet[1] && cornerSet[2] {
+			fields = append(fields, corners)
+		}
+	}
+	return planFromPortalFields(fields)
+}
+
+// OnionPlan - link plan for an onion field returned by LargestOnion.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func OnionPlan(result []IndexedPortal) (Plan, error) {
+	// Every portal replaces one of the corners, same as in a three corners field.
+	return ThreeCornersPlan(result)
+}
+
+// FanPlan - link plan for a fan field returned by LargestFan.
+// The anchor links to consecutive fan portals, each of which then links
+// to the previous one, so all the outbound links of the anchor are to the fan portals.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func FanPlan(anchor Portal, fan []Portal) (Plan, error) {
+	if len(fan) < 2 {
+		return Plan{}, nil
+	}
+	planPortals := newPlanPortals()
+	anchorIndex := planPortals.index(anchor)
+	fanIndices := make([]portalIndex, 0, len(fan))
+	fields := make([][3]portalIndex, 0, len(fan)-1)
+	for i, portal := range fan {
+		fanIndices = append(fanIndices, planPortals.index(portal))
+		if i > 0 {
+			fields = append(fields, planPortals.field(anchor, fan[i-1], portal))
+		}
+	}
+	simulator := newPlanSimulator(planPortals.portals)
+	for i, portal := range fanIndices {
+		if err := simulator.link(anchorIndex, portal); err != nil {
+			return simulator.plan(), err
+		}
+		if i > 0 {
+			if err := simulator.link(portal, fanIndices[i-1]); err != nil {
+				return simulator.plan(), err
+			}
+		}
+	}
+	return simulator.plan(), simulator.verify(fields)
+}
+
+// herringbone spine portals sorted by the area of their field, smallest first
+func sortedHerringboneSpine(b0, b1 Portal, spine []Portal) []Portal {
+	p0, p1 := s2.PointFromLatLng(b0.LatLng), s2.PointFromLatLng(b1.LatLng)
+	sorted := append([]Portal{}, spine...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return s2.GirardArea(p0, p1, s2.PointFromLatLng(sorted[i].LatLng)) <
+			s2.GirardArea(p0, p1, s2.PointFromLatLng(sorted[j].LatLng))
+	})
+	return sorted
+}
+
+// HerringbonePlan - link plan for a herringbone field returned by LargestHerringbone.
+// Spine portals, starting from the one closest to the base, link to both base portals.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func HerringbonePlan(b0, b1 Portal, result []Portal) (Plan, error) {
+	return DoubleHerringbonePlan(b0, b1, result, nil)
+}
+
+// DoubleHerringbonePlan - link plan for a double herringbone field returned by LargestDoubleHerringbone.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func DoubleHerringbonePlan(b0, b1 Portal, result0, result1 []Portal) (Plan, error) {
+	planPortals := newPlanPortals()
+	base0, base1 := planPortals.index(b0), planPortals.index(b1)
+	fields := [][3]portalIndex{}
+	var spine []portalIndex
+	for _, result := range [][]Portal{result0, result1} {
+		for _, portal := range sortedHerringboneSpine(b0, b1, result) {
+			fields = append(fields, planPortals.field(b0, b1, portal))
+			spine = append(spine, planPortals.index(portal))
+		}
+	}
+	simulator := newPlanSimulator(planPortals.portals)
+	if err := simulator.link(base0, base1); err != nil {
+		return simulator.plan(), err
+	}
+	for _, portal := range spine {
+		if err := simulator.link(portal, base0); err != nil {
+			return simulator.plan(), err
+		}
+		if err := simulator.link(portal, base1); err != nil {
+			return simulator.plan(), err
+		}
+	}
+	return simulator.plan(), simulator.verify(fields)
+}
+
+// FlipFieldPhase - phase of building a flip field a step of its execution plan belongs to
+type FlipFieldPhase int
+
+const (
+	// FlipFieldBackbonePhase - linking consecutive backbone portals
+	FlipFieldBackbonePhase FlipFieldPhase = 0
+	// FlipFieldInitialFanPhase - linking the first flip portal to all the backbone portals
+	FlipFieldInitialFanPhase FlipFieldPhase = 1
+	// FlipFieldFlipPhase - flipping a flip portal, destroying its links and fields
+	FlipFieldFlipPhase FlipFieldPhase = 2
+	// FlipFieldReLinkPhase - linking the next flip portal to all the backbone portals
+	// after the previous one has been flipped
+	FlipFieldReLinkPhase FlipFieldPhase = 3
+)
+
+func (p FlipFieldPhase) String() string {
+	switch p {
+	case FlipFieldBackbonePhase:
+		return "backbone"
+	case FlipFieldInitialFanPhase:
+		return "initial fan"
+	case FlipFieldFlipPhase:
+		return "flip"
+	case FlipFieldReLinkPhase:
+		return "re-link"
+	}
+	return fmt.Sprintf("FlipFieldPhase(%d)", int(p))
+}
+
+// FlipFieldExecutionStep - single step of a flip field execution plan
+type FlipFieldExecutionStep struct {
+	PlanStep
+	Phase FlipFieldPhase
+	// Number of fields existing after the step
+	NumFields int
+	// Number of fields created from the beginning of the plan up to and including the step
+	NumFieldsCreated int
+}
+
+// FlipFieldExecution - ordered steps building a flip field
+type FlipFieldExecution struct {
+	Steps []FlipFieldExecutionStep
+	// Flip portals in the order of flipping them
+	FlipOrder []Portal
+}
+
+// Plan returns the steps of the execution plan as a generic Plan.
+func (e FlipFieldExecution) Plan() Plan {
+	var plan Plan
+	for _, step := range e.Steps {
+		plan.Steps = append(plan.Steps, step.PlanStep)
+	}
+	return plan
+}
+
+// PhaseSteps returns the steps belonging to the given phase, in the order of execution.
+func (e FlipFieldExecution) PhaseSteps(phase FlipFieldPhase) []FlipFieldExecutionStep {
+	var steps []FlipFieldExecutionStep
+	for _, step := range e.Steps {
+		if step.Phase == phase {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// FlipFieldPlan - link plan for a flip field returned by LargestFlipField.
+// After linking the backbone each flip portal, starting from the one closest
+// to the backbone, links to all the backbone portals and then gets flipped.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func FlipFieldPlan(backbone, flipPortals []Portal) (Plan, error) {
+	execution, err := FlipFieldExecutionPlan(backbone, flipPortals)
+	return execution.Plan(), err
+}
+
+// FlipFieldExecutionPlan - the plan of FlipFieldPlan split into phases: backbone links,
+// initial fan links of the first flip portal, and then alternating flips and re-links of the next
+// flip portal, together with the number of fields after every step.
+// Returns an error if the plan doesn't create all the fields of the pattern.
+func FlipFieldExecutionPlan(backbone, flipPortals []Portal) (FlipFieldExecution, error) {
+	if len(backbone) < 2 {
+		return FlipFieldExecution{}, nil
+	}
+	planPortals := newPlanPortals()
+	backboneIndices := make([]portalIndex, 0, len(backbone))
+	for _, portal := range backbone {
+		backboneIndices = append(backboneIndices, planPortals.index(portal))
+	}
+	flipIndices := make([]portalIndex, 0, len(flipPortals))
+	for _, portal := range flipPortals {
+		flipIndices = append(flipIndices, planPortals.index(portal))
+	}
+	simulator := newPlanSimulator(planPortals.portals)
+	data := simulator.data
+	distanceToBackbone := func(p portalIndex) float64 {
+		result := distance(data[p], data[backboneIndices[0]])
+		for _, b := range backboneIndices[1:] {
+			result = min(result, distance(data[p], data[b]))
+		}
+		return result
+	}
+	sort.SliceStable(flipIndices, func(i, j int) bool {
+		return distanceToBackbone(flipIndices[i]) < distanceToBackbone(flipIndices[j])
+	})
+	execution := FlipFieldExecution{}
+	for _, flipPortal := range flipIndices {
+		execution.FlipOrder = append(execution.FlipOrder, planPortals.portals[flipPortal])
+	}
+	numFieldsCreated := 0
+	// record adds the steps made by the simulator since the previous call to the execution plan.
+	record := func(phase FlipFieldPhase) {
+		for _, step := range simulator.steps[len(execution.Steps):] {
+			numFieldsCreated += len(step.Fields)
+			execution.Steps = append(execution.Steps, FlipFieldExecutionStep{
+				PlanStep:         step,
+				Phase:            phase,
+				NumFields:        len(simulator.fields),
+				NumFieldsCreated: numFieldsCreated,
+			})
+		}
+	}
+	fields := [][3]portalIndex{}
+	for i := 1; i < len(backboneIndices); i++ {
+		if err := simulator.link(backboneIndices[i-1], backboneIndices[i]); err != nil {
+			return execution, err
+		}
+		record(FlipFieldBackbonePhase)
+	}
+	phase := FlipFieldInitialFanPhase
+	for _, flipPortal := range flipIndices {
+		for i, b := range backboneIndices {
+			if err := simulator.link(flipPortal, b); err != nil {
+				return execution, err
+			}
+			record(phase)
+			if i > 0 {
+				fields = append(fields, [3]portalIndex{flipPortal, backboneIndices[i-1], b})
+			}
+		}
+		simulator.flip(flipPortal)
+		record(FlipFieldFlipPhase)
+		phase = FlipFieldReLinkPhase
+	}
+	return execution, simulator.verify(fields)
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+func checkValidPlan(expectedNumFields int, plan Plan, err error, t *testing.T) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.NumFields() != expectedNumFields {
+		t.Errorf("Expected %d fields, actual %d", expectedNumFields, plan.NumFields())
+	}
+}
+
+// synthetic portal generators don't guarantee unique guids
+func withUniqueGuids(portals []Portal) []Portal {
+	result := make([]Portal, 0, len(portals))
+	for i, portal := range portals {
+		portal.Guid = fmt.Sprintf("%d", i)
+		result = append(result, portal)
+	}
+	return result
+}
+
+func TestHomogeneousPlan(t *testing.T) {
+	for depth := 1; depth <= 5; depth++ {
+		portals := withUniqueGuids(generateHomogeneousPortals(depth))
+		result, resultDepth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousMaxDepth(depth))
+		if err != nil || int(resultDepth) != depth {
+			t.Fatalf("Unexpected homogeneous result, depth %d, error %v", resultDepth, err)
+		}
+		plan, err := HomogeneousPlan(resultDepth, result)
+		// 1 + 3 + 9 + ... fields
+		expectedNumFields := 0
+		for i, numFields := 0, 1; i < depth; i, numFields = i+1, numFields*3 {
+			expectedNumFields += numFields
+		}
+		checkValidPlan(expectedNumFields, plan, err, t)
+		if plan.NumLinks() != 3*numPortalsPerDepth(uint16(depth))-6 {
+			t.Errorf("Unexpected number of links %d", plan.NumLinks())
+		}
+	}
+}
+
+func TestCobwebPlan(t *testing.T) {
+	portals := withUniqueGuids(generateCobwebPortals(10))
+	result, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := CobwebPlan(result)
+	checkValidPlan(len(portals)-2, plan, err, t)
+}
+
+func generateHerringbonePortals(length int) (Portal, Portal, []Portal) {
+	b0 := Portal{Guid: "b0", LatLng: s2.LatLngFromDegrees(20, 20)}
+	b1 := Portal{Guid: "b1", LatLng: s2.LatLngFromDegrees(20, 22)}
+	spine := []Portal{}
+	for i := length; i > 0; i-- {
+		spine = append(spine, Portal{
+			Guid:   fmt.Sprintf("s%d", i),
+			LatLng: s2.LatLngFromDegrees(20+0.1*float64(i), 21+0.01*float64(i%3))})
+	}
+	return b0, b1, spine
+}
+
+func TestHerringbonePlan(t *testing.T) {
+	b0, b1, spine := generateHerringbonePortals(10)
+	plan, err := HerringbonePlan(b0, b1, spine)
+	checkValidPlan(len(spine), plan, err, t)
+	for _, step := range plan.Steps[1:] {
+		if step.Origin.Guid == b0.Guid || step.Origin.Guid == b1.Guid {
+			t.Errorf("Base portal %s shouldn't throw links", step.Origin.Guid)
+		}
+	}
+}
+
+func TestPlanLinkFromInsideField(t *testing.T) {
+	portals := withUniqueGuids(generateHomogeneousPortals(2))
+	simulator := newPlanSimulator(portals)
+	for _, link := range [][2]portalIndex{{0, 1}, {1, 2}, {2, 0}} {
+		if err := simulator.link(link[0], link[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := simulator.link(3, 0); err == nil {
+		t.Errorf("Expected error when linking from inside a field")
+	}
+	if err := simulator.link(0, 3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHerringbonePlanKeys(t *testing.T) {
+	b0, b1, spine := generateHerringbonePortals(10)
+	plan, err := HerringbonePlan(b0, b1, spine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := PlanKeys(plan)
+	if len(keys) != len(spine)+2 {
+		t.Fatalf("Expected %d portals, actual %d", len(spine)+2, len(keys))
+	}
+	for _, k := range keys {
+		expectedKeys, expectedOutbound := 0, 2
+		switch k.Portal.Guid {
+		case b0.Guid:
+			expectedKeys, expectedOutbound = len(spine), 1
+		case b1.Guid:
+			expectedKeys, expectedOutbound = len(spine)+1, 0
+		}
+		if k.Keys != expectedKeys || k.OutboundLinks != expectedOutbound {
+			t.Errorf("Portal %s: expected %d keys and %d outbound links, actual %d and %d",
+				k.Portal.Guid, expectedKeys, expectedOutbound, k.Keys, k.OutboundLinks)
+		}
+	}
+	if len(PortalsExceedingOutboundLimit(keys)) != 0 {
+		t.Errorf("No portal should exceed the outbound link limit")
+	}
+}
+
+func TestPlanKeysOutboundLimit(t *testing.T) {
+	portals := withUniqueGuids(generateCobwebPortals(4))
+	plan := Plan{}
+	for _, portal := range portals[1:] {
+		plan.Steps = append(plan.Steps, PlanStep{Type: LINK, Origin: portals[0], Destination: portal})
+	}
+	exceeding := PortalsExceedingOutboundLimit(PlanKeys(plan))
+	if len(exceeding) != 1 || exceeding[0].Portal.Guid != portals[0].Guid || exceeding[0].OutboundLinks != len(portals)-1 {
+		t.Errorf("Expected portal %s to exceed the outbound link limit, got %v", portals[0].Guid, exceeding)
+	}
+}
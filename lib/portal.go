@@ -1,16 +1,13 @@
 package lib
 
+import "bufio"
 import "encoding/csv"
 import "encoding/json"
 import "errors"
 import "fmt"
 import "io"
-import "io/ioutil"
-import "math"
 import "os"
-import "path/filepath"
 import "strconv"
-import "strings"
 
 import "github.com/golang/geo/s2"
 
@@ -19,6 +16,9 @@ type Portal struct {
 	Guid   string
 	Name   string
 	LatLng s2.LatLng
+	// Cost of using the portal, used to choose between equally good solutions.
+	// Negative cost rewards using the portal.
+	Cost float64
 }
 
 // IndexedPortal - Portal plus a number
@@ -38,13 +38,26 @@ type PortalInfo struct {
 	Guid        string            `json:"guid"`
 	Name        string            `json:"title"`
 	Coordinates PortalCoordinates `json:"coordinates"`
+	Cost        float64           `json:"cost,omitempty"`
 }
 
 // ParseFile parses file to portal list.
 //
-// It tries to guess the file format based on extensions of the file.
+// It tries to guess the file format based on the contents of the file.
+// Supported formats are JSON and CSV exports of the Multi Export IITC plugin,
+// IITC draw tools markers, GeoJSON points and KML placemarks.
 func ParseFile(filename string) ([]Portal, error) {
-	portalInfo, err := parseFileAsPortalInfo(filename)
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseReader(file, AutoDetectFormat)
+}
+
+// ParseReader parses portal list in given format read from the reader.
+func ParseReader(r io.Reader, format PortalFileFormat) ([]Portal, error) {
+	portalInfo, err := parsePortalInfo(r, format)
 	if err != nil {
 		return nil, err
 	}
@@ -58,113 +71,101 @@ func ParseFile(filename string) ([]Portal, error) {
 	return portalInfoToPortal(portalInfo)
 }
 
-// parseFileAsPortalInfo parses file to list of PortalInfo structs
-//
-// It tries to guess the file format based on extensions of the file.
-func parseFileAsPortalInfo(filename string) ([]PortalInfo, error) {
-	switch filepath.Ext(filename) {
-	case ".csv":
-		return parseCSVFileAsPortalInfo(filename)
-	case ".json":
-		return parseJSONFileAsPortalInfo(filename)
-	default:
-		return nil, fmt.Errorf("unknown extension of file %s", filename)
-	}
+// csvQuoteEscapingReader fixes quote escaping from \" to "" while reading.
+type csvQuoteEscapingReader struct {
+	r        io.ByteReader
+	pending  []byte
+	inQuotes bool
+	escaping bool
 }
 
-func fixCSVQuoteEscaping(csvBytes []byte) []byte {
-	escapedCsv := make([]byte, 0, len(csvBytes))
-	inQuotes := false
-	escaping := false
-	for _, b := range csvBytes {
+func newCSVQuoteEscapingReader(r io.Reader) *csvQuoteEscapingReader {
+	return &csvQuoteEscapingReader{r: bufio.NewReader(r)}
+}
+
+func (e *csvQuoteEscapingReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(e.pending) > 0 {
+			copied := copy(p[n:], e.pending)
+			e.pending = e.pending[copied:]
+			n += copied
+			continue
+		}
+		b, err := e.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
 		switch b {
 		case '"':
-			if escaping {
-				escapedCsv = append(escapedCsv, '"', '"')
-				escaping = false
+			if e.escaping {
+				e.pending = append(e.pending, '"', '"')
+				e.escaping = false
 			} else {
-				escapedCsv = append(escapedCsv, '"')
-				inQuotes = !inQuotes
+				e.pending = append(e.pending, '"')
+				e.inQuotes = !e.inQuotes
 			}
 		case '\\':
-			if escaping {
-				escapedCsv = append(escapedCsv, '\\', '\\')
-				escaping = false
-			} else if inQuotes {
-				escaping = true
+			if e.escaping {
+				e.pending = append(e.pending, '\\', '\\')
+				e.escaping = false
+			} else if e.inQuotes {
+				e.escaping = true
 			} else {
-				escapedCsv = append(escapedCsv, '\\')
+				e.pending = append(e.pending, '\\')
 			}
 		default:
-			if escaping {
-				escapedCsv = append(escapedCsv, '\\', b)
+			if e.escaping {
+				e.pending = append(e.pending, '\\', b)
+				e.escaping = false
 			} else {
-				escapedCsv = append(escapedCsv, b)
+				e.pending = append(e.pending, b)
 			}
 		}
 	}
-	return escapedCsv
+	return n, nil
 }
 
-func parseCSVFileAsPortalInfo(filename string) ([]PortalInfo, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	bytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		return nil, err
-	}
-	// Fix quote escaping from \" to ""
-	bytes = fixCSVQuoteEscaping(bytes)
-	fileStr := string(bytes)
-
-	r := csv.NewReader(strings.NewReader(fileStr))
+func parseCSVAsPortalInfo(reader io.Reader) ([]PortalInfo, error) {
+	r := csv.NewReader(newCSVQuoteEscapingReader(reader))
+	r.FieldsPerRecord = -1
 	var portals []PortalInfo
-	lineNo := 0
 	for {
 		record, err := r.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("error: %v, in line %d", err, lineNo+1)
+			return nil, fmt.Errorf("error: %v", err)
 		}
-		if len(record) != 4 {
-			return nil, fmt.Errorf("unexcepted number of fields: %d in line %d", len(record), lineNo+1)
+		lineNo, _ := r.FieldPos(0)
+		if len(record) != 4 && len(record) != 5 {
+			return nil, fmt.Errorf("unexcepted number of fields: %d in line %d", len(record), lineNo)
 		}
 		_, err = strconv.ParseFloat(record[2], 64)
 		if err != nil {
-			return nil, errors.New("cannot parse latitude: \"" + record[2] + "\"")
+			return nil, fmt.Errorf("cannot parse latitude: \"%s\" in line %d", record[2], lineNo)
 		}
 		_, err = strconv.ParseFloat(record[3], 64)
 		if err != nil {
-			return nil, errors.New("cannot parse longitude: \"" + record[3] + "\"")
+			return nil, fmt.Errorf("cannot parse longitude: \"%s\" in line %d", record[3], lineNo)
 		}
-		portalCoordinates := PortalCoordinates{Lat: record[2], Lng: record[3]}
-		portals = append(portals, PortalInfo{Guid: record[0], Name: record[1], Coordinates: portalCoordinates})
-		if len(portals) >= math.MaxUint16-1 {
-			return nil, errors.New("too many portals")
+		var cost float64
+		if len(record) == 5 {
+			cost, err = strconv.ParseFloat(record[4], 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse cost: \"%s\" in line %d", record[4], lineNo)
+			}
 		}
-
-		lineNo++
+		portalCoordinates := PortalCoordinates{Lat: record[2], Lng: record[3]}
+		portals = append(portals, PortalInfo{Guid: record[0], Name: record[1], Coordinates: portalCoordinates, Cost: cost})
 	}
 	return portals, nil
 }
 
-func parseJSONFileAsPortalInfo(filename string) ([]PortalInfo, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	bytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		return nil, err
-	}
+func parseJSONAsPortalInfo(r io.Reader) ([]PortalInfo, error) {
 	var portals []PortalInfo
-	if err := json.Unmarshal(bytes, &portals); err != nil {
+	if err := json.NewDecoder(r).Decode(&portals); err != nil {
 		return nil, err
 	}
 	return portals, nil
@@ -183,10 +184,7 @@ func portalInfoToPortal(portalInfo []PortalInfo) ([]Portal, error) {
 			return nil, errors.New("cannot parse longitude: \"" + latlng.Lng + "\"")
 		}
 		point := s2.LatLngFromDegrees(lat, lng)
-		portals = append(portals, Portal{Guid: portal.Guid, Name: portal.Name, LatLng: point})
-		if len(portals) >= math.MaxUint16-1 {
-			return nil, errors.New("too many portals")
-		}
+		portals = append(portals, Portal{Guid: portal.Guid, Name: portal.Name, LatLng: point, Cost: portal.Cost})
 	}
 	return portals, nil
 }
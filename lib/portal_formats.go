@@ -0,0 +1,327 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PortalFileFormat - format of the portal list
+type PortalFileFormat int
+
+const (
+	// AutoDetectFormat - guess the format from the contents
+	AutoDetectFormat PortalFileFormat = iota
+	// MultiExportJSONFormat - JSON export of the Multi Export IITC plugin
+	MultiExportJSONFormat
+	// MultiExportCSVFormat - CSV export of the Multi Export IITC plugin
+	MultiExportCSVFormat
+	// DrawToolsFormat - markers of IITC draw tools export
+	DrawToolsFormat
+	// GeoJSONFormat - Point features of GeoJSON Feature or FeatureCollection
+	GeoJSONFormat
+	// KMLFormat - Point placemarks of KML document
+	KMLFormat
+)
+
+var portalFileFormatNames = map[string]PortalFileFormat{
+	"auto":      AutoDetectFormat,
+	"json":      MultiExportJSONFormat,
+	"csv":       MultiExportCSVFormat,
+	"drawtools": DrawToolsFormat,
+	"geojson":   GeoJSONFormat,
+	"kml":       KMLFormat,
+}
+
+// ParsePortalFileFormat parses name of a portal list format, one of
+// "auto", "json", "csv", "drawtools", "geojson" or "kml".
+func ParsePortalFileFormat(name string) (PortalFileFormat, error) {
+	format, ok := portalFileFormatNames[name]
+	if !ok {
+		return AutoDetectFormat, fmt.Errorf("unknown portal list format \"%s\"", name)
+	}
+	return format, nil
+}
+
+// parsePortalInfo parses list of portals in given format.
+func parsePortalInfo(r io.Reader, format PortalFileFormat) ([]PortalInfo, error) {
+	switch format {
+	case MultiExportJSONFormat:
+		return parseJSONAsPortalInfo(r)
+	case MultiExportCSVFormat:
+		return parseCSVAsPortalInfo(r)
+	case DrawToolsFormat:
+		return parseDrawToolsAsPortalInfo(r)
+	case GeoJSONFormat:
+		return parseGeoJSONAsPortalInfo(r)
+	case KMLFormat:
+		return parseKMLAsPortalInfo(r)
+	}
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+	}
+	// Skip leading whitespace to find the first character of the contents.
+	var first byte
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !unicode.IsSpace(rune(b)) {
+			first = b
+			br.UnreadByte()
+			break
+		}
+	}
+	switch first {
+	case '<':
+		return parseKMLAsPortalInfo(br)
+	case '{':
+		return parseGeoJSONAsPortalInfo(br)
+	case '[':
+		// Both draw tools and Multi Export JSON files are lists,
+		// they need to be read whole to tell them apart.
+		content, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		if isDrawTools(content) {
+			return parseDrawToolsAsPortalInfo(bytes.NewReader(content))
+		}
+		return parseJSONAsPortalInfo(bytes.NewReader(content))
+	default:
+		return parseCSVAsPortalInfo(br)
+	}
+}
+
+func formatCoordinate(coord float64) string {
+	return strconv.FormatFloat(coord, 'f', -1, 64)
+}
+
+// portalInfoBuilder builds list of portals from formats lacking guids or names,
+// by synthesising them from portal coordinates.
+type portalInfoBuilder struct {
+	portals []PortalInfo
+	guids   map[string]int
+}
+
+func newPortalInfoBuilder() *portalInfoBuilder {
+	return &portalInfoBuilder{guids: make(map[string]int)}
+}
+
+func (b *portalInfoBuilder) add(guid, name string, lat, lng float64) error {
+	if math.IsNaN(lat) || math.IsNaN(lng) || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return fmt.Errorf("invalid portal coordinates %f,%f", lat, lng)
+	}
+	latStr, lngStr := formatCoordinate(lat), formatCoordinate(lng)
+	if name == "" {
+		name = latStr + "," + lngStr
+	}
+	if guid == "" {
+		// Guids depend only on portal coordinates, so they're stable between
+		// different exports of the same portals.
+		hash := sha1.Sum([]byte(latStr + "," + lngStr))
+		guid = hex.EncodeToString(hash[:16]) + ".synthetic"
+		if num := b.guids[guid]; num > 0 {
+			b.guids[guid] = num + 1
+			guid = fmt.Sprintf("%s.%d", guid, num+1)
+		} else {
+			b.guids[guid] = 1
+		}
+	}
+	b.portals = append(b.portals, PortalInfo{
+		Guid:        guid,
+		Name:        name,
+		Coordinates: PortalCoordinates{Lat: latStr, Lng: lngStr},
+	})
+	return nil
+}
+
+type drawToolsItem struct {
+	Type   string           `json:"type"`
+	LatLng *drawToolsLatLng `json:"latLng"`
+	Title  string           `json:"title"`
+	Guid   string           `json:"guid"`
+}
+
+func isDrawTools(content []byte) bool {
+	var items []drawToolsItem
+	if err := json.Unmarshal(content, &items); err != nil {
+		return false
+	}
+	for _, item := range items {
+		if item.Type != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDrawToolsAsPortalInfo takes the markers of IITC draw tools export as portals.
+func parseDrawToolsAsPortalInfo(r io.Reader) ([]PortalInfo, error) {
+	var items []drawToolsItem
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, err
+	}
+	builder := newPortalInfoBuilder()
+	for _, item := range items {
+		if item.Type != "marker" || item.LatLng == nil {
+			continue
+		}
+		if err := builder.add(item.Guid, item.Title, item.LatLng.Lat, item.LatLng.Lng); err != nil {
+			return nil, err
+		}
+	}
+	return builder.portals, nil
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id,omitempty"`
+	Geometry   *geoJSONGeometry       `json:"geometry,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+type geoJSONObject struct {
+	geoJSONFeature
+	Features []geoJSONFeature `json:"features"`
+}
+
+func geoJSONStringProperty(properties map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if value, ok := properties[name].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseGeoJSONAsPortalInfo takes the Point features of a GeoJSON Feature or FeatureCollection as portals.
+func parseGeoJSONAsPortalInfo(r io.Reader) ([]PortalInfo, error) {
+	var object geoJSONObject
+	if err := json.NewDecoder(r).Decode(&object); err != nil {
+		return nil, err
+	}
+	var features []geoJSONFeature
+	switch object.Type {
+	case "FeatureCollection":
+		features = object.Features
+	case "Feature":
+		features = []geoJSONFeature{object.geoJSONFeature}
+	default:
+		return nil, fmt.Errorf("unsupported GeoJSON object type \"%s\"", object.Type)
+	}
+	builder := newPortalInfoBuilder()
+	for _, feature := range features {
+		if feature.Geometry == nil || feature.Geometry.Type != "Point" {
+			continue
+		}
+		var coordinates []float64
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &coordinates); err != nil {
+			return nil, err
+		}
+		if len(coordinates) < 2 {
+			return nil, fmt.Errorf("invalid GeoJSON point coordinates %s", string(feature.Geometry.Coordinates))
+		}
+		guid := geoJSONStringProperty(feature.Properties, "guid")
+		if id, ok := feature.ID.(string); ok && guid == "" {
+			guid = id
+		}
+		name := geoJSONStringProperty(feature.Properties, "name", "title")
+		// GeoJSON coordinates are in lng,lat order.
+		if err := builder.add(guid, name, coordinates[1], coordinates[0]); err != nil {
+			return nil, err
+		}
+	}
+	return builder.portals, nil
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPlacemark struct {
+	ID          string    `xml:"id,attr"`
+	Name        string    `xml:"name"`
+	Coordinates string    `xml:"Point>coordinates"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+}
+
+// parseKMLAsPortalInfo takes the Point placemarks of a KML document as portals.
+func parseKMLAsPortalInfo(r io.Reader) ([]PortalInfo, error) {
+	decoder := xml.NewDecoder(r)
+	builder := newPortalInfoBuilder()
+	foundKML := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "kml":
+			foundKML = true
+		case "Placemark":
+			var placemark kmlPlacemark
+			if err := decoder.DecodeElement(&placemark, &start); err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(placemark.Coordinates) == "" {
+				continue
+			}
+			// KML coordinates are in lng,lat[,alt] order.
+			parts := strings.Split(strings.TrimSpace(placemark.Coordinates), ",")
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("invalid KML point coordinates \"%s\"", placemark.Coordinates)
+			}
+			lng, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+			if err != nil {
+				return nil, errors.New("cannot parse longitude: \"" + parts[0] + "\"")
+			}
+			lat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if err != nil {
+				return nil, errors.New("cannot parse latitude: \"" + parts[1] + "\"")
+			}
+			guid := placemark.ID
+			for _, data := range placemark.Data {
+				if data.Name == "guid" && data.Value != "" {
+					guid = data.Value
+				}
+			}
+			if err := builder.add(guid, strings.TrimSpace(placemark.Name), lat, lng); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !foundKML {
+		return nil, errors.New("not a KML document")
+	}
+	return builder.portals, nil
+}
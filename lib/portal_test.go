@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func checkParsedPortals(format string, portals []PortalInfo, err error, expected []PortalInfo, t *testing.T) {
+	if err != nil {
+		t.Fatalf("%s: %v", format, err)
+	}
+	if len(portals) != len(expected) {
+		t.Fatalf("%s: expected %d portals, got %v", format, len(expected), portals)
+	}
+	for i, portal := range portals {
+		if portal != expected[i] {
+			t.Errorf("%s: expected portal %v, got %v", format, expected[i], portal)
+		}
+	}
+}
+
+func TestParsePortalFormats(t *testing.T) {
+	expected := []PortalInfo{
+		{Guid: "a.16", Name: "Fountain", Coordinates: PortalCoordinates{Lat: "50.061757", Lng: "19.936254"}},
+		{Guid: "b.16", Name: "Statue", Coordinates: PortalCoordinates{Lat: "50.062078", Lng: "19.939332"}},
+	}
+	multiExport := `[{"title":"Fountain","guid":"a.16","coordinates":{"lat":"50.061757","lng":"19.936254"}},
+{"title":"Statue","guid":"b.16","coordinates":{"lat":"50.062078","lng":"19.939332"}}]`
+	portals, err := parsePortalInfo(strings.NewReader(multiExport), AutoDetectFormat)
+	checkParsedPortals("multi export json", portals, err, expected, t)
+
+	csv := "a.16,Fountain,50.061757,19.936254\nb.16,Statue,50.062078,19.939332\n"
+	portals, err = parsePortalInfo(strings.NewReader(csv), AutoDetectFormat)
+	checkParsedPortals("csv", portals, err, expected, t)
+
+	geoJSON := `{"type":"FeatureCollection","features":[
+{"type":"Feature","id":"a.16","geometry":{"type":"Point","coordinates":[19.936254,50.061757]},"properties":{"name":"Fountain"}},
+{"type":"Feature","geometry":{"type":"LineString","coordinates":[[19.9,50.0],[19.8,50.1]]},"properties":{}},
+{"type":"Feature","geometry":{"type":"Point","coordinates":[19.939332,50.062078]},"properties":{"title":"Statue","guid":"b.16"}}]}`
+	portals, err = parsePortalInfo(strings.NewReader(geoJSON), AutoDetectFormat)
+	checkParsedPortals("geojson", portals, err, expected, t)
+
+	kml := `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document><Folder>
+<Placemark id="a.16"><name>Fountain</name><Point><coordinates>19.936254,50.061757,0</coordinates></Point></Placemark>
+<Placemark><name>Statue</name><ExtendedData><Data name="guid"><value>b.16</value></Data></ExtendedData>
+<Point><coordinates>
+  19.939332,50.062078,0
+</coordinates></Point></Placemark>
+</Folder></Document></kml>`
+	portals, err = parsePortalInfo(strings.NewReader(kml), AutoDetectFormat)
+	checkParsedPortals("kml", portals, err, expected, t)
+}
+
+func TestParseDrawToolsSynthesisesGuids(t *testing.T) {
+	drawTools := `[{"type":"marker","latLng":{"lat":50.061757,"lng":19.936254},"color":"#a24ac3"},
+{"type":"polyline","latLngs":[{"lat":50,"lng":19},{"lat":50.1,"lng":19.1}],"color":"#a24ac3"},
+{"type":"marker","latLng":{"lat":50.062078,"lng":19.939332},"color":"#a24ac3"},
+{"type":"marker","latLng":{"lat":50.062078,"lng":19.939332},"color":"#a24ac3"}]`
+	portals, err := parsePortalInfo(strings.NewReader(drawTools), AutoDetectFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(portals) != 3 {
+		t.Fatalf("Expected 3 portals, got %v", portals)
+	}
+	if portals[0].Name != "50.061757,19.936254" {
+		t.Errorf("Expected name synthesised from coordinates, got \"%s\"", portals[0].Name)
+	}
+	if portals[1].Guid == portals[2].Guid || portals[0].Guid == portals[1].Guid {
+		t.Errorf("Expected unique guids, got %v", portals)
+	}
+	again, err := parsePortalInfo(strings.NewReader(drawTools), AutoDetectFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range portals {
+		if portals[i].Guid != again[i].Guid {
+			t.Errorf("Expected stable guids, got %s and %s", portals[i].Guid, again[i].Guid)
+		}
+	}
+}
+
+func TestParseReaderExplicitFormat(t *testing.T) {
+	geoJSON := `{"type":"Feature","geometry":{"type":"Point","coordinates":[19.936254,50.061757]},"properties":{"name":"Fountain"}}`
+	portals, err := ParseReader(strings.NewReader(geoJSON), GeoJSONFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(portals) != 1 || portals[0].Name != "Fountain" {
+		t.Errorf("Unexpected portals %v", portals)
+	}
+	if _, err := ParseReader(strings.NewReader(geoJSON), MultiExportCSVFormat); err == nil {
+		t.Errorf("Expected error when parsing GeoJSON as CSV")
+	}
+	if _, err := ParsePortalFileFormat("shapefile"); err == nil {
+		t.Errorf("Expected error when parsing unknown format name")
+	}
+}
+
+func TestParseCSVReportsLineNumbers(t *testing.T) {
+	csv := "a.16,\"Fountain \\\"Old\\\"\",50.061757,19.936254\nb.16,Statue,50.06x,19.939332\n"
+	_, err := ParseReader(strings.NewReader(csv), MultiExportCSVFormat)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected error in line 2, got %v", err)
+	}
+	portals, err := ParseReader(strings.NewReader(csv[:strings.Index(csv, "\n")+1]), MultiExportCSVFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(portals) != 1 || portals[0].Name != `Fountain "Old"` {
+		t.Errorf("Unexpected portals %v", portals)
+	}
+}
+
+func TestParsePortalCosts(t *testing.T) {
+	csv := "a.16,Fountain,50.061757,19.936254,2.5\nb.16,Statue,50.062078,19.939332\n"
+	portals, err := ParseReader(strings.NewReader(csv), MultiExportCSVFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(portals) != 2 || portals[0].Cost != 2.5 || portals[1].Cost != 0 {
+		t.Errorf("Unexpected portals %v", portals)
+	}
+	if _, err := ParseReader(strings.NewReader("a.16,Fountain,50.061757,19.936254,high\n"), MultiExportCSVFormat); err == nil {
+		t.Errorf("Expected error when parsing invalid cost")
+	}
+	multiExport := `[{"title":"Fountain","guid":"a.16","coordinates":{"lat":"50.061757","lng":"19.936254"},"cost":-1}]`
+	portals, err = ParseReader(strings.NewReader(multiExport), AutoDetectFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(portals) != 1 || portals[0].Cost != -1 {
+		t.Errorf("Unexpected portals %v", portals)
+	}
+}
@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+)
+
+// Region - an area of the map the portals may be restricted to.
+// s2.Cap, *s2.CellUnion, *s2.Loop and *s2.Polygon are all regions.
+type Region interface {
+	ContainsPoint(p s2.Point) bool
+}
+
+// regionUnion - area covered by any of the regions
+type regionUnion []Region
+
+func (u regionUnion) ContainsPoint(p s2.Point) bool {
+	for _, region := range u {
+		if region.ContainsPoint(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// CircleRegion - region within radius meters from the center
+func CircleRegion(center s2.LatLng, radius float64) Region {
+	return s2.CapFromCenterAngle(s2.PointFromLatLng(center), s1.Angle(radius/RadiansToMeters))
+}
+
+// CellTokensRegion - region covered by the s2 cells with given tokens
+func CellTokensRegion(tokens []string) (Region, error) {
+	cells := make(s2.CellUnion, 0, len(tokens))
+	for _, token := range tokens {
+		cell := s2.CellIDFromToken(strings.TrimSpace(token))
+		if !cell.IsValid() {
+			return nil, fmt.Errorf("invalid s2 cell token: \"%s\"", token)
+		}
+		cells = append(cells, cell)
+	}
+	cells.Normalize()
+	return &cells, nil
+}
+
+// PortalsInRegion - portals lying inside the region
+func PortalsInRegion(portals []Portal, region Region) []Portal {
+	result := make([]Portal, 0, len(portals))
+	for _, portal := range portals {
+		if region.ContainsPoint(s2.PointFromLatLng(portal.LatLng)) {
+			result = append(result, portal)
+		}
+	}
+	return result
+}
+
+// ParseRegion parses the polygons of a GeoJSON, KML or IITC draw tools file
+// (draw tools circles are accepted as well). The region is the area covered by any of them.
+func ParseRegion(content []byte) (Region, error) {
+	content = bytes.TrimSpace(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf")))
+	var regions regionUnion
+	var err error
+	switch {
+	case bytes.HasPrefix(content, []byte("<")):
+		regions, err = parseKMLRegion(bytes.NewReader(content))
+	case bytes.HasPrefix(content, []byte("[")):
+		regions, err = parseDrawToolsRegion(content)
+	default:
+		regions, err = parseGeoJSONRegion(content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse region: %v", err)
+	}
+	if len(regions) == 0 {
+		return nil, errors.New("no polygons found in the region file")
+	}
+	if len(regions) == 1 {
+		return regions[0], nil
+	}
+	return regions, nil
+}
+
+// ParseRegionFile parses file with the region the portals are restricted to.
+func ParseRegionFile(filename string) (Region, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	bytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRegion(bytes)
+}
+
+// polygonFromRings makes a polygon of the outer ring with optional holes.
+// Each of the rings is a list of points, the first point may be repeated at the end.
+func polygonFromRings(rings [][]s2.LatLng) (Region, error) {
+	loops := make([]*s2.Loop, 0, len(rings))
+	for _, ring := range rings {
+		if len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+			ring = ring[:len(ring)-1]
+		}
+		if len(ring) < 3 {
+			return nil, fmt.Errorf("polygon ring needs at least 3 distinct points, got %d", len(ring))
+		}
+		points := make([]s2.Point, 0, len(ring))
+		for _, latLng := range ring {
+			points = append(points, s2.PointFromLatLng(latLng))
+		}
+		loop := s2.LoopFromPoints(points)
+		// Rings may be given in either orientation, assume none of them
+		// covers more than half of the globe.
+		loop.Normalize()
+		loops = append(loops, loop)
+	}
+	polygon := s2.PolygonFromLoops(loops)
+	if err := polygon.Validate(); err != nil {
+		return nil, err
+	}
+	return polygon, nil
+}
+
+type geoJSONRegionObject struct {
+	geoJSONGeometry
+	Geometry *geoJSONGeometry `json:"geometry"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+func geoJSONPolygon(coordinates [][][]float64) (Region, error) {
+	rings := make([][]s2.LatLng, 0, len(coordinates))
+	for _, ringCoordinates := range coordinates {
+		ring := make([]s2.LatLng, 0, len(ringCoordinates))
+		for _, point := range ringCoordinates {
+			if len(point) < 2 {
+				return nil, fmt.Errorf("invalid GeoJSON polygon coordinates %v", point)
+			}
+			// GeoJSON coordinates are in lng,lat order.
+			ring = append(ring, s2.LatLngFromDegrees(point[1], point[0]))
+		}
+		rings = append(rings, ring)
+	}
+	return polygonFromRings(rings)
+}
+
+func geoJSONGeometryRegions(geometry *geoJSONGeometry) (regionUnion, error) {
+	if geometry == nil {
+		return nil, nil
+	}
+	switch geometry.Type {
+	case "Polygon":
+		var coordinates [][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &coordinates); err != nil {
+			return nil, err
+		}
+		polygon, err := geoJSONPolygon(coordinates)
+		if err != nil {
+			return nil, err
+		}
+		return regionUnion{polygon}, nil
+	case "MultiPolygon":
+		var coordinates [][][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &coordinates); err != nil {
+			return nil, err
+		}
+		var regions regionUnion
+		for _, polygonCoordinates := range coordinates {
+			polygon, err := geoJSONPolygon(polygonCoordinates)
+			if err != nil {
+				return nil, err
+			}
+			regions = append(regions, polygon)
+		}
+		return regions, nil
+	}
+	return nil, nil
+}
+
+// parseGeoJSONRegion takes the Polygon and MultiPolygon geometries
+// of a GeoJSON geometry, Feature or FeatureCollection.
+func parseGeoJSONRegion(content []byte) (regionUnion, error) {
+	var object geoJSONRegionObject
+	if err := json.Unmarshal(content, &object); err != nil {
+		return nil, err
+	}
+	switch object.Type {
+	case "FeatureCollection":
+		var regions regionUnion
+		for _, feature := range object.Features {
+			featureRegions, err := geoJSONGeometryRegions(feature.Geometry)
+			if err != nil {
+				return nil, err
+			}
+			regions = append(regions, featureRegions...)
+		}
+		return regions, nil
+	case "Feature":
+		return geoJSONGeometryRegions(object.Geometry)
+	default:
+		return geoJSONGeometryRegions(&object.geoJSONGeometry)
+	}
+}
+
+type drawToolsRegionItem struct {
+	Type    string            `json:"type"`
+	LatLng  *drawToolsLatLng  `json:"latLng"`
+	LatLngs []drawToolsLatLng `json:"latLngs"`
+	Radius  float64           `json:"radius"`
+}
+
+// parseDrawToolsRegion takes the polygons and circles of IITC draw tools export.
+func parseDrawToolsRegion(content []byte) (regionUnion, error) {
+	var items []drawToolsRegionItem
+	if err := json.Unmarshal(content, &items); err != nil {
+		return nil, err
+	}
+	var regions regionUnion
+	for _, item := range items {
+		switch item.Type {
+		case "polygon":
+			ring := make([]s2.LatLng, 0, len(item.LatLngs))
+			for _, latLng := range item.LatLngs {
+				ring = append(ring, s2.LatLngFromDegrees(latLng.Lat, latLng.Lng))
+			}
+			polygon, err := polygonFromRings([][]s2.LatLng{ring})
+			if err != nil {
+				return nil, err
+			}
+			regions = append(regions, polygon)
+		case "circle":
+			if item.LatLng == nil {
+				return nil, errors.New("circle without a center")
+			}
+			regions = append(regions, CircleRegion(s2.LatLngFromDegrees(item.LatLng.Lat, item.LatLng.Lng), item.Radius))
+		}
+	}
+	return regions, nil
+}
+
+type kmlPolygon struct {
+	Outer string   `xml:"outerBoundaryIs>LinearRing>coordinates"`
+	Inner []string `xml:"innerBoundaryIs>LinearRing>coordinates"`
+}
+
+func kmlRing(coordinates string) ([]s2.LatLng, error) {
+	var ring []s2.LatLng
+	// KML coordinates are whitespace separated lng,lat[,alt] tuples.
+	for _, tuple := range strings.Fields(coordinates) {
+		parts := strings.Split(tuple, ",")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid KML coordinates \"%s\"", tuple)
+		}
+		lng, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, errors.New("cannot parse longitude: \"" + parts[0] + "\"")
+		}
+		lat, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, errors.New("cannot parse latitude: \"" + parts[1] + "\"")
+		}
+		ring = append(ring, s2.LatLngFromDegrees(lat, lng))
+	}
+	return ring, nil
+}
+
+// parseKMLRegion takes the polygons of a KML document.
+func parseKMLRegion(r io.Reader) (regionUnion, error) {
+	decoder := xml.NewDecoder(r)
+	var regions regionUnion
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Polygon" {
+			continue
+		}
+		var polygon kmlPolygon
+		if err := decoder.DecodeElement(&polygon, &start); err != nil {
+			return nil, err
+		}
+		var rings [][]s2.LatLng
+		for _, coordinates := range append([]string{polygon.Outer}, polygon.Inner...) {
+			ring, err := kmlRing(coordinates)
+			if err != nil {
+				return nil, err
+			}
+			rings = append(rings, ring)
+		}
+		region, err := polygonFromRings(rings)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
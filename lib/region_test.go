@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+func regionTestPortals() []Portal {
+	return []Portal{
+		{Guid: "inside", LatLng: s2.LatLngFromDegrees(50.005, 19.005)},
+		{Guid: "hole", LatLng: s2.LatLngFromDegrees(50.0051, 19.0081)},
+		{Guid: "outside", LatLng: s2.LatLngFromDegrees(50.02, 19.005)},
+	}
+}
+
+func checkPortalsInRegion(name string, region Region, expected []string, t *testing.T) {
+	result := PortalsInRegion(regionTestPortals(), region)
+	if len(result) != len(expected) {
+		t.Fatalf("%s: expected portals %v, got %v", name, expected, result)
+	}
+	for i, portal := range result {
+		if portal.Guid != expected[i] {
+			t.Errorf("%s: expected portals %v, got %v", name, expected, result)
+		}
+	}
+}
+
+func TestParseRegion(t *testing.T) {
+	geoJSON := `{"type":"FeatureCollection","features":[
+{"type":"Feature","geometry":{"type":"Point","coordinates":[19.5,50.5]},"properties":{}},
+{"type":"Feature","geometry":{"type":"Polygon","coordinates":[
+[[19,50],[19.01,50],[19.01,50.01],[19,50.01],[19,50]],
+[[19.008,50.005],[19.0082,50.005],[19.0082,50.0052],[19.008,50.0052],[19.008,50.005]]]},"properties":{}}]}`
+	region, err := ParseRegion([]byte(geoJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPortalsInRegion("geojson", region, []string{"inside"}, t)
+
+	// Clockwise ring, in a Placemark next to a Point.
+	kml := `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document>
+<Placemark><Point><coordinates>19.5,50.5,0</coordinates></Point></Placemark>
+<Placemark><Polygon><outerBoundaryIs><LinearRing><coordinates>
+19,50,0 19,50.01,0 19.01,50.01,0 19.01,50,0 19,50,0
+</coordinates></LinearRing></outerBoundaryIs></Polygon></Placemark>
+</Document></kml>`
+	region, err = ParseRegion([]byte(kml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPortalsInRegion("kml", region, []string{"inside", "hole"}, t)
+
+	drawTools := `[{"type":"circle","latLng":{"lat":50.02,"lng":19.005},"radius":100},
+{"type":"marker","latLng":{"lat":50.005,"lng":19.005}}]`
+	region, err = ParseRegion([]byte(drawTools))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPortalsInRegion("drawtools", region, []string{"outside"}, t)
+
+	if _, err := ParseRegion([]byte(`{"type":"Point","coordinates":[19,50]}`)); err == nil {
+		t.Errorf("Expected error when parsing region without polygons")
+	}
+}
+
+func TestCircleAndCellRegions(t *testing.T) {
+	// The outside portal is ~1.7km from the others, the hole one is ~220m from the inside one.
+	checkPortalsInRegion("circle", CircleRegion(s2.LatLngFromDegrees(50.005, 19.005), 500), []string{"inside", "hole"}, t)
+
+	token := s2.CellIDFromLatLng(s2.LatLngFromDegrees(50.02, 19.005)).Parent(14).ToToken()
+	region, err := CellTokensRegion([]string{token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPortalsInRegion("cells", region, []string{"outside"}, t)
+	if _, err := CellTokensRegion([]string{"xyz"}); err == nil {
+		t.Errorf("Expected error when parsing invalid cell token")
+	}
+}
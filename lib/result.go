@@ -0,0 +1,252 @@
+package lib
+
+import (
+	"strings"
+
+	"github.com/golang/geo/s2"
+)
+
+// PortalRole - role of a portal in a pattern
+type PortalRole string
+
+const (
+	// RoleVertex - a vertex of the pattern's fields, or a portal on the drone flight path
+	RoleVertex PortalRole = "vertex"
+	// RoleBase - a base portal of a herringbone field
+	RoleBase PortalRole = "base"
+	// RoleAnchor - the anchor portal of a fan field
+	RoleAnchor PortalRole = "anchor"
+	// RoleBackbone - a backbone portal of a herringbone or a flip field
+	RoleBackbone PortalRole = "backbone"
+	// RoleFlip - a portal to be flipped in a flip field
+	RoleFlip PortalRole = "flip"
+	// RoleKey - a portal whose key is needed for the drone flight
+	RoleKey PortalRole = "key"
+)
+
+// ResultPortal - portal of a pattern together with its role
+type ResultPortal struct {
+	Portal Portal
+	Role   PortalRole
+}
+
+// Link - a link from the first portal to the second one
+type Link [2]Portal
+
+// Result - pattern found by any of the solvers
+type Result struct {
+	Pattern string
+	// Portals of the pattern in order returned by the algorithm
+	Portals []ResultPortal
+	// Links and Fields are taken from the link plan of the pattern, they're empty
+	// if the pattern has no valid link plan (e.g. drone flight)
+	Links  []Link
+	Fields []Field
+	// PlanError - why the link plan of the pattern is not valid, nil if it is
+	PlanError error
+	// Pattern specific measure of the result, the larger the better, e.g. depth
+	// of a homogeneous field or number of portals in a cobweb
+	Score     float64
+	Polylines [][]Portal
+	Markers   []Portal
+	// Solution - the pattern specific solution the result was made of, e.g. []Portal
+	// for cobweb, []IndexedPortal for three corners or HerringboneSolution for herringbone
+	Solution interface{}
+}
+
+// Solutions returns the pattern specific solutions of the results,
+// all of which have to be of type T.
+func Solutions[T any](results []Result) []T {
+	solutions := make([]T, 0, len(results))
+	for _, result := range results {
+		solutions = append(solutions, result.Solution.(T))
+	}
+	return solutions
+}
+
+// PortalsWithRole returns the portals of the result having the given role.
+func (r Result) PortalsWithRole(role PortalRole) []Portal {
+	var portals []Portal
+	for _, portal := range r.Portals {
+		if portal.Role == role {
+			portals = append(portals, portal.Portal)
+		}
+	}
+	return portals
+}
+
+// DrawToolsString returns the result in the IITC draw tools format.
+func (r Result) DrawToolsString() string {
+	var items []string
+	for _, polyline := range r.Polylines {
+		items = append(items, PolylineFromPortalList(polyline))
+	}
+	if len(r.Markers) > 0 {
+		items = append(items, MarkersFromPortalList(r.Markers))
+	}
+	return "[" + strings.Join(items, ",") + "]"
+}
+
+// Paths returns the polylines of the result as lists of points.
+func (r Result) Paths() [][]s2.Point {
+	paths := make([][]s2.Point, 0, len(r.Polylines))
+	for _, polyline := range r.Polylines {
+		path := make([]s2.Point, 0, len(polyline))
+		for _, portal := range polyline {
+			path = append(path, s2.PointFromLatLng(portal.LatLng))
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func (r *Result) addPortals(role PortalRole, portals []Portal) {
+	for _, portal := range portals {
+		r.Portals = append(r.Portals, ResultPortal{Portal: portal, Role: role})
+	}
+}
+
+func (r *Result) addPlan(plan Plan, err error) {
+	if err != nil {
+		r.PlanError = err
+		return
+	}
+	for _, step := range plan.Steps {
+		if step.Type == LINK {
+			r.Links = append(r.Links, Link{step.Origin, step.Destination})
+		}
+		r.Fields = append(r.Fields, step.Fields...)
+	}
+}
+
+// CobwebResult - result of LargestCobweb as a generic Result.
+func CobwebResult(result []Portal) Result {
+	r := Result{Pattern: "cobweb", Score: float64(len(result)), Solution: result}
+	r.addPortals(RoleVertex, result)
+	r.addPlan(CobwebPlan(result))
+	if len(result) >= 3 {
+		r.Polylines = [][]Portal{CobwebPolyline(result)}
+	}
+	return r
+}
+
+// HerringboneResult - result of LargestHerringbone as a generic Result.
+func HerringboneResult(b0, b1 Portal, result []Portal) Result {
+	r := Result{Pattern: "herringbone", Score: float64(len(result)), Solution: HerringboneSolution{B0: b0, B1: b1, Backbone: result}}
+	if len(result) == 0 {
+		return r
+	}
+	r.addPortals(RoleBase, []Portal{b0, b1})
+	r.addPortals(RoleBackbone, result)
+	r.addPlan(HerringbonePlan(b0, b1, result))
+	r.Polylines = [][]Portal{HerringbonePolyline(b0, b1, result)}
+	return r
+}
+
+// DoubleHerringboneResult - result of LargestDoubleHerringbone as a generic Result.
+func DoubleHerringboneResult(b0, b1 Portal, result0, result1 []Portal) Result {
+	r := Result{Pattern: "double_herringbone", Score: float64(len(result0) + len(result1)),
+		Solution: DoubleHerringboneSolution{B0: b0, B1: b1, Backbone0: result0, Backbone1: result1}}
+	if len(result0)+len(result1) == 0 {
+		return r
+	}
+	r.addPortals(RoleBase, []Portal{b0, b1})
+	r.addPortals(RoleBackbone, result0)
+	r.addPortals(RoleBackbone, result1)
+	r.addPlan(DoubleHerringbonePlan(b0, b1, result0, result1))
+	r.Polylines = [][]Portal{DoubleHerringbonePolyline(b0, b1, result0, result1)}
+	return r
+}
+
+// ThreeCornersResult - result of LargestThreeCorner as a generic Result.
+func ThreeCornersResult(result []IndexedPortal) Result {
+	r := Result{Pattern: "three_corners", Score: float64(len(result)), Solution: result}
+	for _, indexedPortal := range result {
+		r.addPortals(RoleVertex, []Portal{indexedPortal.Portal})
+	}
+	if len(result) >= 3 {
+		r.addPlan(ThreeCornersPlan(result))
+		r.Polylines = [][]Portal{ThreeCornersPolyline(result)}
+	}
+	return r
+}
+
+// OnionResult - result of LargestOnion as a generic Result.
+func OnionResult(result []IndexedPortal) Result {
+	r := Result{Pattern: "onion", Score: float64(len(result)), Solution: result}
+	for _, indexedPortal := range result {
+		r.addPortals(RoleVertex, []Portal{indexedPortal.Portal})
+	}
+	if len(result) >= 3 {
+		r.addPlan(OnionPlan(result))
+		r.Polylines = [][]Portal{OnionPolyline(result)}
+	}
+	return r
+}
+
+// FanResult - result of LargestFan as a generic Result.
+func FanResult(anchor Portal, fan []Portal) Result {
+	r := Result{Pattern: "fan", Score: float64(len(fan)), Solution: FanSolution{Anchor: anchor, Fan: fan}}
+	if len(fan) == 0 {
+		return r
+	}
+	r.addPortals(RoleAnchor, []Portal{anchor})
+	r.addPortals(RoleVertex, fan)
+	r.addPlan(FanPlan(anchor, fan))
+	r.Polylines = FanPolylines(anchor, fan)
+	return r
+}
+
+// FlipFieldResult - result of LargestFlipField as a generic Result.
+func FlipFieldResult(backbone, flipPortals []Portal) Result {
+	r := Result{Pattern: "flip_field", Solution: FlipFieldSolution{Backbone: backbone, FlipPortals: flipPortals}}
+	r.addPortals(RoleBackbone, backbone)
+	r.addPortals(RoleFlip, flipPortals)
+	r.addPlan(FlipFieldPlan(backbone, flipPortals))
+	r.Score = float64(len(r.Fields))
+	if len(backbone) > 0 {
+		r.Polylines = [][]Portal{backbone}
+	}
+	r.Markers = flipPortals
+	return r
+}
+
+// HomogeneousResult - result of DeepestHomogeneous as a generic Result.
+func HomogeneousResult(depth uint16, result []Portal) Result {
+	r := Result{Pattern: "homogeneous", Score: float64(depth), Solution: HomogeneousSolution{Portals: result, Depth: depth}}
+	r.addPortals(RoleVertex, result)
+	r.addPlan(HomogeneousPlan(depth, result))
+	r.Polylines = HomogeneousPolylines(depth, result)
+	return r
+}
+
+// MaxFieldsResult - result of MaxFields as a generic Result.
+func MaxFieldsResult(fields []Field) Result {
+	r := Result{Pattern: "max_fields", Score: float64(len(fields)), Solution: fields}
+	seen := make(map[string]struct{})
+	for _, field := range fields {
+		for _, portal := range field {
+			if _, ok := seen[portal.Guid]; !ok {
+				seen[portal.Guid] = struct{}{}
+				r.addPortals(RoleVertex, []Portal{portal})
+			}
+		}
+	}
+	r.addPlan(MaxFieldsPlan(fields))
+	r.Polylines = MaxFieldsPolylines(fields)
+	return r
+}
+
+// DroneFlightResult - result of LongestDroneFlight as a generic Result.
+// The score is the distance in meters between the start and the end of the flight.
+func DroneFlightResult(path, keysNeeded []Portal) Result {
+	r := Result{Pattern: "drone_flight", Solution: DroneFlightSolution{Path: path, KeysNeeded: keysNeeded}}
+	r.addPortals(RoleVertex, path)
+	r.addPortals(RoleKey, keysNeeded)
+	if len(path) > 0 {
+		r.Score = float64(path[0].LatLng.Distance(path[len(path)-1].LatLng)) * RadiansToMeters
+		r.Polylines = [][]Portal{path}
+	}
+	r.Markers = keysNeeded
+	return r
+}
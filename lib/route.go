@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"sort"
+)
+
+// RouteStop - a visit at a portal together with the plan steps executed there
+type RouteStop struct {
+	Portal Portal
+	Steps  []PlanStep
+}
+
+// Route - order of visiting portals while executing a plan
+type Route struct {
+	Stops []RouteStop
+	// Total walking distance in meters
+	Distance float64
+}
+
+// Plan returns the plan steps in the order of the route.
+func (r Route) Plan() Plan {
+	var steps []PlanStep
+	for _, stop := range r.Stops {
+		steps = append(steps, stop.Steps...)
+	}
+	return Plan{Steps: steps}
+}
+
+const maxRouteStarts = 32
+
+type routeLink struct {
+	from, to portalIndex
+}
+
+// routeQuery reorders links of a plan, checking that the reordered
+// plan creates the same fields as the original one.
+type routeQuery struct {
+	portals  []Portal
+	data     []portalData
+	intended map[[3]portalIndex]struct{}
+}
+
+func (q *routeQuery) distance(a, b portalIndex) float64 {
+	return float64(q.data[a].LatLng.Distance(q.data[b].LatLng)) * RadiansToMeters
+}
+
+// canLink checks if throwing the link now doesn't make the plan fail, i.e. it
+// doesn't prevent creating any of the intended fields and doesn't cover origins
+// of links remaining to be thrown. Validity of the link itself is checked by the simulator.
+func (q *routeQuery) canLink(s *planSimulator, l routeLink, remaining []routeLink) bool {
+	a, b := q.data[l.from].LatLng, q.data[l.to].LatLng
+	ccw := newCCWQuery(a, b)
+	bestOnSide := [2]portalIndex{invalidPortalIndex, invalidPortalIndex}
+	bestArea := [2]float64{}
+	missingOnSide := [2]portalIndex{invalidPortalIndex, invalidPortalIndex}
+	for third := range s.neighbors[l.from] {
+		if !s.hasLink(third, l.to) {
+			continue
+		}
+		side := 0
+		if ccw.IsCCW(q.data[third].LatLng) {
+			side = 1
+		}
+		area := triangleArea(q.data[l.from], q.data[l.to], q.data[third])
+		if bestOnSide[side] == invalidPortalIndex || area > bestArea[side] {
+			bestOnSide[side] = third
+			bestArea[side] = area
+		}
+		triple := sortedTriple(l.from, l.to, third)
+		if _, ok := q.intended[triple]; !ok {
+			continue
+		}
+		if _, ok := s.created[triple]; ok {
+			continue
+		}
+		if missingOnSide[side] != invalidPortalIndex {
+			// Only one of the fields would get created.
+			return false
+		}
+		missingOnSide[side] = third
+	}
+	for side := 0; side < 2; side++ {
+		if missingOnSide[side] != invalidPortalIndex && missingOnSide[side] != bestOnSide[side] {
+			return false
+		}
+		if bestOnSide[side] == invalidPortalIndex {
+			continue
+		}
+		triangle := newTriangleQuery(a, b, q.data[bestOnSide[side]].LatLng)
+		for _, r := range remaining {
+			if r != l && r.from != l.from && r.from != l.to && r.from != bestOnSide[side] &&
+				triangle.ContainsPoint(q.data[r.from].LatLng) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// greedyRoute orders links by always throwing the closest possible link next.
+// Returns false if it gets stuck.
+func (q *routeQuery) greedyRoute(s *planSimulator, position portalIndex, links []routeLink) ([]routeLink, bool) {
+	remaining := append([]routeLink{}, links...)
+	result := make([]routeLink, 0, len(links))
+	for len(remaining) > 0 {
+		sort.SliceStable(remaining, func(i, j int) bool {
+			return q.distance(position, remaining[i].from) < q.distance(position, remaining[j].from)
+		})
+		found := false
+		for i, l := range remaining {
+			if !q.canLink(s, l, remaining) {
+				continue
+			}
+			if err := s.link(l.from, l.to); err != nil {
+				continue
+			}
+			result = append(result, l)
+			remaining = append(remaining[:i], remaining[i+1:]...)
+			position = l.from
+			found = true
+			break
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+func (q *routeQuery) copySimulator(s *planSimulator) *planSimulator {
+	c := newPlanSimulator(q.portals)
+	for _, l := range s.links {
+		c.neighbors[l.from][l.to] = struct{}{}
+		c.neighbors[l.to][l.from] = struct{}{}
+	}
+	c.links = append(c.links, s.links...)
+	c.fields = append(c.fields, s.fields...)
+	for f := range s.created {
+		c.created[f] = struct{}{}
+	}
+	return c
+}
+
+// linksDistance returns the distance walked from position through origins of
+// all the links to the next position.
+func (q *routeQuery) linksDistance(position portalIndex, links []routeLink, next portalIndex) float64 {
+	result := 0.
+	for _, l := range links {
+		if position != invalidPortalIndex {
+			result += q.distance(position, l.from)
+		}
+		position = l.from
+	}
+	if position != invalidPortalIndex && next != invalidPortalIndex {
+		result += q.distance(position, next)
+	}
+	return result
+}
+
+// orderLinks finds the shortest greedy route through a segment of links,
+// trying different starting links. Keeps the original order of links
+// if no reordering makes the route shorter.
+func (q *routeQuery) orderLinks(s *planSimulator, position portalIndex, links []routeLink, next portalIndex) []routeLink {
+	var starts []portalIndex
+	if position != invalidPortalIndex {
+		starts = append(starts, position)
+	} else {
+		seen := make(map[portalIndex]struct{})
+		for _, l := range links {
+			if _, ok := seen[l.from]; ok {
+				continue
+			}
+			seen[l.from] = struct{}{}
+			starts = append(starts, l.from)
+			if len(starts) >= maxRouteStarts {
+				break
+			}
+		}
+	}
+	bestLinks := links
+	bestDistance := q.linksDistance(position, links, next)
+	for _, start := range starts {
+		ordered, ok := q.greedyRoute(q.copySimulator(s), start, links)
+		if !ok {
+			continue
+		}
+		if distance := q.linksDistance(position, ordered, next); distance < bestDistance {
+			bestLinks = ordered
+			bestDistance = distance
+		}
+	}
+	for _, l := range bestLinks {
+		// The original order is known to be valid, and a reordering
+		// has already been checked on a copy of the simulator.
+		s.link(l.from, l.to)
+	}
+	return bestLinks
+}
+
+// WalkingRoute reorders links of a plan, so that the total walking distance
+// between origins of consecutive links is as short as possible, while still
+// creating all the fields of the plan.
+// Flip steps stay in place, only the links between them get reordered.
+func WalkingRoute(plan Plan) Route {
+	planPortals := newPlanPortals()
+	q := &routeQuery{intended: make(map[[3]portalIndex]struct{})}
+	for _, step := range plan.Steps {
+		planPortals.index(step.Origin)
+		if step.Type == LINK {
+			planPortals.index(step.Destination)
+		}
+		for _, f := range step.Fields {
+			field := planPortals.field(f[0], f[1], f[2])
+			q.intended[sortedTriple(field[0], field[1], field[2])] = struct{}{}
+		}
+	}
+	q.portals = planPortals.portals
+	q.data = portalsToPortalData(q.portals)
+
+	s := newPlanSimulator(q.portals)
+	position := invalidPortalIndex
+	route := Route{}
+	addStep := func(p portalIndex, step PlanStep) {
+		if len(route.Stops) == 0 || route.Stops[len(route.Stops)-1].Portal.Guid != q.portals[p].Guid {
+			if position != invalidPortalIndex {
+				route.Distance += q.distance(position, p)
+			}
+			route.Stops = append(route.Stops, RouteStop{Portal: q.portals[p]})
+			position = p
+		}
+		stop := &route.Stops[len(route.Stops)-1]
+		stop.Steps = append(stop.Steps, step)
+	}
+	var segment []routeLink
+	flushSegment := func(next portalIndex) {
+		firstStep := len(s.steps)
+		for i, l := range q.orderLinks(s, position, segment, next) {
+			addStep(l.from, s.steps[firstStep+i])
+		}
+		segment = segment[:0]
+	}
+	for _, step := range plan.Steps {
+		if step.Type == LINK {
+			segment = append(segment, routeLink{
+				from: planPortals.index(step.Origin),
+				to:   planPortals.index(step.Destination),
+			})
+			continue
+		}
+		p := planPortals.index(step.Origin)
+		flushSegment(p)
+		s.flip(p)
+		addStep(p, s.steps[len(s.steps)-1])
+	}
+	flushSegment(invalidPortalIndex)
+	return route
+}
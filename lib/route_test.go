@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+func planWalkingDistance(plan Plan) float64 {
+	result := 0.
+	for i := 1; i < len(plan.Steps); i++ {
+		result += plan.Steps[i-1].Origin.LatLng.Distance(plan.Steps[i].Origin.LatLng).Radians() * RadiansToMeters
+	}
+	return result
+}
+
+func checkValidRoute(plan Plan, t *testing.T) {
+	route := WalkingRoute(plan)
+	routePlan := route.Plan()
+	if len(routePlan.Steps) != len(plan.Steps) {
+		t.Fatalf("Expected %d steps, actual %d", len(plan.Steps), len(routePlan.Steps))
+	}
+	if routePlan.NumFields() != plan.NumFields() {
+		t.Errorf("Expected %d fields, actual %d", plan.NumFields(), routePlan.NumFields())
+	}
+	if route.Distance > planWalkingDistance(plan)+1e-6 {
+		t.Errorf("Route is longer (%f) than the original plan (%f)", route.Distance, planWalkingDistance(plan))
+	}
+	for i := 1; i < len(route.Stops); i++ {
+		if route.Stops[i-1].Portal.Guid == route.Stops[i].Portal.Guid {
+			t.Errorf("Consecutive stops at the same portal %s", route.Stops[i].Portal.Guid)
+		}
+	}
+}
+
+func TestHomogeneousWalkingRoute(t *testing.T) {
+	portals := withUniqueGuids(generateHomogeneousPortals(4))
+	result, depth, err := DeepestHomogeneous(context.Background(), portals, HomogeneousMaxDepth(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := HomogeneousPlan(depth, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValidRoute(plan, t)
+}
+
+func TestFlipFieldWalkingRoute(t *testing.T) {
+	backbone := []Portal{}
+	for i := 0; i < 5; i++ {
+		lng := 20 + 0.75*float64(i)
+		backbone = append(backbone, Portal{
+			Guid:   fmt.Sprintf("b%d", i),
+			LatLng: s2.LatLngFromDegrees(20+0.1*(lng-21.5)*(lng-21.5), lng)})
+	}
+	flipPortals := []Portal{}
+	for i := 0; i < 4; i++ {
+		flipPortals = append(flipPortals, Portal{
+			Guid:   fmt.Sprintf("f%d", i),
+			LatLng: s2.LatLngFromDegrees(19-0.5*float64(i), 21.5+0.1*float64(i))})
+	}
+	plan, err := FlipFieldPlan(backbone, flipPortals)
+	checkValidPlan(len(flipPortals)*(len(backbone)-1), plan, err, t)
+	checkValidRoute(plan, t)
+}
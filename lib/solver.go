@@ -0,0 +1,311 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+)
+
+// Solver - common interface of all the pattern finding algorithms
+type Solver interface {
+	// Solve finds the best pattern among given portals.
+	// If ctx gets cancelled returns the best result found so far and a *CancelledError.
+	Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error)
+}
+
+// TopSolver - Solver able to find a number of alternative patterns
+type TopSolver interface {
+	Solver
+	// SolveTop finds up to numResults best patterns having distinct sets of portals
+	// (or distinct sets of fields in case of max fields), sorted from the best one.
+	// If ctx gets cancelled returns the best results found so far and a *CancelledError.
+	SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error)
+}
+
+// SolveTop - Find up to numResults best patterns using given solver. If the solver
+// doesn't implement TopSolver returns just the single best pattern.
+func SolveTop(ctx context.Context, solver Solver, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	if topSolver, ok := solver.(TopSolver); ok {
+		return topSolver.SolveTop(ctx, portals, numResults, progressFunc)
+	}
+	result, err := solver.Solve(ctx, portals, progressFunc)
+	return []Result{result}, err
+}
+
+// CobwebSolver - Solver running LargestCobweb
+type CobwebSolver struct {
+	FixedCornerIndices []int
+	Options            []CobwebOption
+}
+
+func (s CobwebSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	result, err := LargestCobweb(ctx, portals, s.FixedCornerIndices, progressFunc, s.Options...)
+	return CobwebResult(result), err
+}
+
+func (s CobwebSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	cobwebs, err := TopCobwebs(ctx, portals, s.FixedCornerIndices, numResults, progressFunc, s.Options...)
+	results := make([]Result, 0, len(cobwebs))
+	for _, cobweb := range cobwebs {
+		results = append(results, CobwebResult(cobweb))
+	}
+	return results, err
+}
+
+func numSolverWorkers(numWorkers int) int {
+	if numWorkers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return numWorkers
+}
+
+// HerringboneSolver - Solver running LargestHerringbone
+type HerringboneSolver struct {
+	FixedBaseIndices []int
+	// If <= 0 use as many workers as there are CPUs on the machine
+	NumWorkers int
+	Options    []HerringboneOption
+}
+
+func (s HerringboneSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	b0, b1, result, err := LargestHerringbone(ctx, portals, s.FixedBaseIndices, numSolverWorkers(s.NumWorkers), progressFunc, s.Options...)
+	return HerringboneResult(b0, b1, result), err
+}
+
+func (s HerringboneSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	solutions, err := TopHerringbones(ctx, portals, s.FixedBaseIndices, numResults, numSolverWorkers(s.NumWorkers), progressFunc, s.Options...)
+	results := make([]Result, 0, len(solutions))
+	for _, solution := range solutions {
+		results = append(results, HerringboneResult(solution.B0, solution.B1, solution.Backbone))
+	}
+	return results, err
+}
+
+// DoubleHerringboneSolver - Solver running LargestDoubleHerringbone
+type DoubleHerringboneSolver struct {
+	FixedBaseIndices []int
+	// If <= 0 use as many workers as there are CPUs on the machine
+	NumWorkers int
+	Options    []HerringboneOption
+}
+
+func (s DoubleHerringboneSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	b0, b1, result0, result1, err := LargestDoubleHerringbone(ctx, portals, s.FixedBaseIndices, numSolverWorkers(s.NumWorkers), progressFunc, s.Options...)
+	return DoubleHerringboneResult(b0, b1, result0, result1), err
+}
+
+func (s DoubleHerringboneSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	solutions, err := TopDoubleHerringbones(ctx, portals, s.FixedBaseIndices, numResults, numSolverWorkers(s.NumWorkers), progressFunc, s.Options...)
+	results := make([]Result, 0, len(solutions))
+	for _, solution := range solutions {
+		results = append(results, DoubleHerringboneResult(solution.B0, solution.B1, solution.Backbone0, solution.Backbone1))
+	}
+	return results, err
+}
+
+// ThreeCornersSolver - Solver running LargestThreeCorner.
+// Groups contains indices of portals which may be used as each of the three corners,
+// a nil group means any of the portals.
+type ThreeCornersSolver struct {
+	Groups  [3][]int
+	Options []ThreeCornersOption
+}
+
+func (s ThreeCornersSolver) groups(portals []Portal) ([3][]Portal, error) {
+	var groups [3][]Portal
+	for i, indices := range s.Groups {
+		if indices == nil {
+			groups[i] = portals
+			continue
+		}
+		for _, index := range indices {
+			if index < 0 || index >= len(portals) {
+				return groups, fmt.Errorf("invalid portal index %d in corner group %d", index, i)
+			}
+			groups[i] = append(groups[i], portals[index])
+		}
+	}
+	return groups, nil
+}
+
+func (s ThreeCornersSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	groups, err := s.groups(portals)
+	if err != nil {
+		return Result{Pattern: "three_corners"}, err
+	}
+	result, err := LargestThreeCorner(ctx, groups[0], groups[1], groups[2], progressFunc, s.Options...)
+	return ThreeCornersResult(result), err
+}
+
+func (s ThreeCornersSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	groups, err := s.groups(portals)
+	if err != nil {
+		return nil, err
+	}
+	solutions, err := TopThreeCorners(ctx, groups[0], groups[1], groups[2], numResults, progressFunc, s.Options...)
+	results := make([]Result, 0, len(solutions))
+	for _, solution := range solutions {
+		results = append(results, ThreeCornersResult(solution))
+	}
+	return results, err
+}
+
+// OnionSolver - Solver running LargestOnion
+type OnionSolver struct {
+	FixedAnchorIndices []int
+	Options            []OnionOption
+}
+
+func (s OnionSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	result, err := LargestOnion(ctx, portals, s.FixedAnchorIndices, progressFunc, s.Options...)
+	return OnionResult(result), err
+}
+
+func (s OnionSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	onions, err := TopOnions(ctx, portals, s.FixedAnchorIndices, numResults, progressFunc, s.Options...)
+	results := make([]Result, 0, len(onions))
+	for _, onion := range onions {
+		results = append(results, OnionResult(onion))
+	}
+	return results, err
+}
+
+// FanSolver - Solver running LargestFan
+type FanSolver struct {
+	FixedAnchorIndices []int
+	Options            []FanOption
+}
+
+func (s FanSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	anchor, fan, err := LargestFan(ctx, portals, s.FixedAnchorIndices, progressFunc, s.Options...)
+	return FanResult(anchor, fan), err
+}
+
+func (s FanSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	solutions, err := TopFans(ctx, portals, s.FixedAnchorIndices, numResults, progressFunc, s.Options...)
+	results := make([]Result, 0, len(solutions))
+	for _, solution := range solutions {
+		results = append(results, FanResult(solution.Anchor, solution.Fan))
+	}
+	return results, err
+}
+
+// FlipFieldSolver - Solver running LargestFlipField
+type FlipFieldSolver struct {
+	Options []FlipFieldOption
+}
+
+func (s FlipFieldSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	options := append([]FlipFieldOption{FlipFieldProgressFunc(progressFunc)}, s.Options...)
+	backbone, flipPortals, err := LargestFlipField(ctx, portals, options...)
+	return FlipFieldResult(backbone, flipPortals), err
+}
+
+func (s FlipFieldSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	options := append([]FlipFieldOption{FlipFieldProgressFunc(progressFunc)}, s.Options...)
+	solutions, err := TopFlipFields(ctx, portals, numResults, options...)
+	results := make([]Result, 0, len(solutions))
+	for _, solution := range solutions {
+		results = append(results, FlipFieldResult(solution.Backbone, solution.FlipPortals))
+	}
+	return results, err
+}
+
+// HomogeneousSolver - Solver running DeepestHomogeneous
+type HomogeneousSolver struct {
+	Options []HomogeneousOption
+}
+
+func (s HomogeneousSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	options := append([]HomogeneousOption{HomogeneousProgressFunc(progressFunc)}, s.Options...)
+	result, depth, err := DeepestHomogeneous(ctx, portals, options...)
+	return HomogeneousResult(depth, result), err
+}
+
+func (s HomogeneousSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	options := append([]HomogeneousOption{HomogeneousProgressFunc(progressFunc)}, s.Options...)
+	solutions, err := TopHomogeneous(ctx, portals, numResults, options...)
+	results := make([]Result, 0, len(solutions))
+	for _, solution := range solutions {
+		results = append(results, HomogeneousResult(solution.Depth, solution.Portals))
+	}
+	return results, err
+}
+
+// MaxFieldsSolver - Solver running MaxFields
+type MaxFieldsSolver struct {
+	Options []MaxFieldsOption
+}
+
+func (s MaxFieldsSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	fields, err := MaxFields(ctx, portals, progressFunc, s.Options...)
+	return MaxFieldsResult(fields), err
+}
+
+func (s MaxFieldsSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	plans, err := TopMaxFields(ctx, portals, numResults, progressFunc, s.Options...)
+	results := make([]Result, 0, len(plans))
+	for _, fields := range plans {
+		results = append(results, MaxFieldsResult(fields))
+	}
+	return results, err
+}
+
+// DroneFlightSolver - Solver running LongestDroneFlight
+type DroneFlightSolver struct {
+	Options []DroneFlightOption
+}
+
+func (s DroneFlightSolver) Solve(ctx context.Context, portals []Portal, progressFunc func(int, int)) (Result, error) {
+	options := append([]DroneFlightOption{DroneFlightProgressFunc(progressFunc)}, s.Options...)
+	path, keysNeeded, err := LongestDroneFlight(ctx, portals, options...)
+	return DroneFlightResult(path, keysNeeded), err
+}
+
+func (s DroneFlightSolver) SolveTop(ctx context.Context, portals []Portal, numResults int, progressFunc func(int, int)) ([]Result, error) {
+	options := append([]DroneFlightOption{DroneFlightProgressFunc(progressFunc)}, s.Options...)
+	solutions, err := TopDroneFlights(ctx, portals, numResults, options...)
+	results := make([]Result, 0, len(solutions))
+	for _, solution := range solutions {
+		results = append(results, DroneFlightResult(solution.Path, solution.KeysNeeded))
+	}
+	return results, err
+}
+
+var solvers = map[string]func() Solver{
+	"cobweb":             func() Solver { return CobwebSolver{} },
+	"herringbone":        func() Solver { return HerringboneSolver{} },
+	"double_herringbone": func() Solver { return DoubleHerringboneSolver{} },
+	"three_corners":      func() Solver { return ThreeCornersSolver{} },
+	"flip_field":         func() Solver { return FlipFieldSolver{} },
+	"homogeneous":        func() Solver { return HomogeneousSolver{} },
+	"max_fields":         func() Solver { return MaxFieldsSolver{} },
+	"onion":              func() Solver { return OnionSolver{} },
+	"fan":                func() Solver { return FanSolver{} },
+	"drone_flight":       func() Solver { return DroneFlightSolver{} },
+}
+
+// RegisterSolver registers a constructor of a solver with default parameters under given name.
+func RegisterSolver(name string, newSolver func() Solver) {
+	solvers[name] = newSolver
+}
+
+// NewSolver returns a solver with default parameters registered under given name.
+func NewSolver(name string) (Solver, error) {
+	newSolver, ok := solvers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown pattern \"%s\"", name)
+	}
+	return newSolver(), nil
+}
+
+// SolverNames returns sorted names of all the registered solvers.
+func SolverNames() []string {
+	names := make([]string, 0, len(solvers))
+	for name := range solvers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
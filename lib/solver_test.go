@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+var testSolvers = map[string]Solver{
+	"cobweb":             CobwebSolver{},
+	"herringbone":        HerringboneSolver{},
+	"double_herringbone": DoubleHerringboneSolver{},
+	"three_corners":      ThreeCornersSolver{},
+	"flip_field":         FlipFieldSolver{},
+	"homogeneous":        HomogeneousSolver{},
+	"max_fields":         MaxFieldsSolver{},
+	"onion":              OnionSolver{},
+	"fan":                FanSolver{},
+	"drone_flight":       DroneFlightSolver{},
+}
+
+func TestSolvers(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the flip field and three corners searches fast.
+	portals = portals[:40]
+	for name, solver := range testSolvers {
+		result, err := solver.Solve(context.Background(), portals, func(int, int) {})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if result.Pattern != name {
+			t.Errorf("Expected pattern %s, got %s", name, result.Pattern)
+		}
+		if result.Score <= 0 || len(result.Portals) == 0 || len(result.Polylines) == 0 {
+			t.Errorf("%s: expected non empty result, got %v", name, result)
+		}
+		if name != "drone_flight" && (len(result.Fields) == 0 || len(result.Links) == 0) {
+			t.Errorf("%s: expected result to contain links and fields", name)
+		}
+		if result.Solution == nil {
+			t.Errorf("%s: expected result to contain the pattern specific solution", name)
+		}
+		if result.PlanError != nil {
+			t.Errorf("%s: invalid link plan: %v", name, result.PlanError)
+		}
+		var drawTools []interface{}
+		if err := json.Unmarshal([]byte(result.DrawToolsString()), &drawTools); err != nil {
+			t.Errorf("%s: invalid draw tools string: %v", name, err)
+		}
+	}
+}
+
+func TestSolveTop(t *testing.T) {
+	portals, err := ParseFile("testdata/portals_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portals = portals[:40]
+	for name, solver := range testSolvers {
+		best, err := solver.Solve(context.Background(), portals, func(int, int) {})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		results, err := SolveTop(context.Background(), solver, portals, 3, func(int, int) {})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(results) == 0 || len(results) > 3 {
+			t.Fatalf("%s: expected between 1 and 3 results, got %d", name, len(results))
+		}
+		if results[0].Score != best.Score {
+			t.Errorf("%s: expected the first result to have score %f, got %f", name, best.Score, results[0].Score)
+		}
+		for i := 1; i < len(results); i++ {
+			if results[i].Score > results[i-1].Score {
+				t.Errorf("%s: results not sorted: %f before %f", name, results[i-1].Score, results[i].Score)
+			}
+		}
+	}
+}
+
+func TestSolverResultMatchesPattern(t *testing.T) {
+	portals := generateCobwebPortals(6)
+	cobweb, err := LargestCobweb(context.Background(), portals, []int{}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := CobwebSolver{}.Solve(context.Background(), portals, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(result.Score) != len(cobweb) || len(result.PortalsWithRole(RoleVertex)) != len(cobweb) {
+		t.Errorf("Expected cobweb of %d portals, got %v", len(cobweb), result)
+	}
+	if len(result.Fields) != len(cobweb)-2 {
+		t.Errorf("Expected %d fields, got %d", len(cobweb)-2, len(result.Fields))
+	}
+}
+
+func TestSolverRegistry(t *testing.T) {
+	names := SolverNames()
+	if len(names) != len(testSolvers) {
+		t.Errorf("Expected %d registered solvers, got %v", len(testSolvers), names)
+	}
+	for _, name := range names {
+		solver, err := NewSolver(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := testSolvers[name]; !ok {
+			t.Errorf("Unexpected solver %s", name)
+		} else if fmt.Sprintf("%T", solver) != fmt.Sprintf("%T", testSolvers[name]) {
+			t.Errorf("Expected solver %s to be %T, got %T", name, testSolvers[name], solver)
+		}
+	}
+	if _, err := NewSolver("unknown"); err == nil {
+		t.Errorf("Expected error for an unknown solver")
+	}
+	RegisterSolver("test_cobweb", func() Solver { return CobwebSolver{FixedCornerIndices: []int{0}} })
+	defer delete(solvers, "test_cobweb")
+	solver, err := NewSolver("test_cobweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cobwebSolver, ok := solver.(CobwebSolver); !ok || len(cobwebSolver.FixedCornerIndices) != 1 {
+		t.Errorf("Expected the registered solver, got %v", solver)
+	}
+}
+
+func TestSolutions(t *testing.T) {
+	portals := generateCobwebPortals(6)
+	results, err := SolveTop(context.Background(), CobwebSolver{}, portals, 2, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cobwebs := Solutions[[]Portal](results)
+	if len(cobwebs) != len(results) {
+		t.Fatalf("Expected %d solutions, got %d", len(results), len(cobwebs))
+	}
+	for i, cobweb := range cobwebs {
+		if len(cobweb) != int(results[i].Score) {
+			t.Errorf("Expected cobweb %d of %d portals, got %d", i, int(results[i].Score), len(cobweb))
+		}
+	}
+}
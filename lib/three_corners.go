@@ -1,7 +1,14 @@
 package lib
 
+import "context"
+
 type bestThreeCornersQuery struct {
 	onIndexEntryFilled func()
+	cancellation       cancellation
+	// links possible to be made, portals of all three groups are indexed one after another
+	links linkFilter
+	// fields large enough to be made
+	fields fieldSizeFilter
 	// preallocated storage for lists of portals within triangles at consecutive recursion depths
 	portalsInTriangle1 [][]portalData
 	portalsInTriangle0 [][]portalData
@@ -16,12 +23,20 @@ type bestThreeCornersQuery struct {
 	numPortals1        portalIndex
 	numPortals0        portalIndex
 	depth              uint16
+	// costs of the portals of all three groups, nil if none of them has a cost
+	costs []float64
+	// total cost of the portals of the solution stored in index, nil if costs are nil
+	totalCosts []float32
 }
 
-func newBestThreeCornersQuery(portals0, portals1, portals2 []portalData, onIndexEntryFilled func()) *bestThreeCornersQuery {
+func newBestThreeCornersQuery(ctx context.Context, portals0, portals1, portals2 []portalData, links linkFilter, fields fieldSizeFilter, costs []float64, onIndexEntryFilled func()) *bestThreeCornersQuery {
 	numPortals0x1x2 := uint(len(portals0)) * uint(len(portals1)) * uint(len(portals2))
 	index := make([]bestSolution, numPortals0x1x2)
 	numCornerChanges := make([]uint16, numPortals0x1x2)
+	var totalCosts []float32
+	if costs != nil {
+		totalCosts = make([]float32, numPortals0x1x2)
+	}
 	for i := 0; i < len(index); i++ {
 		index[i].Length = invalidLength
 	}
@@ -33,9 +48,14 @@ func newBestThreeCornersQuery(portals0, portals1, portals2 []portalData, onIndex
 		portals2:           append(make([]portalData, 0, len(portals2)), portals2...),
 		numPortals2:        uint(len(portals2)),
 		numPortals1x2:      uint(len(portals1)) * uint(len(portals2)),
+		links:              links,
+		fields:             fields,
 		index:              index,
 		numCornerChanges:   numCornerChanges,
+		costs:              costs,
+		totalCosts:         totalCosts,
 		onIndexEntryFilled: onIndexEntryFilled,
+		cancellation:       newCancellation(ctx),
 		portalsInTriangle0: make([][]portalData, len(portals0)+len(portals1)+len(portals2)),
 		portalsInTriangle1: make([][]portalData, len(portals0)+len(portals1)+len(portals2)),
 		portalsInTriangle2: make([][]portalData, len(portals0)+len(portals1)+len(portals2)),
@@ -54,6 +74,46 @@ func (q *bestThreeCornersQuery) getNumCornerChanges(i0, i1, i2 portalIndex) uint
 func (q *bestThreeCornersQuery) setNumCornerChanges(i0, i1, i2 portalIndex, n uint16) {
 	q.numCornerChanges[uint(i0)*q.numPortals1x2+uint(i1)*q.numPortals2+uint(i2)] = n
 }
+func (q *bestThreeCornersQuery) getTotalCost(i0, i1, i2 portalIndex) float32 {
+	if q.totalCosts == nil {
+		return 0
+	}
+	return q.totalCosts[uint(i0)*q.numPortals1x2+uint(i1)*q.numPortals2+uint(i2)]
+}
+func (q *bestThreeCornersQuery) setTotalCost(i0, i1, i2 portalIndex, cost float32) {
+	if q.totalCosts != nil {
+		q.totalCosts[uint(i0)*q.numPortals1x2+uint(i1)*q.numPortals2+uint(i2)] = cost
+	}
+}
+
+// portalCost returns the cost of a portal given by its index in the concatenation of the three groups.
+func (q *bestThreeCornersQuery) portalCost(index portalIndex) float32 {
+	if q.costs == nil {
+		return 0
+	}
+	return float32(q.costs[index])
+}
+
+// betterThreeCornersSolution checks if a solution is better than the best one found so far, comparing
+// their lengths, then the total costs of their portals, then the numbers of corner changes.
+func betterThreeCornersSolution(length, bestLength uint16, cost, bestCost float32, numCornerChanges, bestNumCornerChanges uint16) bool {
+	if length != bestLength {
+		return length > bestLength
+	}
+	if cost != bestCost {
+		return cost < bestCost
+	}
+	return numCornerChanges < bestNumCornerChanges
+}
+func (q *bestThreeCornersQuery) allowed01(i0, i1 portalIndex) bool {
+	return q.links.allowed(i0, q.numPortals0+i1)
+}
+func (q *bestThreeCornersQuery) allowed02(i0, i2 portalIndex) bool {
+	return q.links.allowed(i0, q.numPortals0+q.numPortals1+i2)
+}
+func (q *bestThreeCornersQuery) allowed12(i1, i2 portalIndex) bool {
+	return q.links.allowed(q.numPortals0+i1, q.numPortals0+q.numPortals1+i2)
+}
 func (q *bestThreeCornersQuery) findBestThreeCorner(p0, p1, p2 portalData) {
 	if q.getIndex(p0.Index, p1.Index, p2.Index).Length != invalidLength {
 		return
@@ -63,82 +123,163 @@ func (q *bestThreeCornersQuery) findBestThreeCorner(p0, p1, p2 portalData) {
 	q.portalsInTriangle2[0] = portalsInsideTriangle(q.portals2, p0, p1, p2, q.portalsInTriangle2[0])
 	q.findBestThreeCornerAux(p0, p1, p2, q.portalsInTriangle0[0], q.portalsInTriangle1[0], q.portalsInTriangle2[0])
 }
-func (q *bestThreeCornersQuery) findBestThreeCornerAux(p0, p1, p2 portalData, candidates0, candidates1, candidates2 []portalData) (bestSolution, uint16) {
+func (q *bestThreeCornersQuery) findBestThreeCornerAux(p0, p1, p2 portalData, candidates0, candidates1, candidates2 []portalData) (bestSolution, uint16, float32) {
+	if q.cancellation.check() {
+		return bestSolution{Length: invalidLength}, 0, 0
+	}
 	q.depth++
 	q.portalsInTriangle0[q.depth] = append(q.portalsInTriangle0[q.depth][:0], candidates0...)
 	q.portalsInTriangle1[q.depth] = append(q.portalsInTriangle1[q.depth][:0], candidates1...)
 	q.portalsInTriangle2[q.depth] = append(q.portalsInTriangle2[q.depth][:0], candidates2...)
 	var bestTC bestSolution
 	var bestNumCornerChanges uint16
+	var bestCost float32
 	for _, portal := range q.portalsInTriangle0[q.depth] {
+		if !q.allowed01(portal.Index, p1.Index) || !q.allowed02(portal.Index, p2.Index) || !q.fields.allowed(portal, p1, p2) {
+			continue
+		}
 		candidate := q.getIndex(portal.Index, p1.Index, p2.Index)
 		numCornerChanges := q.getNumCornerChanges(portal.Index, p1.Index, p2.Index)
+		cost := q.getTotalCost(portal.Index, p1.Index, p2.Index)
 		if candidate.Length == invalidLength {
 			candidatesInWedge0 := partitionPortalsInsideWedge(candidates0, portal, p1, p2)
 			candidatesInWedge1 := partitionPortalsInsideWedge(candidates1, portal, p1, p2)
 			candidatesInWedge2 := partitionPortalsInsideWedge(candidates2, portal, p1, p2)
-			candidate, numCornerChanges = q.findBestThreeCornerAux(portal, p1, p2, candidatesInWedge0, candidatesInWedge1, candidatesInWedge2)
+			candidate, numCornerChanges, cost = q.findBestThreeCornerAux(portal, p1, p2, candidatesInWedge0, candidatesInWedge1, candidatesInWedge2)
+			if q.cancellation.cancelled {
+				// Leave the index entry unset, so that the index stays consistent.
+				q.depth--
+				return bestSolution{Length: invalidLength}, 0, 0
+			}
 		}
-		if candidate.Length > 0 && candidate.Index >= q.numPortals0 {
+		if candidate.Length > 0 && candidate.Index.portalIndex() >= q.numPortals0 {
 			numCornerChanges = numCornerChanges + 1
 		}
 		candidate.Length = candidate.Length + 1
-		if candidate.Length > bestTC.Length || (candidate.Length == bestTC.Length && numCornerChanges < bestNumCornerChanges) {
+		cost += q.portalCost(portal.Index)
+		if betterThreeCornersSolution(candidate.Length, bestTC.Length, cost, bestCost, numCornerChanges, bestNumCornerChanges) {
 			bestTC.Length = candidate.Length
-			bestTC.Index = portal.Index
+			bestTC.Index = memoPortalIndex(portal.Index)
 			bestNumCornerChanges = numCornerChanges
+			bestCost = cost
 		}
 	}
 	for _, portal := range q.portalsInTriangle1[q.depth] {
+		if !q.allowed01(p0.Index, portal.Index) || !q.allowed12(portal.Index, p2.Index) || !q.fields.allowed(p0, portal, p2) {
+			continue
+		}
 		candidate := q.getIndex(p0.Index, portal.Index, p2.Index)
 		numCornerChanges := q.getNumCornerChanges(p0.Index, portal.Index, p2.Index)
+		cost := q.getTotalCost(p0.Index, portal.Index, p2.Index)
 		if candidate.Length == invalidLength {
 			candidatesInWedge0 := partitionPortalsInsideWedge(candidates0, portal, p0, p2)
 			candidatesInWedge1 := partitionPortalsInsideWedge(candidates1, portal, p0, p2)
 			candidatesInWedge2 := partitionPortalsInsideWedge(candidates2, portal, p0, p2)
-			candidate, numCornerChanges = q.findBestThreeCornerAux(p0, portal, p2, candidatesInWedge0, candidatesInWedge1, candidatesInWedge2)
+			candidate, numCornerChanges, cost = q.findBestThreeCornerAux(p0, portal, p2, candidatesInWedge0, candidatesInWedge1, candidatesInWedge2)
+			if q.cancellation.cancelled {
+				// Leave the index entry unset, so that the index stays consistent.
+				q.depth--
+				return bestSolution{Length: invalidLength}, 0, 0
+			}
 		}
-		if candidate.Length > 0 && (candidate.Index < q.numPortals0 || candidate.Index >= q.numPortals0+q.numPortals1) {
+		if candidate.Length > 0 && (candidate.Index.portalIndex() < q.numPortals0 || candidate.Index.portalIndex() >= q.numPortals0+q.numPortals1) {
 			numCornerChanges = numCornerChanges + 1
 		}
 		candidate.Length = candidate.Length + 1
-		if candidate.Length > bestTC.Length || (candidate.Length == bestTC.Length && numCornerChanges < bestNumCornerChanges) {
+		cost += q.portalCost(portal.Index + q.numPortals0)
+		if betterThreeCornersSolution(candidate.Length, bestTC.Length, cost, bestCost, numCornerChanges, bestNumCornerChanges) {
 			bestTC.Length = candidate.Length
-			bestTC.Index = portal.Index + q.numPortals0
+			bestTC.Index = memoPortalIndex(portal.Index + q.numPortals0)
 			bestNumCornerChanges = numCornerChanges
+			bestCost = cost
 		}
 	}
 	for _, portal := range q.portalsInTriangle2[q.depth] {
+		if !q.allowed02(p0.Index, portal.Index) || !q.allowed12(p1.Index, portal.Index) || !q.fields.allowed(p0, p1, portal) {
+			continue
+		}
 		candidate := q.getIndex(p0.Index, p1.Index, portal.Index)
 		numCornerChanges := q.getNumCornerChanges(p0.Index, p1.Index, portal.Index)
+		cost := q.getTotalCost(p0.Index, p1.Index, portal.Index)
 		if candidate.Length == invalidLength {
 			candidatesInWedge0 := partitionPortalsInsideWedge(candidates0, portal, p0, p1)
 			candidatesInWedge1 := partitionPortalsInsideWedge(candidates1, portal, p0, p1)
 			candidatesInWedge2 := partitionPortalsInsideWedge(candidates2, portal, p0, p1)
-			candidate, numCornerChanges = q.findBestThreeCornerAux(p0, p1, portal, candidatesInWedge0, candidatesInWedge1, candidatesInWedge2)
+			candidate, numCornerChanges, cost = q.findBestThreeCornerAux(p0, p1, portal, candidatesInWedge0, candidatesInWedge1, candidatesInWedge2)
+			if q.cancellation.cancelled {
+				// Leave the index entry unset, so that the index stays consistent.
+				q.depth--
+				return bestSolution{Length: invalidLength}, 0, 0
+			}
 		}
-		if candidate.Length > 0 && candidate.Index < q.numPortals0+q.numPortals1 {
+		if candidate.Length > 0 && candidate.Index.portalIndex() < q.numPortals0+q.numPortals1 {
 			numCornerChanges = numCornerChanges + 1
 		}
 		candidate.Length = candidate.Length + 1
-		if candidate.Length > bestTC.Length || (candidate.Length == bestTC.Length && numCornerChanges < bestNumCornerChanges) {
+		cost += q.portalCost(portal.Index + q.numPortals0 + q.numPortals1)
+		if betterThreeCornersSolution(candidate.Length, bestTC.Length, cost, bestCost, numCornerChanges, bestNumCornerChanges) {
 			bestTC.Length = candidate.Length
-			bestTC.Index = portal.Index + q.numPortals0 + q.numPortals1
+			bestTC.Index = memoPortalIndex(portal.Index + q.numPortals0 + q.numPortals1)
 			bestNumCornerChanges = numCornerChanges
+			bestCost = cost
 		}
 	}
 	q.setIndex(p0.Index, p1.Index, p2.Index, bestTC)
 	q.setNumCornerChanges(p0.Index, p1.Index, p2.Index, bestNumCornerChanges)
+	q.setTotalCost(p0.Index, p1.Index, p2.Index, bestCost)
 	q.onIndexEntryFilled()
 	q.depth--
-	return bestTC, bestNumCornerChanges
+	return bestTC, bestNumCornerChanges, bestCost
+}
+
+// LargestThreeCorner - Find best way to connect three groups of portals.
+// If ctx gets cancelled returns the best solution found so far and a *CancelledError.
+func LargestThreeCorner(ctx context.Context, portals0, portals1, portals2 []Portal, progressFunc func(int, int), options ...ThreeCornersOption) ([]IndexedPortal, error) {
+	results, err := TopThreeCorners(ctx, portals0, portals1, portals2, 1, progressFunc, options...)
+	if len(results) == 0 {
+		return nil, err
+	}
+	return results[0], err
+}
+
+type threeCornersCandidate struct {
+	p0, p1, p2       portalIndex
+	length           uint16
+	numCornerChanges uint16
+	cost             float64
 }
 
-// LargestThreeCorner - Find best way to connect three groups of portals
-func LargestThreeCorner(portals0, portals1, portals2 []Portal, progressFunc func(int, int)) []IndexedPortal {
+func betterThreeCorners(a, b threeCornersCandidate) bool {
+	if a.length != b.length {
+		return a.length > b.length
+	}
+	if a.cost != b.cost {
+		return a.cost < b.cost
+	}
+	return a.numCornerChanges < b.numCornerChanges
+}
+
+// TopThreeCorners - Find up to numResults best ways to connect three groups of portals
+// having distinct sets of portals, sorted from the best one.
+// If ctx gets cancelled returns the best solutions found so far and a *CancelledError.
+func TopThreeCorners(ctx context.Context, portals0, portals1, portals2 []Portal, numResults int, progressFunc func(int, int), options ...ThreeCornersOption) ([][]IndexedPortal, error) {
+	// Portals of all the groups share a single range of indices.
+	if err := checkNumMemoPortals(len(portals0) + len(portals1) + len(portals2)); err != nil {
+		return nil, err
+	}
 	portalsData0 := portalsToPortalData(portals0)
 	portalsData1 := portalsToPortalData(portals1)
 	portalsData2 := portalsToPortalData(portals2)
+	params := defaultThreeCornersParams()
+	for _, option := range options {
+		option.apply(&params)
+	}
+	allPortals := append(append(append(make([]Portal, 0, len(portals0)+len(portals1)+len(portals2)), portals0...), portals1...), portals2...)
+	costs := portalCosts(allPortals)
+	var links linkFilter
+	if len(params.blockers) > 0 || len(params.disabledPortals) > 0 || params.maxLinkLength > 0 {
+		links = newLinkFilter(portalsToPortalData(allPortals), params.blockers, disabledPortalsMask(allPortals, params.disabledPortals), params.maxLinkLength)
+	}
 
 	numIndexEntries := len(portals0) * len(portals1) * len(portals2)
 	everyNth := numIndexEntries / 1000
@@ -156,60 +297,94 @@ func LargestThreeCorner(portals0, portals1, portals2 []Portal, progressFunc func
 		}
 	}
 	progressFunc(0, numIndexEntries)
-	q := newBestThreeCornersQuery(portalsData0, portalsData1, portalsData2, onFillIndexEntry)
+	q := newBestThreeCornersQuery(ctx, portalsData0, portalsData1, portalsData2, links, newFieldSizeFilter(params.minFieldSize), costs, onFillIndexEntry)
+mainLoop:
 	for _, p0 := range portalsData0 {
 		for _, p1 := range portalsData1 {
 			for _, p2 := range portalsData2 {
 				q.findBestThreeCorner(p0, p1, p2)
+				if q.cancellation.cancelled {
+					break mainLoop
+				}
 			}
 		}
 	}
 	progressFunc(numIndexEntries, numIndexEntries)
 
-	var largestTC bestSolution
-	var bestNumCornerChanges uint16
-	var bestP0, bestP1, bestP2 portalData
+	minCost := minTotalCost(costs)
+	top := newTopSolutions(numResults, betterThreeCorners)
 	for _, p0 := range portalsData0 {
 		for _, p1 := range portalsData1 {
 			for _, p2 := range portalsData2 {
 				solution := q.getIndex(p0.Index, p1.Index, p2.Index)
-				numCornerChanges := q.getNumCornerChanges(p0.Index, p1.Index, p2.Index)
-				if solution.Length > largestTC.Length || (solution.Length == largestTC.Length && numCornerChanges < bestNumCornerChanges) {
-					largestTC = solution
-					bestNumCornerChanges = numCornerChanges
-					bestP0, bestP1, bestP2 = p0, p1, p2
+				if solution.Length == invalidLength {
+					continue
+				}
+				if !q.allowed01(p0.Index, p1.Index) || !q.allowed02(p0.Index, p2.Index) || !q.allowed12(p1.Index, p2.Index) || !q.fields.allowed(p0, p1, p2) {
+					continue
+				}
+				candidate := threeCornersCandidate{
+					p0:               p0.Index,
+					p1:               p1.Index,
+					p2:               p2.Index,
+					length:           solution.Length,
+					numCornerChanges: q.getNumCornerChanges(p0.Index, p1.Index, p2.Index),
+					cost:             minCost,
+				}
+				if top.accepts(candidate) {
+					_, portalIndices := q.threeCornersPortals(candidate, portals0, portals1, portals2)
+					candidate.cost = totalCost(costs, portalIndices)
+					top.add(candidate, portalIndices)
 				}
 			}
 		}
 	}
+	var err error
+	if q.cancellation.cancelled {
+		err = cancelledError(ctx)
+	}
+	results := make([][]IndexedPortal, 0, len(top.solutions))
+	for _, candidate := range top.solutions {
+		result, _ := q.threeCornersPortals(candidate, portals0, portals1, portals2)
+		results = append(results, result)
+	}
+	return results, err
+}
+
+// threeCornersPortals returns portals of the solution starting with given triangle,
+// and their indices in the concatenation of the three groups of portals.
+func (q *bestThreeCornersQuery) threeCornersPortals(candidate threeCornersCandidate, portals0, portals1, portals2 []Portal) ([]IndexedPortal, []portalIndex) {
 	numPortals0 := portalIndex(len(portals0))
 	numPortals1 := portalIndex(len(portals1))
-	k0, k1, k2 := bestP0.Index, bestP1.Index, bestP2.Index
-	result := append(make([]IndexedPortal, 0, largestTC.Length+3),
+	k0, k1, k2 := candidate.p0, candidate.p1, candidate.p2
+	result := append(make([]IndexedPortal, 0, candidate.length+3),
 		IndexedPortal{Index: 0, Portal: portals0[k0]},
 		IndexedPortal{Index: 1, Portal: portals1[k1]},
 		IndexedPortal{Index: 2, Portal: portals2[k2]})
+	indices := append(make([]portalIndex, 0, candidate.length+3), k0, numPortals0+k1, numPortals0+numPortals1+k2)
 	for {
 		sol := q.getIndex(k0, k1, k2)
 		if sol.Length == 0 {
 			break
 		}
-		if sol.Index < numPortals0 {
-			result = append(result, IndexedPortal{Index: 0, Portal: portals0[sol.Index]})
-			k0 = sol.Index
+		index := sol.Index.portalIndex()
+		indices = append(indices, index)
+		if index < numPortals0 {
+			result = append(result, IndexedPortal{Index: 0, Portal: portals0[index]})
+			k0 = index
 		} else {
-			sol.Index = sol.Index - numPortals0
-			if sol.Index < numPortals1 {
-				result = append(result, IndexedPortal{Index: 1, Portal: portals1[sol.Index]})
-				k1 = sol.Index
+			index = index - numPortals0
+			if index < numPortals1 {
+				result = append(result, IndexedPortal{Index: 1, Portal: portals1[index]})
+				k1 = index
 			} else {
-				sol.Index = sol.Index - numPortals1
-				result = append(result, IndexedPortal{Index: 2, Portal: portals2[sol.Index]})
-				k2 = sol.Index
+				index = index - numPortals1
+				result = append(result, IndexedPortal{Index: 2, Portal: portals2[index]})
+				k2 = index
 			}
 		}
 	}
-	return result
+	return result, indices
 }
 
 func ThreeCornersPolyline(result []IndexedPortal) []Portal {
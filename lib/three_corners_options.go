@@ -0,0 +1,42 @@
+package lib
+
+type ThreeCornersOption interface {
+	apply(params *threeCornersParams)
+}
+
+type ThreeCornersBlockers []Segment
+
+func (t ThreeCornersBlockers) apply(params *threeCornersParams) {
+	params.blockers = []Segment(t)
+}
+
+type ThreeCornersDisabledPortals []Portal
+
+func (t ThreeCornersDisabledPortals) apply(params *threeCornersParams) {
+	params.disabledPortals = []Portal(t)
+}
+
+// ThreeCornersMaxLinkLength - don't make links longer than that many meters
+type ThreeCornersMaxLinkLength float64
+
+func (t ThreeCornersMaxLinkLength) apply(params *threeCornersParams) {
+	params.maxLinkLength = float64(t)
+}
+
+// ThreeCornersMinFieldSize - don't make fields smaller than that
+type ThreeCornersMinFieldSize FieldSize
+
+func (t ThreeCornersMinFieldSize) apply(params *threeCornersParams) {
+	params.minFieldSize = FieldSize(t)
+}
+
+type threeCornersParams struct {
+	blockers        []Segment
+	disabledPortals []Portal
+	maxLinkLength   float64
+	minFieldSize    FieldSize
+}
+
+func defaultThreeCornersParams() threeCornersParams {
+	return threeCornersParams{}
+}
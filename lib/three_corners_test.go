@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"testing"
 
 	"github.com/golang/geo/s2"
@@ -68,6 +69,9 @@ func TestThreeCorner(t *testing.T) {
 	if len(portals0) < 1 || len(portals1) < 1 || len(portals2) < 1 {
 		t.FailNow()
 	}
-	threeCorner := LargestThreeCorner(portals0, portals1, portals2, func(int, int) {})
+	threeCorner, err := LargestThreeCorner(context.Background(), portals0, portals1, portals2, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
 	checkValidThreeCornerResult(16, 3, threeCorner, t)
 }
@@ -0,0 +1,92 @@
+package lib
+
+import "sort"
+
+// topSolutions keeps the best numSolutions solutions having distinct sets of portals.
+// Solutions differing in a single portal are distinct, so that alternatives avoiding
+// a portal of a better solution are kept.
+type topSolutions[T any] struct {
+	// returns true if solution a is better than b
+	better       func(a, b T) bool
+	solutions    []T
+	portalSets   [][]portalIndex
+	numSolutions int
+}
+
+func newTopSolutions[T any](numSolutions int, better func(a, b T) bool) *topSolutions[T] {
+	if numSolutions < 1 {
+		numSolutions = 1
+	}
+	return &topSolutions[T]{
+		better:       better,
+		numSolutions: numSolutions,
+	}
+}
+
+// accepts returns true if solution may become one of the top ones.
+// Checking it first allows to skip computing portals of most of the solutions.
+func (t *topSolutions[T]) accepts(solution T) bool {
+	return len(t.solutions) < t.numSolutions || t.better(solution, t.solutions[len(t.solutions)-1])
+}
+
+// add adds solution consisting of given portals, if it's one of the top ones.
+// Among equally good solutions the ones added first are preferred.
+func (t *topSolutions[T]) add(solution T, portals []portalIndex) {
+	if !t.accepts(solution) {
+		return
+	}
+	// position of the new solution among the kept ones
+	pos := sort.Search(len(t.solutions), func(i int) bool {
+		return t.better(solution, t.solutions[i])
+	})
+	portalSet := sortedPortalSet(portals)
+	for i := 0; i < pos; i++ {
+		if samePortalSet(t.portalSets[i], portalSet) {
+			return
+		}
+	}
+	// Replace a worse solution having the same portals, there's at most one such.
+	for i := pos; i < len(t.solutions); i++ {
+		if samePortalSet(t.portalSets[i], portalSet) {
+			t.solutions = append(t.solutions[:i], t.solutions[i+1:]...)
+			t.portalSets = append(t.portalSets[:i], t.portalSets[i+1:]...)
+			break
+		}
+	}
+	var zero T
+	t.solutions = append(t.solutions, zero)
+	copy(t.solutions[pos+1:], t.solutions[pos:])
+	t.solutions[pos] = solution
+	t.portalSets = append(t.portalSets, nil)
+	copy(t.portalSets[pos+1:], t.portalSets[pos:])
+	t.portalSets[pos] = portalSet
+	if len(t.solutions) > t.numSolutions {
+		t.solutions = t.solutions[:t.numSolutions]
+		t.portalSets = t.portalSets[:t.numSolutions]
+	}
+}
+
+// sortedPortalSet returns sorted distinct portals of the list.
+func sortedPortalSet(portals []portalIndex) []portalIndex {
+	set := append([]portalIndex(nil), portals...)
+	sort.Slice(set, func(i, j int) bool { return set[i] < set[j] })
+	distinct := set[:0]
+	for i, portal := range set {
+		if i == 0 || portal != set[i-1] {
+			distinct = append(distinct, portal)
+		}
+	}
+	return distinct
+}
+
+func samePortalSet(a, b []portalIndex) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
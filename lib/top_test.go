@@ -0,0 +1,33 @@
+package lib
+
+import "testing"
+
+func TestTopSolutions(t *testing.T) {
+	top := newTopSolutions(3, func(a, b int) bool { return a > b })
+	top.add(5, []portalIndex{3, 4, 5})
+	// Subset of a better solution, an alternative avoiding portal 5.
+	top.add(4, []portalIndex{3, 4})
+	// Same portals as a better solution.
+	top.add(2, []portalIndex{5, 4, 3})
+	top.add(1, []portalIndex{0, 1, 2})
+	// Same portals as a worse solution replace it.
+	top.add(3, []portalIndex{2, 1, 0})
+	checkTopSolutions([]int{5, 4, 3}, top, t)
+	// Superset of a solution is an alternative too.
+	top.add(6, []portalIndex{0, 1, 2, 10})
+	// Worse than all the kept solutions.
+	top.add(0, []portalIndex{11})
+	checkTopSolutions([]int{6, 5, 4}, top, t)
+}
+
+func checkTopSolutions(expected []int, top *topSolutions[int], t *testing.T) {
+	t.Helper()
+	if len(top.solutions) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, top.solutions)
+	}
+	for i, solution := range expected {
+		if top.solutions[i] != solution {
+			t.Fatalf("Expected %v, got %v", expected, top.solutions)
+		}
+	}
+}